@@ -0,0 +1,303 @@
+package peggy
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+// Grammar is a parsed PEG grammar.
+type Grammar struct {
+	// Rules is the list of rules. Rules[0] is the start rule.
+	Rules []*Rule
+
+	// Source is the text from which the grammar was parsed, if any.
+	Source string
+}
+
+// Rule is a single named rule of a Grammar.
+type Rule struct {
+	Name string
+	Expr Expr
+}
+
+// Expr is a node in the syntax tree of a parsing expression.
+type Expr interface {
+	// String returns the expression in grammar syntax.
+	String() string
+
+	// precedence returns the binding strength of the expression's
+	// outermost operator, used to decide where parentheses are needed.
+	precedence() int
+}
+
+const (
+	precChoice = iota
+	precSequence
+	precPrefix
+	precSuffix
+	precPrimary
+)
+
+// Literal matches an exact sequence of bytes.
+type Literal struct {
+	Bytes []byte
+}
+
+// Class matches a single byte that is a member of Set.
+type Class struct {
+	Set byteset.Matcher
+}
+
+// Any matches any single byte.
+type Any struct{}
+
+// Sequence matches each of Items in turn.
+type Sequence struct {
+	Items []Expr
+}
+
+// Choice matches the first of Alts that matches.
+type Choice struct {
+	Alts []Expr
+}
+
+// Star matches Expr zero or more times, greedily.
+type Star struct {
+	Expr Expr
+}
+
+// Plus matches Expr one or more times, greedily.
+type Plus struct {
+	Expr Expr
+}
+
+// Optional matches Expr zero or one times, greedily.
+type Optional struct {
+	Expr Expr
+}
+
+// And succeeds iff Expr matches, without consuming any input.
+type And struct {
+	Expr Expr
+}
+
+// Not succeeds iff Expr does not match, without consuming any input.
+type Not struct {
+	Expr Expr
+}
+
+// Ref invokes the rule with the given Name.
+type Ref struct {
+	Name string
+}
+
+// Capture records the input matched by Expr. Name is empty for anonymous
+// captures.
+type Capture struct {
+	Name string
+	Expr Expr
+}
+
+var (
+	_ Expr = (*Literal)(nil)
+	_ Expr = (*Class)(nil)
+	_ Expr = (*Any)(nil)
+	_ Expr = (*Sequence)(nil)
+	_ Expr = (*Choice)(nil)
+	_ Expr = (*Star)(nil)
+	_ Expr = (*Plus)(nil)
+	_ Expr = (*Optional)(nil)
+	_ Expr = (*And)(nil)
+	_ Expr = (*Not)(nil)
+	_ Expr = (*Ref)(nil)
+	_ Expr = (*Capture)(nil)
+)
+
+func (*Literal) precedence() int  { return precPrimary }
+func (*Class) precedence() int    { return precPrimary }
+func (*Any) precedence() int      { return precPrimary }
+func (*Sequence) precedence() int { return precSequence }
+func (*Choice) precedence() int   { return precChoice }
+func (*Star) precedence() int     { return precSuffix }
+func (*Plus) precedence() int     { return precSuffix }
+func (*Optional) precedence() int { return precSuffix }
+func (*And) precedence() int      { return precPrefix }
+func (*Not) precedence() int      { return precPrefix }
+func (*Ref) precedence() int      { return precPrimary }
+func (*Capture) precedence() int  { return precPrimary }
+
+// String returns the grammar in grammar syntax, one rule per line.
+func (g *Grammar) String() string {
+	var buf bytes.Buffer
+	for _, rule := range g.Rules {
+		buf.WriteString(rule.String())
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// String returns the rule in grammar syntax.
+func (r *Rule) String() string {
+	return r.Name + " <- " + r.Expr.String()
+}
+
+func (e *Literal) String() string {
+	var buf bytes.Buffer
+	buf.WriteByte('\'')
+	for _, b := range e.Bytes {
+		writeEscaped(&buf, b, '\'')
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
+
+func (e *Class) String() string {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	var lo, hi uint
+	have := false
+	flush := func() {
+		writeEscaped(&buf, byte(lo), ']')
+		if hi > lo+1 {
+			buf.WriteByte('-')
+		}
+		if hi > lo {
+			writeEscaped(&buf, byte(hi), ']')
+		}
+	}
+	e.Set.ForEach(func(b byte) {
+		if have && uint(b) == hi+1 {
+			hi = uint(b)
+			return
+		}
+		if have {
+			flush()
+		}
+		lo, hi, have = uint(b), uint(b), true
+	})
+	if have {
+		flush()
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+func (e *Any) String() string {
+	return "."
+}
+
+func (e *Sequence) String() string {
+	if len(e.Items) == 0 {
+		return "''"
+	}
+	var buf bytes.Buffer
+	for i, item := range e.Items {
+		if i != 0 {
+			buf.WriteByte(' ')
+		}
+		writeOperand(&buf, item, precSequence+1)
+	}
+	return buf.String()
+}
+
+func (e *Choice) String() string {
+	var buf bytes.Buffer
+	for i, alt := range e.Alts {
+		if i != 0 {
+			buf.WriteString(" / ")
+		}
+		writeOperand(&buf, alt, precSequence)
+	}
+	return buf.String()
+}
+
+func (e *Star) String() string {
+	var buf bytes.Buffer
+	writeOperand(&buf, e.Expr, precPrimary)
+	buf.WriteByte('*')
+	return buf.String()
+}
+
+func (e *Plus) String() string {
+	var buf bytes.Buffer
+	writeOperand(&buf, e.Expr, precPrimary)
+	buf.WriteByte('+')
+	return buf.String()
+}
+
+func (e *Optional) String() string {
+	var buf bytes.Buffer
+	writeOperand(&buf, e.Expr, precPrimary)
+	buf.WriteByte('?')
+	return buf.String()
+}
+
+func (e *And) String() string {
+	var buf bytes.Buffer
+	buf.WriteByte('&')
+	writeOperand(&buf, e.Expr, precSuffix)
+	return buf.String()
+}
+
+func (e *Not) String() string {
+	var buf bytes.Buffer
+	buf.WriteByte('!')
+	writeOperand(&buf, e.Expr, precSuffix)
+	return buf.String()
+}
+
+func (e *Ref) String() string {
+	return e.Name
+}
+
+func (e *Capture) String() string {
+	var buf bytes.Buffer
+	buf.WriteString("{ ")
+	if e.Name != "" {
+		buf.WriteString(e.Name)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(e.Expr.String())
+	buf.WriteString(" }")
+	return buf.String()
+}
+
+// writeOperand writes e, wrapped in parentheses if it binds more loosely than
+// min.
+func writeOperand(buf *bytes.Buffer, e Expr, min int) {
+	if e.precedence() < min {
+		buf.WriteByte('(')
+		buf.WriteString(e.String())
+		buf.WriteByte(')')
+		return
+	}
+	buf.WriteString(e.String())
+}
+
+var escapeNames = map[byte]byte{
+	0x07: 'a',
+	0x08: 'b',
+	0x09: 't',
+	0x0a: 'n',
+	0x0b: 'v',
+	0x0c: 'f',
+	0x0d: 'r',
+}
+
+// writeEscaped writes b as it would appear in a literal or class delimited by
+// quote.
+func writeEscaped(buf *bytes.Buffer, b byte, quote byte) {
+	if name, found := escapeNames[b]; found {
+		buf.WriteByte('\\')
+		buf.WriteByte(name)
+	} else if b == '\\' || b == quote || (quote == ']' && (b == '-' || b == '^' || b == '[')) {
+		buf.WriteByte('\\')
+		buf.WriteByte(b)
+	} else if b >= 0x20 && b < 0x7f {
+		buf.WriteByte(b)
+	} else {
+		fmt.Fprintf(buf, "\\x%02x", b)
+	}
+}
@@ -304,3 +304,38 @@ func TestBytes(t *testing.T) {
 		t.Errorf("%s: expected %q, actual %q", t.Name(), expected, actual)
 	}
 }
+
+func TestParse(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{".", "."},
+		testrow{"!.", "!."},
+		testrow{"[]", "!."},
+		testrow{`[\x61]`, `[\x61]`},
+		testrow{`[\x30\x31\x32]`, `[\x30\x31\x32]`},
+		testrow{`[a-c]`, `[\x61\x62\x63]`},
+		testrow{`![\x00-\x02]`, `![\x00\x01\x02]`},
+		testrow{makeSparseDemo().String(), makeSparseDemo().String()},
+	}
+
+	for i, row := range data {
+		m, err := Parse(row.Input)
+		if err != nil {
+			t.Errorf("%s/%03d: %q: error: %v", t.Name(), i, row.Input, err)
+			continue
+		}
+		if actual := m.String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	for i, input := range []string{"", "[", `[\x6]`, `[a-]`, "x", ".x", "!"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s/bad%03d: %q: expected error", t.Name(), i, input)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package byteset
+
+import (
+	"fmt"
+)
+
+// ParseError is returned by Parse when its input is malformed.
+type ParseError struct {
+	Input  string
+	Offset int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/byteset: parse error @ offset %d in %q", e.Offset, e.Input)
+}
+
+// Parse is the inverse of Matcher.String: it returns a Matcher for the set
+// described by s.
+//
+// The accepted syntax is:
+//
+//   .         all bytes
+//   !X        the complement of X
+//   [...]     the bytes listed between the brackets
+//
+// Between the brackets, a byte is written either as \xHH or as a printable
+// ASCII character other than '\', ']', and '-'. Two bytes separated by '-'
+// denote an inclusive range.
+//
+func Parse(s string) (Matcher, error) {
+	m, n, ok := parseMatcher(s, 0)
+	if !ok || n != len(s) {
+		if ok {
+			n = len(s)
+		}
+		return nil, &ParseError{Input: s, Offset: n}
+	}
+	return m, nil
+}
+
+func parseMatcher(s string, i int) (Matcher, int, bool) {
+	if i >= len(s) {
+		return nil, i, false
+	}
+	switch s[i] {
+	case '.':
+		return All(), i + 1, true
+
+	case '!':
+		inner, j, ok := parseMatcher(s, i+1)
+		if !ok {
+			return nil, j, false
+		}
+		if inner == singletonAll {
+			return None(), j, true
+		}
+		return Not(inner), j, true
+
+	case '[':
+		var ranges []Range
+		j := i + 1
+		for {
+			if j >= len(s) {
+				return nil, j, false
+			}
+			if s[j] == ']' {
+				return Ranges(ranges...).Optimize(), j + 1, true
+			}
+			lo, k, ok := parseByte(s, j)
+			if !ok {
+				return nil, j, false
+			}
+			hi := lo
+			if k < len(s) && s[k] == '-' {
+				hi, k, ok = parseByte(s, k+1)
+				if !ok {
+					return nil, k, false
+				}
+			}
+			ranges = append(ranges, Range{Lo: lo, Hi: hi})
+			j = k
+		}
+	}
+	return nil, i, false
+}
+
+func parseByte(s string, i int) (byte, int, bool) {
+	if i >= len(s) {
+		return 0, i, false
+	}
+	ch := s[i]
+	if ch == '\\' {
+		if i+4 > len(s) || s[i+1] != 'x' {
+			return 0, i, false
+		}
+		hi, ok0 := hexDigit(s[i+2])
+		lo, ok1 := hexDigit(s[i+3])
+		if !ok0 || !ok1 {
+			return 0, i, false
+		}
+		return (hi << 4) | lo, i + 4, true
+	}
+	if ch < 0x20 || ch >= 0x7f || ch == ']' || ch == '-' {
+		return 0, i, false
+	}
+	return ch, i + 1, true
+}
+
+func hexDigit(ch byte) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	}
+	return 0, false
+}
@@ -0,0 +1,659 @@
+package peggy
+
+import (
+	"fmt"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/peggyvm"
+)
+
+// CompileProgram compiles a parsed grammar to bytecode.
+//
+// The generated program records the whole match as capture 0, then calls the
+// start rule. Each rule is emitted as a public label of the same name, and is
+// declared as an entry point so that it can be matched on its own.
+//
+func CompileProgram(g *Grammar) (*peggyvm.Program, error) {
+	c := &compiler{
+		g:        g,
+		a:        peggyvm.NewAssembler(),
+		rules:    make(map[string]*Rule, len(g.Rules)),
+		captures: make(map[*Capture]uint64),
+		nullable: make(map[string]bool, len(g.Rules)),
+		regular:  make(map[string]bool, len(g.Rules)),
+	}
+	if len(g.Rules) == 0 {
+		return nil, &CompileError{Err: ErrEmptyGrammar}
+	}
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	c.a.Verify = true
+	c.findRegularRules()
+	c.allocateCaptures()
+	c.emitProgram()
+	c.a.TailCalls()
+	c.a.FuseEOI()
+	c.a.HeadFail()
+	c.a.ThreadJumps()
+	return c.a.Finish()
+}
+
+type compiler struct {
+	g        *Grammar
+	a        *peggyvm.Assembler
+	rules    map[string]*Rule
+	captures map[*Capture]uint64
+	nullable map[string]bool
+	regular  map[string]bool
+	nlabels  uint
+}
+
+// check performs semantic checks on the grammar before any code is emitted.
+func (c *compiler) check() error {
+	for _, rule := range c.g.Rules {
+		if _, found := c.rules[rule.Name]; found {
+			return &CompileError{Err: ErrDuplicateRule, Rule: rule.Name}
+		}
+		c.rules[rule.Name] = rule
+	}
+
+	names := make(map[string]*Capture)
+	for _, rule := range c.g.Rules {
+		var err error
+		walk(rule.Expr, func(e Expr) {
+			capture, ok := e.(*Capture)
+			if !ok || capture.Name == "" || err != nil {
+				return
+			}
+			if other, found := names[capture.Name]; found && other != capture {
+				err = &CompileError{Err: ErrDuplicateCapture, Rule: rule.Name, Name: capture.Name}
+			}
+			names[capture.Name] = capture
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range c.g.Rules {
+		var err error
+		walk(rule.Expr, func(e Expr) {
+			if ref, ok := e.(*Ref); ok && err == nil {
+				if _, found := c.rules[ref.Name]; !found {
+					err = &CompileError{Err: ErrUndefinedRule, Rule: rule.Name, Name: ref.Name}
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Compute which rules can match the empty string, iterating until a
+	// fixed point is reached.
+	for {
+		changed := false
+		for _, rule := range c.g.Rules {
+			if !c.nullable[rule.Name] && c.isNullable(rule.Expr) {
+				c.nullable[rule.Name] = true
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	if err := c.checkLeftRecursion(); err != nil {
+		return err
+	}
+
+	for _, rule := range c.g.Rules {
+		var err error
+		walk(rule.Expr, func(e Expr) {
+			var body Expr
+			switch x := e.(type) {
+			case *Star:
+				body = x.Expr
+			case *Plus:
+				body = x.Expr
+			}
+			if body != nil && err == nil && c.isNullable(body) {
+				err = &CompileError{Err: ErrEmptyLoop, Rule: rule.Name}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLeftRecursion rejects any rule that can invoke itself, directly or
+// through other rules, before consuming any input. Such a rule would recurse
+// until the VM's stack limit is reached.
+func (c *compiler) checkLeftRecursion() error {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	marks := make(map[string]int, len(c.g.Rules))
+	var visit func(name string) string
+	visit = func(name string) string {
+		switch marks[name] {
+		case visiting:
+			return name
+		case visited:
+			return ""
+		}
+		marks[name] = visiting
+		for _, callee := range c.leftCalls(c.rules[name].Expr, nil) {
+			if cycle := visit(callee); cycle != "" {
+				return cycle
+			}
+		}
+		marks[name] = visited
+		return ""
+	}
+	for _, rule := range c.g.Rules {
+		if cycle := visit(rule.Name); cycle != "" {
+			return &CompileError{Err: ErrLeftRecursion, Rule: cycle}
+		}
+	}
+	return nil
+}
+
+// leftCalls appends to out the names of the rules that e may invoke before
+// consuming any input, according to the current contents of c.nullable.
+func (c *compiler) leftCalls(e Expr, out []string) []string {
+	switch x := e.(type) {
+	case *Sequence:
+		for _, item := range x.Items {
+			out = c.leftCalls(item, out)
+			if !c.isNullable(item) {
+				break
+			}
+		}
+	case *Choice:
+		for _, alt := range x.Alts {
+			out = c.leftCalls(alt, out)
+		}
+	case *Star:
+		out = c.leftCalls(x.Expr, out)
+	case *Plus:
+		out = c.leftCalls(x.Expr, out)
+	case *Optional:
+		out = c.leftCalls(x.Expr, out)
+	case *And:
+		out = c.leftCalls(x.Expr, out)
+	case *Not:
+		out = c.leftCalls(x.Expr, out)
+	case *Capture:
+		out = c.leftCalls(x.Expr, out)
+	case *Ref:
+		out = append(out, x.Name)
+	}
+	return out
+}
+
+// isNullable returns true iff e can succeed without consuming any input,
+// according to the current contents of c.nullable.
+func (c *compiler) isNullable(e Expr) bool {
+	switch x := e.(type) {
+	case *Literal:
+		return len(x.Bytes) == 0
+	case *Class, *Any:
+		return false
+	case *Sequence:
+		for _, item := range x.Items {
+			if !c.isNullable(item) {
+				return false
+			}
+		}
+		return true
+	case *Choice:
+		for _, alt := range x.Alts {
+			if c.isNullable(alt) {
+				return true
+			}
+		}
+		return false
+	case *Star, *Optional, *And, *Not:
+		return true
+	case *Plus:
+		return c.isNullable(x.Expr)
+	case *Ref:
+		return c.nullable[x.Name]
+	case *Capture:
+		return c.isNullable(x.Expr)
+	}
+	panic(fmt.Errorf("unknown expression type %T", e))
+}
+
+// findRegularRules records which rules are regular: those that contain no
+// captures, and that invoke only other regular rules, without recursion.
+// Their bodies can be inlined into a DFA.
+func (c *compiler) findRegularRules() {
+	const (
+		visiting = iota + 1
+		regular
+		irregular
+	)
+	marks := make(map[string]int, len(c.g.Rules))
+	var visit func(name string) bool
+	visit = func(name string) bool {
+		switch marks[name] {
+		case visiting, irregular:
+			return false
+		case regular:
+			return true
+		}
+		marks[name] = visiting
+		ok := true
+		walk(c.rules[name].Expr, func(e Expr) {
+			switch x := e.(type) {
+			case *Capture:
+				ok = false
+			case *Ref:
+				ok = ok && visit(x.Name)
+			}
+		})
+		if ok {
+			marks[name] = regular
+		} else {
+			marks[name] = irregular
+		}
+		return ok
+	}
+	for _, rule := range c.g.Rules {
+		c.regular[rule.Name] = visit(rule.Name)
+	}
+}
+
+// isRegular returns true iff e can be converted to a DFA.
+func (c *compiler) isRegular(e Expr) bool {
+	ok := true
+	walk(e, func(e Expr) {
+		switch x := e.(type) {
+		case *Capture:
+			ok = false
+		case *Ref:
+			ok = ok && c.regular[x.Name]
+		}
+	})
+	return ok
+}
+
+// wantsDFA returns true iff e is regular and would otherwise be compiled to
+// code that backtracks, so that a DFA is likely to be faster.
+func (c *compiler) wantsDFA(e Expr) bool {
+	backtracks := false
+	walk(e, func(e Expr) {
+		switch e.(type) {
+		case *Choice, *Star, *Plus, *Optional, *And, *Not:
+			backtracks = true
+		}
+	})
+	return backtracks && c.isRegular(e)
+}
+
+// allocateCaptures numbers the grammar's captures in order of appearance.
+func (c *compiler) allocateCaptures() {
+	referenced := make(map[string]bool)
+	for _, rule := range c.g.Rules {
+		walk(rule.Expr, func(e Expr) {
+			if ref, ok := e.(*Ref); ok {
+				referenced[ref.Name] = true
+			}
+		})
+	}
+
+	metas := []peggyvm.CaptureMeta{peggyvm.CaptureMeta{}}
+	for _, rule := range c.g.Rules {
+		// A rule that is invoked from elsewhere in the grammar may
+		// run more than once per match.
+		c.collectCaptures(rule.Expr, referenced[rule.Name], &metas)
+	}
+
+	c.a.DeclareNumCaptures(uint64(len(metas)))
+	copy(c.a.Captures, metas)
+	for i, meta := range metas {
+		if meta.Name != "" {
+			c.a.DeclareNamedCapture(uint64(i), meta.Name)
+		}
+	}
+}
+
+func (c *compiler) collectCaptures(e Expr, repeat bool, metas *[]peggyvm.CaptureMeta) {
+	switch x := e.(type) {
+	case *Sequence:
+		for _, item := range x.Items {
+			c.collectCaptures(item, repeat, metas)
+		}
+	case *Choice:
+		for _, alt := range x.Alts {
+			c.collectCaptures(alt, repeat, metas)
+		}
+	case *Star:
+		c.collectCaptures(x.Expr, true, metas)
+	case *Plus:
+		c.collectCaptures(x.Expr, true, metas)
+	case *Optional:
+		c.collectCaptures(x.Expr, repeat, metas)
+	case *And:
+		c.collectCaptures(x.Expr, repeat, metas)
+	case *Not:
+		c.collectCaptures(x.Expr, repeat, metas)
+	case *Capture:
+		if idx, found := c.captures[x]; found {
+			// The same node appears more than once in the tree,
+			// so it can record more than one range.
+			(*metas)[idx].Repeat = true
+			c.collectCaptures(x.Expr, true, metas)
+			return
+		}
+		c.captures[x] = uint64(len(*metas))
+		*metas = append(*metas, peggyvm.CaptureMeta{Name: x.Name, Repeat: repeat})
+		c.collectCaptures(x.Expr, repeat, metas)
+	}
+}
+
+func (c *compiler) emitProgram() {
+	start := c.g.Rules[0].Name
+	c.emit(peggyvm.OpBCAP, uint64(0), nil, nil)
+	c.emit(peggyvm.OpCALL, c.a.GrabLabel(start), nil, nil)
+	c.emit(peggyvm.OpECAP, uint64(0), nil, nil)
+	c.emit(peggyvm.OpEND, nil, nil, nil)
+	for _, rule := range c.g.Rules {
+		c.a.SetSourcePos(peggyvm.SourcePos{Rule: rule.Name})
+		c.a.DeclareEntry(rule.Name)
+		c.a.EmitLabel(rule.Name)
+		c.emitExpr(rule.Expr)
+		c.emit(peggyvm.OpRET, nil, nil, nil)
+	}
+	c.a.SetSourcePos(peggyvm.SourcePos{})
+}
+
+func (c *compiler) emitExpr(e Expr) {
+	// !. is EOI, which is cheaper than any DFA that wantsDFA would build.
+	if x, ok := e.(*Not); ok {
+		if _, ok := x.Expr.(*Any); ok {
+			c.emit(peggyvm.OpEOI, nil, nil, nil)
+			return
+		}
+	}
+
+	if c.wantsDFA(e) {
+		if dfa := c.buildDFA(e); dfa != nil {
+			c.emit(peggyvm.OpDFAB, c.a.InternDFA(dfa), nil, nil)
+			return
+		}
+	}
+
+	switch x := e.(type) {
+	case *Literal:
+		switch len(x.Bytes) {
+		case 0:
+			// pass
+		case 1:
+			c.emit(peggyvm.OpSAMEB, x.Bytes[0], nil, nil)
+		default:
+			c.emit(peggyvm.OpLITB, c.literal(x.Bytes), nil, nil)
+		}
+
+	case *Class:
+		if bs := byteset.Bytes(x.Set, nil); len(bs) == 1 {
+			c.emit(peggyvm.OpSAMEB, bs[0], nil, nil)
+		} else {
+			c.emit(peggyvm.OpMATCHB, c.byteSet(x), nil, nil)
+		}
+
+	case *Any:
+		c.emit(peggyvm.OpANYB, nil, nil, nil)
+
+	case *Sequence:
+		// Runs of regular items may become a DFA together, even if
+		// the sequence as a whole cannot.
+		items := x.Items
+		for len(items) != 0 {
+			n := 0
+			for n < len(items) && c.isRegular(items[n]) {
+				n++
+			}
+			if n > 1 && n < len(x.Items) {
+				c.emitExpr(&Sequence{Items: items[:n]})
+				items = items[n:]
+				continue
+			}
+			c.emitExpr(items[0])
+			items = items[1:]
+		}
+
+	case *Choice:
+		c.emitChoice(x.Alts)
+
+	case *Star:
+		c.emitStar(x.Expr)
+
+	case *Plus:
+		c.emitExpr(x.Expr)
+		c.emitStar(x.Expr)
+
+	case *Optional:
+		// CHOICE L; p; COMMIT L; L:
+		end := c.newLabel()
+		c.emit(peggyvm.OpCHOICE, c.a.GrabLabel(end), nil, nil)
+		c.emitExpr(x.Expr)
+		c.emit(peggyvm.OpCOMMIT, c.a.GrabLabel(end), nil, nil)
+		c.a.EmitLabel(end)
+
+	case *And:
+		// CHOICE L1; p; BCOMMIT L2; L1: FAIL; L2:
+		fail := c.newLabel()
+		end := c.newLabel()
+		c.emit(peggyvm.OpCHOICE, c.a.GrabLabel(fail), nil, nil)
+		c.emitExpr(x.Expr)
+		c.emit(peggyvm.OpBCOMMIT, c.a.GrabLabel(end), nil, nil)
+		c.a.EmitLabel(fail)
+		c.emit(peggyvm.OpFAIL, nil, nil, nil)
+		c.a.EmitLabel(end)
+
+	case *Not:
+		// CHOICE L; p; FAIL2X; L:
+		end := c.newLabel()
+		c.emit(peggyvm.OpCHOICE, c.a.GrabLabel(end), nil, nil)
+		c.emitExpr(x.Expr)
+		c.emit(peggyvm.OpFAIL2X, nil, nil, nil)
+		c.a.EmitLabel(end)
+
+	case *Ref:
+		c.emit(peggyvm.OpCALL, c.a.GrabLabel(x.Name), nil, nil)
+
+	case *Capture:
+		idx := c.captures[x]
+		c.emit(peggyvm.OpBCAP, idx, nil, nil)
+		c.emitExpr(x.Expr)
+		c.emit(peggyvm.OpECAP, idx, nil, nil)
+
+	default:
+		panic(fmt.Errorf("unknown expression type %T", e))
+	}
+}
+
+// minDispatchAlts is the smallest number of leading alternatives with a known
+// first byte for which emitChoice uses DISPATCH.
+const minDispatchAlts = 4
+
+// emitChoice emits an ordered choice among alts. If enough leading
+// alternatives must each begin with a known byte, they are grouped by that
+// byte and DISPATCH jumps straight to the group for the byte at hand, so that
+// alternatives which cannot match are never tried:
+//
+//   CHOICE Lrest; DISPATCH t; La: pa1; JMP Ldone; Lb: <choice of pb1, pb2>;
+//   Ldone: COMMIT Lend; Lrest: <choice of the rest>; Lend:
+//
+// The CHOICE and COMMIT are omitted if there is no rest. Otherwise, it is
+// emitted as a chain:
+//
+//   CHOICE L1; p1; COMMIT Lend; L1: CHOICE L2; p2; COMMIT Lend; L2: p3; Lend:
+//
+func (c *compiler) emitChoice(alts []Expr) {
+	n := 0
+	for n < len(alts) {
+		if _, ok := firstByte(alts[n]); !ok {
+			break
+		}
+		n++
+	}
+	if n < minDispatchAlts {
+		c.emitChoiceChain(alts)
+		return
+	}
+
+	var rest, end string
+	if n < len(alts) {
+		rest = c.newLabel()
+		end = c.newLabel()
+		c.emit(peggyvm.OpCHOICE, c.a.GrabLabel(rest), nil, nil)
+	}
+
+	var groups [256][]Expr
+	for _, alt := range alts[:n] {
+		b, _ := firstByte(alt)
+		groups[b] = append(groups[b], alt)
+	}
+	var keys []byte
+	var labels []string
+	for b := range groups {
+		if len(groups[b]) != 0 {
+			keys = append(keys, byte(b))
+			labels = append(labels, c.newLabel())
+		}
+	}
+	done := c.newLabel()
+	c.emit(peggyvm.OpDISPATCH, c.a.DeclareJumpTable(keys, labels), nil, nil)
+	for i, b := range keys {
+		c.a.EmitLabel(labels[i])
+		c.emitChoiceChain(groups[b])
+		if i != len(keys)-1 {
+			c.emit(peggyvm.OpJMP, c.a.GrabLabel(done), nil, nil)
+		}
+	}
+	c.a.EmitLabel(done)
+
+	if n < len(alts) {
+		c.emit(peggyvm.OpCOMMIT, c.a.GrabLabel(end), nil, nil)
+		c.a.EmitLabel(rest)
+		c.emitChoiceChain(alts[n:])
+		c.a.EmitLabel(end)
+	}
+}
+
+// emitChoiceChain emits an ordered choice among alts as a chain of CHOICE
+// instructions.
+func (c *compiler) emitChoiceChain(alts []Expr) {
+	end := c.newLabel()
+	for i, alt := range alts {
+		if i == len(alts)-1 {
+			c.emitExpr(alt)
+			break
+		}
+		next := c.newLabel()
+		c.emit(peggyvm.OpCHOICE, c.a.GrabLabel(next), nil, nil)
+		c.emitExpr(alt)
+		c.emit(peggyvm.OpCOMMIT, c.a.GrabLabel(end), nil, nil)
+		c.a.EmitLabel(next)
+	}
+	c.a.EmitLabel(end)
+}
+
+// firstByte returns the byte that every match of e must begin with, or false
+// if there is no such byte or it is not obvious. Rule references are not
+// followed.
+func firstByte(e Expr) (byte, bool) {
+	switch x := e.(type) {
+	case *Literal:
+		if len(x.Bytes) != 0 {
+			return x.Bytes[0], true
+		}
+
+	case *Class:
+		if bs := byteset.Bytes(x.Set, nil); len(bs) == 1 {
+			return bs[0], true
+		}
+
+	case *Sequence:
+		for _, item := range x.Items {
+			if lit, ok := item.(*Literal); ok && len(lit.Bytes) == 0 {
+				continue
+			}
+			return firstByte(item)
+		}
+
+	case *Capture:
+		return firstByte(x.Expr)
+	}
+	return 0, false
+}
+
+// emitStar emits a greedy loop over e:
+//
+//   L1: CHOICE L2; p; COMMIT L1; L2:
+//
+func (c *compiler) emitStar(e Expr) {
+	loop := c.newLabel()
+	end := c.newLabel()
+	c.a.EmitLabel(loop)
+	c.emit(peggyvm.OpCHOICE, c.a.GrabLabel(end), nil, nil)
+	c.emitExpr(e)
+	c.emit(peggyvm.OpCOMMIT, c.a.GrabLabel(loop), nil, nil)
+	c.a.EmitLabel(end)
+}
+
+func (c *compiler) emit(code peggyvm.OpCode, imm0, imm1, imm2 interface{}) {
+	c.a.EmitOp(code.Meta(), imm0, imm1, imm2)
+}
+
+// literal returns the index of lit in the literal pool, adding it if needed.
+func (c *compiler) literal(lit []byte) uint64 {
+	return c.a.InternLiteral(lit)
+}
+
+// byteSet returns the index of x.Set in the byteset pool, adding it if needed.
+func (c *compiler) byteSet(x *Class) uint64 {
+	return c.a.InternByteSet(x.Set)
+}
+
+func (c *compiler) newLabel() string {
+	name := fmt.Sprintf(".L%d", c.nlabels)
+	c.nlabels += 1
+	return name
+}
+
+// walk calls f for e and each of its descendants, in prefix order.
+func walk(e Expr, f func(Expr)) {
+	f(e)
+	switch x := e.(type) {
+	case *Sequence:
+		for _, item := range x.Items {
+			walk(item, f)
+		}
+	case *Choice:
+		for _, alt := range x.Alts {
+			walk(alt, f)
+		}
+	case *Star:
+		walk(x.Expr, f)
+	case *Plus:
+		walk(x.Expr, f)
+	case *Optional:
+		walk(x.Expr, f)
+	case *And:
+		walk(x.Expr, f)
+	case *Not:
+		walk(x.Expr, f)
+	case *Capture:
+		walk(x.Expr, f)
+	}
+}
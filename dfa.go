@@ -0,0 +1,634 @@
+package peggy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/chronos-tachyon/go-peggy/peggyvm"
+)
+
+// maxDFAStates is the largest DFA that buildDFA will construct. Sub-patterns
+// that need more states are compiled to ordinary bytecode instead.
+const maxDFAStates = 256
+
+// maxDFATermSize bounds the size of a single DFA state's term, so that
+// patterns whose terms keep growing are abandoned quickly.
+const maxDFATermSize = 512
+
+// Registers in a dfaTerm. Registers from 0 up name positions saved in earlier
+// states; regNow is the current position, and regAny stands for a position
+// that nothing will ever read.
+const (
+	regNow = -1
+	regAny = -2
+)
+
+type dfaTermKind uint8
+
+const (
+	termFail dfaTermKind = iota
+	termDone
+	termRun
+	termCond
+	termLook
+)
+
+// dfaFrame is one item on the stack of a termRun: an expression, plus a
+// position within it. For a Literal, N is the number of bytes already
+// matched; for a Choice, the first alternative still to try; for a Plus, 1
+// once the first repetition has matched, making it a Star.
+type dfaFrame struct {
+	Expr Expr
+	N    int
+}
+
+// dfaInst is one speculative run of a termCond's continuation, started at the
+// position held by Reg.
+type dfaInst struct {
+	Reg  int
+	Term *dfaTerm
+}
+
+// dfaTerm describes the work that remains to match a regular expression, as
+// a combination of matchers running side by side over the same input. Terms
+// are never modified once built.
+//
+//   termFail    the match has failed
+//   termDone    the match has succeeded, ending at Reg
+//   termRun     match each of Stack in turn, then succeed at the end
+//   termCond    match P; where P succeeds, continue with Stack from there
+//               (each such run is in Insts); if P fails, the result is Q
+//   termLook    match P without consuming it; if it succeeds (or fails, if
+//               Neg), the result is Q, otherwise failure
+//
+type dfaTerm struct {
+	Kind  dfaTermKind
+	Neg   bool
+	Reg   int
+	Stack []dfaFrame
+	P, Q  *dfaTerm
+	Insts []dfaInst
+}
+
+var (
+	failTerm = &dfaTerm{Kind: termFail}
+	nowTerm  = &dfaTerm{Kind: termDone, Reg: regNow}
+)
+
+// dfaAbort is panicked by dfaBuilder when the DFA would be too large.
+type dfaAbort struct{}
+
+type dfaBuilder struct {
+	rules map[string]*Rule
+	size  int
+}
+
+// buildDFA converts e, which must be regular, into a DFA. It returns nil if
+// the DFA would need too many states or registers.
+func (c *compiler) buildDFA(e Expr) (dfa *peggyvm.DFA) {
+	b := &dfaBuilder{rules: c.rules}
+	defer func() {
+		if x := recover(); x != nil {
+			if _, ok := x.(dfaAbort); !ok {
+				panic(x)
+			}
+			dfa = nil
+		}
+	}()
+	return b.build(e)
+}
+
+func (b *dfaBuilder) build(e Expr) *peggyvm.DFA {
+	type pending struct {
+		Term  *dfaTerm
+		Edges [256]peggyvm.DFAEdge
+		EOF   peggyvm.DFAEdge
+	}
+
+	var states []*pending
+	index := make(map[string]int)
+	intern := func(t *dfaTerm) (int, []int) {
+		t, order := b.rename(t)
+		if len(order) > peggyvm.MaxDFARegs {
+			panic(dfaAbort{})
+		}
+		key := termKey(t)
+		if i, found := index[key]; found {
+			return i, order
+		}
+		if len(states) >= maxDFAStates {
+			panic(dfaAbort{})
+		}
+		index[key] = len(states)
+		states = append(states, &pending{Term: t})
+		return len(states) - 1, order
+	}
+	edge := func(t *dfaTerm) peggyvm.DFAEdge {
+		switch t.Kind {
+		case termFail:
+			return peggyvm.DFAEdge{Target: peggyvm.DFAFail}
+		case termDone:
+			return peggyvm.DFAEdge{Target: peggyvm.DFAAccept, End: t.Reg}
+		}
+		target, regs := intern(t)
+		return peggyvm.DFAEdge{Target: target, Regs: regs}
+	}
+
+	b.size = 0
+	intern(b.normalize(&dfaTerm{Kind: termRun, Stack: []dfaFrame{{Expr: e}}}))
+	for i := 0; i < len(states); i++ {
+		s := states[i]
+		for c := 0; c < 256; c++ {
+			b.size = 0
+			s.Edges[c] = edge(b.normalize(b.step(s.Term, byte(c))))
+		}
+		if ok, reg := eofResult(s.Term); ok {
+			s.EOF = peggyvm.DFAEdge{Target: peggyvm.DFAAccept, End: reg}
+		} else {
+			s.EOF = peggyvm.DFAEdge{Target: peggyvm.DFAFail}
+		}
+	}
+
+	dfa := &peggyvm.DFA{States: make([]peggyvm.DFAState, len(states))}
+	for _, s := range states {
+		for _, reg := range s.Term.registers() {
+			if reg+1 > dfa.NumRegs {
+				dfa.NumRegs = reg + 1
+			}
+		}
+	}
+
+	// Bytes that follow the same edge in every state share a class.
+	classOf := make(map[string]int)
+	var columns []int
+	for c := 0; c < 256; c++ {
+		var buf bytes.Buffer
+		for _, s := range states {
+			writeEdgeKey(&buf, s.Edges[c])
+		}
+		class, found := classOf[buf.String()]
+		if !found {
+			class = len(columns)
+			classOf[buf.String()] = class
+			columns = append(columns, c)
+		}
+		dfa.Classes[c] = uint8(class)
+	}
+	dfa.NumClasses = len(columns)
+
+	for i, s := range states {
+		state := &dfa.States[i]
+		state.EOF = s.EOF
+		state.Next = make([]peggyvm.DFAEdge, len(columns))
+		for class, c := range columns {
+			e := s.Edges[c]
+			if e.Target >= 0 {
+				// Every state uses the same number of registers.
+				for len(e.Regs) < dfa.NumRegs {
+					e.Regs = append(e.Regs, peggyvm.DFANow)
+				}
+			}
+			state.Next[class] = e
+		}
+	}
+	if err := dfa.Validate(); err != nil {
+		panic(fmt.Errorf("BUG: built an invalid DFA: %v", err))
+	}
+	return dfa
+}
+
+// normalize rewrites t until every termRun within it is waiting for a byte,
+// and resolves whatever can be decided without one.
+func (b *dfaBuilder) normalize(t *dfaTerm) *dfaTerm {
+	b.size++
+	if b.size > maxDFATermSize {
+		panic(dfaAbort{})
+	}
+
+	switch t.Kind {
+	case termRun:
+		return b.expand(t.Stack)
+
+	case termCond:
+		p := b.normalize(t.P)
+		switch p.Kind {
+		case termFail:
+			return b.normalize(t.Q)
+		case termDone:
+			if len(t.Stack) == 0 {
+				return p
+			}
+			for _, inst := range t.Insts {
+				if inst.Reg == p.Reg {
+					return b.normalize(inst.Term)
+				}
+			}
+			return b.spawn(t.Stack, p.Reg)
+		}
+		q := failTerm
+		if !p.cannotFail() {
+			q = b.normalize(t.Q)
+		}
+		if len(t.Stack) == 0 {
+			if q.Kind == termFail {
+				return p
+			}
+			return &dfaTerm{Kind: termCond, P: p, Q: q}
+		}
+		var insts []dfaInst
+		for _, reg := range p.results() {
+			var term *dfaTerm
+			for _, inst := range t.Insts {
+				if inst.Reg == reg {
+					term = b.normalize(inst.Term)
+				}
+			}
+			if term == nil {
+				term = b.spawn(t.Stack, reg)
+			}
+			insts = append(insts, dfaInst{reg, term})
+		}
+		return &dfaTerm{Kind: termCond, Stack: t.Stack, P: p, Q: q, Insts: insts}
+
+	case termLook:
+		p := b.normalize(t.P)
+		switch p.Kind {
+		case termFail, termDone:
+			if (p.Kind == termDone) == t.Neg {
+				return failTerm
+			}
+			return b.normalize(t.Q)
+		}
+		q := b.normalize(t.Q)
+		if q.Kind == termFail {
+			return failTerm
+		}
+		return &dfaTerm{Kind: termLook, Neg: t.Neg, P: p.forget(), Q: q}
+	}
+	return t
+}
+
+// spawn starts a run of stack at the position held by reg. Only a run that
+// starts now can still see all of its input.
+func (b *dfaBuilder) spawn(stack []dfaFrame, reg int) *dfaTerm {
+	if reg != regNow {
+		panic(dfaAbort{})
+	}
+	return b.expand(stack)
+}
+
+// expand normalizes a termRun for stack.
+func (b *dfaBuilder) expand(stack []dfaFrame) *dfaTerm {
+	if len(stack) == 0 {
+		return nowTerm
+	}
+	top, rest := stack[0], stack[1:]
+	run := func(frames ...dfaFrame) *dfaTerm {
+		list := make([]dfaFrame, 0, len(frames)+len(rest))
+		list = append(list, frames...)
+		list = append(list, rest...)
+		return &dfaTerm{Kind: termRun, Stack: list}
+	}
+
+	var t *dfaTerm
+	switch x := top.Expr.(type) {
+	case *Literal:
+		if top.N < len(x.Bytes) {
+			return &dfaTerm{Kind: termRun, Stack: stack}
+		}
+		t = run()
+
+	case *Class, *Any:
+		return &dfaTerm{Kind: termRun, Stack: stack}
+
+	case *Sequence:
+		frames := make([]dfaFrame, len(x.Items))
+		for i, item := range x.Items {
+			frames[i] = dfaFrame{Expr: item}
+		}
+		t = run(frames...)
+
+	case *Choice:
+		alt := dfaFrame{Expr: x.Alts[top.N]}
+		if top.N == len(x.Alts)-1 {
+			t = run(alt)
+			break
+		}
+		t = &dfaTerm{
+			Kind:  termCond,
+			Stack: rest,
+			P:     &dfaTerm{Kind: termRun, Stack: []dfaFrame{alt}},
+			Q:     run(dfaFrame{Expr: x, N: top.N + 1}),
+		}
+
+	case *Star:
+		t = &dfaTerm{
+			Kind:  termCond,
+			Stack: rest,
+			P:     &dfaTerm{Kind: termRun, Stack: []dfaFrame{{Expr: x.Expr}, top}},
+			Q:     run(),
+		}
+
+	case *Plus:
+		if top.N == 0 {
+			t = run(dfaFrame{Expr: x.Expr}, dfaFrame{Expr: x, N: 1})
+			break
+		}
+		t = &dfaTerm{
+			Kind:  termCond,
+			Stack: rest,
+			P:     &dfaTerm{Kind: termRun, Stack: []dfaFrame{{Expr: x.Expr}, top}},
+			Q:     run(),
+		}
+
+	case *Optional:
+		t = &dfaTerm{
+			Kind:  termCond,
+			Stack: rest,
+			P:     &dfaTerm{Kind: termRun, Stack: []dfaFrame{{Expr: x.Expr}}},
+			Q:     run(),
+		}
+
+	case *And:
+		t = &dfaTerm{
+			Kind: termLook,
+			P:    &dfaTerm{Kind: termRun, Stack: []dfaFrame{{Expr: x.Expr}}},
+			Q:    run(),
+		}
+
+	case *Not:
+		t = &dfaTerm{
+			Kind: termLook,
+			Neg:  true,
+			P:    &dfaTerm{Kind: termRun, Stack: []dfaFrame{{Expr: x.Expr}}},
+			Q:    run(),
+		}
+
+	case *Ref:
+		t = run(dfaFrame{Expr: b.rules[x.Name].Expr})
+
+	default:
+		panic(fmt.Errorf("BUG: %T is not regular", top.Expr))
+	}
+	return b.normalize(t)
+}
+
+// step advances t, which must be normalized, past the byte ch.
+func (b *dfaBuilder) step(t *dfaTerm, ch byte) *dfaTerm {
+	switch t.Kind {
+	case termRun:
+		top, rest := t.Stack[0], t.Stack[1:]
+		matched := false
+		switch x := top.Expr.(type) {
+		case *Literal:
+			if x.Bytes[top.N] == ch {
+				stack := make([]dfaFrame, 0, len(t.Stack))
+				stack = append(stack, dfaFrame{Expr: x, N: top.N + 1})
+				return &dfaTerm{Kind: termRun, Stack: append(stack, rest...)}
+			}
+		case *Class:
+			matched = x.Set.Match(ch)
+		case *Any:
+			matched = true
+		}
+		if !matched {
+			return failTerm
+		}
+		return &dfaTerm{Kind: termRun, Stack: rest}
+
+	case termCond:
+		u := &dfaTerm{Kind: termCond, Stack: t.Stack, P: b.step(t.P, ch), Q: b.step(t.Q, ch)}
+		for _, inst := range t.Insts {
+			u.Insts = append(u.Insts, dfaInst{inst.Reg, b.step(inst.Term, ch)})
+		}
+		return u
+
+	case termLook:
+		return &dfaTerm{Kind: termLook, Neg: t.Neg, P: b.step(t.P, ch), Q: b.step(t.Q, ch)}
+	}
+	return t
+}
+
+// eofResult resolves t, which must be normalized, at the end of the input.
+func eofResult(t *dfaTerm) (bool, int) {
+	switch t.Kind {
+	case termDone:
+		return true, t.Reg
+
+	case termCond:
+		ok, reg := eofResult(t.P)
+		if !ok {
+			return eofResult(t.Q)
+		}
+		if len(t.Stack) == 0 {
+			return true, reg
+		}
+		for _, inst := range t.Insts {
+			if inst.Reg == reg {
+				return eofResult(inst.Term)
+			}
+		}
+		return false, 0
+
+	case termLook:
+		if ok, _ := eofResult(t.P); ok == t.Neg {
+			return false, 0
+		}
+		return eofResult(t.Q)
+	}
+	return false, 0
+}
+
+// results lists the registers at which t may succeed without consuming
+// more input first.
+func (t *dfaTerm) results() []int {
+	var out []int
+	var visit func(t *dfaTerm)
+	visit = func(t *dfaTerm) {
+		switch t.Kind {
+		case termDone:
+			for _, reg := range out {
+				if reg == t.Reg {
+					return
+				}
+			}
+			out = append(out, t.Reg)
+		case termCond:
+			if len(t.Stack) == 0 {
+				visit(t.P)
+			}
+			for _, inst := range t.Insts {
+				visit(inst.Term)
+			}
+			visit(t.Q)
+		case termLook:
+			visit(t.Q)
+		}
+	}
+	visit(t)
+	return out
+}
+
+// cannotFail returns true if t is sure to succeed.
+func (t *dfaTerm) cannotFail() bool {
+	switch t.Kind {
+	case termDone:
+		return true
+	case termCond:
+		return len(t.Stack) == 0 && (t.P.cannotFail() || t.Q.cannotFail())
+	}
+	return false
+}
+
+// forget replaces the registers at which t may succeed with regAny, for use
+// within a lookahead, where only success or failure matters.
+func (t *dfaTerm) forget() *dfaTerm {
+	switch t.Kind {
+	case termDone:
+		return &dfaTerm{Kind: termDone, Reg: regAny}
+	case termCond:
+		u := *t
+		if len(t.Stack) == 0 {
+			u.P = t.P.forget()
+		}
+		u.Insts = make([]dfaInst, len(t.Insts))
+		for i, inst := range t.Insts {
+			u.Insts[i] = dfaInst{inst.Reg, inst.Term.forget()}
+		}
+		u.Q = t.Q.forget()
+		return &u
+	case termLook:
+		u := *t
+		u.Q = t.Q.forget()
+		return &u
+	}
+	return t
+}
+
+// rename numbers the registers used by t, in order of first use. It returns
+// the renamed term and, for each new register, the old register that it
+// copies, with regNow as peggyvm.DFANow.
+func (b *dfaBuilder) rename(t *dfaTerm) (*dfaTerm, []int) {
+	var order []int
+	mapping := make(map[int]int)
+	reg := func(old int) int {
+		if old == regAny {
+			return regAny
+		}
+		if r, found := mapping[old]; found {
+			return r
+		}
+		r := len(order)
+		mapping[old] = r
+		if old == regNow {
+			old = peggyvm.DFANow
+		}
+		order = append(order, old)
+		return r
+	}
+	var visit func(t *dfaTerm) *dfaTerm
+	visit = func(t *dfaTerm) *dfaTerm {
+		switch t.Kind {
+		case termDone:
+			return &dfaTerm{Kind: termDone, Reg: reg(t.Reg)}
+		case termCond:
+			u := *t
+			u.P = visit(t.P)
+			u.Insts = make([]dfaInst, len(t.Insts))
+			for i, inst := range t.Insts {
+				u.Insts[i] = dfaInst{reg(inst.Reg), visit(inst.Term)}
+			}
+			sort.Slice(u.Insts, func(i, j int) bool { return u.Insts[i].Reg < u.Insts[j].Reg })
+			u.Q = visit(t.Q)
+			return &u
+		case termLook:
+			u := *t
+			u.P = visit(t.P)
+			u.Q = visit(t.Q)
+			return &u
+		}
+		return t
+	}
+	return visit(t), order
+}
+
+// registers lists the registers used by t.
+func (t *dfaTerm) registers() []int {
+	var out []int
+	var visit func(t *dfaTerm)
+	visit = func(t *dfaTerm) {
+		switch t.Kind {
+		case termDone:
+			if t.Reg >= 0 {
+				out = append(out, t.Reg)
+			}
+		case termCond:
+			visit(t.P)
+			for _, inst := range t.Insts {
+				out = append(out, inst.Reg)
+				visit(inst.Term)
+			}
+			visit(t.Q)
+		case termLook:
+			visit(t.P)
+			visit(t.Q)
+		}
+	}
+	visit(t)
+	return out
+}
+
+// termKey returns a string that identifies t. Expressions are identified by
+// address, so two terms with equal keys are sure to behave alike.
+func termKey(t *dfaTerm) string {
+	var buf bytes.Buffer
+	var visit func(t *dfaTerm)
+	stack := func(stack []dfaFrame) {
+		buf.WriteByte('[')
+		for _, frame := range stack {
+			fmt.Fprintf(&buf, "%p:%d ", frame.Expr, frame.N)
+		}
+		buf.WriteByte(']')
+	}
+	visit = func(t *dfaTerm) {
+		switch t.Kind {
+		case termFail:
+			buf.WriteString("F")
+		case termDone:
+			buf.WriteString("D")
+			buf.WriteString(strconv.Itoa(t.Reg))
+		case termRun:
+			buf.WriteString("R")
+			stack(t.Stack)
+		case termCond:
+			buf.WriteString("C(")
+			visit(t.P)
+			stack(t.Stack)
+			for _, inst := range t.Insts {
+				fmt.Fprintf(&buf, "%d=", inst.Reg)
+				visit(inst.Term)
+				buf.WriteByte(' ')
+			}
+			visit(t.Q)
+			buf.WriteByte(')')
+		case termLook:
+			if t.Neg {
+				buf.WriteString("N(")
+			} else {
+				buf.WriteString("A(")
+			}
+			visit(t.P)
+			buf.WriteByte(' ')
+			visit(t.Q)
+			buf.WriteByte(')')
+		}
+	}
+	visit(t)
+	return buf.String()
+}
+
+func writeEdgeKey(buf *bytes.Buffer, e peggyvm.DFAEdge) {
+	fmt.Fprintf(buf, "%d/%d/%v;", e.Target, e.End, e.Regs)
+}
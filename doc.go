@@ -0,0 +1,62 @@
+// Package peggy compiles Parsing Expression Grammars into bytecode for the
+// peggyvm virtual machine.
+//
+// The API is modeled on package regexp: Compile turns grammar text into a
+// *Pattern, which may then be used to match input.
+//
+//   p := peggy.MustCompile(`
+//     number <- { [0-9]+ } ('.' { [0-9]+ })?
+//   `)
+//   ok := p.MatchString("3.14")
+//
+//
+// A grammar is a list of rules. The first rule is the start rule.
+//
+//   Grammar    <- Spacing Rule+ EndOfInput
+//   Rule       <- Identifier '<-' Choice
+//   Choice     <- Sequence ('/' Sequence)*
+//   Sequence   <- Prefix*
+//   Prefix     <- ('&' / '!')? Suffix
+//   Suffix     <- Primary ('*' / '+' / '?')?
+//   Primary    <- Identifier !'<-'
+//               / '(' Choice ')'
+//               / '{' (Identifier ':')? Choice '}'
+//               / Literal / Class / '.'
+//
+// Whitespace is insignificant between tokens, and '#' begins a comment that
+// runs to the end of the line.
+//
+// The primary expressions have the following meanings:
+//
+// • 'abc' or "abc" matches the literal bytes. The escapes \a \b \f \n \r \t
+// \v \\ \' \" \[ \] \- \^ and \xHH are recognized.
+//
+// • [a-z_] matches one byte in the class. A leading ^ inverts the class.
+// Only ASCII characters may appear unescaped in a class.
+//
+// • . matches any one byte.
+//
+// • (e) groups.
+//
+// • { e } records a capture of the input matched by e. { name: e } records
+// a named capture. Captures are numbered from 1 in order of appearance;
+// capture 0 is always the whole match.
+//
+// • An identifier invokes the rule of that name.
+//
+// The operators are, from tightest to loosest binding: the suffixes e* (zero
+// or more), e+ (one or more), and e? (optional); the prefixes &e (positive
+// lookahead) and !e (negative lookahead); sequence; and ordered choice e1 / e2.
+//
+// Matches are anchored at the start of the input but not at the end; use !.
+// to require that all input be consumed. Left-recursive rules are not
+// supported; Compile rejects them with ErrLeftRecursion.
+//
+// Parts of a grammar that are regular, meaning that they contain no captures
+// and invoke no recursive rules, are compiled to a DFA where that helps, so
+// that they match in a single pass without backtracking. The results are the
+// same either way. Likewise, a choice among many alternatives that each begin
+// with a known byte, such as a list of keywords, jumps straight to the
+// alternatives for the byte at hand rather than trying each in turn.
+//
+package peggy
@@ -0,0 +1,49 @@
+package peggy
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyGrammar        = errors.New("grammar contains no rules")
+	ErrExpectedRule        = errors.New("expected rule definition")
+	ErrExpectedArrow       = errors.New("expected '<-'")
+	ErrExpectedExpression  = errors.New("expected expression")
+	ErrExpectedCloseParen  = errors.New("expected ')'")
+	ErrExpectedCloseBrace  = errors.New("expected '}'")
+	ErrUnterminatedLiteral = errors.New("unterminated literal")
+	ErrUnterminatedClass   = errors.New("unterminated character class")
+	ErrBadEscape           = errors.New("invalid escape sequence")
+	ErrNonASCIIClass       = errors.New("non-ASCII character in character class")
+	ErrUndefinedRule       = errors.New("undefined rule")
+	ErrDuplicateRule       = errors.New("duplicate rule")
+	ErrDuplicateCapture    = errors.New("duplicate capture name")
+	ErrEmptyLoop           = errors.New("loop body may match the empty string")
+	ErrLeftRecursion       = errors.New("left-recursive rule")
+)
+
+// SyntaxError is an error encountered while parsing grammar text.
+type SyntaxError struct {
+	Err    error
+	Line   uint
+	Column uint
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy: syntax error @ line %d col %d: %v", e.Line, e.Column, e.Err)
+}
+
+// CompileError is an error encountered while compiling a parsed grammar.
+type CompileError struct {
+	Err  error
+	Rule string
+	Name string
+}
+
+func (e *CompileError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("github.com/chronos-tachyon/peggy: compile error in rule %q: %v: %q", e.Rule, e.Err, e.Name)
+	}
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy: compile error in rule %q: %v", e.Rule, e.Err)
+}
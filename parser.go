@@ -0,0 +1,379 @@
+package peggy
+
+import (
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+// Parse parses grammar text into a Grammar. See the package documentation for
+// the syntax.
+func Parse(src string) (*Grammar, error) {
+	p := &parser{src: src}
+	return p.parseGrammar()
+}
+
+type parser struct {
+	src string
+	pos int
+}
+
+type parseError struct {
+	err error
+	pos int
+}
+
+func (p *parser) fail(err error, pos int) {
+	panic(parseError{err, pos})
+}
+
+func (p *parser) syntaxError(err error, pos int) *SyntaxError {
+	line, col := uint(1), uint(1)
+	for i := 0; i < pos && i < len(p.src); i++ {
+		if p.src[i] == '\n' {
+			line += 1
+			col = 1
+		} else {
+			col += 1
+		}
+	}
+	return &SyntaxError{Err: err, Line: line, Column: col}
+}
+
+func (p *parser) parseGrammar() (g *Grammar, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			g = nil
+			err = p.syntaxError(pe.err, pe.pos)
+		}
+	}()
+
+	g = &Grammar{Source: p.src}
+	p.skipSpace()
+	for p.pos < len(p.src) {
+		g.Rules = append(g.Rules, p.parseRule())
+		p.skipSpace()
+	}
+	if len(g.Rules) == 0 {
+		p.fail(ErrEmptyGrammar, p.pos)
+	}
+	return g, nil
+}
+
+func (p *parser) parseRule() *Rule {
+	start := p.pos
+	name := p.parseIdent()
+	if name == "" {
+		p.fail(ErrExpectedRule, start)
+	}
+	p.skipSpace()
+	if !p.consume("<-") {
+		p.fail(ErrExpectedArrow, p.pos)
+	}
+	p.skipSpace()
+	return &Rule{Name: name, Expr: p.parseChoice()}
+}
+
+func (p *parser) parseChoice() Expr {
+	alts := []Expr{p.parseSequence()}
+	for p.consume("/") {
+		p.skipSpace()
+		alts = append(alts, p.parseSequence())
+	}
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return &Choice{Alts: alts}
+}
+
+func (p *parser) parseSequence() Expr {
+	var items []Expr
+	for {
+		item := p.parsePrefix()
+		if item == nil {
+			break
+		}
+		items = append(items, item)
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return &Sequence{Items: items}
+}
+
+func (p *parser) parsePrefix() Expr {
+	start := p.pos
+	var wrap func(Expr) Expr
+	switch {
+	case p.consume("&"):
+		wrap = func(e Expr) Expr { return &And{Expr: e} }
+	case p.consume("!"):
+		wrap = func(e Expr) Expr { return &Not{Expr: e} }
+	}
+	if wrap != nil {
+		p.skipSpace()
+		e := p.parseSuffix()
+		if e == nil {
+			p.fail(ErrExpectedExpression, start)
+		}
+		return wrap(e)
+	}
+	return p.parseSuffix()
+}
+
+func (p *parser) parseSuffix() Expr {
+	e := p.parsePrimary()
+	if e == nil {
+		return nil
+	}
+	for {
+		switch {
+		case p.consume("*"):
+			e = &Star{Expr: e}
+		case p.consume("+"):
+			e = &Plus{Expr: e}
+		case p.consume("?"):
+			e = &Optional{Expr: e}
+		default:
+			return e
+		}
+		p.skipSpace()
+	}
+}
+
+func (p *parser) parsePrimary() Expr {
+	if p.pos >= len(p.src) {
+		return nil
+	}
+	start := p.pos
+	ch := p.src[p.pos]
+	switch {
+	case ch == '(':
+		p.pos += 1
+		p.skipSpace()
+		e := p.parseChoice()
+		if !p.consume(")") {
+			p.fail(ErrExpectedCloseParen, p.pos)
+		}
+		p.skipSpace()
+		return e
+
+	case ch == '{':
+		p.pos += 1
+		p.skipSpace()
+		var name string
+		save := p.pos
+		if id := p.parseIdent(); id != "" {
+			p.skipSpace()
+			if p.consume(":") {
+				name = id
+				p.skipSpace()
+			} else {
+				p.pos = save
+			}
+		}
+		e := p.parseChoice()
+		if !p.consume("}") {
+			p.fail(ErrExpectedCloseBrace, p.pos)
+		}
+		p.skipSpace()
+		return &Capture{Name: name, Expr: e}
+
+	case ch == '\'' || ch == '"':
+		p.pos += 1
+		lit := p.parseLiteral(ch)
+		p.skipSpace()
+		return &Literal{Bytes: lit}
+
+	case ch == '[':
+		p.pos += 1
+		set := p.parseClass()
+		p.skipSpace()
+		return &Class{Set: set}
+
+	case ch == '.':
+		p.pos += 1
+		p.skipSpace()
+		return &Any{}
+
+	case isIdentStart(ch):
+		name := p.parseIdent()
+		p.skipSpace()
+		if p.lookingAt("<-") {
+			// Start of the next rule.
+			p.pos = start
+			return nil
+		}
+		return &Ref{Name: name}
+	}
+	return nil
+}
+
+func (p *parser) parseLiteral(quote byte) []byte {
+	start := p.pos - 1
+	var out []byte
+	for {
+		if p.pos >= len(p.src) {
+			p.fail(ErrUnterminatedLiteral, start)
+		}
+		ch := p.src[p.pos]
+		if ch == quote {
+			p.pos += 1
+			return out
+		}
+		if ch == '\n' {
+			p.fail(ErrUnterminatedLiteral, start)
+		}
+		if ch == '\\' {
+			out = append(out, p.parseEscape())
+			continue
+		}
+		out = append(out, ch)
+		p.pos += 1
+	}
+}
+
+func (p *parser) parseClass() byteset.Matcher {
+	start := p.pos - 1
+	negate := p.consume("^")
+	var ranges []byteset.Range
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			p.fail(ErrUnterminatedClass, start)
+		}
+		if p.src[p.pos] == ']' {
+			p.pos += 1
+			break
+		}
+		lo := p.parseClassByte()
+		hi := lo
+		if p.lookingAt("-") && !p.lookingAt("-]") {
+			p.pos += 1
+			if p.pos >= len(p.src) {
+				p.fail(ErrUnterminatedClass, start)
+			}
+			hi = p.parseClassByte()
+		}
+		ranges = append(ranges, byteset.Range{Lo: lo, Hi: hi})
+	}
+	var m byteset.Matcher = byteset.Ranges(ranges...)
+	if negate {
+		m = byteset.Not(m)
+	}
+	return m.Optimize()
+}
+
+func (p *parser) parseClassByte() byte {
+	ch := p.src[p.pos]
+	if ch == '\\' {
+		return p.parseEscape()
+	}
+	if ch >= 0x80 {
+		p.fail(ErrNonASCIIClass, p.pos)
+	}
+	p.pos += 1
+	return ch
+}
+
+func (p *parser) parseEscape() byte {
+	start := p.pos
+	p.pos += 1
+	if p.pos >= len(p.src) {
+		p.fail(ErrBadEscape, start)
+	}
+	ch := p.src[p.pos]
+	p.pos += 1
+	switch ch {
+	case 'a':
+		return 0x07
+	case 'b':
+		return 0x08
+	case 't':
+		return 0x09
+	case 'n':
+		return 0x0a
+	case 'v':
+		return 0x0b
+	case 'f':
+		return 0x0c
+	case 'r':
+		return 0x0d
+	case '\\', '\'', '"', '[', ']', '-', '^':
+		return ch
+	case 'x':
+		if p.pos+2 > len(p.src) {
+			p.fail(ErrBadEscape, start)
+		}
+		hi, ok0 := hexValue(p.src[p.pos])
+		lo, ok1 := hexValue(p.src[p.pos+1])
+		if !ok0 || !ok1 {
+			p.fail(ErrBadEscape, start)
+		}
+		p.pos += 2
+		return (hi << 4) | lo
+	}
+	p.fail(ErrBadEscape, start)
+	return 0
+}
+
+func (p *parser) parseIdent() string {
+	start := p.pos
+	if p.pos >= len(p.src) || !isIdentStart(p.src[p.pos]) {
+		return ""
+	}
+	p.pos += 1
+	for p.pos < len(p.src) && isIdentContinue(p.src[p.pos]) {
+		p.pos += 1
+	}
+	return p.src[start:p.pos]
+}
+
+// skipSpace skips over whitespace and comments.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos += 1
+		case '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos += 1
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) lookingAt(s string) bool {
+	return len(p.src)-p.pos >= len(s) && p.src[p.pos:p.pos+len(s)] == s
+}
+
+func (p *parser) consume(s string) bool {
+	if p.lookingAt(s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z')
+}
+
+func isIdentContinue(ch byte) bool {
+	return isIdentStart(ch) || (ch >= '0' && ch <= '9')
+}
+
+func hexValue(ch byte) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	}
+	return 0, false
+}
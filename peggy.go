@@ -0,0 +1,210 @@
+package peggy
+
+import (
+	"fmt"
+
+	"github.com/chronos-tachyon/go-peggy/peggyvm"
+)
+
+// Pattern is a compiled grammar, ready to match input.
+//
+// A Pattern is safe for concurrent use by multiple goroutines.
+//
+type Pattern struct {
+	expr string
+	prog *peggyvm.Program
+}
+
+// Compile parses a grammar and, if successful, returns a Pattern that can be
+// used to match against input.
+func Compile(grammar string) (*Pattern, error) {
+	g, err := Parse(grammar)
+	if err != nil {
+		return nil, err
+	}
+	return CompileGrammar(g)
+}
+
+// MustCompile is like Compile but panics if the grammar cannot be compiled.
+// It simplifies safe initialization of global variables holding patterns.
+func MustCompile(grammar string) *Pattern {
+	p, err := Compile(grammar)
+	if err != nil {
+		panic(fmt.Sprintf("peggy: Compile(%q): %v", grammar, err))
+	}
+	return p
+}
+
+// CompileGrammar compiles an already-parsed grammar. This is the hook used by
+// alternative front ends, such as package re, that build a Grammar themselves.
+func CompileGrammar(g *Grammar) (*Pattern, error) {
+	prog, err := CompileProgram(g)
+	if err != nil {
+		return nil, err
+	}
+	if err := prog.Precompile(); err != nil {
+		return nil, err
+	}
+	expr := g.Source
+	if expr == "" {
+		expr = g.String()
+	}
+	return &Pattern{expr: expr, prog: prog}, nil
+}
+
+// String returns the source text used to compile the pattern.
+func (p *Pattern) String() string {
+	return p.expr
+}
+
+// Program returns the compiled bytecode program.
+func (p *Pattern) Program() *peggyvm.Program {
+	return p.prog
+}
+
+// NumSubexp returns the number of captures in the pattern, not counting the
+// implicit whole-match capture 0.
+func (p *Pattern) NumSubexp() int {
+	return len(p.prog.Captures) - 1
+}
+
+// SubexpNames returns the names of the captures in the pattern. The name for
+// capture i is SubexpNames()[i]. Since the whole match cannot be named,
+// names[0] is always the empty string. The slice should not be modified.
+func (p *Pattern) SubexpNames() []string {
+	names := make([]string, len(p.prog.Captures))
+	for i, meta := range p.prog.Captures {
+		names[i] = meta.Name
+	}
+	return names
+}
+
+// SubexpIndex returns the index of the capture with the given name, or -1 if
+// there is no capture with that name.
+func (p *Pattern) SubexpIndex(name string) int {
+	if idx, found := p.prog.NamedCaptures[name]; found {
+		return int(idx)
+	}
+	return -1
+}
+
+// MatchResult matches the pattern against b and returns the full Result.
+func (p *Pattern) MatchResult(b []byte) peggyvm.Result {
+	return p.prog.Match(b)
+}
+
+// MatchRuleResult is like MatchResult, but matches b against the named rule
+// instead of the start rule. It returns an error if there is no such rule.
+func (p *Pattern) MatchRuleResult(rule string, b []byte) (peggyvm.Result, error) {
+	return p.prog.MatchEntry(rule, b)
+}
+
+// Match reports whether the pattern matches a prefix of b.
+func (p *Pattern) Match(b []byte) bool {
+	return p.prog.IsMatch(b)
+}
+
+// MatchString reports whether the pattern matches a prefix of s.
+func (p *Pattern) MatchString(s string) bool {
+	return p.Match([]byte(s))
+}
+
+// FindIndex returns a two-element slice of integers defining the location of
+// the leftmost match of the pattern in b, in the style of regexp.FindIndex.
+// Unlike Match, the match may begin anywhere in b. A return value of nil
+// indicates no match.
+func (p *Pattern) FindIndex(b []byte) []int {
+	r, start := p.prog.Search(b)
+	if !r.Success {
+		return nil
+	}
+	return []int{int(start), int(r.End)}
+}
+
+// Find returns the leftmost match of the pattern in b, or nil if there is no
+// match. See FindIndex.
+func (p *Pattern) Find(b []byte) []byte {
+	loc := p.FindIndex(b)
+	if loc == nil {
+		return nil
+	}
+	return b[loc[0]:loc[1]:loc[1]]
+}
+
+// FindString is like Find but for strings. It returns the empty string if
+// there is no match; use FindIndex to tell that apart from an empty match.
+func (p *Pattern) FindString(s string) string {
+	loc := p.FindIndex([]byte(s))
+	if loc == nil {
+		return ""
+	}
+	return s[loc[0]:loc[1]]
+}
+
+// Split slices s into the substrings separated by matches of the pattern,
+// in the style of regexp.Split. See peggyvm.Program.Split.
+func (p *Pattern) Split(s string, n int) []string {
+	pieces := p.prog.Split([]byte(s), n)
+	if pieces == nil {
+		return nil
+	}
+	out := make([]string, len(pieces))
+	for i, piece := range pieces {
+		out[i] = string(piece)
+	}
+	return out
+}
+
+// SubmatchIndex returns a slice holding the index pairs identifying the most
+// recent input matched by each capture, in the style of
+// regexp.FindSubmatchIndex. Pairs for captures that did not participate are
+// -1. A return value of nil indicates no match.
+func (p *Pattern) SubmatchIndex(b []byte) []int {
+	r := p.prog.Match(b)
+	if !r.Success {
+		return nil
+	}
+	out := make([]int, 2*len(r.Captures))
+	for i, c := range r.Captures {
+		if c.Exists {
+			out[2*i] = int(c.Solo.S)
+			out[2*i+1] = int(c.Solo.E)
+		} else {
+			out[2*i] = -1
+			out[2*i+1] = -1
+		}
+	}
+	return out
+}
+
+// Submatch returns a slice holding the most recent input matched by each
+// capture, in the style of regexp.FindSubmatch. Entries for captures that did
+// not participate are nil. A return value of nil indicates no match.
+func (p *Pattern) Submatch(b []byte) [][]byte {
+	idx := p.SubmatchIndex(b)
+	if idx == nil {
+		return nil
+	}
+	out := make([][]byte, len(idx)/2)
+	for i := range out {
+		if idx[2*i] >= 0 {
+			out[i] = b[idx[2*i]:idx[2*i+1]:idx[2*i+1]]
+		}
+	}
+	return out
+}
+
+// SubmatchString is like Submatch but for strings.
+func (p *Pattern) SubmatchString(s string) []string {
+	idx := p.SubmatchIndex([]byte(s))
+	if idx == nil {
+		return nil
+	}
+	out := make([]string, len(idx)/2)
+	for i := range out {
+		if idx[2*i] >= 0 {
+			out[i] = s[idx[2*i]:idx[2*i+1]]
+		}
+	}
+	return out
+}
@@ -0,0 +1,530 @@
+package peggy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/chronos-tachyon/go-peggy/peggyvm"
+)
+
+func TestParse_String(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{
+			Input:    `main <- 'a' / 'b' 'c'`,
+			Expected: "main <- 'a' / 'b' 'c'\n",
+		},
+		testrow{
+			Input:    `main <- ('a' / "b")* !.`,
+			Expected: "main <- ('a' / 'b')* !.\n",
+		},
+		testrow{
+			Input:    "main <- [a-z_0-9]+ # comment\nrest<-&main{x:.}?",
+			Expected: "main <- [0-9_a-z]+\nrest <- &main { x: . }?\n",
+		},
+		testrow{
+			Input:    `main <- [^\x00-\x1f] '\t\'\x7f'`,
+			Expected: "main <- [ -\\xff] '\\t\\'\\x7f'\n",
+		},
+		testrow{
+			Input:    `main <- [\]\-\^] ''`,
+			Expected: "main <- [\\-\\]\\^] ''\n",
+		},
+	}
+
+	for i, row := range data {
+		g, err := Parse(row.Input)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual := g.String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %q\n\tactual: %q", t.Name(), i, row.Expected, actual)
+		}
+	}
+}
+
+func TestCompile_errors(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected error
+	}
+
+	data := []testrow{
+		testrow{"", ErrEmptyGrammar},
+		testrow{"# nothing", ErrEmptyGrammar},
+		testrow{"main 'a'", ErrExpectedArrow},
+		testrow{"main <- 'a' )", ErrExpectedRule},
+		testrow{"main <- ('a'", ErrExpectedCloseParen},
+		testrow{"main <- { 'a'", ErrExpectedCloseBrace},
+		testrow{"main <- 'a", ErrUnterminatedLiteral},
+		testrow{"main <- [a", ErrUnterminatedClass},
+		testrow{"main <- '\\q'", ErrBadEscape},
+		testrow{"main <- [é]", ErrNonASCIIClass},
+		testrow{"main <- !", ErrExpectedExpression},
+		testrow{"main <- other", ErrUndefinedRule},
+		testrow{"main <- 'a'\nmain <- 'b'", ErrDuplicateRule},
+		testrow{"main <- {x: 'a'} {x: 'b'}", ErrDuplicateCapture},
+		testrow{"main <- ('a'?)*", ErrEmptyLoop},
+		testrow{"main <- e+\ne <- 'a' / ''", ErrEmptyLoop},
+		testrow{"a <- a 'x'", ErrLeftRecursion},
+		testrow{"a <- b 'x'\nb <- ''? a", ErrLeftRecursion},
+		testrow{"a <- !a 'x'", ErrLeftRecursion},
+	}
+
+	for i, row := range data {
+		_, err := Compile(row.Input)
+		var actual error
+		switch x := err.(type) {
+		case *SyntaxError:
+			actual = x.Err
+		case *CompileError:
+			actual = x.Err
+		default:
+			actual = err
+		}
+		if !errors.Is(actual, row.Expected) {
+			t.Errorf("%s/%03d: %q: expected %v, got %v", t.Name(), i, row.Input, row.Expected, err)
+		}
+	}
+}
+
+func TestCompile_leftRecursion(t *testing.T) {
+	_, err := Compile("main <- b\na <- b 'x'\nb <- ''? a")
+	x, ok := err.(*CompileError)
+	if !ok || !errors.Is(x.Err, ErrLeftRecursion) {
+		t.Fatalf("expected ErrLeftRecursion, got %v", err)
+	}
+	if x.Rule != "b" {
+		t.Errorf("expected rule %q, got %q", "b", x.Rule)
+	}
+}
+
+func TestPattern_Match(t *testing.T) {
+	type testrow struct {
+		Grammar  string
+		Input    string
+		Expected string
+	}
+
+	const number = `
+		number  <- { int: [0-9]+ } ('.' { frac: [0-9]+ })? !.
+	`
+	const list = `
+		list    <- '(' _ (item (',' _ item)*)? ')' !.
+		item    <- { [a-z]+ } _
+		_       <- [ \t]*
+	`
+	const nested = `
+		expr    <- '(' expr* ')'
+	`
+
+	data := []testrow{
+		testrow{number, "42", "{true [0:{(0,2) [(0,2)]} 1:{(0,2) [(0,2)]} 2:-]}"},
+		testrow{number, "3.14", "{true [0:{(0,4) [(0,4)]} 1:{(0,1) [(0,1)]} 2:{(2,4) [(2,4)]}]}"},
+		testrow{number, "3.", "{false}"},
+		testrow{number, "x", "{false}"},
+		testrow{list, "()", "{true [0:{(0,2) [(0,2)]} 1:-]}"},
+		testrow{list, "(a, bc ,d)", "{true [0:{(0,10) [(0,10)]} 1:{(8,9) [(1,2) (4,6) (8,9)]}]}"},
+		testrow{list, "(a,)", "{false}"},
+		testrow{nested, "(()(()))x", "{true [0:{(0,8) [(0,8)]}]}"},
+		testrow{nested, "(()", "{false}"},
+		testrow{`main <- &'ab' 'a'`, "abc", "{true [0:{(0,1) [(0,1)]}]}"},
+		testrow{`main <- &'ab' 'a'`, "ac", "{false}"},
+		testrow{`main <- !'ab' .`, "ac", "{true [0:{(0,1) [(0,1)]}]}"},
+		testrow{`main <- !'ab' .`, "ab", "{false}"},
+	}
+
+	for i, row := range data {
+		p, err := Compile(row.Grammar)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual := p.MatchResult([]byte(row.Input)).String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+}
+
+func TestPattern_MatchRuleResult(t *testing.T) {
+	p := MustCompile(`
+		list    <- '(' _ (item (',' _ item)*)? ')' !.
+		item    <- { [a-z]+ } _
+		_       <- [ \t]*
+	`)
+
+	type testrow struct {
+		Rule     string
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"item", "ab  ,", "{true [0:{(0,4) [(0,4)]} 1:{(0,2) [(0,2)]}]}"},
+		testrow{"item", "(ab)", "{false}"},
+		testrow{"_", "  x", "{true [0:{(0,2) [(0,2)]} 1:-]}"},
+		testrow{"list", "(a)", "{true [0:{(0,3) [(0,3)]} 1:{(1,2) [(1,2)]}]}"},
+	}
+
+	for i, row := range data {
+		r, err := p.MatchRuleResult(row.Rule, []byte(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual := r.String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %s %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Rule, row.Input, row.Expected, actual)
+		}
+	}
+
+	if _, err := p.MatchRuleResult("nope", nil); err != peggyvm.ErrUnknownEntry {
+		t.Errorf("%s: expected ErrUnknownEntry, got %v", t.Name(), err)
+	}
+}
+
+func TestPattern_Submatch(t *testing.T) {
+	p := MustCompile(`kv <- { key: [a-z]+ } '=' { value: [^;]* } ';'?`)
+	if n := p.NumSubexp(); n != 2 {
+		t.Errorf("%s: NumSubexp: expected 2, got %d", t.Name(), n)
+	}
+	if i := p.SubexpIndex("value"); i != 2 {
+		t.Errorf("%s: SubexpIndex: expected 2, got %d", t.Name(), i)
+	}
+	names := fmt.Sprintf("%q", p.SubexpNames())
+	if names != `["" "key" "value"]` {
+		t.Errorf("%s: SubexpNames: got %s", t.Name(), names)
+	}
+	parts := fmt.Sprintf("%q", p.SubmatchString("name=peggy;rest"))
+	if parts != `["name=peggy;" "name" "peggy"]` {
+		t.Errorf("%s: SubmatchString: got %s", t.Name(), parts)
+	}
+	if p.SubmatchString("=x") != nil {
+		t.Errorf("%s: SubmatchString: expected nil for failed match", t.Name())
+	}
+}
+
+// refMatch matches e at input[pos:] by direct interpretation, as a reference
+// for the compiled code.
+func refMatch(g *Grammar, e Expr, input []byte, pos int) (int, bool) {
+	switch x := e.(type) {
+	case *Literal:
+		if !bytes.HasPrefix(input[pos:], x.Bytes) {
+			return 0, false
+		}
+		return pos + len(x.Bytes), true
+	case *Class:
+		if pos < len(input) && x.Set.Match(input[pos]) {
+			return pos + 1, true
+		}
+		return 0, false
+	case *Any:
+		if pos < len(input) {
+			return pos + 1, true
+		}
+		return 0, false
+	case *Sequence:
+		for _, item := range x.Items {
+			var ok bool
+			if pos, ok = refMatch(g, item, input, pos); !ok {
+				return 0, false
+			}
+		}
+		return pos, true
+	case *Choice:
+		for _, alt := range x.Alts {
+			if end, ok := refMatch(g, alt, input, pos); ok {
+				return end, true
+			}
+		}
+		return 0, false
+	case *Star:
+		for {
+			end, ok := refMatch(g, x.Expr, input, pos)
+			if !ok {
+				return pos, true
+			}
+			pos = end
+		}
+	case *Plus:
+		end, ok := refMatch(g, x.Expr, input, pos)
+		if !ok {
+			return 0, false
+		}
+		return refMatch(g, &Star{Expr: x.Expr}, input, end)
+	case *Optional:
+		if end, ok := refMatch(g, x.Expr, input, pos); ok {
+			return end, true
+		}
+		return pos, true
+	case *And:
+		if _, ok := refMatch(g, x.Expr, input, pos); ok {
+			return pos, true
+		}
+		return 0, false
+	case *Not:
+		if _, ok := refMatch(g, x.Expr, input, pos); ok {
+			return 0, false
+		}
+		return pos, true
+	case *Ref:
+		for _, rule := range g.Rules {
+			if rule.Name == x.Name {
+				return refMatch(g, rule.Expr, input, pos)
+			}
+		}
+	case *Capture:
+		return refMatch(g, x.Expr, input, pos)
+	}
+	panic(fmt.Errorf("unknown expression type %T", e))
+}
+
+func TestCompile_DFA(t *testing.T) {
+	type testrow struct {
+		Grammar string
+		DFAs    int
+	}
+
+	data := []testrow{
+		testrow{`main <- (!'kw' .)* 'kw'`, 1},
+		testrow{`main <- ('ab' / 'a') 'bc'`, 1},
+		testrow{`main <- ('a' / 'ab')* 'b'?`, 1},
+		testrow{`main <- &('a' 'b'*) [ab]+ !'c'`, 1},
+		testrow{`main <- (x / 'c')+ !.` + "\nx <- 'a' 'b'? 'a'", 2},
+		testrow{`main <- 'c' { ('a' / 'b')* } ('ab' / 'b')?`, 2},
+		testrow{`main <- 'a' '' [bc]`, 0},
+		testrow{`main <- '(' main* ')'`, 0},
+	}
+
+	alphabet := []byte("abck")
+	var inputs [][]byte
+	var gen func(prefix []byte, n int)
+	gen = func(prefix []byte, n int) {
+		inputs = append(inputs, append([]byte(nil), prefix...))
+		if n == 0 {
+			return
+		}
+		for _, ch := range alphabet {
+			gen(append(prefix, ch), n-1)
+		}
+	}
+	gen(nil, 6)
+
+	for i, row := range data {
+		g, err := Parse(row.Grammar)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		p, err := CompileGrammar(g)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if n := len(p.Program().DFAs); n != row.DFAs {
+			t.Errorf("%s/%03d: %q: expected %d DFAs, got %d", t.Name(), i, row.Grammar, row.DFAs, n)
+		}
+		for _, input := range inputs {
+			end, ok := refMatch(g, g.Rules[0].Expr, input, 0)
+			actual := p.SubmatchIndex(input)
+			if (actual != nil) != ok || (ok && actual[1] != end) {
+				t.Errorf("%s/%03d: %q: %q: expected (%d, %v), got %v", t.Name(), i, row.Grammar, input, end, ok, actual)
+			}
+		}
+	}
+}
+
+func TestCompile_EOI(t *testing.T) {
+	type testrow struct {
+		Grammar string
+		EOIs    uint64
+	}
+
+	data := []testrow{
+		testrow{`main <- { 'a' } !.`, 1},
+		testrow{`main <- ('a' { [bc] } / 'b' { [a-c] })* !.`, 1},
+		testrow{`main <- !'a' .`, 0},
+	}
+
+	alphabet := []byte("abck")
+	var inputs [][]byte
+	var gen func(prefix []byte, n int)
+	gen = func(prefix []byte, n int) {
+		inputs = append(inputs, append([]byte(nil), prefix...))
+		if n == 0 {
+			return
+		}
+		for _, ch := range alphabet {
+			gen(append(prefix, ch), n-1)
+		}
+	}
+	gen(nil, 4)
+
+	for i, row := range data {
+		g, err := Parse(row.Grammar)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		p, err := CompileGrammar(g)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		stats, err := p.Program().Stats()
+		if err != nil {
+			t.Errorf("%s/%03d: Stats: error: %v", t.Name(), i, err)
+			continue
+		}
+		if n := stats.Histogram[peggyvm.OpEOI]; n != row.EOIs {
+			t.Errorf("%s/%03d: %q: expected %d EOIs, got %d", t.Name(), i, row.Grammar, row.EOIs, n)
+		}
+		for _, input := range inputs {
+			end, ok := refMatch(g, g.Rules[0].Expr, input, 0)
+			actual := p.SubmatchIndex(input)
+			if (actual != nil) != ok || (ok && actual[1] != end) {
+				t.Errorf("%s/%03d: %q: %q: expected (%d, %v), got %v", t.Name(), i, row.Grammar, input, end, ok, actual)
+			}
+		}
+	}
+}
+
+func TestPattern_FindIndex(t *testing.T) {
+	type testrow struct {
+		Grammar  string
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{`main <- 'ab'+`, "xxababyab", "[2 6]"},
+		testrow{`main <- 'ab'+`, "xxa", "[]"},
+		testrow{`main <- [0-9]+ / 'x'`, "abc 42 x", "[4 6]"},
+		testrow{`main <- [\x80-\xff] 'a'`, "a\x80b\xffa", "[3 5]"},
+		testrow{`main <- [0-9]* !.`, "ab", "[2 2]"},
+		testrow{`main <- [kw] ('ey' / 'ord')`, "kweyword", "[1 4]"},
+		testrow{`main <- !.`, "", "[0 0]"},
+	}
+
+	for i, row := range data {
+		p, err := Compile(row.Grammar)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual := fmt.Sprint(p.FindIndex([]byte(row.Input)))
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	p := MustCompile(`main <- [0-9]+`)
+	if actual := p.FindString("ab 123 4"); actual != "123" {
+		t.Errorf("%s: FindString: expected \"123\", got %q", t.Name(), actual)
+	}
+	if actual := p.Find([]byte("none")); actual != nil {
+		t.Errorf("%s: Find: expected nil, got %q", t.Name(), actual)
+	}
+}
+
+func TestCompile_Dispatch(t *testing.T) {
+	type testrow struct {
+		Grammar    string
+		Dispatches uint64
+	}
+
+	data := []testrow{
+		testrow{`main <- { 'ab' } / { 'b' } / { 'ca' } / { 'cb' } / 'a'`, 1},
+		testrow{`main <- ({ 'a' } / { 'b' 'a' } / { 'c' } / { 'ab' } / [a-c] 'k')+`, 2}, // Plus emits its body twice
+		testrow{`main <- { 'a' } / { 'b' } / { 'c' }`, 0},
+		testrow{`main <- 'a' main 'b' / 'c' main 'k' / 'b' 'c' / 'k' / ''`, 1},
+		testrow{`main <- 'ab' / 'ba' / 'ck' / 'kc'`, 0},
+	}
+
+	alphabet := []byte("abck")
+	var inputs [][]byte
+	var gen func(prefix []byte, n int)
+	gen = func(prefix []byte, n int) {
+		inputs = append(inputs, append([]byte(nil), prefix...))
+		if n == 0 {
+			return
+		}
+		for _, ch := range alphabet {
+			gen(append(prefix, ch), n-1)
+		}
+	}
+	gen(nil, 5)
+
+	for i, row := range data {
+		g, err := Parse(row.Grammar)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		p, err := CompileGrammar(g)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		stats, err := p.Program().Stats()
+		if err != nil {
+			t.Errorf("%s/%03d: Stats: error: %v", t.Name(), i, err)
+			continue
+		}
+		if n := stats.Histogram[peggyvm.OpDISPATCH]; n != row.Dispatches {
+			t.Errorf("%s/%03d: %q: expected %d DISPATCHes, got %d", t.Name(), i, row.Grammar, row.Dispatches, n)
+		}
+		for _, input := range inputs {
+			end, ok := refMatch(g, g.Rules[0].Expr, input, 0)
+			actual := p.SubmatchIndex(input)
+			if (actual != nil) != ok || (ok && actual[1] != end) {
+				t.Errorf("%s/%03d: %q: %q: expected (%d, %v), got %v", t.Name(), i, row.Grammar, input, end, ok, actual)
+			}
+		}
+	}
+}
+
+func TestPattern_Split(t *testing.T) {
+	type testrow struct {
+		Grammar string
+		Regexp  string
+		Input   string
+		N       int
+	}
+
+	data := []testrow{
+		testrow{`main <- ','`, `,`, "a,b,c", -1},
+		testrow{`main <- ','`, `,`, "a,b,c", 2},
+		testrow{`main <- ','`, `,`, "a,b,c", 0},
+		testrow{`main <- ','`, `,`, ",a,,b,", -1},
+		testrow{`main <- ','`, `,`, "", -1},
+		testrow{`main <- ''`, ``, "", -1},
+		testrow{`main <- ''`, ``, "abc", -1},
+		testrow{`main <- ' '*`, ` *`, "a b  c", -1},
+		testrow{`main <- 'x'*`, `x*`, "axxb", -1},
+		testrow{`main <- [0-9]+`, `[0-9]+`, "12ab3", -1},
+	}
+
+	for i, row := range data {
+		p, err := Compile(row.Grammar)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		expected := fmt.Sprintf("%q", regexp.MustCompile(row.Regexp).Split(row.Input, row.N))
+		actual := fmt.Sprintf("%q", p.Split(row.Input, row.N))
+		if actual != expected {
+			t.Errorf("%s/%03d: %q, %d: expected %s, got %s", t.Name(), i, row.Input, row.N, expected, actual)
+		}
+	}
+}
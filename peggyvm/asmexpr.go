@@ -0,0 +1,268 @@
+package peggyvm
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// evalExpr evaluates a constant expression in assembly text.
+//
+// Operands are integers (in any syntax accepted by strconv.ParseInt with base
+// 0), quoted characters ('a', '\n'), and the names of constants. Operators
+// are those of Go, with Go's precedence:
+//
+//   unary:   + - ! ^
+//   5:       * / % << >> & &^
+//   4:       + - | ^
+//   3:       == != < <= > >=
+//   2:       &&
+//   1:       ||
+//
+// Comparisons and logical operators yield 1 for true and 0 for false.
+// Arithmetic is on int64; a result that does not fit, such as that of
+// 1<<63 or -(-9223372036854775807-1), is an error rather than wrapping.
+//
+func (a *Assembler) evalExpr(text string) (int64, error) {
+	e := &exprParser{a: a, text: text}
+	v, err := e.binary(1)
+	if err != nil {
+		return 0, err
+	}
+	e.skipSpace()
+	if e.pos != len(e.text) {
+		return 0, ErrBadExpression
+	}
+	return v, nil
+}
+
+type exprParser struct {
+	a    *Assembler
+	text string
+	pos  int
+}
+
+var exprOperators = []struct {
+	Op   string
+	Prec int
+}{
+	// Longer operators first, so that "<<" is not taken for "<".
+	{"&&", 2}, {"||", 1}, {"==", 3}, {"!=", 3}, {"<=", 3}, {">=", 3},
+	{"<<", 5}, {">>", 5}, {"&^", 5},
+	{"<", 3}, {">", 3}, {"*", 5}, {"/", 5}, {"%", 5}, {"&", 5},
+	{"+", 4}, {"-", 4}, {"|", 4}, {"^", 4},
+}
+
+func (e *exprParser) skipSpace() {
+	for e.pos < len(e.text) && (e.text[e.pos] == ' ' || e.text[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+func (e *exprParser) peekOperator() (string, int) {
+	e.skipSpace()
+	for _, row := range exprOperators {
+		if strings.HasPrefix(e.text[e.pos:], row.Op) {
+			return row.Op, row.Prec
+		}
+	}
+	return "", 0
+}
+
+func (e *exprParser) binary(minPrec int) (int64, error) {
+	x, err := e.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, prec := e.peekOperator()
+		if prec < minPrec || prec == 0 {
+			return x, nil
+		}
+		e.pos += len(op)
+		y, err := e.binary(prec + 1)
+		if err != nil {
+			return 0, err
+		}
+		x, err = applyOperator(op, x, y)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (e *exprParser) unary() (int64, error) {
+	e.skipSpace()
+	if e.pos >= len(e.text) {
+		return 0, ErrBadExpression
+	}
+	switch ch := e.text[e.pos]; ch {
+	case '+', '-', '!', '^':
+		e.pos++
+		x, err := e.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch ch {
+		case '-':
+			if x == math.MinInt64 {
+				return 0, ErrExprOverflow
+			}
+			x = -x
+		case '!':
+			x = boolValue(x == 0)
+		case '^':
+			x = ^x
+		}
+		return x, nil
+
+	case '(':
+		e.pos++
+		x, err := e.binary(1)
+		if err != nil {
+			return 0, err
+		}
+		e.skipSpace()
+		if e.pos >= len(e.text) || e.text[e.pos] != ')' {
+			return 0, ErrBadExpression
+		}
+		e.pos++
+		return x, nil
+
+	case '\'':
+		end := e.pos + 1
+		for end < len(e.text) && e.text[end] != '\'' {
+			if e.text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(e.text) {
+			return 0, ErrBadExpression
+		}
+		r, err := parseCharOperand(e.text[e.pos:end+1], false)
+		if err != nil {
+			return 0, ErrBadExpression
+		}
+		e.pos = end + 1
+		return int64(r), nil
+	}
+
+	start := e.pos
+	for e.pos < len(e.text) && isWordByte(e.text[e.pos]) {
+		e.pos++
+	}
+	word := e.text[start:e.pos]
+	switch {
+	case word == "":
+		return 0, ErrBadExpression
+
+	case word[0] >= '0' && word[0] <= '9':
+		v, err := strconv.ParseInt(word, 0, 64)
+		if err != nil {
+			u, err2 := strconv.ParseUint(word, 0, 64)
+			if err2 != nil {
+				return 0, ErrBadExpression
+			}
+			v = int64(u)
+		}
+		return v, nil
+
+	default:
+		v, found := e.a.Constants[word]
+		if !found {
+			return 0, ErrUndefinedConstant
+		}
+		return v, nil
+	}
+}
+
+func applyOperator(op string, x, y int64) (int64, error) {
+	switch op {
+	case "*":
+		r := x * y
+		if x != 0 && (r/x != y || (x == -1 && y == math.MinInt64)) {
+			return 0, ErrExprOverflow
+		}
+		return r, nil
+	case "/", "%":
+		if y == 0 {
+			return 0, ErrBadExpression
+		}
+		if x == math.MinInt64 && y == -1 {
+			return 0, ErrExprOverflow
+		}
+		if op == "/" {
+			return x / y, nil
+		}
+		return x % y, nil
+	case "<<", ">>":
+		if y < 0 {
+			return 0, ErrBadExpression
+		}
+		if op == "<<" {
+			r := x << uint64(y)
+			if y >= 64 || r>>uint64(y) != x {
+				return 0, ErrExprOverflow
+			}
+			return r, nil
+		}
+		return x >> uint64(y), nil
+	case "&":
+		return x & y, nil
+	case "&^":
+		return x &^ y, nil
+	case "+":
+		r := x + y
+		if (x^r)&(y^r) < 0 {
+			return 0, ErrExprOverflow
+		}
+		return r, nil
+	case "-":
+		r := x - y
+		if (x^y)&(x^r) < 0 {
+			return 0, ErrExprOverflow
+		}
+		return r, nil
+	case "|":
+		return x | y, nil
+	case "^":
+		return x ^ y, nil
+	case "==":
+		return boolValue(x == y), nil
+	case "!=":
+		return boolValue(x != y), nil
+	case "<":
+		return boolValue(x < y), nil
+	case "<=":
+		return boolValue(x <= y), nil
+	case ">":
+		return boolValue(x > y), nil
+	case ">=":
+		return boolValue(x >= y), nil
+	case "&&":
+		return boolValue(x != 0 && y != 0), nil
+	case "||":
+		return boolValue(x != 0 || y != 0), nil
+	}
+	panic("unknown operator " + op)
+}
+
+func boolValue(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isWordByte(ch byte) bool {
+	switch {
+	case ch == '_':
+	case ch >= 'A' && ch <= 'Z':
+	case ch >= 'a' && ch <= 'z':
+	case ch >= '0' && ch <= '9':
+	default:
+		return false
+	}
+	return true
+}
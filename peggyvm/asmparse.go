@@ -0,0 +1,631 @@
+package peggyvm
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
+)
+
+// ParseAssembly assembles a Program from assembly text. It is the inverse of
+// Program.Disassemble; see there for the round-trip guarantees.
+func ParseAssembly(r io.Reader) (*Program, error) {
+	a := NewAssembler()
+	if err := a.Parse(r); err != nil {
+		return nil, err
+	}
+	return a.Finish()
+}
+
+// Parse reads assembly text in the dialect produced by Program.Disassemble,
+// emitting its directives, labels, and instructions into the Assembler. Call
+// Finish afterward to obtain the Program.
+//
+// The dialect is line-oriented:
+//
+//   ; comment               ignored, as is everything after an unquoted ';'
+//   %literal "ana"          declare a literal (Go string syntax)
+//   %literal 0x61, 0x6e     declare a literal (list of bytes)
+//   %matcher [a-z]          declare a matcher (byteset.Parse syntax)
+//   %runeset [a-z\u00e9]   declare a rune set (runeset.Parse syntax)
+//   %dfa 0x00, 0x01, ...    declare a DFA (list of bytes, see DFA.MarshalBinary)
+//   %jumptable 0x61 L1, ... declare a jump table (keys in ascending order)
+//   %namedliteral kw "if"   declare a literal named kw
+//   %namedmatcher lc [a-z]  declare a matcher named lc
+//   %captures 2             declare the number of captures
+//   %namedcapture 1 "k"     name a capture
+//   %repeatcapture 1        mark a capture as possibly repeating
+//   %capturekind 1 int      hint at the type of a capture (see CaptureKind)
+//   %entry main             declare a public label as an entry point
+//   %bytes 0x90, 0x40      emit raw bytes (list of bytes)
+//   %align 4, 0x00          pad with 0x00 to a multiple of 4 (fill optional)
+//   %if DEBUG               assemble what follows iff DEBUG is nonzero
+//   %else                   ...otherwise, assemble what follows
+//   %endif                  end of conditional assembly
+//   COUNT = 4               define a constant
+//   name:                   define a label
+//   CHOICE .L1 <.+7>        instruction; the <...> annotation is ignored
+//
+// A label definition may share its line with an instruction. Byte and rune
+// operands may be written as quoted characters ('a', '\n') or in hex ($61).
+// Literal and matcher operands may be written as indices or as names.
+//
+// Numeric operands, including those of directives, may be constant
+// expressions such as COUNT*2; see evalExpr for the syntax. Constants must be
+// defined before use, and may not be redefined. Callers may predefine
+// constants, such as DEBUG, by setting them in a.Constants before calling
+// Parse.
+//
+func (a *Assembler) Parse(r io.Reader) error {
+	st := &parseState{referenced: make(map[string]uint)}
+	sc := bufio.NewScanner(r)
+	var lineno uint
+	for sc.Scan() {
+		lineno++
+		text := sc.Text()
+		if err := a.parseLine(text, lineno, st); err != nil {
+			return &AssemblyError{Err: err, Line: lineno, Text: text}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(st.conds) != 0 {
+		return &AssemblyError{Err: ErrUnbalancedIf, Line: st.conds[len(st.conds)-1].line, Text: "%if"}
+	}
+	for name, line := range st.referenced {
+		if !a.LabelsByName[name].Seen {
+			return &AssemblyError{Err: ErrUndefinedLabel, Line: line, Text: name}
+		}
+	}
+	return nil
+}
+
+// parseState holds the state of a single call to Parse.
+type parseState struct {
+	// referenced maps each label referenced so far to the line number of
+	// its first reference.
+	referenced map[string]uint
+
+	// conds holds the enclosing %if blocks, innermost last.
+	conds []condFrame
+}
+
+type condFrame struct {
+	line   uint
+	active bool
+	done   bool
+	inElse bool
+}
+
+// active returns true iff lines are currently being assembled.
+func (st *parseState) active() bool {
+	return len(st.conds) == 0 || st.conds[len(st.conds)-1].active
+}
+
+func (a *Assembler) parseLine(text string, lineno uint, st *parseState) error {
+	line := strings.TrimSpace(stripComment(text))
+	if line == "" {
+		return nil
+	}
+
+	word, rest := splitWord(line)
+	switch word {
+	case "%if", "%else", "%endif":
+		return a.parseConditional(word, rest, lineno, st)
+	}
+	if !st.active() {
+		return nil
+	}
+
+	if line[0] == '%' {
+		return a.parseDirective(line)
+	}
+
+	if isSymbol(word) && strings.HasPrefix(rest, "=") {
+		if _, found := a.Constants[word]; found {
+			return ErrDuplicateConstant
+		}
+		v, err := a.evalExpr(rest[1:])
+		if err != nil {
+			return err
+		}
+		a.Constants[word] = v
+		return nil
+	}
+
+	if strings.HasSuffix(word, ":") {
+		name := word[:len(word)-1]
+		if name == "" {
+			return ErrBadOperand
+		}
+		if item := a.LabelsByName[name]; item != nil && item.Seen {
+			return ErrDuplicateLabel
+		}
+		a.EmitLabel(name)
+		if rest == "" {
+			return nil
+		}
+		word, rest = splitWord(rest)
+	}
+
+	code, found := LookupOpCode(word)
+	if !found {
+		return ErrUnknownMnemonic
+	}
+	meta := code.Meta()
+
+	var operands []string
+	if rest != "" {
+		operands = splitOperands(rest)
+	}
+
+	slots := [3]*ImmMeta{&meta.Imm0, &meta.Imm1, &meta.Imm2}
+	var values [3]interface{}
+	var minCount, maxCount int
+	for _, m := range slots {
+		if m.Type == ImmNone {
+			continue
+		}
+		if m.Required {
+			minCount++
+		}
+		maxCount++
+	}
+	if len(operands) < minCount || len(operands) > maxCount {
+		return ErrOperandCount
+	}
+
+	j := 0
+	for i, m := range slots {
+		if m.Type == ImmNone || j >= len(operands) {
+			continue
+		}
+		operand := stripAnnotation(operands[j])
+		j++
+		if m.Type == ImmCodeOffset {
+			name := operand
+			if name == "" || strings.ContainsAny(name, " \t") {
+				return ErrBadOperand
+			}
+			if _, found := st.referenced[name]; !found {
+				st.referenced[name] = lineno
+			}
+			values[i] = a.GrabLabel(name)
+			continue
+		}
+		v, err := a.parseImmediate(m.Type, operand)
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+
+	a.EmitOp(meta, values[0], values[1], values[2])
+	return nil
+}
+
+// parseConditional handles %if, %else, and %endif. An %if nested within a
+// block that is being skipped is tracked, but its expression is ignored.
+func (a *Assembler) parseConditional(word, rest string, lineno uint, st *parseState) error {
+	switch word {
+	case "%if":
+		frame := condFrame{line: lineno}
+		if st.active() {
+			v, err := a.evalExpr(rest)
+			if err != nil {
+				return err
+			}
+			frame.active = (v != 0)
+			frame.done = frame.active
+		} else {
+			frame.done = true
+		}
+		st.conds = append(st.conds, frame)
+		return nil
+
+	case "%else":
+		if len(st.conds) == 0 || rest != "" {
+			return ErrUnbalancedIf
+		}
+		frame := &st.conds[len(st.conds)-1]
+		if frame.inElse {
+			return ErrUnbalancedIf
+		}
+		frame.inElse = true
+		frame.active = !frame.done
+		frame.done = true
+		return nil
+
+	default:
+		if len(st.conds) == 0 || rest != "" {
+			return ErrUnbalancedIf
+		}
+		st.conds = st.conds[:len(st.conds)-1]
+		return nil
+	}
+}
+
+func (a *Assembler) parseDirective(line string) error {
+	word, rest := splitWord(line)
+	switch word {
+	case "%literal":
+		lit, err := parseLiteral(rest)
+		if err != nil {
+			return err
+		}
+		a.DeclareLiteral(lit)
+		return nil
+
+	case "%namedliteral":
+		name, rest := splitWord(rest)
+		if _, found := a.LiteralsByName[name]; found || !isSymbol(name) {
+			return ErrBadOperand
+		}
+		lit, err := parseLiteral(rest)
+		if err != nil {
+			return err
+		}
+		a.DeclareNamedLiteral(name, lit)
+		return nil
+
+	case "%matcher":
+		m, err := byteset.Parse(rest)
+		if err != nil {
+			return err
+		}
+		a.DeclareByteSet(m)
+		return nil
+
+	case "%namedmatcher":
+		name, rest := splitWord(rest)
+		if _, found := a.ByteSetsByName[name]; found || !isSymbol(name) {
+			return ErrBadOperand
+		}
+		m, err := byteset.Parse(rest)
+		if err != nil {
+			return err
+		}
+		a.DeclareNamedByteSet(name, m)
+		return nil
+
+	case "%runeset":
+		m, err := runeset.Parse(rest)
+		if err != nil {
+			return err
+		}
+		a.DeclareRuneSet(m)
+		return nil
+
+	case "%dfa":
+		raw, err := parseLiteral(rest)
+		if err != nil || strings.HasPrefix(rest, "\"") {
+			return ErrBadOperand
+		}
+		dfa := new(DFA)
+		if err := dfa.UnmarshalBinary(raw); err != nil {
+			return err
+		}
+		a.DeclareDFA(dfa)
+		return nil
+
+	case "%jumptable":
+		var keys []byte
+		var labels []string
+		if rest != "" {
+			for _, operand := range splitOperands(rest) {
+				keyText, name := splitWord(operand)
+				key, err := a.evalUint(keyText)
+				if err != nil {
+					return err
+				}
+				if key > 0xff || (len(keys) != 0 && byte(key) <= keys[len(keys)-1]) {
+					return ErrBadOperand
+				}
+				if name == "" || strings.ContainsAny(name, " \t") {
+					return ErrBadOperand
+				}
+				keys = append(keys, byte(key))
+				labels = append(labels, name)
+			}
+		}
+		a.DeclareJumpTable(keys, labels)
+		return nil
+
+	case "%bytes":
+		raw, err := parseLiteral(rest)
+		if err != nil || strings.HasPrefix(rest, "\"") {
+			return ErrBadOperand
+		}
+		a.EmitRaw(raw)
+		return nil
+
+	case "%align":
+		operands := splitOperands(rest)
+		if len(operands) > 2 {
+			return ErrOperandCount
+		}
+		n, err := a.evalUint(operands[0])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrBadOperand
+		}
+		var fill uint64
+		if len(operands) == 2 {
+			fill, err = a.evalUint(operands[1])
+			if err != nil {
+				return err
+			}
+			if fill > 0xff {
+				return ErrBadOperand
+			}
+		}
+		a.EmitAlign(n, byte(fill))
+		return nil
+
+	case "%captures":
+		u, err := a.evalUint(rest)
+		if err != nil {
+			return err
+		}
+		if u > MaxCaptures {
+			return ErrCountRange
+		}
+		a.DeclareNumCaptures(u)
+		return nil
+
+	case "%namedcapture":
+		idxText, nameText := splitWord(rest)
+		idx, err := a.evalUint(idxText)
+		if err != nil {
+			return err
+		}
+		if idx >= MaxCaptures || idx >= uint64(len(a.Captures)) {
+			return ErrBadOperand
+		}
+		name, err := strconv.Unquote(nameText)
+		if err != nil {
+			return ErrBadOperand
+		}
+		a.DeclareNamedCapture(idx, name)
+		return nil
+
+	case "%entry":
+		if rest == "" || strings.ContainsAny(rest, " \t") {
+			return ErrBadOperand
+		}
+		a.DeclareEntry(rest)
+		return nil
+
+	case "%repeatcapture":
+		idx, err := a.evalUint(rest)
+		if err != nil {
+			return err
+		}
+		if idx >= MaxCaptures || idx >= uint64(len(a.Captures)) {
+			return ErrBadOperand
+		}
+		a.Captures[idx].Repeat = true
+		return nil
+
+	case "%capturekind":
+		idxText, kindText := splitWord(rest)
+		idx, err := a.evalUint(idxText)
+		if err != nil {
+			return err
+		}
+		if idx >= MaxCaptures || idx >= uint64(len(a.Captures)) {
+			return ErrBadOperand
+		}
+		kind, err := ParseCaptureKind(kindText)
+		if err != nil {
+			return err
+		}
+		a.DeclareCaptureKind(idx, kind)
+		return nil
+	}
+	return ErrUnknownDirective
+}
+
+// parseLiteral parses the operand of a %literal directive.
+func parseLiteral(text string) ([]byte, error) {
+	if strings.HasPrefix(text, "\"") {
+		str, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, ErrBadOperand
+		}
+		return []byte(str), nil
+	}
+	var lit []byte
+	if text != "" {
+		for _, operand := range splitOperands(text) {
+			u, err := strconv.ParseUint(operand, 0, 8)
+			if err != nil {
+				return nil, ErrBadOperand
+			}
+			lit = append(lit, byte(u))
+		}
+	}
+	return lit, nil
+}
+
+func (a *Assembler) parseImmediate(t ImmType, operand string) (interface{}, error) {
+	switch t {
+	case ImmLiteralIdx, ImmMatcherIdx:
+		if _, found := a.Constants[operand]; isSymbol(operand) && !found {
+			return operand, nil
+		}
+		return a.evalUint(operand)
+
+	case ImmByte:
+		r, err := a.parseChar(operand, true)
+		if err != nil {
+			return nil, err
+		}
+		if r > 0xff {
+			return nil, ErrBadOperand
+		}
+		return uint8(r), nil
+
+	case ImmRune:
+		r, err := a.parseChar(operand, false)
+		if err != nil {
+			return nil, err
+		}
+		if r > utf8.MaxRune || !utf8.ValidRune(rune(r)) {
+			return nil, ErrBadOperand
+		}
+		return uint32(r), nil
+
+	case ImmSint:
+		return a.evalExpr(operand)
+
+	default:
+		return a.evalUint(operand)
+	}
+}
+
+// parseChar parses a byte or rune operand: either a quoted character or a
+// $-prefixed hex value, as written by Disassemble, or a constant expression.
+func (a *Assembler) parseChar(operand string, isByte bool) (uint64, error) {
+	if strings.HasPrefix(operand, "$") || (len(operand) >= 3 && operand[0] == '\'' && operand[len(operand)-1] == '\'') {
+		r, err := parseCharOperand(operand, isByte)
+		if err != nil {
+			return 0, ErrBadOperand
+		}
+		return r, nil
+	}
+	return a.evalUint(operand)
+}
+
+// evalUint is like evalExpr, but rejects negative results.
+func (a *Assembler) evalUint(text string) (uint64, error) {
+	v, err := a.evalExpr(text)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, ErrBadOperand
+	}
+	return uint64(v), nil
+}
+
+// parseCharOperand parses the output of writeByteLiteral (isByte) or
+// writeRuneLiteral (!isByte). Plain integers are also accepted.
+func parseCharOperand(operand string, isByte bool) (uint64, error) {
+	if len(operand) >= 2 && operand[0] == '$' {
+		return strconv.ParseUint(operand[1:], 16, 32)
+	}
+	if len(operand) >= 3 && operand[0] == '\'' && operand[len(operand)-1] == '\'' {
+		body := operand[1 : len(operand)-1]
+		if len(body) == 2 && body[0] == '\\' {
+			if body[1] == '\\' || body[1] == '\'' {
+				return uint64(body[1]), nil
+			}
+			for r, ch := range wellKnownControls {
+				if ch == body[1] {
+					return uint64(r), nil
+				}
+			}
+			return 0, ErrBadOperand
+		}
+		r, size := utf8.DecodeRuneInString(body)
+		if size != len(body) || r == utf8.RuneError {
+			return 0, ErrBadOperand
+		}
+		if isByte && r >= 0x80 {
+			return 0, ErrBadOperand
+		}
+		return uint64(r), nil
+	}
+	return strconv.ParseUint(operand, 0, 32)
+}
+
+// isSymbol returns true iff s is usable as a literal or byte set name: a
+// letter or '_', followed by letters, digits, and '_'.
+func isSymbol(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, ch := range s {
+		switch {
+		case ch == '_':
+		case ch >= 'A' && ch <= 'Z':
+		case ch >= 'a' && ch <= 'z':
+		case ch >= '0' && ch <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// stripComment removes a trailing ';' comment, respecting quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+		switch {
+		case quote != 0 && ch == '\\':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+			// pass
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ';':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// stripAnnotation removes a trailing "<...>" annotation, such as the "<.+7>"
+// that Disassemble writes after each code offset.
+func stripAnnotation(operand string) string {
+	if strings.HasSuffix(operand, ">") {
+		if k := strings.LastIndexByte(operand, '<'); k > 0 {
+			return strings.TrimSpace(operand[:k])
+		}
+	}
+	return operand
+}
+
+// splitOperands splits on ',', respecting quotes, and trims each operand.
+func splitOperands(text string) []string {
+	var out []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(text); i++ {
+		ch := text[i]
+		switch {
+		case quote != 0 && ch == '\\':
+			i++
+		case quote != 0 && ch == quote:
+			quote = 0
+		case quote != 0:
+			// pass
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ',':
+			out = append(out, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	return append(out, strings.TrimSpace(text[start:]))
+}
+
+func splitWord(text string) (string, string) {
+	i := strings.IndexAny(text, " \t")
+	if i < 0 {
+		return text, ""
+	}
+	return text[:i], strings.TrimSpace(text[i+1:])
+}
@@ -3,8 +3,11 @@ package peggyvm
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"unicode/utf8"
 
 	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
 )
 
 // Assembler turns sequences of instructions into Program objects.
@@ -14,16 +17,59 @@ type Assembler struct {
 	LabelsByName map[string]*AsmItem
 
 	// Literals holds the future Program.Literals list.
-	Literals [][]byte
+	Literals       [][]byte
+	LiteralsByName map[string]uint64
+	literalIndex   map[string]uint64
 
 	// ByteSets holds the future Program.ByteSets list.
-	ByteSets []byteset.Matcher
+	ByteSets       []byteset.Matcher
+	ByteSetsByName map[string]uint64
+	byteSetIndex   map[[32]byte]uint64
+
+	// DFAs holds the future Program.DFAs list.
+	DFAs     []*DFA
+	dfaIndex map[string]uint64
+
+	// RuneSets holds the future Program.RuneSets list.
+	RuneSets     []runeset.Matcher
+	runeSetIndex map[string]uint64
+
+	// JumpTables holds the future Program.JumpTables list.
+	JumpTables []AsmJumpTable
+
+	// Predicates holds the future predicates of the Program; see
+	// Program.AddPredicate.
+	Predicates []Predicate
+
+	// Folders holds the future folders of the Program; see
+	// Program.AddFolder.
+	Folders []Folder
 
 	// Captures holds the future Program.Captures list.
 	Captures      []CaptureMeta
 	NamedCaptures map[string]uint64
 
-	Queue []*AsmItem
+	// Entries holds the names of the future Program.Entries list.
+	Entries []string
+
+	// Constants holds the named constants available to Parse.
+	Constants map[string]int64
+
+	// Verify is true iff Finish should check the Program with
+	// Program.VerifyStack before returning it.
+	Verify bool
+
+	// Fragments holds separately-assembled Programs that may satisfy calls
+	// made with EmitCallRule. See AddFragment.
+	Fragments []*Program
+
+	pos       SourcePos
+	nextLabel uint
+
+	// memoRules is one more than the largest MEMOGET/MEMOSET rule ID
+	// emitted so far, so that importProgram can give each imported
+	// program rule IDs of its own.
+	memoRules uint64
 }
 
 type AsmItem struct {
@@ -34,15 +80,17 @@ type AsmItem struct {
 	IsOp bool
 
 	// XP is the absolute code address of (a) this label, or (b) the start
-	// of this instruction. Only available if all prior instructions and
-	// labels have been fixed.
+	// of this instruction. Only available once Fix has run.
 	KnownXP bool
 	XP      uint64
 
-	// Name and Public contain information about the label.
-	Name   string
-	Public bool
-	Seen   bool
+	// Name and Public contain information about the label. Seen is true
+	// iff the label has been emitted, and Referenced is true iff Fix has
+	// resolved a code offset that points at it.
+	Name       string
+	Public     bool
+	Seen       bool
+	Referenced bool
 
 	// Meta, Imm0, Imm1, and Imm2 contain information about the op.
 	Meta *OpMeta
@@ -56,41 +104,253 @@ type AsmItem struct {
 	// Bytes holds the actual bytes iff this op has been fixed, nil otherwise.
 	Bytes []byte
 
-	// MaxLength hold this op's max encoded length.
+	// MaxLength holds this op's encoded length: an upper bound until Fix
+	// runs, then Fix's current estimate, then the final length.
 	MaxLength uint
 
 	// Fixup points to one of this op's Imm[012] slots, indicating which
 	// one should be modified when fixing this op.
 	Fixup *uint64
 
-	Blocking     []*AsmItem
+	// FixBlockedBy is the label whose position determines Fixup.
 	FixBlockedBy *AsmItem
+
+	// Align and Fill describe padding emitted by EmitAlign. Bytes is
+	// recomputed from them whenever the item's XP changes.
+	Align uint64
+	Fill  byte
+
+	// Pos is the source position that was current when this op was
+	// emitted; see SetSourcePos.
+	Pos SourcePos
+
+	// symbols lists the immediates that name a literal or byte set,
+	// pending resolution by Finish.
+	symbols []symbolRef
+}
+
+// AsmJumpTable is a jump table whose targets are labels, which Finish resolves
+// to code addresses.
+type AsmJumpTable struct {
+	Keys   []byte
+	Labels []*AsmItem
+}
+
+type symbolRef struct {
+	Type ImmType
+	Name string
+	Ptr  *uint64
 }
 
 func NewAssembler() *Assembler {
 	return &Assembler{
-		LabelsByName:  make(map[string]*AsmItem),
-		NamedCaptures: make(map[string]uint64),
+		LabelsByName:   make(map[string]*AsmItem),
+		NamedCaptures:  make(map[string]uint64),
+		LiteralsByName: make(map[string]uint64),
+		ByteSetsByName: make(map[string]uint64),
+		literalIndex:   make(map[string]uint64),
+		byteSetIndex:   make(map[[32]byte]uint64),
+		dfaIndex:       make(map[string]uint64),
+		runeSetIndex:   make(map[string]uint64),
+		Constants:      make(map[string]int64),
 	}
 }
 
 func (a *Assembler) DeclareLiteral(lit []byte) {
+	key := string(lit)
+	if _, found := a.literalIndex[key]; !found {
+		a.literalIndex[key] = uint64(len(a.Literals))
+	}
 	a.Literals = append(a.Literals, lit)
 }
 
 func (a *Assembler) DeclareByteSet(set byteset.Matcher) {
+	key := byteSetKey(set)
+	if _, found := a.byteSetIndex[key]; !found {
+		a.byteSetIndex[key] = uint64(len(a.ByteSets))
+	}
 	a.ByteSets = append(a.ByteSets, set)
 }
 
+func (a *Assembler) DeclareDFA(dfa *DFA) {
+	key := dfaKey(dfa)
+	if _, found := a.dfaIndex[key]; !found {
+		a.dfaIndex[key] = uint64(len(a.DFAs))
+	}
+	a.DFAs = append(a.DFAs, dfa)
+}
+
+func (a *Assembler) DeclareRuneSet(set runeset.Matcher) {
+	key := runeSetKey(set)
+	if _, found := a.runeSetIndex[key]; !found {
+		a.runeSetIndex[key] = uint64(len(a.RuneSets))
+	}
+	a.RuneSets = append(a.RuneSets, set)
+}
+
+// DeclarePredicate appends fn to the predicates, and returns its index.
+// Since functions cannot be compared, each call adds a new entry.
+func (a *Assembler) DeclarePredicate(fn Predicate) uint64 {
+	a.Predicates = append(a.Predicates, fn)
+	return uint64(len(a.Predicates) - 1)
+}
+
+// DeclareFolder appends fn to the folders, and returns its index. Like
+// DeclarePredicate, each call adds a new entry.
+func (a *Assembler) DeclareFolder(fn Folder) uint64 {
+	a.Folders = append(a.Folders, fn)
+	return uint64(len(a.Folders) - 1)
+}
+
+// DeclareJumpTable declares a jump table that maps each of keys to the label
+// with the same index in labels, and returns its index. The keys must be in
+// strictly ascending order.
+func (a *Assembler) DeclareJumpTable(keys []byte, labels []string) uint64 {
+	assert(len(keys) == len(labels), "%d keys but %d labels", len(keys), len(labels))
+	table := AsmJumpTable{Keys: append([]byte(nil), keys...)}
+	for i, name := range labels {
+		assert(i == 0 || keys[i-1] < keys[i], "jump table keys out of order")
+		table.Labels = append(table.Labels, a.GrabLabel(name))
+	}
+	a.JumpTables = append(a.JumpTables, table)
+	return uint64(len(a.JumpTables) - 1)
+}
+
+// DeclareNamedLiteral declares lit under the given name. Instructions may then
+// refer to it by passing the name as a string immediate to EmitOp.
+func (a *Assembler) DeclareNamedLiteral(name string, lit []byte) {
+	_, dupe := a.LiteralsByName[name]
+	assert(!dupe, "duplicate literal name %q", name)
+	a.LiteralsByName[name] = uint64(len(a.Literals))
+	a.DeclareLiteral(lit)
+}
+
+// DeclareNamedByteSet declares set under the given name. Instructions may
+// then refer to it by passing the name as a string immediate to EmitOp.
+func (a *Assembler) DeclareNamedByteSet(name string, set byteset.Matcher) {
+	_, dupe := a.ByteSetsByName[name]
+	assert(!dupe, "duplicate byte set name %q", name)
+	a.ByteSetsByName[name] = uint64(len(a.ByteSets))
+	a.DeclareByteSet(set)
+}
+
+// InternLiteral returns the index of a literal equal to lit, declaring lit
+// only if no such literal has been declared yet.
+func (a *Assembler) InternLiteral(lit []byte) uint64 {
+	if idx, found := a.literalIndex[string(lit)]; found {
+		return idx
+	}
+	a.DeclareLiteral(lit)
+	return uint64(len(a.Literals) - 1)
+}
+
+// InternByteSet returns the index of a matcher that matches the same bytes as
+// set, declaring set only if no such matcher has been declared yet.
+func (a *Assembler) InternByteSet(set byteset.Matcher) uint64 {
+	if idx, found := a.byteSetIndex[byteSetKey(set)]; found {
+		return idx
+	}
+	a.DeclareByteSet(set)
+	return uint64(len(a.ByteSets) - 1)
+}
+
+// InternRuneSet returns the index of a matcher that matches the same runes
+// as set, declaring set only if no such matcher has been declared yet.
+func (a *Assembler) InternRuneSet(set runeset.Matcher) uint64 {
+	if idx, found := a.runeSetIndex[runeSetKey(set)]; found {
+		return idx
+	}
+	a.DeclareRuneSet(set)
+	return uint64(len(a.RuneSets) - 1)
+}
+
+// InternDFA returns the index of a DFA equal to dfa, declaring dfa only if no
+// such DFA has been declared yet.
+func (a *Assembler) InternDFA(dfa *DFA) uint64 {
+	if idx, found := a.dfaIndex[dfaKey(dfa)]; found {
+		return idx
+	}
+	a.DeclareDFA(dfa)
+	return uint64(len(a.DFAs) - 1)
+}
+
+// byteSetKey returns a bitmap of the bytes matched by set. Two matchers are
+// equivalent iff their keys are equal.
+func byteSetKey(set byteset.Matcher) [32]byte {
+	var key [32]byte
+	set.ForEach(func(b byte) {
+		key[b>>3] |= 1 << (b & 7)
+	})
+	return key
+}
+
+// byteSetFromKey is the inverse of byteSetKey.
+func byteSetFromKey(key [32]byte) byteset.Matcher {
+	var list []byte
+	for i := 0; i < 256; i++ {
+		if key[i>>3]&(1<<(uint(i)&7)) != 0 {
+			list = append(list, byte(i))
+		}
+	}
+	return byteset.DenseSet(list...).Optimize()
+}
+
 func (a *Assembler) DeclareNumCaptures(n uint64) {
 	a.Captures = make([]CaptureMeta, n)
 }
 
 func (a *Assembler) DeclareNamedCapture(idx uint64, name string) {
 	assert(idx < uint64(len(a.Captures)), "capture index out of range")
+	a.Captures[idx].Name = name
 	a.NamedCaptures[name] = idx
 }
 
+// DeclareCaptureKind records a hint as to the type of value that the capture
+// holds.
+func (a *Assembler) DeclareCaptureKind(idx uint64, kind CaptureKind) {
+	assert(idx < uint64(len(a.Captures)), "capture index out of range")
+	a.Captures[idx].Kind = kind
+}
+
+// Capture returns the index of the capture with the given name, allocating a
+// new capture with that name if there is none yet. This spares callers from
+// declaring the number of captures up front; if DeclareNumCaptures is used as
+// well, it must come first.
+func (a *Assembler) Capture(name string) uint64 {
+	if idx, found := a.NamedCaptures[name]; found {
+		return idx
+	}
+	idx := uint64(len(a.Captures))
+	a.Captures = append(a.Captures, CaptureMeta{})
+	a.DeclareNamedCapture(idx, name)
+	return idx
+}
+
+// DeclareEntry marks the public label with the given name as an entry point,
+// at which Program.ExecEntry may start execution. The label itself may be
+// emitted before or after this call.
+func (a *Assembler) DeclareEntry(name string) {
+	a.Entries = append(a.Entries, name)
+}
+
+// AddFragment registers a separately-assembled Program whose entry points may
+// be called with EmitCallRule. At Finish, each fragment that defines a rule
+// which is called but not defined here is appended to the code, with its
+// literals, byte sets, and captures renumbered as by importProgram. Fragments
+// that are not needed are left out.
+func (a *Assembler) AddFragment(p *Program) {
+	a.Fragments = append(a.Fragments, p)
+}
+
+// EmitCallRule emits a CALL to the entry point of the named rule. The rule may
+// be defined by a public label in this Assembler, or by an entry point of a
+// fragment registered with AddFragment; either way, it is resolved at Finish.
+func (a *Assembler) EmitCallRule(rule string) {
+	label := a.GrabLabel(rule)
+	assert(label.Public, "rule name %q is not public", rule)
+	a.EmitOp(OpCALL.Meta(), label, nil, nil)
+}
+
 func (a *Assembler) GrabLabel(name string) *AsmItem {
 	item := a.LabelsByName[name]
 	if item != nil {
@@ -118,6 +378,37 @@ func (a *Assembler) EmitLabel(name string) {
 	a.link(item)
 }
 
+// EmitRaw emits pre-encoded bytes verbatim. The assembler does not interpret
+// them, so any code offsets within them are the caller's responsibility.
+func (a *Assembler) EmitRaw(raw []byte) {
+	item := &AsmItem{
+		Index: ^uint(0),
+		IsOp:  true,
+		Name:  "%bytes",
+		Fixed: true,
+		Bytes: append([]byte(nil), raw...),
+		Pos:   a.pos,
+	}
+	item.MaxLength = uint(len(item.Bytes))
+	a.link(item)
+}
+
+// EmitAlign emits as many copies of fill as are needed to advance to the next
+// multiple of n. A fill of 0x00 pads with NOP instructions.
+func (a *Assembler) EmitAlign(n uint64, fill byte) {
+	assert(n != 0, "alignment must be positive")
+	item := &AsmItem{
+		Index: ^uint(0),
+		IsOp:  true,
+		Name:  "%align",
+		Fixed: true,
+		Align: n,
+		Fill:  fill,
+	}
+	item.MaxLength = uint(n - 1)
+	a.link(item)
+}
+
 func (a *Assembler) EmitOp(meta *OpMeta, imm0, imm1, imm2 interface{}) {
 	item := &AsmItem{
 		Index:     ^uint(0),
@@ -125,6 +416,7 @@ func (a *Assembler) EmitOp(meta *OpMeta, imm0, imm1, imm2 interface{}) {
 		Meta:      meta,
 		Name:      meta.Name,
 		MaxLength: 26,
+		Pos:       a.pos,
 	}
 
 	type tuple struct {
@@ -196,6 +488,11 @@ func (a *Assembler) EmitOp(meta *OpMeta, imm0, imm1, imm2 interface{}) {
 			assert(t.Signed(), "%T for unsigned immediate", x)
 			*row.Ptr = s2u(x)
 
+		case string:
+			assert(t == ImmLiteralIdx || t == ImmMatcherIdx, "name for %v immediate", t)
+			item.symbols = append(item.symbols, symbolRef{t, x, row.Ptr})
+			*row.Ptr = allbits
+
 		case *AsmItem:
 			assert(t == ImmCodeOffset, "not a code offset")
 			assert(!x.IsOp, "not a label")
@@ -207,25 +504,61 @@ func (a *Assembler) EmitOp(meta *OpMeta, imm0, imm1, imm2 interface{}) {
 		default:
 			panic(fmt.Errorf("illegal type %T", x))
 		}
+
+		switch t {
+		case ImmByte:
+			assert(*row.Ptr <= 0xff, "%#x out of range for byte immediate", *row.Ptr)
+		case ImmRune:
+			assert(*row.Ptr <= utf8.MaxRune && utf8.ValidRune(rune(*row.Ptr)), "%#x is not a valid rune", *row.Ptr)
+		}
+	}
+
+	switch meta.Code {
+	case OpMEMOGET:
+		a.noteMemoRule(item.Imm1)
+	case OpMEMOSET:
+		a.noteMemoRule(item.Imm0)
 	}
 
 	a.link(item)
 
+	if len(item.symbols) != 0 && !variableLen {
+		item.MaxLength = uint(len(meta.Encode(item.Imm0, item.Imm1, item.Imm2)))
+		return
+	}
+
 	if !variableLen {
 		item.generate()
 		return
 	}
 
-	label := item.FixBlockedBy
-	label.Blocking = append(label.Blocking, item)
 	*item.Fixup = ^highbit
 	raw := meta.Encode(item.Imm0, item.Imm1, item.Imm2)
 	item.MaxLength = uint(len(raw))
 }
 
 func (a *Assembler) Finish() (*Program, error) {
+	if err := a.resolveSymbols(); err != nil {
+		return nil, err
+	}
+	if err := a.linkFragments(); err != nil {
+		return nil, err
+	}
+	if err := a.checkLabels(); err != nil {
+		return nil, err
+	}
 	a.Fix()
+	p := a.build()
+	if a.Verify {
+		if err := p.VerifyStack(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
 
+// build assembles the Program from the fixed items.
+func (a *Assembler) build() *Program {
 	var endxp uint64
 	if len(a.List) != 0 {
 		last := a.List[len(a.List)-1]
@@ -236,6 +569,11 @@ func (a *Assembler) Finish() (*Program, error) {
 		Bytes:         make([]byte, 0, endxp),
 		Literals:      a.Literals,
 		ByteSets:      a.ByteSets,
+		DFAs:          a.DFAs,
+		RuneSets:      a.RuneSets,
+		predicates:    a.Predicates,
+		folders:       a.Folders,
+		JumpTables:    make([]JumpTable, len(a.JumpTables)),
 		Captures:      a.Captures,
 		NamedCaptures: a.NamedCaptures,
 		LabelsByName:  make(map[string]*Label),
@@ -243,6 +581,9 @@ func (a *Assembler) Finish() (*Program, error) {
 
 	for _, item := range a.List {
 		if item.IsOp {
+			if !item.Pos.IsZero() && len(item.Bytes) != 0 {
+				p.Debug = append(p.Debug, DebugEntry{XP: item.XP, Pos: item.Pos})
+			}
 			p.Bytes = append(p.Bytes, item.Bytes...)
 		} else {
 			label := &Label{
@@ -255,56 +596,232 @@ func (a *Assembler) Finish() (*Program, error) {
 		}
 	}
 
-	return p, nil
+	for _, name := range a.Entries {
+		p.Entries = append(p.Entries, p.LabelsByName[name])
+	}
+
+	for i, table := range a.JumpTables {
+		out := &p.JumpTables[i]
+		out.Keys = table.Keys
+		for _, label := range table.Labels {
+			out.Targets = append(out.Targets, label.XP)
+		}
+	}
+	if len(p.JumpTables) == 0 {
+		p.JumpTables = nil
+	}
+
+	return p
 }
 
+// Fix determines the final position and encoding of every item.
+//
+// Code offsets are resolved by iterative relaxation. Each op with a code
+// offset starts at the shortest encoding it could possibly have; each pass
+// then lays out the code, recomputes every offset, and widens any op whose
+// offset no longer fits. Widening an op can only lengthen the offsets that
+// span it -- including, for a backward branch, the op's own offset -- so
+// lengths grow monotonically and the loop terminates. The result is the
+// least fixed point: no op is encoded longer than necessary.
+//
+// Alignment padding is the exception, as it can shrink when an earlier op
+// grows. Ops never shrink, so the loop still terminates, but an op may end
+// up wider than its final offset requires; its offset is then sign-extended
+// to fill the space.
+//
 func (a *Assembler) Fix() {
-	a.Queue = make([]*AsmItem, 0, len(a.List))
+	var pending []*AsmItem
+	for _, item := range a.List {
+		if item.Fixed {
+			continue
+		}
+		assert(len(item.symbols) == 0, "%s has unresolved names", item)
+		label := item.FixBlockedBy
+		assert(label.Seen, "label %q is referenced but never emitted", label.Name)
+		label.Referenced = true
+		item.applyFixup(0)
+		item.MaxLength = uint(len(item.Meta.Encode(item.Imm0, item.Imm1, item.Imm2)))
+		pending = append(pending, item)
+	}
+	for _, table := range a.JumpTables {
+		for _, label := range table.Labels {
+			assert(label.Seen, "label %q is referenced but never emitted", label.Name)
+			label.Referenced = true
+		}
+	}
 
-	// First, try logically reasoning out all the lengths and positions.
 	for {
-		a.Queue = append(a.Queue, a.List...)
-		progress := a.process()
-		if !progress {
+		a.layout()
+		grew := false
+		for _, item := range pending {
+			end := item.XP + uint64(item.MaxLength)
+			item.applyFixup(int64(item.FixBlockedBy.XP - end))
+			n := uint(len(item.Meta.Encode(item.Imm0, item.Imm1, item.Imm2)))
+			if n > item.MaxLength {
+				item.MaxLength = n
+				grew = true
+			}
+		}
+		if !grew {
 			break
 		}
 	}
 
-	// Last resort: start jiggling the cables until it works.
+	for _, item := range pending {
+		length := item.MaxLength
+		item.generateWidth(length)
+		assert(uint(len(item.Bytes)) == length, "length of %s changed", item)
+	}
+	a.layout()
+}
+
+// checkLabels verifies that every label referenced by an op or declared as an
+// entry point has been emitted.
+func (a *Assembler) checkLabels() error {
+	var undefined *LabelError
 	for _, item := range a.List {
-		if item.Fixed {
+		if !item.IsOp || item.Fixed || item.FixBlockedBy == nil || item.FixBlockedBy.Seen {
 			continue
 		}
+		if undefined == nil {
+			undefined = &LabelError{Err: ErrUndefinedLabel, Label: item.FixBlockedBy.Name}
+		}
+		if item.FixBlockedBy.Name == undefined.Label {
+			undefined.Indices = append(undefined.Indices, item.Index)
+		}
+	}
+	if undefined != nil {
+		return undefined
+	}
+	for _, table := range a.JumpTables {
+		for _, label := range table.Labels {
+			if !label.Seen {
+				return &LabelError{Err: ErrUndefinedLabel, Label: label.Name}
+			}
+		}
+	}
+	for _, name := range a.Entries {
+		item := a.LabelsByName[name]
+		if item == nil || !item.Seen {
+			return &LabelError{Err: ErrUndefinedLabel, Label: name}
+		}
+		if !item.Public {
+			return &LabelError{Err: ErrPrivateEntry, Label: name, Indices: []uint{item.Index}}
+		}
+	}
+	return nil
+}
 
-		n, _ := a.distance(item, item.FixBlockedBy)
-		item.applyFixup(n)
+// UnreferencedLabels returns the private labels that have been emitted but
+// that no op refers to, in order of appearance. Public labels are exports,
+// and so are never reported. It may be called before or after Finish.
+func (a *Assembler) UnreferencedLabels() []*AsmItem {
+	used := make(map[*AsmItem]struct{})
+	for _, item := range a.List {
+		if item.IsOp && item.FixBlockedBy != nil {
+			used[item.FixBlockedBy] = struct{}{}
+		}
+	}
+	for _, table := range a.JumpTables {
+		for _, label := range table.Labels {
+			used[label] = struct{}{}
+		}
+	}
+	var out []*AsmItem
+	for _, item := range a.List {
+		if item.IsOp || item.Public || item.Referenced {
+			continue
+		}
+		if _, found := used[item]; !found {
+			out = append(out, item)
+		}
+	}
+	return out
+}
 
-		// Special consideration: negative offsets are affected by the
-		// encoded length of the instruction itself. This produces edge
-		// cases that are tricky to resolve optimally.
-		if item.Index > item.FixBlockedBy.Index {
-			first := item.Meta.Encode(item.Imm0, item.Imm1, item.Imm2)
-			item.applyFixup(n + 1)
-			second := item.Meta.Encode(item.Imm0, item.Imm1, item.Imm2)
-			if len(second) == len(first) {
-				item.applyFixup(n)
+// linkFragments imports each fragment that defines a rule which is referenced
+// but not yet defined. Imported fragments are resolved already, so a single
+// pass suffices.
+func (a *Assembler) linkFragments() error {
+	needed := make(map[string]struct{})
+	for _, item := range a.List {
+		if item.IsOp && !item.Fixed && item.FixBlockedBy != nil && !item.FixBlockedBy.Seen {
+			needed[item.FixBlockedBy.Name] = struct{}{}
+		}
+	}
+	for i, p := range a.Fragments {
+		exports := make(map[string]struct{}, len(p.Entries))
+		use := false
+		for _, entry := range p.Entries {
+			if label := a.LabelsByName[entry.Name]; label != nil && label.Seen {
+				continue
+			}
+			exports[entry.Name] = struct{}{}
+			if _, found := needed[entry.Name]; found {
+				delete(needed, entry.Name)
+				use = true
+			}
+		}
+		if !use {
+			continue
+		}
+		if a.canFallOffEnd() {
+			a.EmitOp(OpEND.Meta(), nil, nil, nil)
+		}
+		capBase, err := a.importProgram(p, fmt.Sprintf(".F%d/", i), exports, nil, "")
+		if err != nil {
+			return err
+		}
+		for name, idx := range p.NamedCaptures {
+			if _, found := a.NamedCaptures[name]; !found {
+				a.NamedCaptures[name] = capBase + idx
 			}
 		}
-
-		item.generate()
 	}
+	return nil
+}
 
-	// Now that all lengths are determined, calculate positions.
-	for {
-		a.Queue = append(a.Queue, a.List...)
-		progress := a.process()
-		if !progress {
-			break
+// resolveSymbols replaces literal and byte set names with their indices.
+func (a *Assembler) resolveSymbols() error {
+	for _, item := range a.List {
+		if len(item.symbols) == 0 {
+			continue
+		}
+		for _, sym := range item.symbols {
+			byName := a.LiteralsByName
+			err := ErrUndefinedLiteral
+			if sym.Type == ImmMatcherIdx {
+				byName = a.ByteSetsByName
+				err = ErrUndefinedByteSet
+			}
+			idx, found := byName[sym.Name]
+			if !found {
+				return &AssemblyError{Err: err, Text: sym.Name}
+			}
+			*sym.Ptr = idx
+		}
+		item.symbols = nil
+		if item.FixBlockedBy == nil {
+			item.generate()
 		}
 	}
+	return nil
+}
 
+// layout assigns an XP to every item, using MaxLength for unfixed ops.
+func (a *Assembler) layout() {
+	var xp uint64
 	for _, item := range a.List {
-		assert(item.KnownXP && item.Fixed, "I done goofed: [%s]", item)
+		item.XP = xp
+		item.KnownXP = true
+		if item.Align != 0 {
+			item.Bytes = bytes.Repeat([]byte{item.Fill}, int((item.Align-xp%item.Align)%item.Align))
+		}
+		if item.Fixed {
+			xp += uint64(len(item.Bytes))
+		} else {
+			xp += uint64(item.MaxLength)
+		}
 	}
 }
 
@@ -352,132 +869,250 @@ func (item *AsmItem) applyFixup(s int64) {
 }
 
 func (item *AsmItem) generate() {
+	item.generateWidth(0)
+}
+
+// generateWidth is like generate, but sign-extends the code offset (if any) as
+// needed to make the encoding at least n bytes long.
+func (item *AsmItem) generateWidth(n uint) {
 	item.Bytes = item.Meta.Encode(item.Imm0, item.Imm1, item.Imm2)
+	if uint(len(item.Bytes)) < n && item.Fixup != nil {
+		meta := item.Meta
+		slots := [3]*ImmMeta{&meta.Imm0, &meta.Imm1, &meta.Imm2}
+		values := [3]*uint64{&item.Imm0, &item.Imm1, &item.Imm2}
+		var raws [3][]byte
+		k := 0
+		for i := range slots {
+			raws[i] = slots[i].Encode(*values[i])
+			if values[i] == item.Fixup {
+				k = i
+			}
+		}
+		fill := byte(0x00)
+		if (*item.Fixup & highbit) == highbit {
+			fill = 0xff
+		}
+		for uint(len(item.Bytes)) < n && len(raws[k]) < 8 {
+			w := 2 * len(raws[k])
+			for len(raws[k]) < w {
+				raws[k] = append(raws[k], fill)
+			}
+			item.Bytes = meta.encodeRaw(raws[0], raws[1], raws[2])
+		}
+	}
 	item.MaxLength = uint(len(item.Bytes))
 	item.Fixed = true
 	item.Fixup = nil
 	item.FixBlockedBy = nil
 }
 
-func (a *Assembler) trySetXP(item *AsmItem) bool {
-	if item.KnownXP {
-		return false
+// noteMemoRule records that rule ID id is in use by MEMOGET or MEMOSET.
+func (a *Assembler) noteMemoRule(id uint64) {
+	switch {
+	case id == ^uint64(0):
+		a.memoRules = id
+	case id >= a.memoRules:
+		a.memoRules = id + 1
 	}
-
-	if item.Index == 0 {
-		item.XP = 0
-		item.KnownXP = true
-		return true
-	}
-
-	prev := a.List[item.Index-1]
-	if prev.KnownXP && prev.Fixed {
-		item.XP = prev.XP + uint64(len(prev.Bytes))
-		item.KnownXP = true
-		return true
-	} else {
-		prev.Blocking = append(prev.Blocking, item)
-	}
-	return false
 }
 
-func (a *Assembler) tryFix(item *AsmItem) bool {
-	if item.Fixed {
-		return false
+// importProgram decodes p and emits its instructions, merging p's literals
+// and byte sets into the ones being assembled, appending p's captures, and
+// renumbering the instructions that refer to them. The rule IDs of MEMOGET
+// and MEMOSET are likewise offset past those already in use, so that rules of
+// different programs do not share memoized results. Code offsets are replaced
+// with labels named prefix + the target's label name, and p's own labels are
+// emitted with the same prefix. Labels named in exports are also emitted
+// without the prefix.
+//
+// The code offset of each op whose XP is a key of relocs is not decoded;
+// instead, it refers to the public label named by the corresponding value.
+//
+// If endLabel is not empty, each END is replaced by a JMP to that label.
+//
+// Returns the index of p's first capture within a.Captures.
+//
+func (a *Assembler) importProgram(p *Program, prefix string, exports map[string]struct{}, relocs map[uint64]string, endLabel string) (uint64, error) {
+	var ops []Op
+	targets := make(map[uint64]struct{})
+	var xp uint64
+	for {
+		var op Op
+		err := op.Decode(p.Bytes, xp)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		xp += uint64(op.Len)
+		ops = append(ops, op)
+		if _, found := relocs[op.XP]; found {
+			continue
+		}
+		meta := op.Code.Meta()
+		for _, pair := range []struct {
+			m ImmMeta
+			v uint64
+		}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+			if pair.m.Type == ImmCodeOffset {
+				target, ok := tryAddOffset(xp, u2s(pair.v))
+				if !ok || target > uint64(len(p.Bytes)) {
+					return 0, &DisassembleError{Err: ErrCodeOffsetRange, XP: op.XP}
+				}
+				targets[target] = struct{}{}
+			}
+		}
 	}
-
-	label := item.FixBlockedBy
-	if !label.Seen {
-		return false
+	for _, table := range p.JumpTables {
+		if !table.wellFormed() {
+			return 0, ErrBadJumpTable
+		}
+		for _, target := range table.Targets {
+			if target > uint64(len(p.Bytes)) {
+				return 0, ErrCodeOffsetRange
+			}
+			targets[target] = struct{}{}
+		}
 	}
 
-	n, exact := a.distance(item, label)
-	item.applyFixup(n)
-	if exact {
-		item.generate()
-		return true
+	litMap := make([]uint64, len(p.Literals))
+	for i, lit := range p.Literals {
+		litMap[i] = a.InternLiteral(lit)
 	}
-
-	raw := item.Meta.Encode(item.Imm0, item.Imm1, item.Imm2)
-	ml := uint(len(raw))
-	if ml < item.MaxLength {
-		item.MaxLength = ml
-		return true
+	setMap := make([]uint64, len(p.ByteSets))
+	for i, set := range p.ByteSets {
+		setMap[i] = a.InternByteSet(set)
 	}
-	assert(ml == item.MaxLength, "max length of %s grew", item)
-	return false
-}
-
-func (a *Assembler) processItem(item *AsmItem) bool {
-	var prog0, prog1 bool
-	if !item.KnownXP || !item.Fixed {
-		prog0 = a.trySetXP(item)
-		prog1 = a.tryFix(item)
+	dfaMap := make([]uint64, len(p.DFAs))
+	for i, dfa := range p.DFAs {
+		dfaMap[i] = a.InternDFA(dfa)
 	}
-	if len(item.Blocking) != 0 {
-		list := item.Blocking
-		item.Blocking = nil
-		a.Queue = append(a.Queue, list...)
+	runeSetMap := make([]uint64, len(p.RuneSets))
+	for i, set := range p.RuneSets {
+		runeSetMap[i] = a.InternRuneSet(set)
 	}
-	return prog0 || prog1
-}
-
-func (a *Assembler) process() bool {
-	progress := false
-	for len(a.Queue) != 0 {
-		item := a.Queue[0]
-		a.Queue[0] = nil
-		a.Queue = a.Queue[1:]
-		if a.processItem(item) {
-			progress = true
+	tableBase := uint64(len(a.JumpTables))
+	for _, table := range p.JumpTables {
+		labels := make([]string, len(table.Targets))
+		for i, target := range table.Targets {
+			labels[i] = prefix + p.FindLabel(target).Name
 		}
+		a.DeclareJumpTable(table.Keys, labels)
 	}
-	return progress
-}
-
-// distance measures the distance between the *end* of p and the *start* of q.
-func (a *Assembler) distance(p, q *AsmItem) (int64, bool) {
-	i := p.Index + 1
-	j := q.Index
-	if i >= uint(len(a.List)) {
-		a.List = append(a.List, &AsmItem{
-			Index:  i,
-			IsOp:   false,
-			Name:   ".$bogus$",
-			Public: false,
-			Fixed:  true,
-		})
-		defer func() {
-			a.List = a.List[:len(a.List)-1]
-		}()
+	predBase := uint64(len(a.Predicates))
+	a.Predicates = append(a.Predicates, p.predicates...)
+	folderBase := uint64(len(a.Folders))
+	a.Folders = append(a.Folders, p.folders...)
+	capBase := uint64(len(a.Captures))
+	a.Captures = append(a.Captures, p.Captures...)
+	memoBase := a.memoRules
+
+	labelsAt := make(map[uint64][]string)
+	for _, label := range p.Labels {
+		labelsAt[label.Offset] = append(labelsAt[label.Offset], label.Name)
 	}
-
-	total := uint64(0)
-	exact := true
-
-	f := func() {
-		item := a.List[i]
-		if item.Fixed {
-			total += uint64(len(item.Bytes))
-		} else {
-			total += uint64(item.MaxLength)
-			exact = false
+	emitLabels := func(xp uint64) {
+		seen := false
+		best := p.FindLabel(xp).Name
+		for _, name := range labelsAt[xp] {
+			a.EmitLabel(prefix + name)
+			if _, found := exports[name]; found {
+				a.EmitLabel(name)
+			}
+			seen = seen || (name == best)
+		}
+		if _, found := targets[xp]; found && !seen {
+			a.EmitLabel(prefix + best)
 		}
 	}
 
-	var n int64
-	if i > j {
-		for i != j {
-			i -= 1
-			f()
+	savedPos := a.pos
+	defer func() { a.pos = savedPos }()
+
+	for i := range ops {
+		op := &ops[i]
+		emitLabels(op.XP)
+		a.pos, _ = p.SourcePos(op.XP)
+		if op.Code == OpEND && endLabel != "" {
+			a.EmitOp(OpJMP.Meta(), a.GrabLabel(endLabel), nil, nil)
+			continue
 		}
-		n = -int64(total)
-	} else {
-		for i != j {
-			f()
-			i += 1
+		meta := op.Code.Meta()
+		next := op.XP + uint64(op.Len)
+		symbol, isReloc := relocs[op.XP]
+		imms := [3]interface{}{}
+		for j, pair := range []struct {
+			m ImmMeta
+			v uint64
+		}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+			v := pair.v
+			switch pair.m.Type {
+			case ImmNone:
+				continue
+			case ImmCodeOffset:
+				if isReloc {
+					imms[j] = a.GrabLabel(symbol)
+				} else {
+					target, ok := tryAddOffset(next, u2s(v))
+					if !ok {
+						return 0, &DisassembleError{Err: ErrCodeOffsetRange, XP: op.XP}
+					}
+					imms[j] = a.GrabLabel(prefix + p.FindLabel(target).Name)
+				}
+				continue
+			case ImmLiteralIdx:
+				if v >= uint64(len(litMap)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v = litMap[v]
+			case ImmMatcherIdx:
+				if v >= uint64(len(setMap)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v = setMap[v]
+			case ImmDFAIdx:
+				if v >= uint64(len(dfaMap)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v = dfaMap[v]
+			case ImmRuneSetIdx:
+				if v >= uint64(len(runeSetMap)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v = runeSetMap[v]
+			case ImmJumpTableIdx:
+				if v >= uint64(len(p.JumpTables)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v += tableBase
+			case ImmPredicateIdx:
+				if v >= uint64(len(p.predicates)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v += predBase
+			case ImmFolderIdx:
+				if v >= uint64(len(p.folders)) {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v += folderBase
+			case ImmCaptureIdx:
+				v += capBase
+			}
+			if (op.Code == OpMEMOGET && j == 1) || (op.Code == OpMEMOSET && j == 0) {
+				if v > ^uint64(0)-memoBase {
+					return 0, &DisassembleError{Err: ErrIndexRange, XP: op.XP}
+				}
+				v += memoBase
+			}
+			if pair.m.Type.Signed() {
+				imms[j] = u2s(v)
+			} else {
+				imms[j] = v
+			}
 		}
-		n = int64(total)
+		a.EmitOp(meta, imms[0], imms[1], imms[2])
 	}
-	return n, exact
+	emitLabels(uint64(len(p.Bytes)))
+	return capBase, nil
 }
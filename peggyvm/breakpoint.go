@@ -0,0 +1,69 @@
+package peggyvm
+
+import (
+	"sort"
+)
+
+// SetBreakpoint sets a breakpoint at the instruction starting at xp, so that
+// RunUntilBreak stops before executing it.
+func (x *Execution) SetBreakpoint(xp uint64) {
+	if x.breakpoints == nil {
+		x.breakpoints = make(map[uint64]struct{})
+	}
+	x.breakpoints[xp] = struct{}{}
+}
+
+// SetLabelBreakpoint sets a breakpoint at the named label. It returns
+// ErrUndefinedLabel if the program has no such label.
+func (x *Execution) SetLabelBreakpoint(name string) error {
+	label := x.P.LabelsByName[name]
+	if label == nil {
+		return ErrUndefinedLabel
+	}
+	x.SetBreakpoint(label.Offset)
+	return nil
+}
+
+// ClearBreakpoint removes the breakpoint at xp, if any.
+func (x *Execution) ClearBreakpoint(xp uint64) {
+	delete(x.breakpoints, xp)
+}
+
+// ClearBreakpoints removes every breakpoint.
+func (x *Execution) ClearBreakpoints() {
+	x.breakpoints = nil
+}
+
+// Breakpoints returns the addresses of all breakpoints, in ascending order.
+func (x *Execution) Breakpoints() []uint64 {
+	out := make([]uint64, 0, len(x.breakpoints))
+	for xp := range x.breakpoints {
+		out = append(out, xp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// RunUntilBreak is like Run, but stops just before executing an instruction
+// that has a breakpoint, and returns true. The Execution is left as it was
+// after the last Step, so that its registers and stacks may be inspected or
+// changed; calling RunUntilBreak again resumes it, executing the instruction
+// at the breakpoint before checking for breakpoints again. It returns false
+// once the Execution halts.
+//
+func (x *Execution) RunUntilBreak() (bool, error) {
+	resume := x.atBreak && x.XP == x.breakXP
+	x.atBreak = false
+	for x.R == RunningState {
+		if _, found := x.breakpoints[x.XP]; found && !resume {
+			x.atBreak = true
+			x.breakXP = x.XP
+			return true, nil
+		}
+		resume = false
+		if err := x.Step(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
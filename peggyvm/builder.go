@@ -0,0 +1,370 @@
+package peggyvm
+
+import (
+	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
+)
+
+// Builder is a chainable wrapper around an Assembler, for writing programs by
+// hand. Each method emits one directive, label, or instruction and returns
+// the Builder, so that a program reads much like its assembly:
+//
+//   p, err := NewBuilder().
+//           Choice(".L1").Lit("ana").AnyB().Fail2x().
+//           Label(".L1").End().
+//           Finish()
+//
+// Code offsets are given as label names. Literals and byte sets are given as
+// values, and are interned; see Assembler.InternLiteral.
+//
+// The embedded Assembler remains available for anything that Builder does not
+// cover, such as Finish.
+//
+type Builder struct {
+	*Assembler
+}
+
+// NewBuilder returns a Builder wrapped around a new Assembler.
+func NewBuilder() *Builder {
+	return &Builder{NewAssembler()}
+}
+
+// NumCaptures declares the number of captures.
+func (b *Builder) NumCaptures(n uint64) *Builder {
+	b.DeclareNumCaptures(n)
+	return b
+}
+
+// NamedCapture names a capture.
+func (b *Builder) NamedCapture(idx uint64, name string) *Builder {
+	b.DeclareNamedCapture(idx, name)
+	return b
+}
+
+// Entry declares a public label as an entry point.
+func (b *Builder) Entry(name string) *Builder {
+	b.DeclareEntry(name)
+	return b
+}
+
+// Label defines a label.
+func (b *Builder) Label(name string) *Builder {
+	b.EmitLabel(name)
+	return b
+}
+
+// Op emits an arbitrary instruction, as EmitOp does.
+func (b *Builder) Op(code OpCode, imm0, imm1, imm2 interface{}) *Builder {
+	b.EmitOp(code.Meta(), imm0, imm1, imm2)
+	return b
+}
+
+func (b *Builder) jump(code OpCode, label string, imm1, imm2 interface{}) *Builder {
+	return b.Op(code, b.GrabLabel(label), imm1, imm2)
+}
+
+// Nop emits NOP.
+func (b *Builder) Nop() *Builder {
+	return b.Op(OpNOP, nil, nil, nil)
+}
+
+// Choice emits CHOICE.
+func (b *Builder) Choice(label string) *Builder {
+	return b.jump(OpCHOICE, label, nil, nil)
+}
+
+// Commit emits COMMIT.
+func (b *Builder) Commit(label string) *Builder {
+	return b.jump(OpCOMMIT, label, nil, nil)
+}
+
+// Fail emits FAIL.
+func (b *Builder) Fail() *Builder {
+	return b.Op(OpFAIL, nil, nil, nil)
+}
+
+// AnyB emits ANYB.
+func (b *Builder) AnyB() *Builder {
+	return b.Op(OpANYB, nil, nil, nil)
+}
+
+// AnyBN emits ANYB with a count.
+func (b *Builder) AnyBN(n uint64) *Builder {
+	return b.Op(OpANYB, n, nil, nil)
+}
+
+// SameB emits SAMEB.
+func (b *Builder) SameB(ch byte) *Builder {
+	return b.Op(OpSAMEB, ch, nil, nil)
+}
+
+// SameBN emits SAMEB with a count.
+func (b *Builder) SameBN(ch byte, n uint64) *Builder {
+	return b.Op(OpSAMEB, ch, n, nil)
+}
+
+// Lit emits LITB.
+func (b *Builder) Lit(lit string) *Builder {
+	return b.Op(OpLITB, b.lit(lit), nil, nil)
+}
+
+// AnyR emits ANYR.
+func (b *Builder) AnyR() *Builder {
+	return b.Op(OpANYR, nil, nil, nil)
+}
+
+// SameR emits SAMER.
+func (b *Builder) SameR(r rune) *Builder {
+	return b.Op(OpSAMER, r, nil, nil)
+}
+
+// FSameR emits FSAMER.
+func (b *Builder) FSameR(r rune) *Builder {
+	return b.Op(OpFSAMER, r, nil, nil)
+}
+
+// MatchR emits MATCHR.
+func (b *Builder) MatchR(m runeset.Matcher) *Builder {
+	return b.Op(OpMATCHR, b.InternRuneSet(m), nil, nil)
+}
+
+// TMatchR emits TMATCHR.
+func (b *Builder) TMatchR(label string, m runeset.Matcher) *Builder {
+	return b.jump(OpTMATCHR, label, b.InternRuneSet(m), nil)
+}
+
+// SpanR emits SPANR.
+func (b *Builder) SpanR(m runeset.Matcher) *Builder {
+	return b.Op(OpSPANR, b.InternRuneSet(m), nil, nil)
+}
+
+// Match emits MATCHB.
+func (b *Builder) Match(m byteset.Matcher) *Builder {
+	return b.Op(OpMATCHB, b.InternByteSet(m), nil, nil)
+}
+
+// MatchN emits MATCHB with a count.
+func (b *Builder) MatchN(m byteset.Matcher, n uint64) *Builder {
+	return b.Op(OpMATCHB, b.InternByteSet(m), n, nil)
+}
+
+// Jmp emits JMP.
+func (b *Builder) Jmp(label string) *Builder {
+	return b.jump(OpJMP, label, nil, nil)
+}
+
+// Call emits CALL.
+func (b *Builder) Call(label string) *Builder {
+	return b.jump(OpCALL, label, nil, nil)
+}
+
+// Ret emits RET.
+func (b *Builder) Ret() *Builder {
+	return b.Op(OpRET, nil, nil, nil)
+}
+
+// TAnyB emits TANYB.
+func (b *Builder) TAnyB(label string) *Builder {
+	return b.jump(OpTANYB, label, nil, nil)
+}
+
+// TAnyBN emits TANYB with a count.
+func (b *Builder) TAnyBN(label string, n uint64) *Builder {
+	return b.jump(OpTANYB, label, n, nil)
+}
+
+// TSameB emits TSAMEB.
+func (b *Builder) TSameB(label string, ch byte) *Builder {
+	return b.jump(OpTSAMEB, label, ch, nil)
+}
+
+// TSameBN emits TSAMEB with a count.
+func (b *Builder) TSameBN(label string, ch byte, n uint64) *Builder {
+	return b.jump(OpTSAMEB, label, ch, n)
+}
+
+// TLit emits TLITB.
+func (b *Builder) TLit(label string, lit string) *Builder {
+	return b.jump(OpTLITB, label, b.lit(lit), nil)
+}
+
+// TMatch emits TMATCHB.
+func (b *Builder) TMatch(label string, m byteset.Matcher) *Builder {
+	return b.jump(OpTMATCHB, label, b.InternByteSet(m), nil)
+}
+
+// TMatchN emits TMATCHB with a count.
+func (b *Builder) TMatchN(label string, m byteset.Matcher, n uint64) *Builder {
+	return b.jump(OpTMATCHB, label, b.InternByteSet(m), n)
+}
+
+// PCommit emits PCOMMIT.
+func (b *Builder) PCommit(label string) *Builder {
+	return b.jump(OpPCOMMIT, label, nil, nil)
+}
+
+// BCommit emits BCOMMIT.
+func (b *Builder) BCommit(label string) *Builder {
+	return b.jump(OpBCOMMIT, label, nil, nil)
+}
+
+// DCommit emits DCOMMIT.
+func (b *Builder) DCommit(label string) *Builder {
+	return b.jump(OpDCOMMIT, label, nil, nil)
+}
+
+// EOI emits EOI.
+func (b *Builder) EOI() *Builder {
+	return b.Op(OpEOI, nil, nil, nil)
+}
+
+// WordB emits WORDB, with m as the set of word bytes.
+func (b *Builder) WordB(m byteset.Matcher) *Builder {
+	return b.Op(OpWORDB, b.InternByteSet(m), nil, nil)
+}
+
+// Bal emits BALB.
+func (b *Builder) Bal(open, close byte) *Builder {
+	return b.Op(OpBALB, open, close, nil)
+}
+
+// Span emits SPANB.
+func (b *Builder) Span(m byteset.Matcher) *Builder {
+	return b.Op(OpSPANB, b.InternByteSet(m), nil, nil)
+}
+
+// DFA emits DFAB.
+func (b *Builder) DFA(d *DFA) *Builder {
+	return b.Op(OpDFAB, b.InternDFA(d), nil, nil)
+}
+
+// Pred emits a PRED that calls fn, which is added to the predicates.
+func (b *Builder) Pred(fn Predicate) *Builder {
+	return b.Op(OpPRED, b.DeclarePredicate(fn), nil, nil)
+}
+
+// VCap emits VCAP.
+func (b *Builder) VCap(idx uint64) *Builder {
+	return b.Op(OpVCAP, idx, nil, nil)
+}
+
+// VFold emits a VFOLD that folds the top n values with fn, which is added to
+// the folders.
+func (b *Builder) VFold(fn Folder, n uint64) *Builder {
+	return b.Op(OpVFOLD, b.DeclareFolder(fn), n, nil)
+}
+
+// Dispatch emits DISPATCH, with a new jump table that maps each of keys to
+// the label with the same index in labels.
+func (b *Builder) Dispatch(keys []byte, labels []string) *Builder {
+	return b.Op(OpDISPATCH, b.DeclareJumpTable(keys, labels), nil, nil)
+}
+
+// RAnyB emits RANYB.
+func (b *Builder) RAnyB() *Builder {
+	return b.Op(OpRANYB, nil, nil, nil)
+}
+
+// RAnyBN emits RANYB with a count.
+func (b *Builder) RAnyBN(n uint64) *Builder {
+	return b.Op(OpRANYB, n, nil, nil)
+}
+
+// RSameB emits RSAMEB.
+func (b *Builder) RSameB(ch byte) *Builder {
+	return b.Op(OpRSAMEB, ch, nil, nil)
+}
+
+// RSameBN emits RSAMEB with a count.
+func (b *Builder) RSameBN(ch byte, n uint64) *Builder {
+	return b.Op(OpRSAMEB, ch, n, nil)
+}
+
+// RLit emits RLITB.
+func (b *Builder) RLit(lit string) *Builder {
+	return b.Op(OpRLITB, b.lit(lit), nil, nil)
+}
+
+// RMatch emits RMATCHB.
+func (b *Builder) RMatch(m byteset.Matcher) *Builder {
+	return b.Op(OpRMATCHB, b.InternByteSet(m), nil, nil)
+}
+
+// RMatchN emits RMATCHB with a count.
+func (b *Builder) RMatchN(m byteset.Matcher, n uint64) *Builder {
+	return b.Op(OpRMATCHB, b.InternByteSet(m), n, nil)
+}
+
+// TSpan emits TSPANB.
+func (b *Builder) TSpan(label string, m byteset.Matcher) *Builder {
+	return b.jump(OpTSPANB, label, b.InternByteSet(m), nil)
+}
+
+// MemoGet emits MEMOGET.
+func (b *Builder) MemoGet(label string, rule uint64) *Builder {
+	return b.jump(OpMEMOGET, label, rule, nil)
+}
+
+// MemoSet emits MEMOSET.
+func (b *Builder) MemoSet(rule uint64) *Builder {
+	return b.Op(OpMEMOSET, rule, nil, nil)
+}
+
+// Throw emits THROW.
+func (b *Builder) Throw(label uint64) *Builder {
+	return b.Op(OpTHROW, label, nil, nil)
+}
+
+// Recover emits RECOVER.
+func (b *Builder) Recover(handler string, label uint64) *Builder {
+	return b.jump(OpRECOVER, handler, label, nil)
+}
+
+// BehindB emits BEHINDB.
+func (b *Builder) BehindB(label string, n uint64) *Builder {
+	return b.jump(OpBEHINDB, label, n, nil)
+}
+
+// RSpan emits RSPANB.
+func (b *Builder) RSpan(m byteset.Matcher) *Builder {
+	return b.Op(OpRSPANB, b.InternByteSet(m), nil, nil)
+}
+
+// Fail2x emits FAIL2X.
+func (b *Builder) Fail2x() *Builder {
+	return b.Op(OpFAIL2X, nil, nil, nil)
+}
+
+// Rwnd emits RWNDB.
+func (b *Builder) Rwnd(n uint64) *Builder {
+	return b.Op(OpRWNDB, n, nil, nil)
+}
+
+// FCap emits FCAP.
+func (b *Builder) FCap(idx, n uint64) *Builder {
+	return b.Op(OpFCAP, idx, n, nil)
+}
+
+// BCap emits BCAP.
+func (b *Builder) BCap(idx uint64) *Builder {
+	return b.Op(OpBCAP, idx, nil, nil)
+}
+
+// ECap emits ECAP.
+func (b *Builder) ECap(idx uint64) *Builder {
+	return b.Op(OpECAP, idx, nil, nil)
+}
+
+// GiveUp emits GIVEUP.
+func (b *Builder) GiveUp() *Builder {
+	return b.Op(OpGIVEUP, nil, nil, nil)
+}
+
+// End emits END.
+func (b *Builder) End() *Builder {
+	return b.Op(OpEND, nil, nil, nil)
+}
+
+func (b *Builder) lit(lit string) uint64 {
+	return b.InternLiteral([]byte(lit))
+}
@@ -13,6 +13,61 @@ type CaptureMeta struct {
 	// Repeat is true iff the compiled program can record multiple input
 	// ranges for this capture.
 	Repeat bool
+
+	// Kind hints at how the captured bytes should be interpreted, for the
+	// benefit of code that binds captures to Go values or builds ASTs. The
+	// VM itself ignores it.
+	Kind CaptureKind
+}
+
+// CaptureKind describes the type of value that a capture holds.
+type CaptureKind uint8
+
+const (
+	// KindNone means that no hint was given.
+	KindNone CaptureKind = iota
+
+	// KindString means the capture is text.
+	KindString
+
+	// KindInt means the capture is an integer.
+	KindInt
+
+	// KindFloat means the capture is a floating-point number.
+	KindFloat
+
+	// KindBytes means the capture is binary data.
+	KindBytes
+
+	// KindTimestamp means the capture is a date and/or time.
+	KindTimestamp
+)
+
+var captureKindNames = []string{
+	"none",
+	"string",
+	"int",
+	"float",
+	"bytes",
+	"timestamp",
+}
+
+func (k CaptureKind) String() string {
+	if int(k) < len(captureKindNames) {
+		return captureKindNames[k]
+	}
+	return fmt.Sprintf("CaptureKind(%d)", uint8(k))
+}
+
+// ParseCaptureKind returns the CaptureKind with the given name, as returned
+// by CaptureKind.String.
+func ParseCaptureKind(name string) (CaptureKind, error) {
+	for i, other := range captureKindNames {
+		if name == other {
+			return CaptureKind(i), nil
+		}
+	}
+	return KindNone, ErrBadOperand
 }
 
 // Assignment records the start or end position of a capture.
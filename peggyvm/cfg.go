@@ -0,0 +1,205 @@
+package peggyvm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// EdgeKind identifies how control passes along an Edge of a CFG.
+type EdgeKind uint8
+
+const (
+	// EdgeFallthrough continues at the next instruction.
+	EdgeFallthrough EdgeKind = iota
+
+	// EdgeJump transfers to a code offset: unconditionally for JMP, COMMIT,
+	// and BCOMMIT, or when the test fails for TANYB, TSAMEB, TLITB, TMATCHB,
+	// TMATCHR, and TSPANB, or when MEMOGET finds a stored match.
+	EdgeJump
+
+	// EdgeFailure leads to the code offset saved by CHOICE or PCOMMIT, where
+	// execution resumes if the match fails, or by RECOVER, where it resumes
+	// if a label is thrown.
+	EdgeFailure
+
+	// EdgeCall leads to the subroutine entered by CALL or BEHINDB.
+	EdgeCall
+)
+
+var edgeKindNames = []string{
+	"fallthrough",
+	"jump",
+	"failure",
+	"call",
+}
+
+func (kind EdgeKind) String() string {
+	if int(kind) < len(edgeKindNames) {
+		return edgeKindNames[kind]
+	}
+	return fmt.Sprintf("EdgeKind(%d)", uint8(kind))
+}
+
+// Edge is a successor edge of a BasicBlock.
+type Edge struct {
+	Kind EdgeKind
+
+	// XP is the code address of the successor. It is either the Start of
+	// a block or the end of the code, where the match succeeds.
+	XP uint64
+}
+
+// BasicBlock is a maximal run of instructions that is only entered at its
+// first instruction and that only transfers control at its last.
+//
+// Instructions that match input may fail, which unwinds to the most recent
+// CHOICE frame; those implicit transfers are not recorded as edges. Blocks
+// that end in RET, FAIL, FAIL2X, END, or GIVEUP have no successors.
+//
+type BasicBlock struct {
+	// Start is the code address of the first instruction.
+	Start uint64
+
+	// End is the code address just past the last instruction.
+	End uint64
+
+	// Ops lists the instructions of the block.
+	Ops []Op
+
+	// Succs lists the successor edges, in the order that the VM would
+	// consider them.
+	Succs []Edge
+}
+
+// CFG is the control-flow graph of a Program.
+type CFG struct {
+	// Program is the Program that the graph was built from.
+	Program *Program
+
+	// Blocks lists the basic blocks, sorted by Start.
+	Blocks []*BasicBlock
+}
+
+// CFG decodes the program into basic blocks. The whole of the code is
+// included, whether or not it is reachable.
+//
+// A new block starts at XP 0, at every label and entry point, at every code
+// offset named by an instruction, and after every instruction that transfers
+// control. It returns an error if the bytecode cannot be decoded or if a code
+// offset lies outside of the code or inside of an instruction.
+//
+func (p *Program) CFG() (*CFG, error) {
+	var ops []Op
+	boundaries := make(map[uint64]struct{})
+	it := p.Instructions()
+	for it.Next() {
+		boundaries[it.XP()] = struct{}{}
+		ops = append(ops, *it.Op())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	end := it.XP()
+
+	leaders := make(map[uint64]struct{})
+	leaders[0] = struct{}{}
+	for _, label := range p.Labels {
+		leaders[label.Offset] = struct{}{}
+	}
+	for _, label := range p.Entries {
+		leaders[label.Offset] = struct{}{}
+	}
+
+	succs := make([][]Edge, len(ops))
+	for i, op := range ops {
+		next := op.XP + uint64(op.Len)
+		target, hasTarget, err := opTarget(&op, end)
+		if err != nil {
+			return nil, err
+		}
+		if hasTarget {
+			if _, found := boundaries[target]; !found && target != end {
+				return nil, &VerifyError{Err: ErrMisalignedTarget, XP: op.XP}
+			}
+			leaders[target] = struct{}{}
+		}
+
+		var list []Edge
+		switch op.Code {
+		case OpCHOICE, OpPCOMMIT, OpRECOVER:
+			list = []Edge{{EdgeFallthrough, next}, {EdgeFailure, target}}
+		case OpCOMMIT, OpBCOMMIT, OpDCOMMIT, OpJMP:
+			list = []Edge{{EdgeJump, target}}
+		case OpTANYB, OpTSAMEB, OpTLITB, OpTMATCHB, OpTMATCHR, OpTSPANB, OpMEMOGET:
+			list = []Edge{{EdgeFallthrough, next}, {EdgeJump, target}}
+		case OpCALL, OpBEHINDB:
+			list = []Edge{{EdgeCall, target}, {EdgeFallthrough, next}}
+		case OpDISPATCH:
+			if op.Imm0 >= uint64(len(p.JumpTables)) {
+				return nil, &VerifyError{Err: ErrIndexRange, XP: op.XP}
+			}
+			for _, target := range p.JumpTables[op.Imm0].distinctTargets() {
+				if _, found := boundaries[target]; !found && target != end {
+					return nil, &VerifyError{Err: ErrMisalignedTarget, XP: op.XP}
+				}
+				leaders[target] = struct{}{}
+				list = append(list, Edge{EdgeJump, target})
+			}
+		case OpRET, OpFAIL, OpFAIL2X, OpEND, OpGIVEUP, OpTHROW:
+			// no successors
+		default:
+			succs[i] = []Edge{{EdgeFallthrough, next}}
+			continue
+		}
+		succs[i] = list
+		leaders[next] = struct{}{}
+	}
+
+	g := &CFG{Program: p}
+	var block *BasicBlock
+	for i, op := range ops {
+		if _, found := leaders[op.XP]; found || block == nil {
+			block = &BasicBlock{Start: op.XP}
+			g.Blocks = append(g.Blocks, block)
+		}
+		block.Ops = append(block.Ops, op)
+		block.End = op.XP + uint64(op.Len)
+		block.Succs = succs[i]
+	}
+	return g, nil
+}
+
+// BlockAt returns the block that starts at xp, or nil if there is none.
+func (g *CFG) BlockAt(xp uint64) *BasicBlock {
+	i := sort.Search(len(g.Blocks), func(i int) bool {
+		return g.Blocks[i].Start >= xp
+	})
+	if i < len(g.Blocks) && g.Blocks[i].Start == xp {
+		return g.Blocks[i]
+	}
+	return nil
+}
+
+// opTarget returns the code address named by the op's code offset immediate,
+// if it has one. The address must not lie beyond end.
+func opTarget(op *Op, end uint64) (uint64, bool, error) {
+	meta := op.Code.Meta()
+	for _, pair := range []struct {
+		m ImmMeta
+		v uint64
+	}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+		if pair.m.Type != ImmCodeOffset {
+			continue
+		}
+		next := op.XP + uint64(op.Len)
+		offset := u2s(pair.v)
+		if offset < 0 && uint64(-offset) > next {
+			return 0, false, &DisassembleError{Err: ErrCodeOffsetRange, XP: op.XP}
+		}
+		if offset > 0 && uint64(offset) > end-next {
+			return 0, false, &DisassembleError{Err: ErrCodeOffsetRange, XP: op.XP}
+		}
+		return addOffset(next, offset), true, nil
+	}
+	return 0, false, nil
+}
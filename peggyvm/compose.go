@@ -0,0 +1,131 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// Concat returns a Program that matches a, then matches b where a left off.
+//
+// The combined program has its own capture 0 for the whole match. The
+// captures of a follow it, then those of b, each renumbered as a block, so
+// that capture i of a becomes capture 1+i and capture i of b becomes capture
+// 1+len(a.Captures)+i. Named captures keep their names; if both programs use
+// a name, the first one wins. Literals and byte sets are merged, and END is
+// rewritten to continue with the next program. Entry points are dropped.
+//
+// Each program must reach END, or the end of its code, with no CHOICE frames
+// pending, as otherwise a failure in b could backtrack into a. Programs that
+// do not are rejected with ErrNotComposable.
+//
+func Concat(a, b *Program) (*Program, error) {
+	asm, err := newComposer(a, b)
+	if err != nil {
+		return nil, err
+	}
+	asm.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	for i, p := range []*Program{a, b} {
+		end := fmt.Sprintf(".C%d.end", i)
+		if err := composeImport(asm, p, fmt.Sprintf(".C%d/", i), end); err != nil {
+			return nil, err
+		}
+		asm.EmitLabel(end)
+	}
+	asm.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	asm.EmitOp(OpEND.Meta(), nil, nil, nil)
+	return asm.Finish()
+}
+
+// Alternate returns a Program that tries each of ps in turn, as with the PEG
+// ordered choice operator, and succeeds with the first one that matches. With
+// no programs, it always fails.
+//
+// Captures, literals, byte sets, and entry points are handled as in Concat.
+// As with ProgramSet, programs that contain GIVEUP or THROW are rejected
+// with ErrNotComposable, since either would abandon the remaining
+// alternatives.
+//
+func Alternate(ps ...*Program) (*Program, error) {
+	for _, p := range ps {
+		if err := checkComposable(p); err != nil {
+			return nil, err
+		}
+	}
+	asm, err := newComposer(ps...)
+	if err != nil {
+		return nil, err
+	}
+	asm.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	for i, p := range ps {
+		last := (i+1 == len(ps))
+		end := fmt.Sprintf(".A%d.end", i)
+		asm.EmitLabel(fmt.Sprintf(".A%d", i))
+		if !last {
+			asm.EmitOp(OpCHOICE.Meta(), asm.GrabLabel(fmt.Sprintf(".A%d", i+1)), nil, nil)
+		}
+		if err := composeImport(asm, p, fmt.Sprintf(".A%d/", i), end); err != nil {
+			return nil, err
+		}
+		asm.EmitLabel(end)
+		if !last {
+			asm.EmitOp(OpCOMMIT.Meta(), asm.GrabLabel(".A.done"), nil, nil)
+		}
+	}
+	if len(ps) == 0 {
+		asm.EmitOp(OpFAIL.Meta(), nil, nil, nil)
+	}
+	asm.EmitLabel(".A.done")
+	asm.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	asm.EmitOp(OpEND.Meta(), nil, nil, nil)
+	return asm.Finish()
+}
+
+// newComposer checks that each of ps is balanced, then returns an Assembler
+// with capture 0 declared.
+func newComposer(ps ...*Program) (*Assembler, error) {
+	for _, p := range ps {
+		if err := checkBalanced(p); err != nil {
+			return nil, err
+		}
+	}
+	asm := NewAssembler()
+	asm.DeclareNumCaptures(1)
+	return asm, nil
+}
+
+// composeImport appends p to asm, with END replaced by a jump to end.
+func composeImport(asm *Assembler, p *Program, prefix string, end string) error {
+	capBase, err := asm.importProgram(p, prefix, nil, nil, end)
+	if err != nil {
+		return err
+	}
+	for name, idx := range p.NamedCaptures {
+		if _, found := asm.NamedCaptures[name]; !found {
+			asm.NamedCaptures[name] = capBase + idx
+		}
+	}
+	return nil
+}
+
+// checkBalanced returns ErrNotComposable if p can reach END, or the end of
+// its code, with a CHOICE frame pending.
+func checkBalanced(p *Program) error {
+	depths, ends, err := p.stackDepths()
+	if err != nil {
+		return p.annotate(err)
+	}
+	for depth := range ends {
+		if depth != 0 {
+			return p.annotate(&DisassembleError{Err: ErrNotComposable, XP: uint64(len(p.Bytes))})
+		}
+	}
+	it := p.Instructions()
+	for it.Next() {
+		if it.Op().Code != OpEND {
+			continue
+		}
+		if depth, found := depths[it.XP()]; found && depth != 0 {
+			return p.annotate(&DisassembleError{Err: ErrNotComposable, XP: it.XP()})
+		}
+	}
+	return it.Err()
+}
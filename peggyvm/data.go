@@ -92,6 +92,13 @@ var opMeta = []OpMeta{
 		Imm2: none(),
 		Name: "JMP",
 	},
+	OpMeta{
+		Code: OpDFAB,
+		Imm0: required(ImmDFAIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "DFAB",
+	},
 	OpMeta{
 		Code: OpCALL,
 		Imm0: required(ImmCodeOffset),
@@ -190,6 +197,181 @@ var opMeta = []OpMeta{
 		Imm2: none(),
 		Name: "ECAP",
 	},
+	OpMeta{
+		Code: OpDISPATCH,
+		Imm0: required(ImmJumpTableIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "DISPATCH",
+	},
+	OpMeta{
+		Code: OpRANYB,
+		Imm0: optional(ImmCount, 1),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "RANYB",
+	},
+	OpMeta{
+		Code: OpRSAMEB,
+		Imm0: required(ImmByte),
+		Imm1: optional(ImmCount, 1),
+		Imm2: none(),
+		Name: "RSAMEB",
+	},
+	OpMeta{
+		Code: OpRLITB,
+		Imm0: required(ImmLiteralIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "RLITB",
+	},
+	OpMeta{
+		Code: OpRMATCHB,
+		Imm0: required(ImmMatcherIdx),
+		Imm1: optional(ImmCount, 1),
+		Imm2: none(),
+		Name: "RMATCHB",
+	},
+	OpMeta{
+		Code: OpRSPANB,
+		Imm0: required(ImmMatcherIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "RSPANB",
+	},
+	OpMeta{
+		Code: OpPRED,
+		Imm0: required(ImmPredicateIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "PRED",
+	},
+	OpMeta{
+		Code: OpVCAP,
+		Imm0: required(ImmCaptureIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "VCAP",
+	},
+	OpMeta{
+		Code: OpVFOLD,
+		Imm0: required(ImmFolderIdx),
+		Imm1: optional(ImmCount, 2),
+		Imm2: none(),
+		Name: "VFOLD",
+	},
+	OpMeta{
+		Code: OpEOI,
+		Imm0: none(),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "EOI",
+	},
+	OpMeta{
+		Code: OpWORDB,
+		Imm0: required(ImmMatcherIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "WORDB",
+	},
+	OpMeta{
+		Code: OpBALB,
+		Imm0: required(ImmByte),
+		Imm1: required(ImmByte),
+		Imm2: none(),
+		Name: "BALB",
+	},
+	OpMeta{
+		Code: OpDCOMMIT,
+		Imm0: required(ImmCodeOffset),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "DCOMMIT",
+	},
+	OpMeta{
+		Code: OpANYR,
+		Imm0: none(),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "ANYR",
+	},
+	OpMeta{
+		Code: OpSAMER,
+		Imm0: required(ImmRune),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "SAMER",
+	},
+	OpMeta{
+		Code: OpMATCHR,
+		Imm0: required(ImmRuneSetIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "MATCHR",
+	},
+	OpMeta{
+		Code: OpSPANR,
+		Imm0: required(ImmRuneSetIdx),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "SPANR",
+	},
+	OpMeta{
+		Code: OpTMATCHR,
+		Imm0: required(ImmCodeOffset),
+		Imm1: required(ImmRuneSetIdx),
+		Imm2: none(),
+		Name: "TMATCHR",
+	},
+	OpMeta{
+		Code: OpFSAMER,
+		Imm0: required(ImmRune),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "FSAMER",
+	},
+	OpMeta{
+		Code: OpTSPANB,
+		Imm0: required(ImmCodeOffset),
+		Imm1: required(ImmMatcherIdx),
+		Imm2: none(),
+		Name: "TSPANB",
+	},
+	OpMeta{
+		Code: OpMEMOGET,
+		Imm0: required(ImmCodeOffset),
+		Imm1: required(ImmUint),
+		Imm2: none(),
+		Name: "MEMOGET",
+	},
+	OpMeta{
+		Code: OpMEMOSET,
+		Imm0: required(ImmUint),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "MEMOSET",
+	},
+	OpMeta{
+		Code: OpTHROW,
+		Imm0: required(ImmUint),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "THROW",
+	},
+	OpMeta{
+		Code: OpRECOVER,
+		Imm0: required(ImmCodeOffset),
+		Imm1: required(ImmUint),
+		Imm2: none(),
+		Name: "RECOVER",
+	},
+	OpMeta{
+		Code: OpBEHINDB,
+		Imm0: required(ImmCodeOffset),
+		Imm1: required(ImmCount),
+		Imm2: none(),
+		Name: "BEHINDB",
+	},
 	OpMeta{
 		Code: OpGIVEUP,
 		Imm0: none(),
@@ -206,6 +388,14 @@ var opMeta = []OpMeta{
 	},
 }
 
+// opJumps is true for each built-in opcode whose Imm0 is a code offset, so
+// that Step can check the offset before following it.
+var opJumps [256]bool
+
 func init() {
 	assert(sort.IsSorted(byCode(opMeta)), "IsSorted(byCode(opMeta))")
+	for _, meta := range opMeta {
+		assert(meta.Code < MinExtOpCode || meta.Code > MaxExtOpCode, "%s (%#02x) is in the extension range", meta.Name, uint8(meta.Code))
+		opJumps[meta.Code] = (meta.Imm0.Type == ImmCodeOffset)
+	}
 }
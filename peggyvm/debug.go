@@ -0,0 +1,64 @@
+package peggyvm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SourcePos identifies where an instruction came from: a line of a source
+// file, a grammar rule, or both. The zero value means "unknown".
+type SourcePos struct {
+	File string
+	Line uint
+	Rule string
+}
+
+// IsZero returns true iff pos carries no information.
+func (pos SourcePos) IsZero() bool {
+	return pos == SourcePos{}
+}
+
+func (pos SourcePos) String() string {
+	var where string
+	switch {
+	case pos.File != "" && pos.Line != 0:
+		where = fmt.Sprintf("%s:%d", pos.File, pos.Line)
+	case pos.File != "":
+		where = pos.File
+	case pos.Line != 0:
+		where = fmt.Sprintf("line %d", pos.Line)
+	}
+	switch {
+	case where == "":
+		return pos.Rule
+	case pos.Rule == "":
+		return where
+	default:
+		return fmt.Sprintf("%s (%s)", where, pos.Rule)
+	}
+}
+
+// DebugEntry records the source position of the instruction at XP.
+type DebugEntry struct {
+	XP  uint64
+	Pos SourcePos
+}
+
+// SourcePos returns the source position recorded for the instruction that
+// starts at xp, if any.
+func (p *Program) SourcePos(xp uint64) (SourcePos, bool) {
+	i := sort.Search(len(p.Debug), func(i int) bool {
+		return p.Debug[i].XP >= xp
+	})
+	if i < len(p.Debug) && p.Debug[i].XP == xp {
+		return p.Debug[i].Pos, true
+	}
+	return SourcePos{}, false
+}
+
+// SetSourcePos sets the source position to record for the instructions
+// emitted from now on, until the next call. Pass the zero SourcePos to stop
+// recording positions.
+func (a *Assembler) SetSourcePos(pos SourcePos) {
+	a.pos = pos
+}
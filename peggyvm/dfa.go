@@ -0,0 +1,354 @@
+package peggyvm
+
+import (
+	"encoding"
+)
+
+// DFA is a deterministic finite automaton that matches a regular pattern in a
+// single forward pass over the input, without backtracking. It is run by the
+// DFAB instruction.
+//
+// Each byte of input moves the DFA from one state to the next, along the edge
+// for the byte's class. Ordered choice and lookahead can make the end of a
+// match depend on input that lies beyond it, so a DFA also has a few
+// registers, each of which holds an earlier input position. An edge that
+// enters a state says how to fill that state's registers, and an edge that
+// accepts says which of them holds the end of the match.
+//
+type DFA struct {
+	// Classes maps each byte to its class. Bytes in the same class follow
+	// the same edge in every state.
+	Classes [256]uint8
+
+	// NumClasses is the number of classes. Every value in Classes must be
+	// less than it.
+	NumClasses int
+
+	// NumRegs is the number of registers, at most MaxDFARegs.
+	NumRegs int
+
+	// States lists the states. Matching begins in state 0, with every
+	// register holding the starting position.
+	States []DFAState
+}
+
+// DFAState is a single state of a DFA.
+type DFAState struct {
+	// Next holds the edge to follow for each class of byte.
+	Next []DFAEdge
+
+	// EOF is the edge to follow at the end of the input. Its Target must
+	// be DFAFail or DFAAccept.
+	EOF DFAEdge
+}
+
+// DFAEdge is a transition between the states of a DFA.
+type DFAEdge struct {
+	// Target is the index of the next state, or DFAFail or DFAAccept.
+	Target int
+
+	// Regs lists, for each register of the next state, the register of
+	// this state whose value it takes, or DFANow for the position after
+	// the byte that the edge consumes. It is empty unless Target is a
+	// state.
+	Regs []int
+
+	// End is the register that holds the end of the match, or DFANow. It
+	// is only used if Target is DFAAccept.
+	End int
+}
+
+const (
+	// DFAFail is the DFAEdge.Target that ends the match in failure.
+	DFAFail = -1
+
+	// DFAAccept is the DFAEdge.Target that ends the match in success.
+	DFAAccept = -2
+
+	// DFANow stands for the current input position in DFAEdge.Regs and
+	// DFAEdge.End. After a byte, that is the position just past it; at
+	// the end of the input, it is the end of the input.
+	DFANow = -1
+
+	// MaxDFARegs is the largest number of registers that a DFA may have.
+	MaxDFARegs = 8
+)
+
+var (
+	_ encoding.BinaryMarshaler   = (*DFA)(nil)
+	_ encoding.BinaryUnmarshaler = (*DFA)(nil)
+)
+
+// Match runs the DFA over input, starting at position dp. It returns the
+// position at which the match ends, and whether there is a match at all. The
+// DFA must be valid.
+func (d *DFA) Match(input []byte, dp uint64) (uint64, bool) {
+	end, ok, _ := d.match(input, nil, dp)
+	return end, ok
+}
+
+// match is Match, but reads from in instead if it is not nil, and also
+// returns true if the DFA reached the end of the input, so that the outcome
+// might differ if there were more.
+func (d *DFA) match(input []byte, in Input, dp uint64) (uint64, bool, bool) {
+	var regs, next [MaxDFARegs]uint64
+	for i := 0; i < d.NumRegs; i++ {
+		regs[i] = dp
+	}
+	n := uint64(len(input))
+	if in != nil {
+		n = in.Len()
+	}
+	state := &d.States[0]
+	atEOF := false
+	for {
+		edge := &state.EOF
+		if dp < n {
+			var b byte
+			if in != nil {
+				b = in.ByteAt(dp)
+			} else {
+				b = input[dp]
+			}
+			edge = &state.Next[d.Classes[b]]
+			dp++
+		} else {
+			atEOF = true
+		}
+		switch edge.Target {
+		case DFAFail:
+			return 0, false, atEOF
+		case DFAAccept:
+			if edge.End == DFANow {
+				return dp, true, atEOF
+			}
+			return regs[edge.End], true, atEOF
+		}
+		for i, src := range edge.Regs {
+			if src == DFANow {
+				next[i] = dp
+			} else {
+				next[i] = regs[src]
+			}
+		}
+		regs = next
+		state = &d.States[edge.Target]
+	}
+}
+
+// Validate returns ErrBadDFA unless every class, state index, and register
+// index is in range, and every state has an edge for every class. A valid DFA
+// always halts.
+func (d *DFA) Validate() error {
+	if d.NumClasses < 1 || d.NumClasses > 256 {
+		return ErrBadDFA
+	}
+	if d.NumRegs < 0 || d.NumRegs > MaxDFARegs || len(d.States) == 0 {
+		return ErrBadDFA
+	}
+	for _, class := range d.Classes {
+		if int(class) >= d.NumClasses {
+			return ErrBadDFA
+		}
+	}
+	checkReg := func(reg int) bool {
+		return reg >= DFANow && reg < d.NumRegs
+	}
+	checkEdge := func(edge *DFAEdge, eof bool) bool {
+		switch {
+		case edge.Target == DFAFail:
+			return len(edge.Regs) == 0
+		case edge.Target == DFAAccept:
+			return len(edge.Regs) == 0 && checkReg(edge.End)
+		case eof || edge.Target < 0 || edge.Target >= len(d.States):
+			return false
+		}
+		if len(edge.Regs) != d.NumRegs {
+			return false
+		}
+		for _, src := range edge.Regs {
+			if !checkReg(src) {
+				return false
+			}
+		}
+		return true
+	}
+	for i := range d.States {
+		state := &d.States[i]
+		if len(state.Next) != d.NumClasses || !checkEdge(&state.EOF, true) {
+			return ErrBadDFA
+		}
+		for j := range state.Next {
+			if !checkEdge(&state.Next[j], false) {
+				return ErrBadDFA
+			}
+		}
+	}
+	return nil
+}
+
+// MayMatchEmpty returns true if the DFA may succeed without consuming any
+// input.
+func (d *DFA) MayMatchEmpty() bool {
+	// start[i][r] is true if register r may hold the starting position
+	// when the DFA is in state i.
+	start := make([][]bool, len(d.States))
+	for i := range start {
+		start[i] = make([]bool, d.NumRegs)
+	}
+	for r := range start[0] {
+		start[0][r] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := range d.States {
+			for _, edge := range d.States[i].Next {
+				if edge.Target < 0 {
+					continue
+				}
+				for r, src := range edge.Regs {
+					if src != DFANow && start[i][src] && !start[edge.Target][r] {
+						start[edge.Target][r] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	if eof := d.States[0].EOF; eof.Target == DFAAccept && eof.End == DFANow {
+		return true
+	}
+	for i := range d.States {
+		accepts := func(edge *DFAEdge) bool {
+			return edge.Target == DFAAccept && edge.End != DFANow && start[i][edge.End]
+		}
+		state := &d.States[i]
+		if accepts(&state.EOF) {
+			return true
+		}
+		for j := range state.Next {
+			if accepts(&state.Next[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// firstBytes returns a bitmap, as in byteSetKey, of the bytes that do not make
+// the DFA fail at once.
+func (d *DFA) firstBytes() [32]byte {
+	var key [32]byte
+	for b := 0; b < 256; b++ {
+		if d.States[0].Next[d.Classes[b]].Target != DFAFail {
+			key[b>>3] |= 1 << (uint(b) & 7)
+		}
+	}
+	return key
+}
+
+// MarshalBinary encodes the DFA. The encoding is the number of registers, the
+// number of classes, the class of each byte, and the number of states, each
+// as a uvarint; then, for each state, its edges, with the EOF edge last. Each
+// edge is a uvarint that is 0 for DFAFail, 1 for DFAAccept, and 2+N for state
+// N, followed by the register sources (End for DFAAccept, Regs for a state),
+// each plus one so that DFANow is written as 0.
+//
+func (d *DFA) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.uint(uint64(d.NumRegs))
+	e.uint(uint64(d.NumClasses))
+	e.buf.Write(d.Classes[:])
+	e.uint(uint64(len(d.States)))
+	edge := func(edge *DFAEdge) {
+		switch edge.Target {
+		case DFAFail:
+			e.uint(0)
+		case DFAAccept:
+			e.uint(1)
+			e.uint(uint64(edge.End + 1))
+		default:
+			e.uint(uint64(edge.Target + 2))
+			for _, src := range edge.Regs {
+				e.uint(uint64(src + 1))
+			}
+		}
+	}
+	for i := range d.States {
+		state := &d.States[i]
+		for j := range state.Next {
+			edge(&state.Next[j])
+		}
+		edge(&state.EOF)
+	}
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a DFA written by MarshalBinary, replacing the
+// contents of d. It returns ErrBadEncoding if data cannot be decoded, and
+// ErrBadDFA if the result fails Validate.
+func (d *DFA) UnmarshalBinary(data []byte) error {
+	dec := &binaryDecoder{data: data}
+	var q DFA
+	numRegs := dec.uint()
+	numClasses := dec.uint()
+	if numRegs > MaxDFARegs || numClasses > 256 || len(dec.data) < len(q.Classes) {
+		return ErrBadEncoding
+	}
+	q.NumRegs = int(numRegs)
+	q.NumClasses = int(numClasses)
+	copy(q.Classes[:], dec.data)
+	dec.data = dec.data[len(q.Classes):]
+	// Each state takes at least one byte per edge.
+	numStates := dec.uint()
+	if numStates > uint64(len(dec.data))/uint64(q.NumClasses+1) {
+		return ErrBadEncoding
+	}
+	reg := func() int {
+		return int(dec.uint()) - 1
+	}
+	edge := func(edge *DFAEdge) {
+		switch tag := dec.uint(); tag {
+		case 0:
+			edge.Target = DFAFail
+		case 1:
+			edge.Target = DFAAccept
+			edge.End = reg()
+		default:
+			if tag-2 >= numStates {
+				dec.fail()
+				return
+			}
+			edge.Target = int(tag - 2)
+			edge.Regs = make([]int, q.NumRegs)
+			for i := range edge.Regs {
+				edge.Regs[i] = reg()
+			}
+		}
+	}
+	q.States = make([]DFAState, numStates)
+	for i := range q.States {
+		state := &q.States[i]
+		state.Next = make([]DFAEdge, q.NumClasses)
+		for j := range state.Next {
+			edge(&state.Next[j])
+		}
+		edge(&state.EOF)
+	}
+	if dec.bad || len(dec.data) != 0 {
+		return ErrBadEncoding
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	*d = q
+	return nil
+}
+
+// dfaKey returns the encoding of d. Two DFAs are interchangeable iff their
+// keys are equal.
+func dfaKey(d *DFA) string {
+	raw, _ := d.MarshalBinary()
+	return string(raw)
+}
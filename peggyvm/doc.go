@@ -62,29 +62,29 @@
 //
 // The opcodes are organized in the following fashion:
 //
-//   +------+---------+---------+---------+---------+
-//   |      | 00      | 01      | 10      | 11      |
-//   +------+---------+---------+---------+---------+
-//   | 0000 | NOP     | CHOICE  | COMMIT  | FAIL    |
-//   | 0001 | ANYB    | SAMEB   | LITB    | MATCHB  |
-//   | 0010 | JMP     | -       | CALL    | RET     |
-//   | 0011 | TANYB   | TSAMEB  | TLITB   | TMATCHB |
-//   +------+---------+---------+---------+---------+
-//   | 0100 | PCOMMIT | BCOMMIT | SPANB   | FAIL2X  |
-//   | 0101 | RWNDB   | FCAP    | BCAP    | ECAP    |
-//   | 0110 | -       | -       | -       | -       |
-//   | 0111 | -       | -       | -       | -       |
-//   +------+---------+---------+---------+---------+
-//   | 1000 | -       | -       | -       | -       |
-//   | 1001 | -       | -       | -       | -       |
-//   | 1010 | -       | -       | -       | -       |
-//   | 1011 | -       | -       | -       | -       |
-//   +------+---------+---------+---------+---------+
-//   | 1100 | -       | -       | -       | -       |
-//   | 1101 | -       | -       | -       | -       |
-//   | 1110 | -       | -       | -       | -       |
-//   | 1111 | -       | -       | GIVEUP  | END     |
-//   +------+---------+---------+---------+---------+
+//   +------+----------+----------+----------+----------+
+//   |      | 00       | 01       | 10       | 11       |
+//   +------+----------+----------+----------+----------+
+//   | 0000 | NOP      | CHOICE   | COMMIT   | FAIL     |
+//   | 0001 | ANYB     | SAMEB    | LITB     | MATCHB   |
+//   | 0010 | JMP      | DFAB     | CALL     | RET      |
+//   | 0011 | TANYB    | TSAMEB   | TLITB    | TMATCHB  |
+//   +------+----------+----------+----------+----------+
+//   | 0100 | PCOMMIT  | BCOMMIT  | SPANB    | FAIL2X   |
+//   | 0101 | RWNDB    | FCAP     | BCAP     | ECAP     |
+//   | 0110 | DISPATCH | RANYB    | RSAMEB   | RLITB    |
+//   | 0111 | RMATCHB  | RSPANB   | PRED     | VCAP     |
+//   +------+----------+----------+----------+----------+
+//   | 1000 | VFOLD    | EOI      | WORDB    | BALB     |
+//   | 1001 | DCOMMIT  | ANYR     | SAMER    | MATCHR   |
+//   | 1010 | SPANR    | TMATCHR  | FSAMER   | TSPANB   |
+//   | 1011 | MEMOGET  | MEMOSET  | THROW    | RECOVER  |
+//   +------+----------+----------+----------+----------+
+//   | 1100 | BEHINDB  | -        | -        | -        |
+//   | 1101 | -        | -        | -        | -        |
+//   | 1110 | -        | -        | -        | -        |
+//   | 1111 | -        | -        | GIVEUP   | END      |
+//   +------+----------+----------+----------+----------+
 //
 //   (Left: bits 5-4-3-2; top: bits 1-0.)
 //
@@ -104,12 +104,14 @@
 //
 //   altDP := exec.DP
 //   altXP := exec.XP + imm0
-//   altKS := exec.KS
+//   altKSLen := exec.KS.len()
+//   altVSLen := exec.VS.len()
 //   exec.CS.push({
 //     IsChoice: true,
 //     DP:       altDP,
 //     XP:       altXP,
-//     KS:       altKS,
+//     KSLen:    altKSLen,
+//     VSLen:    altVSLen,
 //   })
 //
 // Sets up an alternative parse: if the current parse fails, the parse state
@@ -121,10 +123,11 @@
 //   imm0: required ImmCodeOffset (signed)
 //
 //   frame, ok := exec.CS.pop()
-//   assert(ok && frame.IsChoice)
+//   assert(ok && (frame.IsChoice || frame.Recover))
 //   exec.XP += imm0
 //
-// Commits to the current parse & jumps to imm0.
+// Commits to the current parse & jumps to imm0. Also pops the frame pushed
+// by RECOVER.
 //
 // • FAIL (0x03)
 //
@@ -142,12 +145,14 @@
 //   if ok {
 //     exec.DP = frame.DP
 //     exec.XP = frame.XP
-//     exec.KS = frame.KS
+//     exec.KS.truncate(frame.KSLen)
+//     exec.VS.truncate(frame.VSLen)
 //   } else {
 //     giveUp()
 //   }
 //
-// Fails the match, backtracking the data stream and capture stack and jumping
+// Fails the match, backtracking the data stream, capture stack, and value
+// stack and jumping
 // to the saved imm0 of the last CHOICE.
 //
 // • ANYB (0x04)
@@ -250,6 +255,25 @@
 //
 // Unconditionally jumps to imm0.
 //
+// • DFAB (0x09)
+//
+//   DFAB imm0
+//   imm0: required ImmDFAIdx
+//
+//   dfa := exec.P.DFAs[imm0]
+//   end, good := dfa.Match(exec.I, exec.DP)
+//   if good {
+//     exec.DP = end
+//   } else {
+//     fail()
+//   }
+//
+// Matches a regular sub-pattern in one pass, using the DFA with index imm0.
+// Fails if the DFA rejects the data that follows.
+//
+// Used to replace backtracking over sub-patterns that have no captures and
+// no recursion, such as scans for a keyword.
+//
 // • CALL (0x0a)
 //
 //   CALL imm0
@@ -259,7 +283,7 @@
 //     IsChoice: false,
 //     DP:       0,
 //     XP:       exec.XP,
-//     KS:       nil,
+//     KSLen:    0,
 //   })
 //   exec.XP += imm0
 //
@@ -271,10 +295,13 @@
 //
 //   frame, ok := exec.CS.pop()
 //   assert(ok && !frame.IsChoice)
+//   if frame.Behind && exec.DP != frame.DP {
+//     fail()
+//   }
 //   exec.XP = frame.XP
 //
 // Pops a CALL/RET frame, jumping back to the instruction that directly
-// followed the invoking CALL.
+// followed the invoking CALL or BEHINDB.
 //
 // • TANYB (0x0c)
 //
@@ -359,7 +386,8 @@
 //   assert(ok && frame.IsChoice)
 //   frame.DP = exec.DP
 //   frame.XP = exec.XP + imm0
-//   frame.KS = exec.KS
+//   frame.KSLen = exec.KS.len()
+//   frame.VSLen = exec.VS.len()
 //   exec.CS.push(frame)
 //
 // Updates the alternative parse already set up by a previous CHOICE:
@@ -378,9 +406,11 @@
 //   assert(ok && frame.IsChoice)
 //   exec.DP = frame.DP
 //   exec.XP += imm0  // ignore frame.XP
-//   exec.KS = frame.KS
+//   exec.KS.truncate(frame.KSLen)
+//   exec.VS.truncate(frame.VSLen)
 //
-// Backtracks the data stream and capture stack (like a FAIL), but
+// Backtracks the data stream, capture stack, and value stack (like a FAIL),
+// but
 // jumps to BCOMMIT's imm0 (not the CHOICE's imm0).
 //
 // Used to efficiently implement positive lookahead assertions.
@@ -468,6 +498,454 @@
 //
 // Records that the capture with index imm0 ends at this data position.
 //
+// • DISPATCH (0x18)
+//
+//   DISPATCH imm0
+//   imm0: required ImmJumpTableIdx
+//
+//   table := exec.P.JumpTables[imm0]
+//   if exec.DP < len(exec.I) && table.Lookup(exec.I[exec.DP]) is found {
+//     exec.XP = the target found
+//   } else {
+//     fail()
+//   }
+//
+// Jumps to the target that the jump table with index imm0 gives for the byte
+// at the current data position, without consuming it. Fails if there is no
+// such target, or at the end of the data.
+//
+// Used to replace a long chain of CHOICEs between alternatives that each
+// begin with a known byte, such as keywords: only the alternatives that can
+// match the byte are tried.
+//
+// • RANYB (0x19), RSAMEB (0x1a), RLITB (0x1b), RMATCHB (0x1c), RSPANB (0x1d)
+//
+//   RANYB imm0
+//   RSAMEB imm0, imm1
+//   RLITB imm0
+//   RMATCHB imm0, imm1
+//   RSPANB imm0
+//
+//   literal := exec.P.Literals[imm0]
+//   n := len(literal)
+//   if exec.DP >= n && exec.I[exec.DP-n:exec.DP] == literal {
+//     exec.DP -= n
+//   } else {
+//     fail()
+//   }
+//
+// The reverse variants of ANYB, SAMEB, LITB, MATCHB, and SPANB, with the same
+// immediates. Each examines the bytes just before the current data position
+// instead of those just after it, and moves DP backward over them; the
+// pseudocode above is for RLITB. RSPANB stops at the start of the data.
+//
+// Used by programs that match backward from the end of the data, such as
+// suffix checks (see Program.MatchReverse), and by lookbehind assertions.
+//
+// • PRED (0x1e)
+//
+//   PRED imm0
+//   imm0: required ImmPredicateIdx
+//
+//   if !exec.P.Predicates()[imm0](exec.I, exec.DP) {
+//     fail()
+//   }
+//
+// Calls the Go callback with index imm0, passing it the data and the current
+// data position, and fails if it returns false. Consumes nothing.
+//
+// Used for context-sensitive checks that a PEG cannot express, such as
+// whether a length field equals the number of bytes that remain.
+//
+// • VCAP (0x1f)
+//
+//   VCAP imm0
+//   imm0: required ImmCaptureIdx
+//
+//   s, e, ok := lastCapture(imm0)
+//   if ok {
+//     exec.VS.push(copy(exec.I[s:e]))
+//   } else {
+//     exec.VS.push(nil)
+//   }
+//
+// Pushes a copy of the bytes last captured by capture imm0, as a []byte, onto
+// the value stack, or nil if that capture has no value.
+//
+// • VFOLD (0x20)
+//
+//   VFOLD imm0, [imm1]
+//   imm0: required ImmFolderIdx
+//   imm1: optional ImmCount (default: 2)
+//
+//   values := exec.VS.pop(imm1)
+//   v, err := exec.P.Folders()[imm0](values)
+//   if err != nil {
+//     halt(err)
+//   }
+//   exec.VS.push(v)
+//
+// Replaces the top imm1 values of the value stack with the result of the Go
+// callback with index imm0. It is an error if fewer than imm1 values are on
+// the stack.
+//
+// Together with VCAP, used to evaluate a grammar as it is parsed, such as a
+// numeric expression; the value left on top of the stack becomes the Value
+// of the Result. Like the captures, the value stack is rewound by FAIL and
+// BCOMMIT, and both instructions do nothing when Execution.MatchOnly is set.
+//
+// • EOI (0x21)
+//
+//   EOI
+//
+//   if exec.DP != exec.I.Len() {
+//     fail()
+//   }
+//
+// Short for "End Of Input". Fails unless no data remains. Consumes nothing.
+//
+// Equivalent to, and used in place of, the negative lookahead "CHOICE L;
+// ANYB; FAIL2X; L:" with which grammars anchor themselves to the end of the
+// data; see Assembler.FuseEOI.
+//
+// • WORDB (0x22)
+//
+//   WORDB imm0
+//   imm0: required ImmMatcherIdx
+//
+//   m := exec.P.ByteSets[imm0]
+//   before := exec.DP > 0 && m.Match(exec.I[exec.DP-1])
+//   after := exec.DP < exec.I.Len() && m.Match(exec.I[exec.DP])
+//   if before == after {
+//     fail()
+//   }
+//
+// Fails unless DP lies on a word boundary, where the byteset.Matcher with
+// index imm0 matches the bytes that make up words: that is, unless exactly
+// one of the bytes on either side of DP is a word byte. The start and end of
+// the data count as non-word bytes. Consumes nothing.
+//
+// Used for the "\b" assertion of patterns ported from regular expressions.
+//
+// • BALB (0x23)
+//
+//   BALB imm0, imm1
+//   imm0: required ImmByte
+//   imm1: required ImmByte
+//
+//   assert(availableBytes() >= 1 && exec.I[exec.DP] == imm0)
+//   depth := 1
+//   for dp := exec.DP + 1; dp < exec.I.Len(); dp++ {
+//     switch exec.I[dp] {
+//     case imm1:
+//       depth--
+//       if depth == 0 {
+//         exec.DP = dp + 1
+//         return
+//       }
+//     case imm0:
+//       depth++
+//     }
+//   }
+//   fail()
+//
+// Matches a balanced run, like LPeg's %b: the byte imm0, then anything in
+// which each imm0 is closed by a later imm1, then the imm1 that closes the
+// first. For instance, "BALB '(', ')'" matches "(a(b)c)" but not "(a(b)c".
+// The nesting is counted in the VM, which is much cheaper than recursing
+// with CALL.
+//
+// • DCOMMIT (0x24)
+//
+//   DCOMMIT imm0
+//   imm0: required ImmCodeOffset (signed)
+//
+//   frame, ok := exec.CS.pop()
+//   assert(ok && frame.IsChoice)
+//   exec.XP += imm0  // ignore frame.XP
+//   exec.KS.truncate(frame.KSLen)
+//   exec.VS.truncate(frame.VSLen)
+//
+// Like COMMIT, but discards the captures and values recorded since the
+// CHOICE, as BCOMMIT does, while keeping the data consumed.
+//
+// Used for speculative sub-parses, such as a lookahead used to disambiguate,
+// whose captures should not appear in the Result.
+//
+// • ANYR (0x25)
+//
+//   ANYR
+//
+//   r, size := utf8.DecodeRune(exec.I[exec.DP:])
+//   if size == 0 || (r == utf8.RuneError && size == 1) {
+//     fail()
+//   }
+//   exec.DP += size
+//
+// Matches one well-formed UTF-8 encoded rune. Fails at the end of the input,
+// and on an invalid encoding: a truncated, overlong, or surrogate sequence,
+// or a stray continuation byte.
+//
+// • SAMER (0x26)
+//
+//   SAMER imm0
+//   imm0: required ImmRune
+//
+//   r, size := utf8.DecodeRune(exec.I[exec.DP:])
+//   if size == 0 || (r == utf8.RuneError && size == 1) || r != imm0 {
+//     fail()
+//   }
+//   exec.DP += size
+//
+// Matches the UTF-8 encoding of the rune imm0.
+//
+// • MATCHR (0x27)
+//
+//   MATCHR imm0
+//   imm0: required ImmRuneSetIdx
+//
+//   r, size := utf8.DecodeRune(exec.I[exec.DP:])
+//   if size == 0 || (r == utf8.RuneError && size == 1) {
+//     fail()
+//   }
+//   if !exec.P.RuneSets[imm0].Match(r) {
+//     fail()
+//   }
+//   exec.DP += size
+//
+// Matches one UTF-8 encoded rune using the runeset.Matcher with index imm0.
+// Fails on an invalid encoding, as ANYR does.
+//
+// • SPANR (0x28)
+//
+//   SPANR imm0
+//   imm0: required ImmRuneSetIdx
+//
+//   matcher := exec.P.RuneSets[imm0]
+//   for {
+//     r, size := utf8.DecodeRune(exec.I[exec.DP:])
+//     if size == 0 || (r == utf8.RuneError && size == 1) { break }
+//     if !matcher.Match(r) { break }
+//     exec.DP += size
+//   }
+//
+// Greedily matches zero or more UTF-8 encoded runes using the
+// runeset.Matcher with index imm0, stopping before an invalid encoding.
+// Always succeeds.
+//
+// • TMATCHR (0x29)
+//
+//   TMATCHR imm0, imm1
+//   imm0: required ImmCodeOffset (signed)
+//   imm1: required ImmRuneSetIdx
+//
+//   r, size := utf8.DecodeRune(exec.I[exec.DP:])
+//   good := size != 0 && !(r == utf8.RuneError && size == 1)
+//   if good && exec.P.RuneSets[imm1].Match(r) {
+//     exec.DP += size
+//   } else {
+//     exec.XP += imm0
+//   }
+//
+// Like MATCHR, but jumps to imm0 instead of failing.
+//
+// • FSAMER (0x2a)
+//
+//   FSAMER imm0
+//   imm0: required ImmRune
+//
+//   r, size := utf8.DecodeRune(exec.I[exec.DP:])
+//   if size == 0 || (r == utf8.RuneError && size == 1) {
+//     fail()
+//   }
+//   if !foldEqual(r, imm0) {
+//     fail()
+//   }
+//   exec.DP += size
+//
+// Like SAMER, but matches any rune equal to imm0 under Unicode simple case
+// folding, as with unicode.SimpleFold. For example, "FSAMER 'k'" matches
+// 'k', 'K', and 'K' (U+212A KELVIN SIGN).
+//
+// To match a rune set case-insensitively, use MATCHR with runeset.Fold.
+//
+// • TSPANB (0x2b)
+//
+//   TSPANB imm0, imm1
+//   imm0: required ImmCodeOffset (signed)
+//   imm1: required ImmMatcherIdx
+//
+//   matcher := exec.P.ByteSets[imm1]
+//   start := exec.DP
+//   for availableBytes() >= 1 {
+//     b := exec.I[exec.DP]
+//     if !matcher.MatchByte(b) { break }
+//     exec.DP += 1
+//   }
+//   if exec.DP == start {
+//     exec.XP += imm0
+//   }
+//
+// Like SPANB, but jumps to imm0 if it matched no bytes at all. "One or more
+// bytes of a set", which would otherwise be MATCHB followed by SPANB, is
+// thus a single instruction that branches to the next alternative:
+//
+//   TSPANB .L1, 0
+//   ... // the rest of this alternative
+//   .L1:
+//   ... // the next alternative
+//
+// • MEMOGET (0x2c)
+//
+//   MEMOGET imm0, imm1
+//   imm0: required ImmCodeOffset (signed)
+//   imm1: required ImmUint
+//
+//   entry, found := exec.memo[(imm1, exec.DP)]
+//   if !found {
+//     exec.CS.push({
+//       Memo:  true,
+//       DP:    exec.DP,
+//       XP:    imm1,
+//       KSLen: exec.KS.len(),
+//       VSLen: exec.VS.len(),
+//     })
+//   } else if !entry.OK {
+//     fail()
+//   } else {
+//     exec.KS.push(entry.Assignments...)
+//     exec.DP += entry.Len
+//     exec.XP += imm0
+//   }
+//
+// Looks up the memoized result of trying the rule with ID imm1 at DP, for
+// packrat parsing. If the rule is known to fail there, fails. If it is known
+// to match, replays the captures it made and the bytes it consumed, then
+// jumps to imm0. Otherwise, pushes a MEMOGET/MEMOSET frame and continues, to
+// try the rule. Should the rule fail, FAIL pops the frame on its way to the
+// next CHOICE/FAIL frame, recording the failure. Memoized rules are used so:
+//
+//   MEMOGET .L0, 7
+//   CALL rule
+//   MEMOSET 7
+//   .L0:
+//
+// The rule IDs are chosen by the compiler. Alternate, Concat, Link, and
+// ProgramSet renumber them, so that the rules of different programs never
+// share results. A rule must not be memoized if what it matches depends on
+// anything but the input from DP onward, such as PRED callbacks with side
+// effects. Left recursion through a memoized rule is not detected, and
+// recurses as it would without MEMOGET.
+//
+// The results are kept for the duration of the Execution, up to the cap of
+// Limits.MaxMemoEntries, beyond which the oldest are forgotten.
+//
+// • MEMOSET (0x2d)
+//
+//   MEMOSET imm0
+//   imm0: required ImmUint
+//
+//   frame, ok := exec.CS.pop()
+//   assert(ok && frame.Memo && frame.XP == imm0)
+//   if exec.VS.len() == frame.VSLen {
+//     exec.memo[(imm0, frame.DP)] = {
+//       OK:          true,
+//       Len:         exec.DP - frame.DP,
+//       Assignments: exec.KS[frame.KSLen:],
+//     }
+//   }
+//
+// Pops the frame pushed by MEMOGET for the rule with ID imm0, and records
+// that the rule matched the bytes since, with the captures made since. A
+// match that pushed values onto the value stack is not recorded, as values
+// cannot be replayed.
+//
+// • THROW (0x2e)
+//
+//   THROW imm0
+//   imm0: required ImmUint
+//
+//   for {
+//     frame, ok := exec.CS.pop()
+//     if !ok {
+//       exec.Thrown = {Label: imm0, DP: exec.DP}
+//       giveup()
+//     }
+//     if frame.Recover && frame.DP == imm0 {
+//       exec.XP = frame.XP  // but not DP
+//       exec.KS.truncate(frame.KSLen)
+//       exec.VS.truncate(frame.VSLen)
+//       break
+//     }
+//   }
+//
+// Fails with the label imm0. Unlike FAIL, it is not caught by CHOICE/FAIL
+// frames, but only by a RECOVER frame for the same label, so an error found
+// deep within the grammar is not masked by the alternatives around it. If
+// no RECOVER frame catches it, the match fails, and Result.Thrown reports
+// the label and the position at which it was thrown. The meaning of each
+// label, such as "expected ')'", is up to the compiler.
+//
+// • RECOVER (0x2f)
+//
+//   RECOVER imm0, imm1
+//   imm0: required ImmCodeOffset (signed)
+//   imm1: required ImmUint
+//
+//   exec.CS.push({
+//     Recover: true,
+//     DP:      imm1,  // the label, not a position
+//     XP:      exec.XP + imm0,
+//     KSLen:   exec.KS.len(),
+//     VSLen:   exec.VS.len(),
+//   })
+//
+// Sets up a recovery handler at imm0 for the label imm1, until the matching
+// COMMIT pops the frame. If the label is thrown meanwhile, the captures and
+// values recorded since are discarded, and execution resumes at imm0 from
+// the position at which the label was thrown, so that the handler can skip
+// past the error and let the parse continue. Ordinary failures pass the
+// frame by, as they do a CALL/RET frame:
+//
+//   RECOVER .L0, 1
+//   CALL statement  // may THROW 1
+//   COMMIT .L1
+//   .L0:
+//   ... // skip to the next ';'
+//   .L1:
+//
+// • BEHINDB (0x30)
+//
+//   BEHINDB imm0, imm1
+//   imm0: required ImmCodeOffset (signed)
+//   imm1: required ImmCount
+//
+//   if exec.DP < imm1 {
+//     fail()
+//   }
+//   exec.CS.push({
+//     IsChoice: false,
+//     Behind:   true,
+//     DP:       exec.DP,
+//     XP:       exec.XP,
+//   })
+//   exec.DP -= imm1
+//   exec.XP += imm0
+//
+// Fixed-width lookbehind. Calls the subroutine at imm0, as CALL does, but
+// with DP moved back by imm1 bytes; the RET that returns from it fails
+// unless DP is back where BEHINDB found it. Thus it succeeds, without
+// consuming anything, iff the imm1 bytes before DP match the subroutine.
+// Fails, rather than erring as RWNDB would, if there are fewer than imm1
+// bytes before DP. Captures made by the subroutine are kept.
+//
+// A negative lookbehind wraps it as a negative lookahead would be:
+//
+//   CHOICE .L0
+//   BEHINDB behind, 3
+//   FAIL2X
+//   .L0:
+//
 // • GIVEUP (0x3e)
 //
 //   GIVEUP
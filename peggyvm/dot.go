@@ -0,0 +1,98 @@
+package peggyvm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteDot renders the program's control-flow graph in the Graphviz DOT
+// language, writing the result to the provided writer.
+//
+// Each basic block becomes a node, headed by the names of its labels (if any)
+// and listing its instructions. Edges to failure targets, as saved by CHOICE
+// and PCOMMIT, are dashed; edges into subroutines are bold. Reaching the end
+// of the code is drawn as a separate "end" node.
+//
+// For example, to render a program as an SVG image:
+//
+//   dot -Tsvg -o program.svg program.dot
+//
+func (p *Program) WriteDot(w io.Writer) (int, error) {
+	g, err := p.CFG()
+	if err != nil {
+		return 0, err
+	}
+
+	labelsAt := make(map[uint64][]string, len(p.Labels))
+	for _, label := range p.Labels {
+		labelsAt[label.Offset] = append(labelsAt[label.Offset], label.Name)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("digraph program {\n")
+	buf.WriteString("\tnode [shape=box, fontname=\"monospace\"];\n")
+
+	var line bytes.Buffer
+	needEnd := false
+	for _, block := range g.Blocks {
+		var text bytes.Buffer
+		for _, name := range labelsAt[block.Start] {
+			text.WriteString(name)
+			text.WriteString(":\n")
+		}
+		for i := range block.Ops {
+			op := &block.Ops[i]
+			line.Reset()
+			p.writeOp(&line, op, op.XP+uint64(op.Len))
+			fmt.Fprintf(&text, "%03x  %s\n", op.XP, line.String())
+		}
+		fmt.Fprintf(&buf, "\tx%x [label=\"%s\"];\n", block.Start, dotEscape(text.String()))
+
+		for _, edge := range block.Succs {
+			to := fmt.Sprintf("x%x", edge.XP)
+			if g.BlockAt(edge.XP) == nil {
+				to = "end"
+				needEnd = true
+			}
+			var attrs string
+			switch edge.Kind {
+			case EdgeFailure:
+				attrs = " [style=dashed]"
+			case EdgeCall:
+				attrs = " [style=bold]"
+			}
+			fmt.Fprintf(&buf, "\tx%x -> %s%s;\n", block.Start, to, attrs)
+		}
+	}
+	if len(g.Blocks) == 0 {
+		needEnd = true
+	}
+	if needEnd {
+		buf.WriteString("\tend [shape=doublecircle, label=\"end\"];\n")
+	}
+	buf.WriteString("}\n")
+
+	return w.Write(buf.Bytes())
+}
+
+// dotEscape quotes text for use in a DOT string, with each line of the text
+// left-justified.
+func dotEscape(text string) string {
+	text = strings.TrimSuffix(text, "\n")
+	var buf bytes.Buffer
+	for _, ch := range text {
+		switch ch {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(ch)
+		case '\n':
+			buf.WriteString("\\l")
+		default:
+			buf.WriteRune(ch)
+		}
+	}
+	buf.WriteString("\\l")
+	return buf.String()
+}
@@ -0,0 +1,151 @@
+package peggyvm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	// stringOps is the number of instructions shown by Program.String.
+	stringOps = 4
+
+	// dumpOps is the number of instructions shown by Program.DumpTo.
+	dumpOps = 16
+)
+
+// String summarizes the program on a single line, for logging. For example:
+//
+//   Program{size=21 literals=1 byteSets=1 captures=2 labels=1 code=[BCAP 0; LITB 0; FCAP 1, 0; SPANB 0; ...]}
+//
+func (p *Program) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Program{size=%d literals=%d byteSets=%d captures=%d labels=%d code=[",
+		len(p.Bytes), len(p.Literals), len(p.ByteSets), len(p.Captures), len(p.Labels))
+	first := true
+	p.firstOps(stringOps, func(xp uint64, text string) {
+		if !first {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(text)
+		first = false
+	}, func() {
+		if !first {
+			buf.WriteString("; ")
+		}
+		buf.WriteString("...")
+	})
+	buf.WriteString("]}")
+	return buf.String()
+}
+
+// DumpTo writes a multi-line summary of the program, for debugging: its size,
+// then each of its literals, byte sets, DFAs and rune sets (if any), captures,
+// labels, and entry points, then its first few instructions. Unlike
+// Disassemble, the output is meant for humans and is not accepted by
+// ParseAssembly.
+func (p *Program) DumpTo(w io.Writer) (int, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Program: %d bytes of code\n", len(p.Bytes))
+
+	fmt.Fprintf(&buf, "literals: %d\n", len(p.Literals))
+	for i, lit := range p.Literals {
+		fmt.Fprintf(&buf, "\t%d\t%q\n", i, lit)
+	}
+
+	fmt.Fprintf(&buf, "byteSets: %d\n", len(p.ByteSets))
+	for i, set := range p.ByteSets {
+		fmt.Fprintf(&buf, "\t%d\t%s\n", i, set.String())
+	}
+
+	if len(p.DFAs) != 0 {
+		fmt.Fprintf(&buf, "dfas: %d\n", len(p.DFAs))
+		for i, dfa := range p.DFAs {
+			fmt.Fprintf(&buf, "\t%d\tstates=%d classes=%d regs=%d\n", i, len(dfa.States), dfa.NumClasses, dfa.NumRegs)
+		}
+	}
+
+	if len(p.RuneSets) != 0 {
+		fmt.Fprintf(&buf, "runeSets: %d\n", len(p.RuneSets))
+		for i, set := range p.RuneSets {
+			fmt.Fprintf(&buf, "\t%d\t%s\n", i, set.String())
+		}
+	}
+
+	if len(p.JumpTables) != 0 {
+		fmt.Fprintf(&buf, "jumpTables: %d\n", len(p.JumpTables))
+		for i, table := range p.JumpTables {
+			fmt.Fprintf(&buf, "\t%d", i)
+			for j, key := range table.Keys {
+				fmt.Fprintf(&buf, " %#02x:%d", key, table.Targets[j])
+			}
+			buf.WriteByte('\n')
+		}
+	}
+
+	fmt.Fprintf(&buf, "captures: %d\n", len(p.Captures))
+	for i, capture := range p.Captures {
+		fmt.Fprintf(&buf, "\t%d", i)
+		if capture.Name != "" {
+			fmt.Fprintf(&buf, "\tname=%q", capture.Name)
+		}
+		if capture.Repeat {
+			buf.WriteString("\trepeat")
+		}
+		if capture.Kind != KindNone {
+			fmt.Fprintf(&buf, "\tkind=%s", capture.Kind)
+		}
+		buf.WriteByte('\n')
+	}
+
+	fmt.Fprintf(&buf, "labels: %d\n", len(p.Labels))
+	for _, label := range p.Labels {
+		fmt.Fprintf(&buf, "\t%03x\t%s", label.Offset, label.Name)
+		if label.Public {
+			buf.WriteString("\tpublic")
+		}
+		buf.WriteByte('\n')
+	}
+
+	fmt.Fprintf(&buf, "entries: %d\n", len(p.Entries))
+	for _, label := range p.Entries {
+		fmt.Fprintf(&buf, "\t%s\n", label.Name)
+	}
+
+	fmt.Fprintf(&buf, "code:\n")
+	p.firstOps(dumpOps, func(xp uint64, text string) {
+		fmt.Fprintf(&buf, "\t%03x\t%s\n", xp, text)
+	}, func() {
+		buf.WriteString("\t...\n")
+	})
+
+	return w.Write(buf.Bytes())
+}
+
+// firstOps calls fn with the code address and text of each of the first n
+// instructions, then calls more if there are further instructions. Code that
+// fails to decode is reported to fn as "<bad-op>", and ends the listing.
+func (p *Program) firstOps(n int, fn func(uint64, string), more func()) {
+	var line bytes.Buffer
+	var op Op
+	var xp uint64
+	for i := 0; ; i++ {
+		err := op.Decode(p.Bytes, xp)
+		if err == io.EOF {
+			return
+		}
+		if i >= n {
+			more()
+			return
+		}
+		if err != nil {
+			fn(xp, "<bad-op>")
+			return
+		}
+		next := xp + uint64(op.Len)
+		line.Reset()
+		p.writeOp(&line, &op, next)
+		fn(xp, line.String())
+		xp = next
+	}
+}
@@ -15,35 +15,96 @@ var (
 	ErrEmptyStack          = errors.New("empty stack")
 	ErrCallRetFrame        = errors.New("encountered CALL/RET stack frame")
 	ErrChoiceFailFrame     = errors.New("encountered CHOICE/FAIL stack frame")
+	ErrMemoFrame           = errors.New("encountered MEMOGET/MEMOSET stack frame")
+	ErrRecoverFrame        = errors.New("encountered RECOVER stack frame")
 	ErrIndexRange          = errors.New("index out of range")
 	ErrCountRange          = errors.New("count out of range")
+	ErrCodeOffsetRange     = errors.New("code offset out of range")
+	ErrNotComposable       = errors.New("program cannot be composed with other programs")
+	ErrUnknownMnemonic     = errors.New("unknown instruction mnemonic")
+	ErrUnknownDirective    = errors.New("unknown directive")
+	ErrBadOperand          = errors.New("malformed operand")
+	ErrOperandCount        = errors.New("wrong number of operands")
+	ErrDuplicateLabel      = errors.New("label defined more than once")
+	ErrUndefinedLabel      = errors.New("label referenced but never defined")
+	ErrUndefinedLiteral    = errors.New("literal name referenced but never declared")
+	ErrUndefinedByteSet    = errors.New("byte set name referenced but never declared")
+	ErrPrivateEntry        = errors.New("entry point label is not public")
+	ErrUnknownEntry        = errors.New("no such entry point")
+	ErrNoChoicePending     = errors.New("no CHOICE frame is pending")
+	ErrChoicePending       = errors.New("RET with a CHOICE frame pending")
+	ErrStackDepth          = errors.New("paths disagree on the number of pending CHOICE frames")
+	ErrMisalignedTarget    = errors.New("code offset does not land on an instruction boundary")
+	ErrBadExpression       = errors.New("malformed constant expression")
+	ErrExprOverflow        = errors.New("constant expression overflows int64")
+	ErrUndefinedConstant   = errors.New("constant referenced but never defined")
+	ErrDuplicateConstant   = errors.New("constant defined more than once")
+	ErrUnbalancedIf        = errors.New("unbalanced %if/%else/%endif")
+	ErrBadEncoding         = errors.New("malformed program encoding")
+	ErrBadVersion          = errors.New("unsupported program encoding version")
+	ErrBadMagic            = errors.New("not a program file")
+	ErrExtOpCodeRange      = errors.New("opcode outside of the extension range")
+	ErrDuplicateOpCode     = errors.New("opcode or mnemonic already in use")
+	ErrBudgetExceeded      = errors.New("step budget exceeded")
+	ErrCanceled            = errors.New("execution canceled")
+	ErrTimeout             = errors.New("time limit exceeded")
+	ErrStackLimit          = errors.New("stack depth limit exceeded")
+	ErrCaptureLimit        = errors.New("capture assignment limit exceeded")
+	ErrCodeSizeLimit       = errors.New("code size limit exceeded")
+	ErrBadDFA              = errors.New("malformed DFA")
+	ErrBadJumpTable        = errors.New("malformed jump table")
 )
 
 // DisassembleError is an error encountered during the decoding of a compiled
 // bytecode program. This typically means that corrupt or hostile bytecode is
 // being run.
+//
+// Symbol, if not empty, names XP relative to the program's labels, as
+// returned by Program.Symbolize. The same is true of VerifyError and
+// RuntimeError.
+//
 type DisassembleError struct {
-	Err error
-	XP  uint64
+	Err    error
+	XP     uint64
+	Symbol string
 }
 
 func (e *DisassembleError) Error() string {
-	return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: disassemble error @ XP %d: %v", e.XP, e.Err)
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: disassemble error @ %s: %v", xpString(e.XP, e.Symbol), e.Err)
+}
+
+// VerifyError is a problem found by Program.VerifyStack, at the instruction
+// starting at XP.
+type VerifyError struct {
+	Err    error
+	XP     uint64
+	Symbol string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: verify error @ %s: %v", xpString(e.XP, e.Symbol), e.Err)
 }
 
 // RuntimeError is an error encountered during the execution of a compiled
 // bytecode program. This typically means that there is a bug in the VM, or
 // that corrupt or hostile bytecode is being run.
+//
+// History holds the last instructions executed, oldest first, if the
+// Execution kept any (see KeepHistory).
+//
 type RuntimeError struct {
-	Err error
-	XP  uint64
-	DP  uint64
-	Op  *Op
+	Err     error
+	XP      uint64
+	Symbol  string
+	DP      uint64
+	Op      *Op
+	Pos     SourcePos
+	History []HistoryEntry
 }
 
 func (e *RuntimeError) Error() string {
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "github.com/chronos-tachyon/peggy/peggyvm: runtime error @ XP %d DP %d: ", e.XP, e.DP)
+	fmt.Fprintf(&buf, "github.com/chronos-tachyon/peggy/peggyvm: runtime error @ %s DP %d: ", xpString(e.XP, e.Symbol), e.DP)
 	if e.Op != nil {
 		meta := e.Op.Meta
 		if meta == nil {
@@ -53,5 +114,44 @@ func (e *RuntimeError) Error() string {
 		buf.WriteString(": ")
 	}
 	buf.WriteString(e.Err.Error())
+	if !e.Pos.IsZero() {
+		fmt.Fprintf(&buf, " (from %s)", e.Pos)
+	}
 	return buf.String()
 }
+
+// xpString formats a code address for an error message.
+func xpString(xp uint64, symbol string) string {
+	if symbol == "" {
+		return fmt.Sprintf("XP %d", xp)
+	}
+	return fmt.Sprintf("XP %d (%s)", xp, symbol)
+}
+
+// LabelError reports a problem with a label, found while finishing assembly.
+// Indices lists the positions within Assembler.List of the items involved:
+// for an undefined label, the ops that refer to it.
+type LabelError struct {
+	Err     error
+	Label   string
+	Indices []uint
+}
+
+func (e *LabelError) Error() string {
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: label %q: %v (items %v)", e.Label, e.Err, e.Indices)
+}
+
+// AssemblyError is an error encountered while parsing assembly text or while
+// resolving names. Line is zero if the error is not tied to a line of text.
+type AssemblyError struct {
+	Err  error
+	Line uint
+	Text string
+}
+
+func (e *AssemblyError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: assembly error: %v: %q", e.Err, e.Text)
+	}
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: assembly error @ line %d: %v: %q", e.Line, e.Err, e.Text)
+}
@@ -0,0 +1,64 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// ExecStats counts the work done by an Execution, to help spot inputs that
+// make a grammar backtrack pathologically, and to see the effect of tuning
+// it. See Execution.KeepStats.
+type ExecStats struct {
+	// Steps is the number of instructions executed.
+	Steps uint64
+
+	// Choices is the number of CHOICE frames pushed.
+	Choices uint64
+
+	// Failures is the number of times the Execution failed, whether by
+	// FAIL or by an instruction that did not match. Backtracks is the
+	// number of those that restored a CHOICE frame, rather than giving up.
+	Failures   uint64
+	Backtracks uint64
+
+	// MaxStackDepth is the greatest length that CS reached.
+	MaxStackDepth uint64
+
+	// MaxAssignments is the greatest length that KS reached.
+	MaxAssignments uint64
+}
+
+func (s ExecStats) String() string {
+	return fmt.Sprintf("steps=%d choices=%d failures=%d backtracks=%d maxstack=%d maxks=%d",
+		s.Steps, s.Choices, s.Failures, s.Backtracks, s.MaxStackDepth, s.MaxAssignments)
+}
+
+// KeepStats makes the Execution count the work that it does, as reported by
+// Stats and Result.Stats. Calling it discards any counts already kept.
+//
+// Exec calls KeepStats if p.KeepStats is true.
+//
+func (x *Execution) KeepStats() {
+	x.stats = &ExecStats{}
+}
+
+// Stats returns the counts kept since KeepStats was called, or nil if it has
+// not been.
+func (x *Execution) Stats() *ExecStats {
+	if x.stats == nil {
+		return nil
+	}
+	s := *x.stats
+	s.Steps = x.Steps
+	s.Backtracks = x.Backtracks
+	return &s
+}
+
+// observeStacks updates the high-water marks of the stacks.
+func (s *ExecStats) observeStacks(x *Execution) {
+	if n := uint64(len(x.CS)); n > s.MaxStackDepth {
+		s.MaxStackDepth = n
+	}
+	if n := uint64(len(x.KS)); n > s.MaxAssignments {
+		s.MaxAssignments = n
+	}
+}
@@ -1,7 +1,10 @@
 package peggyvm
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"time"
 
 	"github.com/chronos-tachyon/go-peggy/byteset"
 )
@@ -32,9 +35,15 @@ type Execution struct {
 	// P is the program to run.
 	P *Program
 
-	// I is the input bytestring on which the match is executing.
+	// I is the input bytestring on which the match is executing. During
+	// MatchReader, it holds only the part of the input read so far that
+	// may still be examined.
 	I []byte
 
+	// In, if not nil, is read instead of I. It is set by ExecInput.
+	// Extension opcode handlers that read I directly will not see it.
+	In Input
+
 	// DP (Data Pointer) is the index into I of the current byte.
 	DP uint64
 
@@ -76,6 +85,71 @@ type Execution struct {
 	CS []Frame
 
 	R ExecutionState
+
+	// Limits caps the resources that the Execution may consume. It is
+	// copied from Program.Limits by Exec, and may be changed before the
+	// first Step.
+	Limits Limits
+
+	// Steps counts the instructions executed so far.
+	Steps uint64
+
+	// Backtracks counts the failures so far that restored a CHOICE
+	// frame.
+	Backtracks uint64
+
+	// Observer, if not nil, is called back as the Execution runs.
+	Observer Observer
+
+	// MatchOnly, if true, skips the bookkeeping that only Result needs, for
+	// callers that want just a yes or no: FCAP, BCAP, and ECAP check their
+	// operands but record nothing in KS, and Expected is not gathered. It
+	// should be set before the first Step. See Program.IsMatch.
+	MatchOnly bool
+
+	// op is the instruction being executed. Step decodes into it, rather than
+	// into a local, so that passing it to the handlers does not allocate.
+	op Op
+
+	// breakpoints holds the addresses at which RunUntilBreak stops. If
+	// atBreak is true, it last stopped at breakXP.
+	breakpoints map[uint64]struct{}
+	atBreak     bool
+	breakXP     uint64
+
+	// history is the ring buffer kept by KeepHistory, of which
+	// history[historyNext] is the oldest entry if historyFull is true.
+	history     []HistoryEntry
+	historyNext int
+	historyFull bool
+
+	// stats, if not nil, holds the counts kept by KeepStats.
+	stats *ExecStats
+
+	// progress, if not nil, is the callback set by SetProgress.
+	progress *progress
+
+	// vs is the value stack of VCAP and VFOLD; see valueEntry.
+	vs []valueEntry
+
+	// memo, if not nil, holds the results of MEMOSET; see memoTable.
+	memo *memoTable
+
+	// thrown, if not nil, is the label whose THROW ended the match.
+	thrown *Thrown
+
+	// expect accumulates what Expected returns.
+	expect expectation
+
+	// stacks is where Exec got the backing arrays of KS and CS, which
+	// release returns to stackPool; it is nil once they have been returned,
+	// or if they did not come from there.
+	stacks *stacks
+
+	// base is the position in the input of I[0], and partial is true if
+	// more input may follow I. Both are used only by MatchReader.
+	base    uint64
+	partial bool
 }
 
 func (x *Execution) popCS() (Frame, bool) {
@@ -89,7 +163,7 @@ func (x *Execution) popCS() (Frame, bool) {
 }
 
 func (x *Execution) availableBytes() uint64 {
-	return uint64(len(x.I)) - x.DP
+	return x.inputEnd() - x.DP
 }
 
 func (x *Execution) matchN(m byteset.Matcher, n uint64) bool {
@@ -97,7 +171,20 @@ func (x *Execution) matchN(m byteset.Matcher, n uint64) bool {
 		return false
 	}
 	for i := uint64(0); i < n; i++ {
-		if !m.Match(x.I[x.DP+i]) {
+		if !m.Match(x.byteAt(x.DP + i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchByteN is matchN for n copies of b, which saves boxing a Matcher.
+func (x *Execution) matchByteN(b byte, n uint64) bool {
+	if x.availableBytes() < n {
+		return false
+	}
+	for i := uint64(0); i < n; i++ {
+		if x.byteAt(x.DP+i) != b {
 			return false
 		}
 	}
@@ -109,8 +196,51 @@ func (x *Execution) matchLit(l []byte) (uint64, bool) {
 	if x.availableBytes() < n {
 		return 0, false
 	}
+	if x.In != nil {
+		return n, bytes.Equal(x.In.Slice(x.DP, x.DP+n), l)
+	}
 	for i := uint64(0); i < n; i++ {
-		if x.I[x.DP+i] != l[i] {
+		if x.I[x.DP-x.base+i] != l[i] {
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// matchBackN is matchN for the n bytes before DP.
+func (x *Execution) matchBackN(m byteset.Matcher, n uint64) bool {
+	if x.DP-x.base < n {
+		return false
+	}
+	for i := x.DP - n; i < x.DP; i++ {
+		if !m.Match(x.byteAt(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBackByteN is matchByteN for the n bytes before DP.
+func (x *Execution) matchBackByteN(b byte, n uint64) bool {
+	if x.DP-x.base < n {
+		return false
+	}
+	for i := x.DP - n; i < x.DP; i++ {
+		if x.byteAt(i) != b {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBackLit is matchLit for the bytes before DP.
+func (x *Execution) matchBackLit(l []byte) (uint64, bool) {
+	n := uint64(len(l))
+	if x.DP-x.base < n {
+		return 0, false
+	}
+	for i := uint64(0); i < n; i++ {
+		if x.byteAt(x.DP-n+i) != l[i] {
 			return 0, false
 		}
 	}
@@ -118,6 +248,12 @@ func (x *Execution) matchLit(l []byte) (uint64, bool) {
 }
 
 func (x *Execution) fail() {
+	if x.Observer != nil {
+		x.Observer.OnFail(x, &x.op)
+	}
+	if x.stats != nil {
+		x.stats.Failures++
+	}
 	for {
 		fr, ok := x.popCS()
 		if !ok {
@@ -125,10 +261,15 @@ func (x *Execution) fail() {
 			x.KS = nil
 			return
 		}
+		if fr.Memo {
+			x.memoize(memoKey{fr.XP, fr.DP}, &memoEntry{ok: false})
+		}
 		if fr.IsChoice {
 			x.DP = fr.DP
 			x.XP = fr.XP
-			x.KS = fr.KS
+			x.KS = x.KS[:fr.KSLen]
+			x.vs = x.vs[:fr.VSLen]
+			x.Backtracks++
 			return
 		}
 	}
@@ -140,8 +281,8 @@ func (x *Execution) Step() error {
 		return ErrExecutionHalted
 	}
 
-	var op Op
-	err := op.Decode(x.P.Bytes, x.XP)
+	op := &x.op
+	err := x.P.fetch(op, x.XP)
 	if err == io.EOF {
 		x.R = SuccessState
 		return nil
@@ -149,237 +290,669 @@ func (x *Execution) Step() error {
 	if err != nil {
 		x.R = ErrorState
 		x.KS = nil
-		return err
+		return x.P.annotate(err)
 	}
 
-	rterr := func(err error) error {
-		x.R = ErrorState
-		x.KS = nil
-		return &RuntimeError{
-			Err: err,
-			XP:  op.XP,
-			DP:  x.DP,
-			Op:  &op,
-		}
+	if x.partial && x.needsInput(op) {
+		return errNeedInput
 	}
 
-	x.XP += uint64(op.Len)
-	switch op.Code {
-	case OpNOP:
-		// pass
+	if x.Limits.MaxSteps != 0 && x.Steps >= x.Limits.MaxSteps {
+		return x.runtimeError(op, ErrBudgetExceeded)
+	}
+	x.Steps++
+	if x.history != nil {
+		x.record(op)
+	}
 
-	case OpCHOICE:
-		x.CS = append(x.CS, Frame{
-			IsChoice: true,
-			DP:       x.DP,
-			XP:       addOffset(x.XP, u2s(op.Imm0)),
-			KS:       x.KS,
-		})
+	if x.Observer != nil {
+		x.Observer.OnStep(x, op)
+	}
 
-	case OpCOMMIT:
-		fr, ok := x.popCS()
-		if !ok {
-			return rterr(ErrEmptyStack)
+	x.XP += uint64(op.Len)
+	if opJumps[op.Code] {
+		if _, ok := tryAddOffset(x.XP, u2s(op.Imm0)); !ok {
+			return x.runtimeError(op, ErrCodeOffsetRange)
 		}
-		if !fr.IsChoice {
-			return rterr(ErrCallRetFrame)
+	}
+	handler := opHandlers[op.Code]
+	if handler == nil {
+		handler = execExt
+	}
+	if err := handler(x, op); err != nil {
+		return x.runtimeError(op, err)
+	}
+	if x.stats != nil {
+		x.stats.observeStacks(x)
+	}
+	if err := x.checkLimits(); err != nil {
+		return x.runtimeError(op, err)
+	}
+	if x.progress != nil {
+		if err := x.progress.check(x); err != nil {
+			return x.runtimeError(op, err)
 		}
-		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
+
+// runtimeError halts the Execution in ErrorState, and returns a RuntimeError
+// for err, which happened while executing op.
+func (x *Execution) runtimeError(op *Op, err error) error {
+	x.R = ErrorState
+	x.KS = nil
+	pos, _ := x.P.SourcePos(op.XP)
+	opCopy := *op
+	return &RuntimeError{
+		Err:     err,
+		XP:      op.XP,
+		Symbol:  x.P.Symbolize(op.XP),
+		DP:      x.DP,
+		Op:      &opCopy,
+		Pos:     pos,
+		History: x.History(),
+	}
+}
+
+// checkLimits returns the error for a limit in x.Limits, other than
+// MaxSteps, that the Execution has exceeded, or nil if none.
+func (x *Execution) checkLimits() error {
+	if x.Limits.MaxBacktracks != 0 && x.Backtracks > x.Limits.MaxBacktracks {
+		return ErrBudgetExceeded
+	}
+	if uint64(len(x.CS)) > x.Limits.stackDepth() {
+		return ErrStackLimit
+	}
+	if uint64(len(x.KS)) > x.Limits.assignments() {
+		return ErrCaptureLimit
+	}
+	return nil
+}
+
+// opHandler executes one instruction, op, after Step has advanced XP past
+// it. A non-nil error is reported by Step as a RuntimeError at op.
+type opHandler func(x *Execution, op *Op) error
+
+// opHandlers maps each built-in opcode to its opHandler. Step calls execExt
+// for the rest, which dispatches to the handlers of the extension opcodes
+// registered with RegisterOpCode.
+var opHandlers = [256]opHandler{
+	OpNOP:      execNOP,
+	OpCHOICE:   execCHOICE,
+	OpCOMMIT:   execCOMMIT,
+	OpFAIL:     execFAIL,
+	OpANYB:     execANYB,
+	OpSAMEB:    execSAMEB,
+	OpLITB:     execLITB,
+	OpMATCHB:   execMATCHB,
+	OpJMP:      execJMP,
+	OpDFAB:     execDFAB,
+	OpCALL:     execCALL,
+	OpRET:      execRET,
+	OpTANYB:    execTANYB,
+	OpTSAMEB:   execTSAMEB,
+	OpTLITB:    execTLITB,
+	OpTMATCHB:  execTMATCHB,
+	OpPCOMMIT:  execPCOMMIT,
+	OpBCOMMIT:  execBCOMMIT,
+	OpSPANB:    execSPANB,
+	OpTSPANB:   execTSPANB,
+	OpMEMOGET:  execMEMOGET,
+	OpMEMOSET:  execMEMOSET,
+	OpTHROW:    execTHROW,
+	OpRECOVER:  execRECOVER,
+	OpBEHINDB:  execBEHINDB,
+	OpFAIL2X:   execFAIL2X,
+	OpRWNDB:    execRWNDB,
+	OpFCAP:     execFCAP,
+	OpBCAP:     execBCAP,
+	OpECAP:     execECAP,
+	OpDISPATCH: execDISPATCH,
+	OpRANYB:    execRANYB,
+	OpRSAMEB:   execRSAMEB,
+	OpRLITB:    execRLITB,
+	OpRMATCHB:  execRMATCHB,
+	OpRSPANB:   execRSPANB,
+	OpPRED:     execPRED,
+	OpVCAP:     execVCAP,
+	OpVFOLD:    execVFOLD,
+	OpEOI:      execEOI,
+	OpWORDB:    execWORDB,
+	OpBALB:     execBALB,
+	OpDCOMMIT:  execDCOMMIT,
+	OpANYR:     execANYR,
+	OpSAMER:    execSAMER,
+	OpFSAMER:   execFSAMER,
+	OpMATCHR:   execMATCHR,
+	OpSPANR:    execSPANR,
+	OpTMATCHR:  execTMATCHR,
+	OpGIVEUP:   execGIVEUP,
+	OpEND:      execEND,
+}
+
+func execNOP(x *Execution, op *Op) error {
+	return nil
+}
 
-	case OpFAIL:
+func execCHOICE(x *Execution, op *Op) error {
+	x.CS = append(x.CS, Frame{
+		IsChoice: true,
+		DP:       x.DP,
+		XP:       addOffset(x.XP, u2s(op.Imm0)),
+		KSLen:    uint64(len(x.KS)),
+		VSLen:    uint64(len(x.vs)),
+	})
+	if x.stats != nil {
+		x.stats.Choices++
+	}
+	if x.Observer != nil {
+		x.Observer.OnChoicePush(x, op)
+	}
+	return nil
+}
+
+func execCOMMIT(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if !fr.IsChoice && !fr.Recover {
+		return ErrCallRetFrame
+	}
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	return nil
+}
+
+func execFAIL(x *Execution, op *Op) error {
+	x.fail()
+	return nil
+}
+
+func execANYB(x *Execution, op *Op) error {
+	if x.availableBytes() >= op.Imm0 {
+		x.DP += op.Imm0
+	} else {
 		x.fail()
+	}
+	return nil
+}
 
-	case OpANYB:
-		if x.availableBytes() >= op.Imm0 {
-			x.DP += op.Imm0
-		} else {
-			x.fail()
-		}
+func execSAMEB(x *Execution, op *Op) error {
+	if x.matchByteN(byte(op.Imm0), op.Imm1) {
+		x.DP += op.Imm1
+	} else {
+		x.expectByte(byte(op.Imm0), op.Imm1)
+		x.fail()
+	}
+	return nil
+}
 
-	case OpSAMEB:
-		if x.matchN(byteset.Exactly(byte(op.Imm0)), op.Imm1) {
-			x.DP += op.Imm1
-		} else {
-			x.fail()
-		}
+func execLITB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.Literals)) {
+		return ErrIndexRange
+	}
+	if n, good := x.matchLit(x.P.Literals[op.Imm0]); good {
+		x.DP += n
+	} else {
+		x.expectLiteral(x.P.Literals[op.Imm0])
+		x.fail()
+	}
+	return nil
+}
 
-	case OpLITB:
-		if op.Imm0 >= uint64(len(x.P.Literals)) {
-			return rterr(ErrIndexRange)
-		}
-		if n, good := x.matchLit(x.P.Literals[op.Imm0]); good {
-			x.DP += n
-		} else {
-			x.fail()
-		}
+func execMATCHB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	if x.matchN(x.P.ByteSets[op.Imm0], op.Imm1) {
+		x.DP += op.Imm1
+	} else {
+		x.expectSet(x.P.ByteSets[op.Imm0])
+		x.fail()
+	}
+	return nil
+}
 
-	case OpMATCHB:
-		if op.Imm0 >= uint64(len(x.P.ByteSets)) {
-			return rterr(ErrIndexRange)
-		}
-		if x.matchN(x.P.ByteSets[op.Imm0], op.Imm1) {
-			x.DP += op.Imm1
-		} else {
-			x.fail()
-		}
+func execJMP(x *Execution, op *Op) error {
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	return nil
+}
+
+func execDFAB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.DFAs)) {
+		return ErrIndexRange
+	}
+	if end, good, _ := x.P.DFAs[op.Imm0].match(x.I, x.In, x.DP-x.base); good {
+		x.DP = x.base + end
+	} else {
+		x.fail()
+	}
+	return nil
+}
+
+func execCALL(x *Execution, op *Op) error {
+	x.CS = append(x.CS, Frame{
+		IsChoice: false,
+		XP:       x.XP,
+	})
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	if x.Observer != nil {
+		x.Observer.OnCall(x, op)
+	}
+	return nil
+}
+
+func execBEHINDB(x *Execution, op *Op) error {
+	if x.DP-x.base < op.Imm1 {
+		x.fail()
+		return nil
+	}
+	x.CS = append(x.CS, Frame{
+		Behind: true,
+		DP:     x.DP,
+		XP:     x.XP,
+	})
+	x.DP -= op.Imm1
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	if x.Observer != nil {
+		x.Observer.OnCall(x, op)
+	}
+	return nil
+}
+
+func execRET(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if fr.IsChoice {
+		return ErrChoiceFailFrame
+	}
+	if fr.Memo {
+		return ErrMemoFrame
+	}
+	if fr.Recover {
+		return ErrRecoverFrame
+	}
+	if fr.Behind && x.DP != fr.DP {
+		x.fail()
+		return nil
+	}
+	x.XP = fr.XP
+	return nil
+}
 
-	case OpJMP:
+func execTANYB(x *Execution, op *Op) error {
+	if x.availableBytes() >= op.Imm1 {
+		x.DP += op.Imm1
+	} else {
 		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
 
-	case OpCALL:
-		x.CS = append(x.CS, Frame{
-			IsChoice: false,
-			XP:       x.XP,
-		})
+func execTSAMEB(x *Execution, op *Op) error {
+	if x.matchByteN(byte(op.Imm1), op.Imm2) {
+		x.DP += op.Imm2
+	} else {
+		x.expectByte(byte(op.Imm1), op.Imm2)
 		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
 
-	case OpRET:
-		fr, ok := x.popCS()
-		if !ok {
-			return rterr(ErrEmptyStack)
-		}
-		if !fr.IsChoice {
-			return rterr(ErrChoiceFailFrame)
-		}
-		x.XP = fr.XP
+func execTLITB(x *Execution, op *Op) error {
+	if op.Imm1 >= uint64(len(x.P.Literals)) {
+		return ErrIndexRange
+	}
+	if n, good := x.matchLit(x.P.Literals[op.Imm1]); good {
+		x.DP += n
+	} else {
+		x.expectLiteral(x.P.Literals[op.Imm1])
+		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
 
-	case OpTANYB:
-		if x.availableBytes() >= op.Imm1 {
-			x.DP += op.Imm1
-		} else {
-			x.XP = addOffset(x.XP, u2s(op.Imm0))
-		}
+func execTMATCHB(x *Execution, op *Op) error {
+	if op.Imm1 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	if x.matchN(x.P.ByteSets[op.Imm1], op.Imm2) {
+		x.DP += op.Imm2
+	} else {
+		x.expectSet(x.P.ByteSets[op.Imm1])
+		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
 
-	case OpTSAMEB:
-		if x.matchN(byteset.Exactly(byte(op.Imm1)), op.Imm2) {
-			x.DP += op.Imm2
-		} else {
-			x.XP = addOffset(x.XP, u2s(op.Imm0))
-		}
+func execPCOMMIT(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if !fr.IsChoice {
+		return ErrCallRetFrame
+	}
+	fr.DP = x.DP
+	fr.XP = addOffset(x.XP, u2s(op.Imm0))
+	fr.KSLen = uint64(len(x.KS))
+	fr.VSLen = uint64(len(x.vs))
+	x.CS = append(x.CS, fr)
+	return nil
+}
 
-	case OpTLITB:
-		if op.Imm1 >= uint64(len(x.P.Literals)) {
-			return rterr(ErrIndexRange)
-		}
-		if n, good := x.matchLit(x.P.Literals[op.Imm1]); good {
-			x.DP += n
-		} else {
-			x.XP = addOffset(x.XP, u2s(op.Imm0))
-		}
+func execBCOMMIT(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if !fr.IsChoice {
+		return ErrCallRetFrame
+	}
+	x.DP = fr.DP
+	x.KS = x.KS[:fr.KSLen]
+	x.vs = x.vs[:fr.VSLen]
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	return nil
+}
 
-	case OpTMATCHB:
-		if op.Imm1 >= uint64(len(x.P.ByteSets)) {
-			return rterr(ErrIndexRange)
-		}
-		if x.matchN(x.P.ByteSets[op.Imm1], op.Imm2) {
-			x.DP += op.Imm2
-		} else {
-			x.XP = addOffset(x.XP, u2s(op.Imm0))
-		}
+func execDCOMMIT(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if !fr.IsChoice {
+		return ErrCallRetFrame
+	}
+	x.KS = x.KS[:fr.KSLen]
+	x.vs = x.vs[:fr.VSLen]
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	return nil
+}
 
-	case OpPCOMMIT:
-		fr, ok := x.popCS()
-		if !ok {
-			return rterr(ErrEmptyStack)
-		}
-		if !fr.IsChoice {
-			return rterr(ErrCallRetFrame)
-		}
-		fr.DP = x.DP
-		fr.XP = addOffset(x.XP, u2s(op.Imm0))
-		fr.KS = x.KS
-		x.CS = append(x.CS, fr)
+func execEOI(x *Execution, op *Op) error {
+	if x.DP != x.inputEnd() {
+		x.fail()
+	}
+	return nil
+}
 
-	case OpBCOMMIT:
-		fr, ok := x.popCS()
-		if !ok {
-			return rterr(ErrEmptyStack)
+func execWORDB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	m := x.P.ByteSets[op.Imm0]
+	before := x.DP > 0 && m.Match(x.byteAt(x.DP-1))
+	after := x.DP < x.inputEnd() && m.Match(x.byteAt(x.DP))
+	if before == after {
+		x.fail()
+	}
+	return nil
+}
+
+func execBALB(x *Execution, op *Op) error {
+	if end, good, _ := x.scanBalanced(byte(op.Imm0), byte(op.Imm1)); good {
+		x.DP = end
+	} else {
+		if x.DP >= x.inputEnd() || x.byteAt(x.DP) != byte(op.Imm0) {
+			x.expectByte(byte(op.Imm0), 1)
 		}
-		if !fr.IsChoice {
-			return rterr(ErrCallRetFrame)
+		x.fail()
+	}
+	return nil
+}
+
+// scanBalanced looks for a balanced run at DP: an open byte, then anything
+// in which every open byte is matched by a later close byte, then the close
+// byte that matches the first. It returns the position just past the run.
+// atEOF is true if the input ran out before the run could be ruled in or out.
+func (x *Execution) scanBalanced(open, close byte) (end uint64, good bool, atEOF bool) {
+	n := x.inputEnd()
+	if x.DP >= n {
+		return 0, false, true
+	}
+	if x.byteAt(x.DP) != open {
+		return 0, false, false
+	}
+	depth := uint64(1)
+	for dp := x.DP + 1; dp < n; dp++ {
+		switch x.byteAt(dp) {
+		case close:
+			depth--
+			if depth == 0 {
+				return dp + 1, true, false
+			}
+		case open:
+			depth++
 		}
-		x.DP = fr.DP
-		x.KS = fr.KS
+	}
+	return 0, false, true
+}
+
+func execSPANB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	for m, n := x.P.ByteSets[op.Imm0], x.inputEnd(); x.DP < n && m.Match(x.byteAt(x.DP)); x.DP += 1 {
+		// pass
+	}
+	return nil
+}
+
+func execTSPANB(x *Execution, op *Op) error {
+	if op.Imm1 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	m, start := x.P.ByteSets[op.Imm1], x.DP
+	for n := x.inputEnd(); x.DP < n && m.Match(x.byteAt(x.DP)); x.DP += 1 {
+		// pass
+	}
+	if x.DP == start {
+		x.expectSet(m)
 		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
 
-	case OpSPANB:
-		if op.Imm0 >= uint64(len(x.P.ByteSets)) {
-			return rterr(ErrIndexRange)
-		}
-		for m, n := x.P.ByteSets[op.Imm0], uint64(len(x.I)); x.DP < n && m.Match(x.I[x.DP]); x.DP += 1 {
-			// pass
-		}
+func execFAIL2X(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if !fr.IsChoice {
+		return ErrCallRetFrame
+	}
+	x.fail()
+	return nil
+}
 
-	case OpFAIL2X:
-		fr, ok := x.popCS()
-		if !ok {
-			return rterr(ErrEmptyStack)
-		}
-		if !fr.IsChoice {
-			return rterr(ErrCallRetFrame)
-		}
+func execRWNDB(x *Execution, op *Op) error {
+	if op.Imm0 > x.DP {
+		return ErrCountRange
+	}
+	x.DP -= op.Imm0
+	return nil
+}
+
+func execFCAP(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.Captures)) {
+		return ErrIndexRange
+	}
+	if op.Imm1 > x.DP {
+		return ErrCountRange
+	}
+	if x.MatchOnly {
+		return nil
+	}
+	x.KS = append(x.KS, Assignment{
+		Index: op.Imm0,
+		IsEnd: false,
+		DP:    x.DP - op.Imm1,
+	})
+	x.KS = append(x.KS, Assignment{
+		Index: op.Imm0,
+		IsEnd: true,
+		DP:    x.DP,
+	})
+	if x.Observer != nil {
+		x.Observer.OnCaptureCommit(x, op, x.KS[len(x.KS)-1])
+	}
+	return nil
+}
+
+func execBCAP(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.Captures)) {
+		return ErrIndexRange
+	}
+	if x.MatchOnly {
+		return nil
+	}
+	x.KS = append(x.KS, Assignment{
+		Index: op.Imm0,
+		IsEnd: false,
+		DP:    x.DP,
+	})
+	return nil
+}
+
+func execECAP(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.Captures)) {
+		return ErrIndexRange
+	}
+	if x.MatchOnly {
+		return nil
+	}
+	x.KS = append(x.KS, Assignment{
+		Index: op.Imm0,
+		IsEnd: true,
+		DP:    x.DP,
+	})
+	if x.Observer != nil {
+		x.Observer.OnCaptureCommit(x, op, x.KS[len(x.KS)-1])
+	}
+	return nil
+}
+
+func execDISPATCH(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.JumpTables)) {
+		return ErrIndexRange
+	}
+	if x.availableBytes() == 0 {
 		x.fail()
+		return nil
+	}
+	if target, found := x.P.JumpTables[op.Imm0].Lookup(x.byteAt(x.DP)); found {
+		x.XP = target
+	} else {
+		x.fail()
+	}
+	return nil
+}
 
-	case OpRWNDB:
-		if op.Imm0 > x.DP {
-			return rterr(ErrCountRange)
-		}
+func execRANYB(x *Execution, op *Op) error {
+	if x.DP-x.base >= op.Imm0 {
 		x.DP -= op.Imm0
+	} else {
+		x.fail()
+	}
+	return nil
+}
 
-	case OpFCAP:
-		if op.Imm0 >= uint64(len(x.P.Captures)) {
-			return rterr(ErrIndexRange)
-		}
-		if op.Imm1 > x.DP {
-			return rterr(ErrCountRange)
-		}
-		x.KS = append(x.KS, Assignment{
-			Index: op.Imm0,
-			IsEnd: false,
-			DP:    x.DP - op.Imm1,
-		})
-		x.KS = append(x.KS, Assignment{
-			Index: op.Imm0,
-			IsEnd: true,
-			DP:    x.DP,
-		})
-
-	case OpBCAP:
-		if op.Imm0 >= uint64(len(x.P.Captures)) {
-			return rterr(ErrIndexRange)
+func execRSAMEB(x *Execution, op *Op) error {
+	if x.matchBackByteN(byte(op.Imm0), op.Imm1) {
+		x.DP -= op.Imm1
+	} else {
+		x.fail()
+	}
+	return nil
+}
+
+func execRLITB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.Literals)) {
+		return ErrIndexRange
+	}
+	if n, good := x.matchBackLit(x.P.Literals[op.Imm0]); good {
+		x.DP -= n
+	} else {
+		x.fail()
+	}
+	return nil
+}
+
+func execRMATCHB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	if x.matchBackN(x.P.ByteSets[op.Imm0], op.Imm1) {
+		x.DP -= op.Imm1
+	} else {
+		x.fail()
+	}
+	return nil
+}
+
+func execRSPANB(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.ByteSets)) {
+		return ErrIndexRange
+	}
+	for m := x.P.ByteSets[op.Imm0]; x.DP > x.base && m.Match(x.byteAt(x.DP-1)); x.DP -= 1 {
+		// pass
+	}
+	return nil
+}
+
+func execGIVEUP(x *Execution, op *Op) error {
+	x.R = FailureState
+	x.KS = nil
+	return nil
+}
+
+func execEND(x *Execution, op *Op) error {
+	x.R = SuccessState
+	return nil
+}
+
+// execExt executes an extension opcode, or fails with ErrUnknownOpcode.
+func execExt(x *Execution, op *Op) error {
+	ext := lookupExtOp(op.Code)
+	if ext == nil {
+		return ErrUnknownOpcode
+	}
+	n := len(x.KS)
+	if err := ext.handler(x, op); err != nil {
+		return err
+	}
+	if x.DP > x.inputEnd() {
+		return ErrCountRange
+	}
+	for i := len(x.CS) - 1; i >= 0; i-- {
+		if fr := &x.CS[i]; fr.IsChoice {
+			if fr.KSLen > uint64(len(x.KS)) {
+				return ErrCountRange
+			}
+			break
 		}
-		x.KS = append(x.KS, Assignment{
-			Index: op.Imm0,
-			IsEnd: false,
-			DP:    x.DP,
-		})
-
-	case OpECAP:
-		if op.Imm0 >= uint64(len(x.P.Captures)) {
-			return rterr(ErrIndexRange)
+	}
+	for i := n; i < len(x.KS); i++ {
+		if x.KS[i].Index >= uint64(len(x.P.Captures)) {
+			return ErrIndexRange
 		}
-		x.KS = append(x.KS, Assignment{
-			Index: op.Imm0,
-			IsEnd: true,
-			DP:    x.DP,
-		})
-
-	case OpGIVEUP:
-		x.R = FailureState
-		x.KS = nil
-
-	case OpEND:
-		x.R = SuccessState
 	}
 	return nil
 }
 
 // Run attempts to execute the bytecode program to completion.
 //
-// WARNING: No time limits are enforced, and it's easy to write an infinite
-//          loop. Think carefully before running untrusted bytecode.
+// WARNING: Unless x.Limits says otherwise, no time limits are enforced, and
+//          it's easy to write an infinite loop. Use LoadUntrusted to load
+//          untrusted bytecode, and RunContext to bound the time taken.
 //
 func (x *Execution) Run() error {
+	if j := x.P.jit; j != nil && x.Observer == nil && x.history == nil && !x.partial {
+		return j.run(x)
+	}
 	for x.R == RunningState {
 		err := x.Step()
 		if err != nil {
@@ -388,3 +961,145 @@ func (x *Execution) Run() error {
 	}
 	return nil
 }
+
+// contextCheckInterval is the number of instructions that RunContext and
+// RunTimeout execute between checks of the context or the clock.
+const contextCheckInterval = 1024
+
+// RunContext is like Run, but halts with a RuntimeError wrapping ErrCanceled
+// once ctx is done; ctx.Err() says why. The context is checked before the
+// first instruction and then every contextCheckInterval instructions, so
+// that the check costs little, but even a program that loops forever is
+// stopped promptly.
+//
+func (x *Execution) RunContext(ctx context.Context) error {
+	done := ctx.Done()
+	if done == nil {
+		return x.Run()
+	}
+	for n := 0; x.R == RunningState; n++ {
+		if n%contextCheckInterval == 0 {
+			select {
+			case <-done:
+				return x.halt(ErrCanceled)
+			default:
+			}
+		}
+		err := x.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunTimeout is like Run, but halts with a RuntimeError wrapping ErrTimeout
+// once d has elapsed. As with RunContext, the clock is read before the first
+// instruction and then every contextCheckInterval instructions, rather than
+// watched by another goroutine, so the Execution may run a little past the
+// deadline. If d is not positive, it halts before the first instruction.
+//
+func (x *Execution) RunTimeout(d time.Duration) error {
+	deadline := time.Now().Add(d)
+	for n := 0; x.R == RunningState; n++ {
+		if n%contextCheckInterval == 0 && !time.Now().Before(deadline) {
+			return x.halt(ErrTimeout)
+		}
+		err := x.Step()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// halt halts the Execution, between instructions, with a RuntimeError
+// wrapping err.
+func (x *Execution) halt(err error) error {
+	x.R = ErrorState
+	x.KS = nil
+	pos, _ := x.P.SourcePos(x.XP)
+	return &RuntimeError{
+		Err:     err,
+		XP:      x.XP,
+		Symbol:  x.P.Symbolize(x.XP),
+		DP:      x.DP,
+		Pos:     pos,
+		History: x.History(),
+	}
+}
+
+// Result summarizes the outcome of a terminated Execution, collecting the
+// capture assignments on KS into a Capture for each of the program's
+// captures. If KS assigns to a capture that the program does not declare, as
+// only hostile bytecode or a tampered KS can, the Result reports failure.
+func (x *Execution) Result() Result {
+	var r Result
+	r.Success = (x.R == SuccessState)
+	if r.Success {
+		r.End = x.DP
+		r.Value = x.Value()
+	} else {
+		r.History = x.History()
+		r.Expected = x.Expected()
+		r.Thrown = x.thrown
+	}
+	r.Names = x.P.NamedCaptures
+	r.Stats = x.Stats()
+	r.Captures = make([]Capture, len(x.P.Captures))
+	pending := make([]uint64, len(x.P.Captures))
+	for _, a := range x.KS {
+		if a.Index >= uint64(len(r.Captures)) {
+			return Result{Names: r.Names, Stats: r.Stats}
+		}
+		if a.IsEnd {
+			var pair CapturePair
+			pair.S = pending[a.Index]
+			pair.E = a.DP
+			ptr := &r.Captures[a.Index]
+			ptr.Exists = true
+			ptr.Solo = pair
+			ptr.Multi = append(ptr.Multi, pair)
+			pending[a.Index] = 0
+		} else {
+			pending[a.Index] = a.DP
+		}
+	}
+	return r
+}
+
+// Clone returns a copy of the Execution that can be run independently of x,
+// e.g. to see what happens if it continues from here on different input.
+// CS, KS, the breakpoints, the history, the stats, the memoized results, and
+// the schedule of the SetProgress callback are copied; P, I, In, Observer,
+// and the callback itself are shared. Set them on the copy to change them.
+//
+func (x *Execution) Clone() *Execution {
+	y := *x
+	y.stacks = nil
+	y.KS = append([]Assignment(nil), x.KS...)
+	y.CS = append([]Frame(nil), x.CS...)
+	y.vs = append([]valueEntry(nil), x.vs...)
+	if x.breakpoints != nil {
+		y.breakpoints = make(map[uint64]struct{}, len(x.breakpoints))
+		for xp := range x.breakpoints {
+			y.breakpoints[xp] = struct{}{}
+		}
+	}
+	if x.history != nil {
+		y.history = append([]HistoryEntry(nil), x.history...)
+	}
+	if x.stats != nil {
+		stats := *x.stats
+		y.stats = &stats
+	}
+	if x.memo != nil {
+		y.memo = x.memo.clone()
+	}
+	if x.progress != nil {
+		pr := *x.progress
+		y.progress = &pr
+	}
+	y.expect.literals = append([][]byte(nil), x.expect.literals...)
+	return &y
+}
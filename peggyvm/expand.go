@@ -0,0 +1,94 @@
+package peggyvm
+
+import (
+	"bytes"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expand appends template to dst and returns the result, replacing each
+// reference to a capture with the text of input that it matched. Input must
+// be the input on which the match ran. As in regexp.Expand:
+//
+//   $name or ${name}   the capture named name (see Program.NamedCaptures)
+//   $1 or ${1}         capture 1; $0 is the whole match
+//   $$                 a literal $
+//
+// In the $name form, name is taken to be as long as possible: $1x is
+// equivalent to ${1x}, not ${1}x. A reference to a capture that does not
+// exist, or that did not participate in the match, is replaced with an empty
+// slice. If a capture matched more than once, its most recent match is used.
+//
+func (r Result) Expand(dst []byte, template []byte, input []byte) []byte {
+	for len(template) > 0 {
+		i := bytes.IndexByte(template, '$')
+		if i < 0 {
+			break
+		}
+		dst = append(dst, template[:i]...)
+		template = template[i:]
+		if len(template) > 1 && template[1] == '$' {
+			dst = append(dst, '$')
+			template = template[2:]
+			continue
+		}
+		name, rest, ok := extractRef(template)
+		if !ok {
+			// Malformed; treat $ as raw text.
+			dst = append(dst, '$')
+			template = template[1:]
+			continue
+		}
+		template = rest
+		if idx, found := r.captureIndex(name); found {
+			c := r.Captures[idx]
+			if c.Exists && c.Solo.S <= c.Solo.E && c.Solo.E <= uint64(len(input)) {
+				dst = append(dst, input[c.Solo.S:c.Solo.E]...)
+			}
+		}
+	}
+	return append(dst, template...)
+}
+
+// captureIndex resolves a capture reference, by number or by name.
+func (r Result) captureIndex(name string) (uint64, bool) {
+	if idx, err := strconv.ParseUint(name, 10, 64); err == nil {
+		return idx, idx < uint64(len(r.Captures))
+	}
+	idx, found := r.Names[name]
+	return idx, found && idx < uint64(len(r.Captures))
+}
+
+// extractRef parses a $name or ${name} reference at the start of template,
+// returning the name and the rest of the template.
+func extractRef(template []byte) (string, []byte, bool) {
+	if len(template) < 2 || template[0] != '$' {
+		return "", nil, false
+	}
+	brace := false
+	i := 1
+	if template[1] == '{' {
+		brace = true
+		i = 2
+	}
+	j := i
+	for j < len(template) {
+		ch, size := utf8.DecodeRune(template[j:])
+		if !unicode.IsLetter(ch) && !unicode.IsDigit(ch) && ch != '_' {
+			break
+		}
+		j += size
+	}
+	if j == i {
+		return "", nil, false
+	}
+	name := string(template[i:j])
+	if brace {
+		if j >= len(template) || template[j] != '}' {
+			return "", nil, false
+		}
+		j++
+	}
+	return name, template[j:], true
+}
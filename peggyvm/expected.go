@@ -0,0 +1,158 @@
+package peggyvm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+// maxExpectedRepeat is the longest run of a byte that SAMEB may expect which
+// is recorded as a literal. Longer runs are recorded as just the byte.
+const maxExpectedRepeat = 64
+
+// Expected describes what a failed match would have accepted at the farthest
+// position that it reached, for messages such as:
+//
+//   expected ')' or ',' at offset 517
+//
+// It is gathered from the SAMEB, LITB, and MATCHB instructions that failed
+// there, from their TSAMEB, TLITB, and TMATCHB variants, and from TSPANB
+// when it matches nothing.
+//
+type Expected struct {
+	// DP is the farthest position at which one of those instructions
+	// failed.
+	DP uint64
+
+	// Bytes is the set of bytes that would have been accepted at DP.
+	Bytes byteset.Matcher
+
+	// Literals holds the literals of two or more bytes that would have
+	// been accepted at DP, in the order they were tried.
+	Literals []string
+}
+
+// String lists the alternatives, e.g. "')' or '0'-'9' or \"end\"". Runs of
+// three or more consecutive bytes are written as ranges.
+func (e *Expected) String() string {
+	var buf bytes.Buffer
+	first := true
+	sep := func() {
+		if !first {
+			buf.WriteString(" or ")
+		}
+		first = false
+	}
+	bs := byteset.Bytes(e.Bytes, nil)
+	for i := 0; i < len(bs); {
+		j := i + 1
+		for j < len(bs) && bs[j] == bs[j-1]+1 {
+			j++
+		}
+		if j-i < 3 {
+			j = i + 1
+		}
+		sep()
+		writeByteLiteral(&buf, bs[i])
+		if j-i > 1 {
+			buf.WriteByte('-')
+			writeByteLiteral(&buf, bs[j-1])
+		}
+		i = j
+	}
+	for _, lit := range e.Literals {
+		sep()
+		fmt.Fprintf(&buf, "%q", lit)
+	}
+	return buf.String()
+}
+
+// expectation accumulates an Expected for an Execution. The literals share
+// storage with the program's literals, so that recording one does not
+// allocate, and are converted to strings only by Expected.
+type expectation struct {
+	valid    bool
+	dp       uint64
+	bytes    [4]uint64
+	literals [][]byte
+}
+
+// at returns true if a failure at dp should be recorded, discarding what was
+// recorded before if dp is farther than any earlier failure.
+func (e *expectation) at(dp uint64) bool {
+	if e.valid && dp < e.dp {
+		return false
+	}
+	if !e.valid || dp > e.dp {
+		*e = expectation{valid: true, dp: dp, literals: e.literals[:0]}
+	}
+	return true
+}
+
+func (e *expectation) addByte(b byte) {
+	e.bytes[b>>6] |= 1 << (b & 63)
+}
+
+func (e *expectation) addLiteral(lit []byte) {
+	if len(lit) == 1 {
+		e.addByte(lit[0])
+		return
+	}
+	for _, other := range e.literals {
+		if bytes.Equal(other, lit) {
+			return
+		}
+	}
+	e.literals = append(e.literals, lit)
+}
+
+// expectByte records that byte b, repeated n times, was expected at DP.
+func (x *Execution) expectByte(b byte, n uint64) {
+	if n == 0 || x.MatchOnly || !x.expect.at(x.DP) {
+		return
+	}
+	if n == 1 || n > maxExpectedRepeat {
+		x.expect.addByte(b)
+	} else {
+		x.expect.addLiteral(bytes.Repeat([]byte{b}, int(n)))
+	}
+}
+
+// expectLiteral records that lit was expected at DP.
+func (x *Execution) expectLiteral(lit []byte) {
+	if len(lit) != 0 && !x.MatchOnly && x.expect.at(x.DP) {
+		x.expect.addLiteral(lit)
+	}
+}
+
+// expectSet records that some byte of m was expected at DP.
+func (x *Execution) expectSet(m byteset.Matcher) {
+	if !x.MatchOnly && x.expect.at(x.DP) {
+		m.ForEach(x.expect.addByte)
+	}
+}
+
+// Expected returns what the Execution would have accepted at the farthest
+// position where a SAMEB, LITB, or MATCHB instruction (or a T-variant of
+// one) has failed so far, or nil if none has.
+func (x *Execution) Expected() *Expected {
+	if !x.expect.valid {
+		return nil
+	}
+	var bs []byte
+	for i := 0; i < 256; i++ {
+		if x.expect.bytes[i>>6]&(1<<(uint(i)&63)) != 0 {
+			bs = append(bs, byte(i))
+		}
+	}
+	var lits []string
+	for _, lit := range x.expect.literals {
+		lits = append(lits, string(lit))
+	}
+	return &Expected{
+		DP:       x.expect.dp,
+		Bytes:    byteset.DenseSet(bs...).Optimize(),
+		Literals: lits,
+	}
+}
@@ -0,0 +1,82 @@
+package peggyvm
+
+import (
+	"sync"
+)
+
+// Extension opcodes live in the range 0x31 .. 0x3d, which is never
+// assigned to core opcodes.
+const (
+	MinExtOpCode OpCode = 0x31
+	MaxExtOpCode OpCode = 0x3d
+)
+
+// OpHandler executes an extension opcode. When it is called, x.XP already
+// points at the following instruction. The handler may update x.DP and x.XP
+// as it sees fit, push assignments onto x.KS, or call x.Fail to backtrack. A
+// non-nil error halts the Execution with a RuntimeError, as does leaving x.DP
+// past the end of the input, pushing an assignment to a capture that does not
+// exist, or popping assignments that a pending CHOICE frame would restore.
+type OpHandler func(x *Execution, op *Op) error
+
+type extOp struct {
+	meta    OpMeta
+	handler OpHandler
+}
+
+var (
+	extMu  sync.RWMutex
+	extOps = make(map[OpCode]*extOp)
+)
+
+// RegisterOpCode adds an extension opcode, described by meta, to the VM.
+// Once registered, the opcode is accepted by Decode, Encode, the assembler,
+// and the disassembler, and Step calls handler to execute it.
+//
+// The opcode must lie between MinExtOpCode and MaxExtOpCode, and both it and
+// its mnemonic must be unused. Registration is global to the process, and is
+// typically done from an init function.
+//
+func RegisterOpCode(meta OpMeta, handler OpHandler) error {
+	if meta.Code < MinExtOpCode || meta.Code > MaxExtOpCode {
+		return ErrExtOpCodeRange
+	}
+	if meta.Name == "" || handler == nil {
+		return ErrBadOperand
+	}
+
+	extMu.Lock()
+	defer extMu.Unlock()
+	if _, found := extOps[meta.Code]; found {
+		return ErrDuplicateOpCode
+	}
+	if _, found := lookupOpCodeLocked(meta.Name); found {
+		return ErrDuplicateOpCode
+	}
+	meta.Illegal = false
+	extOps[meta.Code] = &extOp{meta: meta, handler: handler}
+	return nil
+}
+
+// UnregisterOpCode removes an extension opcode added by RegisterOpCode.
+func UnregisterOpCode(code OpCode) {
+	extMu.Lock()
+	delete(extOps, code)
+	extMu.Unlock()
+}
+
+func lookupExtOp(code OpCode) *extOp {
+	if code < MinExtOpCode || code > MaxExtOpCode {
+		return nil
+	}
+	extMu.RLock()
+	ext := extOps[code]
+	extMu.RUnlock()
+	return ext
+}
+
+// Fail backtracks as if a FAIL instruction had executed. It is meant for use
+// by extension opcode handlers.
+func (x *Execution) Fail() {
+	x.fail()
+}
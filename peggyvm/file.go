@@ -0,0 +1,309 @@
+package peggyvm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+)
+
+// Program files are containers for compiled Programs, suitable for shipping
+// as build artifacts and for inspection by tools. A file consists of a
+// header, a section table, and the contents of the sections. Fixed-width
+// integers are little-endian.
+//
+//   offset  size  field
+//   0       4     magic, "PGVM"
+//   4       2     format version, currently 1
+//   6       2     number of sections, N
+//   8       24*N  section table, one 24-byte entry per section:
+//                   8 bytes  name, NUL-padded
+//                   8 bytes  offset of the contents from the start of the file
+//                   8 bytes  length of the contents
+//   ...           contents of the sections
+//
+// The standard sections are:
+//
+//   .code    Program.Bytes, verbatim
+//   .lits    Program.Literals
+//   .sets    Program.ByteSets
+//   .caps    Program.Captures and Program.NamedCaptures
+//   .labels  Program.Labels and Program.Entries
+//   .debug   Program.Debug
+//   .kinds   the Kind of each of Program.Captures
+//   .dfas    Program.DFAs
+//   .jumps   Program.JumpTables
+//   .rsets   Program.RuneSets
+//
+// Apart from .code, each is encoded as in Program.MarshalBinary. Only .code is
+// mandatory. Readers ignore sections that they do not recognize, so that new
+// sections may be added without breaking old readers.
+//
+// Any standard section may instead be stored compressed, under the same name
+// with the leading '.' replaced by ".z" (so .code becomes .zcode). Its
+// contents are then compressed with DEFLATE (RFC 1951), and within .zlabels
+// and .zdebug each XP is written as the signed difference from the one
+// before it, which makes the mostly ascending XPs small and repetitive. See
+// NewCompressedProgramFile.
+//
+const (
+	fileMagic       = "PGVM"
+	fileVersion     = 1
+	fileHeaderSize  = 8
+	fileSectionSize = 24
+	maxSectionName  = 8
+)
+
+// ProgramFile is the in-memory form of a program file.
+type ProgramFile struct {
+	// Version is the format version.
+	Version uint16
+
+	// Sections lists the sections, in file order.
+	Sections []Section
+}
+
+// Section is a single named section of a ProgramFile.
+type Section struct {
+	Name string
+	Data []byte
+}
+
+// NewProgramFile returns a ProgramFile holding p. The .debug section is
+// omitted if p has no debug information, and .kinds if no capture has a
+// Kind.
+func NewProgramFile(p *Program) *ProgramFile {
+	return newProgramFile(p, false)
+}
+
+// NewCompressedProgramFile is like NewProgramFile, but stores every section in
+// compressed form. This typically shrinks a program to a fraction of its
+// size, for applications that embed many compiled grammars; ReadProgram
+// decompresses it transparently.
+func NewCompressedProgramFile(p *Program) *ProgramFile {
+	return newProgramFile(p, true)
+}
+
+func newProgramFile(p *Program, compress bool) *ProgramFile {
+	f := &ProgramFile{Version: fileVersion}
+	add := func(name string, data []byte) {
+		if compress {
+			name, data = ".z"+name[1:], deflate(data)
+		}
+		f.Sections = append(f.Sections, Section{name, data})
+	}
+	encode := func(name string, fn func(e *binaryEncoder)) {
+		e := binaryEncoder{delta: compress}
+		fn(&e)
+		add(name, e.buf.Bytes())
+	}
+	add(".code", p.Bytes)
+	encode(".lits", func(e *binaryEncoder) { e.literals(p) })
+	encode(".sets", func(e *binaryEncoder) { e.byteSets(p) })
+	encode(".caps", func(e *binaryEncoder) { e.captures(p) })
+	encode(".labels", func(e *binaryEncoder) { e.labels(p) })
+	if len(p.Debug) != 0 {
+		encode(".debug", func(e *binaryEncoder) { e.debug(p) })
+	}
+	for _, capture := range p.Captures {
+		if capture.Kind != KindNone {
+			encode(".kinds", func(e *binaryEncoder) { e.captureKinds(p) })
+			break
+		}
+	}
+	if len(p.DFAs) != 0 {
+		encode(".dfas", func(e *binaryEncoder) { e.dfas(p) })
+	}
+	if len(p.JumpTables) != 0 {
+		encode(".jumps", func(e *binaryEncoder) { e.jumpTables(p) })
+	}
+	if len(p.RuneSets) != 0 {
+		encode(".rsets", func(e *binaryEncoder) { e.runeSets(p) })
+	}
+	return f
+}
+
+// Section returns the first section with the given name, or nil if there is
+// no such section.
+func (f *ProgramFile) Section(name string) *Section {
+	for i := range f.Sections {
+		if f.Sections[i].Name == name {
+			return &f.Sections[i]
+		}
+	}
+	return nil
+}
+
+// Program decodes the Program held by f.
+func (f *ProgramFile) Program() (*Program, error) {
+	code, _, found, err := f.sectionData(".code")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrBadEncoding
+	}
+	p := newEmptyProgram()
+	p.Bytes = append([]byte(nil), code...)
+
+	decoders := []struct {
+		Name string
+		Fn   func(d *binaryDecoder, p *Program)
+	}{
+		{".lits", (*binaryDecoder).literals},
+		{".sets", (*binaryDecoder).byteSets},
+		{".caps", (*binaryDecoder).captures},
+		{".labels", (*binaryDecoder).labels},
+		{".debug", (*binaryDecoder).debug},
+		{".kinds", (*binaryDecoder).captureKinds},
+		{".dfas", (*binaryDecoder).dfas},
+		{".jumps", (*binaryDecoder).jumpTables},
+		{".rsets", (*binaryDecoder).runeSets},
+	}
+	for _, row := range decoders {
+		data, delta, found, err := f.sectionData(row.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		d := &binaryDecoder{data: data, delta: delta}
+		row.Fn(d, p)
+		if d.bad || len(d.data) != 0 {
+			return nil, ErrBadEncoding
+		}
+	}
+	return p, nil
+}
+
+// sectionData returns the contents of the named standard section, which may
+// be stored either as is or in compressed form. If it was compressed, the
+// contents are decompressed, and delta is true.
+func (f *ProgramFile) sectionData(name string) (data []byte, delta bool, found bool, err error) {
+	if s := f.Section(name); s != nil {
+		return s.Data, false, true, nil
+	}
+	s := f.Section(".z" + name[1:])
+	if s == nil {
+		return nil, false, false, nil
+	}
+	data, err = inflate(s.Data)
+	if err != nil {
+		return nil, false, false, err
+	}
+	return data, true, true, nil
+}
+
+// deflate compresses data with DEFLATE.
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	assert(err == nil, "flate.NewWriter: %v", err)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// inflate decompresses data compressed by deflate.
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ErrBadEncoding
+	}
+	return out, nil
+}
+
+// WriteTo writes f in the program file format.
+func (f *ProgramFile) WriteTo(w io.Writer) (int64, error) {
+	assert(len(f.Sections) <= 0xffff, "too many sections")
+
+	var buf bytes.Buffer
+	var scratch [8]byte
+	buf.WriteString(fileMagic)
+	binary.LittleEndian.PutUint16(scratch[:2], f.Version)
+	buf.Write(scratch[:2])
+	binary.LittleEndian.PutUint16(scratch[:2], uint16(len(f.Sections)))
+	buf.Write(scratch[:2])
+
+	offset := uint64(fileHeaderSize + fileSectionSize*len(f.Sections))
+	for _, s := range f.Sections {
+		assert(len(s.Name) <= maxSectionName, "section name %q is too long", s.Name)
+		var name [maxSectionName]byte
+		copy(name[:], s.Name)
+		buf.Write(name[:])
+		binary.LittleEndian.PutUint64(scratch[:], offset)
+		buf.Write(scratch[:])
+		binary.LittleEndian.PutUint64(scratch[:], uint64(len(s.Data)))
+		buf.Write(scratch[:])
+		offset += uint64(len(s.Data))
+	}
+	for _, s := range f.Sections {
+		buf.Write(s.Data)
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// ReadProgramFile reads a program file from r, which is consumed until EOF.
+func ReadProgramFile(r io.Reader) (*ProgramFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < fileHeaderSize || string(data[:4]) != fileMagic {
+		return nil, ErrBadMagic
+	}
+	f := &ProgramFile{Version: binary.LittleEndian.Uint16(data[4:6])}
+	if f.Version != fileVersion {
+		return nil, ErrBadVersion
+	}
+	n := int(binary.LittleEndian.Uint16(data[6:8]))
+	if len(data) < fileHeaderSize+fileSectionSize*n {
+		return nil, ErrBadEncoding
+	}
+
+	seen := make(map[string]struct{}, n)
+	for i := 0; i < n; i++ {
+		entry := data[fileHeaderSize+fileSectionSize*i:]
+		name := string(bytes.TrimRight(entry[:maxSectionName], "\x00"))
+		offset := binary.LittleEndian.Uint64(entry[8:16])
+		length := binary.LittleEndian.Uint64(entry[16:24])
+		if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+			return nil, ErrBadEncoding
+		}
+		if _, dupe := seen[name]; dupe {
+			return nil, ErrBadEncoding
+		}
+		seen[name] = struct{}{}
+		f.Sections = append(f.Sections, Section{name, data[offset : offset+length]})
+	}
+	return f, nil
+}
+
+// WriteProgram writes p to w in the program file format.
+func WriteProgram(w io.Writer, p *Program) error {
+	_, err := NewProgramFile(p).WriteTo(w)
+	return err
+}
+
+// WriteCompressedProgram writes p to w in the program file format, with every
+// section compressed.
+func WriteCompressedProgram(w io.Writer, p *Program) error {
+	_, err := NewCompressedProgramFile(p).WriteTo(w)
+	return err
+}
+
+// ReadProgram reads a Program from r, which must hold a program file. The
+// file's sections may be compressed or not.
+func ReadProgram(r io.Reader) (*Program, error) {
+	f, err := ReadProgramFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.Program()
+}
@@ -0,0 +1,325 @@
+package peggyvm
+
+import (
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+// FirstSet describes the bytes that can begin a successful match from some
+// point in a program.
+type FirstSet struct {
+	// Bytes holds each byte that may be at the current position when the
+	// match succeeds.
+	Bytes byteset.Matcher
+
+	// MayBeEmpty is true iff the match may succeed without examining the
+	// byte at the current position at all, as when it can match the empty
+	// string. If so, Bytes places no constraint on the input.
+	MayBeEmpty bool
+}
+
+// Matcher returns a matcher for the bytes at which a match may succeed: Bytes
+// if MayBeEmpty is false, or byteset.All() if it is true. A match cannot
+// succeed at a position whose byte it rejects, nor at the end of the input
+// unless MayBeEmpty is true.
+func (fs FirstSet) Matcher() byteset.Matcher {
+	if fs.MayBeEmpty {
+		return byteset.All()
+	}
+	return fs.Bytes
+}
+
+// FirstSets holds the results of Program.FirstSets.
+type FirstSets struct {
+	// Start describes matches that begin at XP 0.
+	Start FirstSet
+
+	// Entries describes matches that begin at each entry point, by name.
+	Entries map[string]FirstSet
+
+	// Choices describes the two alternatives of each CHOICE, keyed by the
+	// CHOICE's XP: index 0 is the code that follows the CHOICE, and index 1
+	// is the code at its target.
+	Choices map[uint64][2]FirstSet
+
+	byXP map[uint64]firstSummary
+}
+
+// At describes matches that begin at the instruction at xp. The result is
+// meaningless if xp is not the start of an instruction.
+func (sets *FirstSets) At(xp uint64) FirstSet {
+	return sets.byXP[xp].export()
+}
+
+// FirstSets computes, for each entry point and each CHOICE alternative, the
+// set of bytes that can begin a successful match.
+//
+// The analysis is conservative: Bytes may include bytes that cannot in fact
+// begin a match, and MayBeEmpty may be true when the match always examines
+// the current byte, but never the other way around. Each instruction that
+// examines the current byte and fails unless it is in some set (SAMEB, LITB,
+// MATCHB, and so on) contributes that set. CHOICE contributes both of its
+// alternatives; DISPATCH, each key of its jump table with which the key's
+// target may begin; and CALL, the subroutine, followed by whatever comes
+// after the CALL if the subroutine may be empty. Reaching END, RET, or
+// the end of the code sets MayBeEmpty; FAIL and FAIL2X contribute nothing.
+// RWNDB and extension opcodes are not understood, and set MayBeEmpty.
+//
+func (p *Program) FirstSets() (*FirstSets, error) {
+	var ops []Op
+	index := make(map[uint64]int)
+	it := p.Instructions()
+	for it.Next() {
+		index[it.XP()] = len(ops)
+		ops = append(ops, *it.Op())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	end := it.XP()
+
+	targets := make([]uint64, len(ops))
+	for i := range ops {
+		target, hasTarget, err := opTarget(&ops[i], end)
+		if err != nil {
+			return nil, err
+		}
+		if hasTarget {
+			if _, found := index[target]; !found && target != end {
+				return nil, &VerifyError{Err: ErrMisalignedTarget, XP: ops[i].XP}
+			}
+		}
+		targets[i] = target
+	}
+
+	summaries := make([]firstSummary, len(ops))
+	at := func(xp uint64) firstSummary {
+		if i, found := index[xp]; found {
+			return summaries[i]
+		}
+		return firstSummary{empty: true}
+	}
+
+	// Iterate to a fixed point. Summaries only ever grow, so this ends.
+	for changed := true; changed; {
+		changed = false
+		for i := len(ops) - 1; i >= 0; i-- {
+			s := p.summarize(&ops[i], targets[i], at)
+			if s != summaries[i] {
+				summaries[i] = s
+				changed = true
+			}
+		}
+	}
+
+	sets := &FirstSets{
+		Start:   at(0).export(),
+		Entries: make(map[string]FirstSet, len(p.Entries)),
+		Choices: make(map[uint64][2]FirstSet),
+		byXP:    make(map[uint64]firstSummary, len(ops)+1),
+	}
+	for i, op := range ops {
+		sets.byXP[op.XP] = summaries[i]
+		if op.Code == OpCHOICE {
+			next := op.XP + uint64(op.Len)
+			sets.Choices[op.XP] = [2]FirstSet{at(next).export(), at(targets[i]).export()}
+		}
+	}
+	sets.byXP[end] = at(end)
+	for _, label := range p.Entries {
+		sets.Entries[label.Name] = at(label.Offset).export()
+	}
+	return sets, nil
+}
+
+// firstSummary is the working form of a FirstSet.
+type firstSummary struct {
+	bytes [32]byte
+	empty bool
+}
+
+func (s *firstSummary) add(b byte) {
+	s.bytes[b>>3] |= 1 << (b & 7)
+}
+
+func (s *firstSummary) addAll() {
+	for i := range s.bytes {
+		s.bytes[i] = 0xff
+	}
+}
+
+func (s *firstSummary) addSet(key [32]byte) {
+	for i := range s.bytes {
+		s.bytes[i] |= key[i]
+	}
+}
+
+func (s *firstSummary) merge(t firstSummary) {
+	s.addSet(t.bytes)
+	s.empty = s.empty || t.empty
+}
+
+func (s firstSummary) export() FirstSet {
+	return FirstSet{
+		Bytes:      byteSetFromKey(s.bytes),
+		MayBeEmpty: s.empty,
+	}
+}
+
+// summarize computes the summary for op, given the current summaries of the
+// other instructions.
+func (p *Program) summarize(op *Op, target uint64, at func(uint64) firstSummary) firstSummary {
+	next := op.XP + uint64(op.Len)
+	var s firstSummary
+
+	// examine handles an instruction that consumes count bytes if they are
+	// in key, and fails otherwise.
+	examine := func(key [32]byte, count uint64) firstSummary {
+		if count == 0 {
+			return at(next)
+		}
+		var s firstSummary
+		s.addSet(key)
+		return s
+	}
+
+	var all [32]byte
+	for i := range all {
+		all[i] = 0xff
+	}
+	literalKey := func(idx uint64) ([32]byte, uint64) {
+		var key [32]byte
+		if idx >= uint64(len(p.Literals)) || len(p.Literals[idx]) == 0 {
+			return key, 0
+		}
+		b := p.Literals[idx][0]
+		key[b>>3] |= 1 << (b & 7)
+		return key, 1
+	}
+	matcherKey := func(idx uint64) [32]byte {
+		if idx >= uint64(len(p.ByteSets)) {
+			return [32]byte{}
+		}
+		return byteSetKey(p.ByteSets[idx])
+	}
+	runeSetKey := func(idx uint64) [32]byte {
+		if idx >= uint64(len(p.RuneSets)) {
+			return [32]byte{}
+		}
+		return runeSetLeadKey(p.RuneSets[idx])
+	}
+	exactKey := func(b uint64) [32]byte {
+		var key [32]byte
+		key[(b&0xff)>>3] |= 1 << (b & 7)
+		return key
+	}
+
+	switch op.Code {
+	case OpANYB:
+		s = examine(all, op.Imm0)
+	case OpSAMEB:
+		s = examine(exactKey(op.Imm0), op.Imm1)
+	case OpLITB:
+		s = examine(literalKey(op.Imm0))
+	case OpMATCHB:
+		s = examine(matcherKey(op.Imm0), op.Imm1)
+
+	case OpTANYB:
+		s = examine(all, op.Imm1)
+		s.merge(at(target))
+	case OpTSAMEB:
+		s = examine(exactKey(op.Imm1), op.Imm2)
+		s.merge(at(target))
+	case OpTLITB:
+		key, count := literalKey(op.Imm1)
+		s = examine(key, count)
+		s.merge(at(target))
+	case OpTMATCHB:
+		s = examine(matcherKey(op.Imm1), op.Imm2)
+		s.merge(at(target))
+	case OpTSPANB:
+		s = examine(matcherKey(op.Imm1), 1)
+		s.merge(at(target))
+
+	case OpMEMOGET:
+		// A stored match consumed what the code at next would have.
+		s = at(next)
+		s.merge(at(target))
+
+	case OpBALB:
+		s = examine(exactKey(op.Imm0), 1)
+
+	case OpANYR:
+		s = examine(runeLeadKey(), 1)
+	case OpSAMER:
+		s = examine(exactKey(uint64(string(rune(op.Imm0))[0])), 1)
+	case OpFSAMER:
+		s = examine(runeFoldLeadKey(rune(op.Imm0)), 1)
+	case OpMATCHR:
+		s = examine(runeSetKey(op.Imm0), 1)
+	case OpTMATCHR:
+		s = examine(runeSetKey(op.Imm1), 1)
+		s.merge(at(target))
+	case OpSPANR:
+		s.addSet(runeSetKey(op.Imm0))
+		s.merge(at(next))
+
+	case OpSPANB:
+		s.addSet(matcherKey(op.Imm0))
+		s.merge(at(next))
+
+	case OpDFAB:
+		if op.Imm0 >= uint64(len(p.DFAs)) {
+			break
+		}
+		dfa := p.DFAs[op.Imm0]
+		s.addSet(dfa.firstBytes())
+		if dfa.MayMatchEmpty() {
+			s.merge(at(next))
+		}
+
+	case OpDISPATCH:
+		if op.Imm0 >= uint64(len(p.JumpTables)) {
+			s.addAll()
+			s.empty = true
+			break
+		}
+		table := &p.JumpTables[op.Imm0]
+		for i, key := range table.Keys {
+			if i >= len(table.Targets) {
+				break
+			}
+			t := at(table.Targets[i])
+			if t.empty || t.bytes[key>>3]&(1<<(key&7)) != 0 {
+				s.add(key)
+			}
+		}
+
+	case OpCHOICE, OpPCOMMIT, OpRECOVER:
+		s = at(next)
+		s.merge(at(target))
+
+	case OpCOMMIT, OpBCOMMIT, OpDCOMMIT, OpJMP:
+		s = at(target)
+
+	case OpCALL:
+		s = at(target)
+		if s.empty {
+			s.empty = false
+			s.merge(at(next))
+		}
+
+	case OpRET, OpEND:
+		s.empty = true
+
+	case OpFAIL, OpFAIL2X, OpGIVEUP, OpTHROW:
+		// contributes nothing
+
+	case OpNOP, OpFCAP, OpBCAP, OpECAP, OpPRED, OpVCAP, OpVFOLD, OpEOI, OpWORDB, OpMEMOSET, OpBEHINDB:
+		s = at(next)
+
+	default:
+		s.addAll()
+		s.empty = true
+	}
+	return s
+}
@@ -0,0 +1,267 @@
+package peggyvm
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+// genAlphabet holds the bytes used by the literals, byte sets, and jump
+// tables of generated programs. It is small, so that random inputs over it
+// often match.
+const genAlphabet = "abc"
+
+// Generate implements testing/quick.Generator, so that quick.Check can pass
+// random Programs to a property. It calls GenProgram.
+func (*Program) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(GenProgram(r, size))
+}
+
+// GenProgram returns a random Program of about size instructions, for
+// property-based tests of the assembler, the disassembler, and the VM.
+//
+// The Program is structurally valid: every CHOICE is balanced by a COMMIT
+// (or one of its variants), every CALL by a RET, and every BCAP by an ECAP,
+// so that it passes Validate and VerifyStack. It also always halts: rules
+// call only rules defined after them, and the body of every loop consumes
+// input. The start of the code matches the whole input as capture 0 by
+// calling rule "r0"; each rule "rN" is also an entry point.
+//
+// The literals, byte sets, and jump tables only use the bytes "abc".
+//
+func GenProgram(r *rand.Rand, size int) *Program {
+	if size < 1 {
+		size = 1
+	}
+	g := &generator{r: r, b: NewBuilder(), ncaps: 1}
+	g.b.Verify = true
+	g.b.BCap(0).Call("r0").ECap(0).End()
+
+	// Rules are generated last to first, so that the nullability of each
+	// rule that might be called is already known.
+	n := 1 + r.Intn(1+size/8)
+	g.nullable = make([]bool, n)
+	for g.rule = n - 1; g.rule >= 0; g.rule-- {
+		name := fmt.Sprintf("r%d", g.rule)
+		g.b.Entry(name).Label(name)
+		g.nullable[g.rule] = g.expr(1 + size/n)
+		g.b.Ret()
+	}
+
+	g.b.NumCaptures(g.ncaps)
+	p, err := g.b.Finish()
+	if err != nil {
+		panic(fmt.Errorf("BUG: generated an invalid program: %v", err))
+	}
+	return p
+}
+
+type generator struct {
+	r       *rand.Rand
+	b       *Builder
+	nlabels uint
+	ncaps   uint64
+
+	// rule is the index of the rule being generated, and nullable[i] is
+	// true iff rule i > rule may succeed without consuming input.
+	rule     int
+	nullable []bool
+}
+
+func (g *generator) label() string {
+	name := fmt.Sprintf(".G%d", g.nlabels)
+	g.nlabels++
+	return name
+}
+
+func (g *generator) byteOf() byte {
+	return genAlphabet[g.r.Intn(len(genAlphabet))]
+}
+
+func (g *generator) literal() string {
+	buf := make([]byte, 1+g.r.Intn(3))
+	for i := range buf {
+		buf[i] = g.byteOf()
+	}
+	return string(buf)
+}
+
+func (g *generator) byteSet() byteset.Matcher {
+	var bs []byte
+	for i := 0; i < len(genAlphabet); i++ {
+		if g.r.Intn(2) == 0 {
+			bs = append(bs, genAlphabet[i])
+		}
+	}
+	if len(bs) == 0 {
+		bs = append(bs, g.byteOf())
+	}
+	return byteset.SparseSet(bs...)
+}
+
+// expr emits code for a random expression of about size instructions, and
+// returns true iff it may succeed without consuming input.
+func (g *generator) expr(size int) bool {
+	if size <= 1 {
+		return g.atom()
+	}
+	b := g.b
+	size--
+	half := size / 2
+	switch g.r.Intn(10) {
+	case 0, 1:
+		// a b
+		x := g.expr(half)
+		y := g.expr(size - half)
+		return x && y
+
+	case 2:
+		// CHOICE L1; a; COMMIT L2; L1: b; L2:
+		alt, done := g.label(), g.label()
+		b.Choice(alt)
+		x := g.expr(half)
+		b.Commit(done).Label(alt)
+		y := g.expr(size - half)
+		b.Label(done)
+		return x || y
+
+	case 3:
+		// Txxx L1; a; JMP L2; L1: b; L2:
+		alt, done := g.label(), g.label()
+		switch g.r.Intn(4) {
+		case 0:
+			b.TAnyB(alt)
+		case 1:
+			b.TSameB(alt, g.byteOf())
+		case 2:
+			b.TLit(alt, g.literal())
+		default:
+			b.TMatch(alt, g.byteSet())
+		}
+		g.expr(half)
+		b.Jmp(done).Label(alt)
+		y := g.expr(size - half)
+		b.Label(done)
+		return y
+
+	case 4:
+		// L1: CHOICE L2; a; COMMIT L1; L2:
+		// or: CHOICE L2; L1: a; PCOMMIT L2; JMP L1; L2:
+		loop, done := g.label(), g.label()
+		pcommit := g.r.Intn(2) == 0
+		if pcommit {
+			b.Choice(done).Label(loop)
+		} else {
+			b.Label(loop).Choice(done)
+		}
+		if g.expr(size) {
+			b.AnyB()
+		}
+		if pcommit {
+			b.PCommit(done).Jmp(loop)
+		} else {
+			b.Commit(loop)
+		}
+		b.Label(done)
+		return true
+
+	case 5:
+		// CHOICE L; a; COMMIT L; L:
+		done := g.label()
+		b.Choice(done)
+		g.expr(size)
+		b.Commit(done).Label(done)
+		return true
+
+	case 6:
+		// CHOICE L1; a; BCOMMIT L2; L1: FAIL; L2:
+		fail, done := g.label(), g.label()
+		b.Choice(fail)
+		g.expr(size)
+		b.BCommit(done).Label(fail).Fail().Label(done)
+		return true
+
+	case 7:
+		// CHOICE L; a; FAIL2X; L:
+		done := g.label()
+		b.Choice(done)
+		g.expr(size)
+		b.Fail2x().Label(done)
+		return true
+
+	case 8:
+		// BCAP k; a; ECAP k
+		idx := g.ncaps
+		g.ncaps++
+		b.BCap(idx)
+		x := g.expr(size)
+		b.ECap(idx)
+		return x
+
+	default:
+		// DISPATCH t; L1: a; JMP L; L2: b; JMP L; ...; L:
+		var keys []byte
+		var labels []string
+		for i := 0; i < len(genAlphabet); i++ {
+			if g.r.Intn(2) == 0 {
+				keys = append(keys, genAlphabet[i])
+				labels = append(labels, g.label())
+			}
+		}
+		if len(keys) == 0 {
+			return g.expr(size + 1)
+		}
+		done := g.label()
+		b.Dispatch(keys, labels)
+		nullable := false
+		for i, label := range labels {
+			b.Label(label)
+			if g.expr(size / len(labels)) {
+				nullable = true
+			}
+			if i != len(labels)-1 {
+				b.Jmp(done)
+			}
+		}
+		b.Label(done)
+		return nullable
+	}
+}
+
+// atom emits a single instruction, or two for FCAP, and returns true iff it
+// may succeed without consuming input.
+func (g *generator) atom() bool {
+	b := g.b
+	switch g.r.Intn(8) {
+	case 0:
+		b.AnyBN(1 + uint64(g.r.Intn(2)))
+	case 1:
+		b.SameBN(g.byteOf(), 1+uint64(g.r.Intn(2)))
+	case 2:
+		b.Lit(g.literal())
+	case 3:
+		b.Match(g.byteSet())
+	case 4:
+		b.Span(g.byteSet())
+		return true
+	case 5:
+		if g.rule+1 < len(g.nullable) {
+			callee := g.rule + 1 + g.r.Intn(len(g.nullable)-g.rule-1)
+			b.Call(fmt.Sprintf("r%d", callee))
+			return g.nullable[callee]
+		}
+		b.Nop()
+		return true
+	case 6:
+		n := 1 + uint64(g.r.Intn(2))
+		idx := g.ncaps
+		g.ncaps++
+		b.AnyBN(n).FCap(idx, n)
+	default:
+		b.Nop()
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package peggyvm
+
+import (
+	"encoding/gob"
+)
+
+// gobVersion is the version byte written by Program.GobEncode. Versions 1,
+// which lacked capture kinds, 2, which lacked DFAs, 3, which lacked jump
+// tables, and 4, which lacked rune sets, are still accepted.
+const gobVersion = 5
+
+var (
+	_ gob.GobEncoder = (*Program)(nil)
+	_ gob.GobDecoder = (*Program)(nil)
+)
+
+func init() {
+	gob.Register(&Program{})
+}
+
+// GobEncode implements gob.GobEncoder, so that Programs can be passed over
+// net/rpc or kept in gob-based caches. The encoding is that of MarshalBinary,
+// with its own version byte, except that each byte set is written as a
+// 32-byte bitmap of the bytes it matches. This is canonical, so equivalent
+// byte sets always encode the same way, and it decodes without parsing. Rune
+// sets are still written as text, as a bitmap of every rune would be huge.
+func (p *Program) GobEncode() ([]byte, error) {
+	var e binaryEncoder
+	e.buf.WriteByte(gobVersion)
+	e.bytes(p.Bytes)
+	e.literals(p)
+	e.byteSetBitmaps(p)
+	e.captures(p)
+	e.labels(p)
+	e.debug(p)
+	e.captureKinds(p)
+	e.dfas(p)
+	e.jumpTables(p)
+	e.runeSets(p)
+	return e.buf.Bytes(), nil
+}
+
+// GobDecode implements gob.GobDecoder, replacing the contents of p.
+func (p *Program) GobDecode(data []byte) error {
+	if len(data) == 0 {
+		return ErrBadEncoding
+	}
+	if data[0] < 1 || data[0] > gobVersion {
+		return ErrBadVersion
+	}
+	d := &binaryDecoder{data: data[1:]}
+	q := newEmptyProgram()
+	q.Bytes = d.bytes()
+	d.literals(q)
+	d.byteSetBitmaps(q)
+	d.captures(q)
+	d.labels(q)
+	d.debug(q)
+	if data[0] >= 2 {
+		d.captureKinds(q)
+	}
+	if data[0] >= 3 {
+		d.dfas(q)
+	}
+	if data[0] >= 4 {
+		d.jumpTables(q)
+	}
+	if data[0] >= 5 {
+		d.runeSets(q)
+	}
+	if d.bad || len(d.data) != 0 {
+		return ErrBadEncoding
+	}
+	*p = *q
+	return nil
+}
+
+func (e *binaryEncoder) byteSetBitmaps(p *Program) {
+	e.uint(uint64(len(p.ByteSets)))
+	for _, set := range p.ByteSets {
+		key := byteSetKey(set)
+		e.buf.Write(key[:])
+	}
+}
+
+func (d *binaryDecoder) byteSetBitmaps(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		var key [32]byte
+		if len(d.data) < len(key) {
+			d.fail()
+			return
+		}
+		copy(key[:], d.data)
+		d.data = d.data[len(key):]
+		q.ByteSets = append(q.ByteSets, byteSetFromKey(key))
+	}
+}
@@ -0,0 +1,62 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// HistoryEntry records one instruction executed by an Execution.
+type HistoryEntry struct {
+	// XP is the address of the instruction.
+	XP uint64
+
+	// DP is the value of DP just before it executed.
+	DP uint64
+
+	// Code is its opcode.
+	Code OpCode
+}
+
+func (h HistoryEntry) String() string {
+	return fmt.Sprintf("XP %d DP %d %s", h.XP, h.DP, h.Code)
+}
+
+// KeepHistory makes the Execution remember the last n instructions that it
+// executes, in a ring buffer, so that a RuntimeError or a failed Result can
+// show how it got there without re-running it under a Tracer. If n is zero,
+// no history is kept. Calling it discards any history already recorded.
+//
+// Exec calls KeepHistory(p.HistorySize).
+//
+func (x *Execution) KeepHistory(n int) {
+	x.history = nil
+	x.historyNext = 0
+	x.historyFull = false
+	if n > 0 {
+		x.history = make([]HistoryEntry, n)
+	}
+}
+
+// History returns the instructions recorded since KeepHistory was called, up
+// to its limit, oldest first.
+func (x *Execution) History() []HistoryEntry {
+	if x.history == nil {
+		return nil
+	}
+	if !x.historyFull {
+		return append([]HistoryEntry(nil), x.history[:x.historyNext]...)
+	}
+	out := make([]HistoryEntry, 0, len(x.history))
+	out = append(out, x.history[x.historyNext:]...)
+	out = append(out, x.history[:x.historyNext]...)
+	return out
+}
+
+// record adds op to the history.
+func (x *Execution) record(op *Op) {
+	x.history[x.historyNext] = HistoryEntry{XP: op.XP, DP: x.DP, Code: op.Code}
+	x.historyNext++
+	if x.historyNext == len(x.history) {
+		x.historyNext = 0
+		x.historyFull = true
+	}
+}
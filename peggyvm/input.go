@@ -0,0 +1,234 @@
+package peggyvm
+
+import (
+	"io"
+	"sort"
+)
+
+// Input is a source of input for an Execution, for input that is not already
+// a single []byte: a file read through io.ReaderAt, a rope, and so on. See
+// Program.ExecInput.
+type Input interface {
+	// Len returns the length of the input.
+	Len() uint64
+
+	// ByteAt returns the byte at position i, which is less than Len.
+	ByteAt(i uint64) byte
+
+	// Slice returns the bytes from position i up to but not including j,
+	// where i <= j <= Len. The result may share storage with the input,
+	// and must not be modified.
+	Slice(i, j uint64) []byte
+}
+
+// Bytes is an Input over a byte slice. ExecInput recognizes it and runs the
+// program as Exec would, without calling through the interface.
+type Bytes []byte
+
+var _ Input = Bytes(nil)
+
+func (b Bytes) Len() uint64              { return uint64(len(b)) }
+func (b Bytes) ByteAt(i uint64) byte     { return b[i] }
+func (b Bytes) Slice(i, j uint64) []byte { return b[i:j:j] }
+
+// readerAtBlockSize is the size of the blocks cached by ReaderAtInput.
+const readerAtBlockSize = 4096
+
+// ReaderAtInput is an Input that reads from R, an input of Size bytes, one
+// block at a time, keeping the last block read. The first error from R is
+// kept in Err, after which ByteAt and Slice return zeroes; MatchInput
+// reports it.
+type ReaderAtInput struct {
+	R    io.ReaderAt
+	Size int64
+	Err  error
+
+	block    []byte
+	blockPos uint64
+}
+
+var _ Input = (*ReaderAtInput)(nil)
+
+// NewReaderAtInput returns a ReaderAtInput for the first size bytes of r.
+func NewReaderAtInput(r io.ReaderAt, size int64) *ReaderAtInput {
+	return &ReaderAtInput{R: r, Size: size}
+}
+
+func (in *ReaderAtInput) Len() uint64 {
+	return uint64(in.Size)
+}
+
+func (in *ReaderAtInput) ByteAt(i uint64) byte {
+	if i < in.blockPos || i-in.blockPos >= uint64(len(in.block)) {
+		pos := i - i%readerAtBlockSize
+		end := pos + readerAtBlockSize
+		if end > uint64(in.Size) {
+			end = uint64(in.Size)
+		}
+		if !in.read(pos, end) {
+			return 0
+		}
+	}
+	return in.block[i-in.blockPos]
+}
+
+func (in *ReaderAtInput) Slice(i, j uint64) []byte {
+	if i >= in.blockPos && j-in.blockPos <= uint64(len(in.block)) {
+		return in.block[i-in.blockPos : j-in.blockPos]
+	}
+	buf := make([]byte, j-i)
+	if in.Err == nil {
+		if _, err := in.R.ReadAt(buf, int64(i)); err != nil && err != io.EOF {
+			in.Err = err
+		}
+	}
+	return buf
+}
+
+// read loads the block from pos up to end.
+func (in *ReaderAtInput) read(pos, end uint64) bool {
+	if in.Err != nil {
+		return false
+	}
+	if cap(in.block) < readerAtBlockSize {
+		in.block = make([]byte, readerAtBlockSize)
+	}
+	in.block = in.block[:end-pos]
+	if _, err := in.R.ReadAt(in.block, int64(pos)); err != nil && err != io.EOF {
+		in.Err = err
+		in.block = in.block[:0]
+		return false
+	}
+	in.blockPos = pos
+	return true
+}
+
+// ExecInput is like Exec, but reads the input through in.
+func (p *Program) ExecInput(in Input) *Execution {
+	if b, ok := in.(Bytes); ok {
+		return p.Exec(b)
+	}
+	x := p.Exec(nil)
+	x.In = in
+	return x
+}
+
+// MatchInput is like Match, but reads the input through in. It returns an
+// error if the program has a runtime error, or if in is a ReaderAtInput that
+// failed to read.
+func (p *Program) MatchInput(in Input) (Result, error) {
+	x := p.ExecInput(in)
+	defer x.release()
+	if err := x.Run(); err != nil {
+		return Result{}, err
+	}
+	if in, ok := in.(*ReaderAtInput); ok && in.Err != nil {
+		return Result{}, in.Err
+	}
+	return x.Result(), nil
+}
+
+// inputEnd returns the length of the input.
+func (x *Execution) inputEnd() uint64 {
+	if x.In != nil {
+		return x.In.Len()
+	}
+	return x.base + uint64(len(x.I))
+}
+
+// byteAt returns the byte at position dp, which is less than inputEnd.
+func (x *Execution) byteAt(dp uint64) byte {
+	if x.In != nil {
+		return x.In.ByteAt(dp)
+	}
+	return x.I[dp-x.base]
+}
+
+// Segments is an Input over a list of byte slices, such as the net.Buffers
+// read off a socket, that matches across their boundaries without
+// concatenating them. Literals and spans may straddle segments.
+type Segments struct {
+	segs [][]byte
+
+	// starts[i] is the position of segs[i][0]; starts[len(segs)] is the
+	// length of the input.
+	starts []uint64
+
+	// cur is the index of the segment last read, which is tried first.
+	cur int
+}
+
+var _ Input = (*Segments)(nil)
+
+// NewSegments returns a Segments over segs. Empty segments are skipped. The
+// slices are not copied, and must not be modified while in use.
+func NewSegments(segs [][]byte) *Segments {
+	s := &Segments{starts: []uint64{0}}
+	var pos uint64
+	for _, seg := range segs {
+		if len(seg) == 0 {
+			continue
+		}
+		pos += uint64(len(seg))
+		s.segs = append(s.segs, seg)
+		s.starts = append(s.starts, pos)
+	}
+	return s
+}
+
+func (s *Segments) Len() uint64 {
+	return s.starts[len(s.segs)]
+}
+
+func (s *Segments) ByteAt(i uint64) byte {
+	k := s.find(i)
+	return s.segs[k][i-s.starts[k]]
+}
+
+func (s *Segments) Slice(i, j uint64) []byte {
+	if i == j {
+		return nil
+	}
+	k := s.find(i)
+	if j <= s.starts[k+1] {
+		seg := s.segs[k][i-s.starts[k] : j-s.starts[k]]
+		return seg[:len(seg):len(seg)]
+	}
+	out := make([]byte, 0, j-i)
+	for ; i < j; k++ {
+		end := s.starts[k+1]
+		if end > j {
+			end = j
+		}
+		out = append(out, s.segs[k][i-s.starts[k]:end-s.starts[k]]...)
+		i = end
+	}
+	return out
+}
+
+// find returns the index of the segment holding position i < Len.
+func (s *Segments) find(i uint64) int {
+	if k := s.cur; i >= s.starts[k] && i < s.starts[k+1] {
+		return k
+	}
+	if k := s.cur + 1; k < len(s.segs) && i >= s.starts[k] && i < s.starts[k+1] {
+		s.cur = k
+		return k
+	}
+	s.cur = sort.Search(len(s.segs), func(k int) bool { return s.starts[k+1] > i })
+	return s.cur
+}
+
+// MatchSegments is like Match, but matches the concatenation of segs without
+// building it. See Segments.
+func (p *Program) MatchSegments(segs [][]byte) Result {
+	if len(segs) == 1 {
+		return p.Match(segs[0])
+	}
+	x := p.ExecInput(NewSegments(segs))
+	defer x.release()
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.Result()
+}
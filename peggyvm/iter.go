@@ -0,0 +1,75 @@
+package peggyvm
+
+import (
+	"io"
+)
+
+// OpIterator walks a Program's bytecode, decoding one instruction at a time.
+// Its use is modeled on bufio.Scanner:
+//
+//   it := p.Instructions()
+//   for it.Next() {
+//     op := it.Op()
+//     ...
+//   }
+//   if err := it.Err(); err != nil {
+//     ...
+//   }
+//
+type OpIterator struct {
+	p   *Program
+	xp  uint64
+	op  Op
+	err error
+}
+
+// Instructions returns an OpIterator positioned before the first instruction.
+func (p *Program) Instructions() *OpIterator {
+	return &OpIterator{p: p}
+}
+
+// Next decodes the next instruction, returning true iff there was one. It
+// returns false at the end of the code or if the bytecode cannot be decoded,
+// after which Err reports the error, if any.
+func (it *OpIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.op.Len != 0 {
+		it.xp += uint64(it.op.Len)
+	}
+	err := it.op.Decode(it.p.Bytes, it.xp)
+	if err == io.EOF {
+		it.op = Op{}
+		it.err = io.EOF
+		return false
+	}
+	if err != nil {
+		it.op = Op{}
+		it.err = err
+		return false
+	}
+	return true
+}
+
+// Op returns the instruction decoded by the last call to Next. The pointer
+// remains valid only until the next call to Next.
+func (it *OpIterator) Op() *Op {
+	return &it.op
+}
+
+// XP returns the code address at which the last call to Next began
+// decoding. Once Next has returned false, this is the address of the end of
+// the code or of the instruction that could not be decoded.
+func (it *OpIterator) XP() uint64 {
+	return it.xp
+}
+
+// Err returns the first error that stopped the iteration, or nil if the
+// iteration stopped at the end of the code.
+func (it *OpIterator) Err() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.p.annotate(it.err)
+}
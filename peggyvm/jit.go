@@ -0,0 +1,220 @@
+package peggyvm
+
+// jitCode is the closure code built by Program.CompileJIT.
+type jitCode struct {
+	// blocks maps the address of the first instruction of each basic
+	// block to the block.
+	blocks map[uint64]*jitBlock
+}
+
+// jitBlock is a basic block: a run of instructions that is only entered at
+// the top. Each instruction is compiled to a jitFunc, which does what its
+// opHandler would do, with the immediates already looked up.
+type jitBlock struct {
+	ops []Op
+	fns []jitFunc
+}
+
+// jitFunc executes one compiled instruction. Like an opHandler, it is called
+// after XP has been advanced past the instruction.
+type jitFunc func(x *Execution) error
+
+// CompileJIT translates the program into Go closures, one per instruction,
+// grouped into basic blocks, so that Run can execute it without decoding or
+// dispatching each instruction. It returns an error, and leaves the program
+// as it was, if the bytecode cannot be decoded.
+//
+// The compiled code is used by Run, and so by Match and its relatives,
+// whenever the Execution has no Observer and keeps no history, and is not
+// reading its input from MatchReader; otherwise Run steps through the
+// bytecode as usual. Either way, the Result, the counts, and any
+// RuntimeError are the same. Control that reaches an address that does not
+// begin a block, such as one set by an extension opcode, is handled by Step
+// until it reaches one that does.
+//
+// As with Precompile, the closures are not updated to match later changes to
+// the program; call CompileJIT again after making any.
+//
+func (p *Program) CompileJIT() error {
+	var ops []Op
+	it := p.Instructions()
+	for it.Next() {
+		ops = append(ops, *it.Op())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	leaders := map[uint64]bool{0: true}
+	for _, label := range p.Labels {
+		leaders[label.Offset] = true
+	}
+	for _, label := range p.Entries {
+		leaders[label.Offset] = true
+	}
+	for i := range p.JumpTables {
+		for _, target := range p.JumpTables[i].Targets {
+			leaders[target] = true
+		}
+	}
+	for i := range ops {
+		op := &ops[i]
+		next := op.XP + uint64(op.Len)
+		if opJumps[op.Code] {
+			if target, ok := tryAddOffset(next, u2s(op.Imm0)); ok {
+				leaders[target] = true
+			}
+			leaders[next] = true
+		}
+		switch op.Code {
+		case OpFAIL, OpFAIL2X, OpRET, OpDISPATCH, OpGIVEUP, OpEND:
+			leaders[next] = true
+		}
+	}
+
+	code := &jitCode{blocks: make(map[uint64]*jitBlock)}
+	var cur *jitBlock
+	for _, op := range ops {
+		fn := p.compileOp(op)
+		if fn == nil {
+			// Left for Step, to report the error.
+			cur = nil
+			continue
+		}
+		if cur == nil || leaders[op.XP] {
+			cur = &jitBlock{}
+			code.blocks[op.XP] = cur
+		}
+		cur.ops = append(cur.ops, op)
+		cur.fns = append(cur.fns, fn)
+	}
+	p.jit = code
+	return nil
+}
+
+// IsJITCompiled returns true iff CompileJIT has been called successfully.
+func (p *Program) IsJITCompiled() bool {
+	return p.jit != nil
+}
+
+// compileOp returns the jitFunc for op, or nil if op jumps out of the
+// program, which Step reports as an error.
+func (p *Program) compileOp(op Op) jitFunc {
+	var target uint64
+	if opJumps[op.Code] {
+		var ok bool
+		if target, ok = tryAddOffset(op.XP+uint64(op.Len), u2s(op.Imm0)); !ok {
+			return nil
+		}
+	}
+
+	switch op.Code {
+	case OpSAMEB:
+		b, n := byte(op.Imm0), op.Imm1
+		return func(x *Execution) error {
+			if x.matchByteN(b, n) {
+				x.DP += n
+			} else {
+				x.expectByte(b, n)
+				x.fail()
+			}
+			return nil
+		}
+
+	case OpLITB:
+		if op.Imm0 >= uint64(len(p.Literals)) {
+			break
+		}
+		lit := p.Literals[op.Imm0]
+		return func(x *Execution) error {
+			if n, good := x.matchLit(lit); good {
+				x.DP += n
+			} else {
+				x.expectLiteral(lit)
+				x.fail()
+			}
+			return nil
+		}
+
+	case OpMATCHB:
+		if op.Imm0 >= uint64(len(p.ByteSets)) {
+			break
+		}
+		m, n := p.ByteSets[op.Imm0], op.Imm1
+		return func(x *Execution) error {
+			if x.matchN(m, n) {
+				x.DP += n
+			} else {
+				x.expectSet(m)
+				x.fail()
+			}
+			return nil
+		}
+
+	case OpSPANB:
+		if op.Imm0 >= uint64(len(p.ByteSets)) {
+			break
+		}
+		m := p.ByteSets[op.Imm0]
+		return func(x *Execution) error {
+			for n := x.inputEnd(); x.DP < n && m.Match(x.byteAt(x.DP)); x.DP += 1 {
+				// pass
+			}
+			return nil
+		}
+
+	case OpJMP:
+		return func(x *Execution) error {
+			x.XP = target
+			return nil
+		}
+	}
+
+	handler := opHandlers[op.Code]
+	if handler == nil {
+		handler = execExt
+	}
+	return func(x *Execution) error {
+		return handler(x, &op)
+	}
+}
+
+// run is Run, using the compiled code.
+func (j *jitCode) run(x *Execution) error {
+	for x.R == RunningState {
+		b := j.blocks[x.XP]
+		if b == nil || x.Observer != nil || x.history != nil {
+			if err := x.Step(); err != nil {
+				return err
+			}
+			continue
+		}
+		for i := range b.ops {
+			op := &b.ops[i]
+			if x.Limits.MaxSteps != 0 && x.Steps >= x.Limits.MaxSteps {
+				return x.runtimeError(op, ErrBudgetExceeded)
+			}
+			x.Steps++
+			next := op.XP + uint64(op.Len)
+			x.XP = next
+			if err := b.fns[i](x); err != nil {
+				return x.runtimeError(op, err)
+			}
+			if x.stats != nil {
+				x.stats.observeStacks(x)
+			}
+			if err := x.checkLimits(); err != nil {
+				return x.runtimeError(op, err)
+			}
+			if x.progress != nil {
+				if err := x.progress.check(x); err != nil {
+					return x.runtimeError(op, err)
+				}
+			}
+			if x.R != RunningState || x.XP != next {
+				break
+			}
+		}
+	}
+	return nil
+}
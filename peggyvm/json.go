@@ -0,0 +1,261 @@
+package peggyvm
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
+)
+
+// jsonVersion is the version number written by Program.MarshalJSON. Fields
+// added since version 1, such as the kind of a capture, are optional, so it
+// has not needed to change.
+const jsonVersion = 1
+
+var (
+	_ json.Marshaler   = (*Program)(nil)
+	_ json.Unmarshaler = (*Program)(nil)
+)
+
+// jsonProgram is the JSON form of a Program. Byte slices become base64
+// strings, as usual for encoding/json, and so do DFAs in the encoding of
+// DFA.MarshalBinary; byte sets and rune sets are written in the syntax of
+// byteset.Parse and runeset.Parse, and entry points by label name.
+type jsonProgram struct {
+	Version       int               `json:"version"`
+	Bytes         []byte            `json:"bytes"`
+	Literals      [][]byte          `json:"literals,omitempty"`
+	ByteSets      []string          `json:"byteSets,omitempty"`
+	DFAs          [][]byte          `json:"dfas,omitempty"`
+	RuneSets      []string          `json:"runeSets,omitempty"`
+	JumpTables    []jsonJumpTable   `json:"jumpTables,omitempty"`
+	Captures      []jsonCapture     `json:"captures,omitempty"`
+	NamedCaptures map[string]uint64 `json:"namedCaptures,omitempty"`
+	Labels        []jsonLabel       `json:"labels,omitempty"`
+	Entries       []string          `json:"entries,omitempty"`
+	Debug         []jsonDebugEntry  `json:"debug,omitempty"`
+}
+
+type jsonJumpTable struct {
+	Keys    []byte   `json:"keys"`
+	Targets []uint64 `json:"targets"`
+}
+
+type jsonCapture struct {
+	Name   string `json:"name,omitempty"`
+	Repeat bool   `json:"repeat,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+}
+
+type jsonLabel struct {
+	Name   string `json:"name"`
+	Public bool   `json:"public,omitempty"`
+	Offset uint64 `json:"offset"`
+}
+
+type jsonDebugEntry struct {
+	XP   uint64 `json:"xp"`
+	File string `json:"file,omitempty"`
+	Line uint   `json:"line,omitempty"`
+	Rule string `json:"rule,omitempty"`
+}
+
+// MarshalJSON encodes the Program as a JSON object. The bytecode and the
+// literals are base64-encoded; everything else is structured, so that tools
+// outside of Go can inspect the labels, captures, and so on.
+func (p *Program) MarshalJSON() ([]byte, error) {
+	jp := jsonProgram{
+		Version:       jsonVersion,
+		Bytes:         p.Bytes,
+		Literals:      p.Literals,
+		NamedCaptures: p.NamedCaptures,
+	}
+	if jp.Bytes == nil {
+		jp.Bytes = []byte{}
+	}
+	for _, set := range p.ByteSets {
+		jp.ByteSets = append(jp.ByteSets, set.String())
+	}
+	for _, dfa := range p.DFAs {
+		raw, _ := dfa.MarshalBinary()
+		jp.DFAs = append(jp.DFAs, raw)
+	}
+	for _, set := range p.RuneSets {
+		jp.RuneSets = append(jp.RuneSets, set.String())
+	}
+	for _, table := range p.JumpTables {
+		jp.JumpTables = append(jp.JumpTables, jsonJumpTable{table.Keys, table.Targets})
+	}
+	for _, capture := range p.Captures {
+		jc := jsonCapture{Name: capture.Name, Repeat: capture.Repeat}
+		if capture.Kind != KindNone {
+			jc.Kind = capture.Kind.String()
+		}
+		jp.Captures = append(jp.Captures, jc)
+	}
+	for _, label := range p.Labels {
+		jp.Labels = append(jp.Labels, jsonLabel{label.Name, label.Public, label.Offset})
+	}
+	for _, label := range p.Entries {
+		jp.Entries = append(jp.Entries, label.Name)
+	}
+	for _, entry := range p.Debug {
+		jp.Debug = append(jp.Debug, jsonDebugEntry{entry.XP, entry.Pos.File, entry.Pos.Line, entry.Pos.Rule})
+	}
+	return json.Marshal(&jp)
+}
+
+// UnmarshalJSON decodes a Program encoded by MarshalJSON, replacing the
+// contents of p.
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var jp jsonProgram
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return err
+	}
+	if jp.Version != jsonVersion {
+		return ErrBadVersion
+	}
+
+	q := newEmptyProgram()
+	q.Bytes = jp.Bytes
+	q.Literals = jp.Literals
+	for _, text := range jp.ByteSets {
+		set, err := byteset.Parse(text)
+		if err != nil {
+			return err
+		}
+		q.ByteSets = append(q.ByteSets, set)
+	}
+	for _, raw := range jp.DFAs {
+		dfa := new(DFA)
+		if err := dfa.UnmarshalBinary(raw); err != nil {
+			return err
+		}
+		q.DFAs = append(q.DFAs, dfa)
+	}
+	for _, text := range jp.RuneSets {
+		set, err := runeset.Parse(text)
+		if err != nil {
+			return err
+		}
+		q.RuneSets = append(q.RuneSets, set)
+	}
+	for _, jt := range jp.JumpTables {
+		table := JumpTable{Keys: jt.Keys, Targets: jt.Targets}
+		if !table.wellFormed() {
+			return ErrBadJumpTable
+		}
+		q.JumpTables = append(q.JumpTables, table)
+	}
+	for _, capture := range jp.Captures {
+		meta := CaptureMeta{Name: capture.Name, Repeat: capture.Repeat}
+		if capture.Kind != "" {
+			kind, err := ParseCaptureKind(capture.Kind)
+			if err != nil {
+				return err
+			}
+			meta.Kind = kind
+		}
+		q.Captures = append(q.Captures, meta)
+	}
+	for name, idx := range jp.NamedCaptures {
+		q.NamedCaptures[name] = idx
+	}
+	for _, jl := range jp.Labels {
+		label := &Label{Name: jl.Name, Public: jl.Public, Offset: jl.Offset}
+		q.Labels = append(q.Labels, label)
+		q.LabelsByName[label.Name] = label
+	}
+	for _, name := range jp.Entries {
+		label := q.LabelsByName[name]
+		if label == nil {
+			return ErrBadEncoding
+		}
+		q.Entries = append(q.Entries, label)
+	}
+	for _, entry := range jp.Debug {
+		pos := SourcePos{File: entry.File, Line: entry.Line, Rule: entry.Rule}
+		q.Debug = append(q.Debug, DebugEntry{XP: entry.XP, Pos: pos})
+	}
+	*p = *q
+	return nil
+}
+
+// jsonOp is the JSON form of a decoded instruction, as written by
+// DisassembleJSON.
+type jsonOp struct {
+	XP     uint64    `json:"xp"`
+	Len    uint      `json:"len"`
+	Op     string    `json:"op"`
+	Labels []string  `json:"labels,omitempty"`
+	Imms   []jsonImm `json:"imms,omitempty"`
+}
+
+// jsonImm is the JSON form of an immediate. Value is an int64 for signed
+// types and a uint64 otherwise. Code offsets also carry the target address
+// and the name of the label there.
+type jsonImm struct {
+	Type   string      `json:"type"`
+	Value  interface{} `json:"value"`
+	Target *uint64     `json:"target,omitempty"`
+	Label  string      `json:"label,omitempty"`
+}
+
+// DisassembleJSON writes the program's decoded instruction stream as a JSON
+// array, with one object per instruction. Each object holds the code address,
+// the encoded length, the mnemonic, the names of any labels at that address,
+// and every immediate slot that the opcode uses, tagged with its ImmType:
+//
+//   {"xp":3,"len":2,"op":"CHOICE","labels":[".L0"],
+//    "imms":[{"type":"codeOffset","value":7,"target":12,"label":".L1"}]}
+//
+// Immediates are listed even when they equal their defaults.
+//
+func (p *Program) DisassembleJSON(w io.Writer) error {
+	labelsAt := make(map[uint64][]string, len(p.Labels))
+	for _, label := range p.Labels {
+		labelsAt[label.Offset] = append(labelsAt[label.Offset], label.Name)
+	}
+
+	list := []jsonOp{}
+	it := p.Instructions()
+	for it.Next() {
+		op := it.Op()
+		xp := it.XP()
+		jo := jsonOp{
+			XP:     xp,
+			Len:    op.Len,
+			Op:     op.Code.String(),
+			Labels: labelsAt[xp],
+		}
+		meta := op.Code.Meta()
+		for _, pair := range []struct {
+			m ImmMeta
+			v uint64
+		}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+			if pair.m.Type == ImmNone {
+				continue
+			}
+			ji := jsonImm{Type: pair.m.Type.String(), Value: pair.v}
+			if pair.m.Type.Signed() {
+				ji.Value = u2s(pair.v)
+			}
+			if pair.m.Type == ImmCodeOffset {
+				target, _, err := opTarget(op, uint64(len(p.Bytes)))
+				if err != nil {
+					return err
+				}
+				ji.Target = &target
+				ji.Label = p.FindLabel(target).Name
+			}
+			jo.Imms = append(jo.Imms, ji)
+		}
+		list = append(list, jo)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(list)
+}
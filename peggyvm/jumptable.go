@@ -0,0 +1,54 @@
+package peggyvm
+
+import (
+	"sort"
+)
+
+// JumpTable maps bytes to code addresses. It is used by the DISPATCH
+// instruction to branch on the byte at the current data position.
+type JumpTable struct {
+	// Keys lists the bytes that have a target, in strictly ascending
+	// order.
+	Keys []byte
+
+	// Targets holds the absolute XP to jump to for each of Keys.
+	Targets []uint64
+}
+
+// Lookup returns the target for b, or false if b has none.
+func (t *JumpTable) Lookup(b byte) (uint64, bool) {
+	i := sort.Search(len(t.Keys), func(i int) bool {
+		return t.Keys[i] >= b
+	})
+	if i < len(t.Keys) && t.Keys[i] == b {
+		return t.Targets[i], true
+	}
+	return 0, false
+}
+
+// wellFormed returns true iff Keys is sorted and matches Targets in length.
+func (t *JumpTable) wellFormed() bool {
+	if len(t.Keys) != len(t.Targets) {
+		return false
+	}
+	for i := 1; i < len(t.Keys); i++ {
+		if t.Keys[i-1] >= t.Keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// distinctTargets returns the targets of t, without duplicates, in order of
+// first appearance.
+func (t *JumpTable) distinctTargets() []uint64 {
+	seen := make(map[uint64]struct{}, len(t.Targets))
+	var out []uint64
+	for _, target := range t.Targets {
+		if _, found := seen[target]; !found {
+			seen[target] = struct{}{}
+			out = append(out, target)
+		}
+	}
+	return out
+}
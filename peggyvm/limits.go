@@ -0,0 +1,154 @@
+package peggyvm
+
+import (
+	"bytes"
+)
+
+const (
+	// DefaultMaxStackDepth is the cap on the length of Execution.CS when
+	// Limits.MaxStackDepth is zero.
+	DefaultMaxStackDepth = 1 << 20
+
+	// DefaultMaxAssignments is the cap on the length of Execution.KS when
+	// Limits.MaxAssignments is zero.
+	DefaultMaxAssignments = 1 << 22
+
+	// DefaultMaxMemoEntries is the cap on the number of results in the
+	// memo table of MEMOGET and MEMOSET when Limits.MaxMemoEntries is zero.
+	DefaultMaxMemoEntries = 1 << 16
+
+	// MaxCaptures is the largest number of captures that the %captures
+	// directive of the assembly dialect may declare. Capture indices in
+	// %namedcapture, %repeatcapture, and %capturekind are bounded likewise.
+	MaxCaptures = 1 << 16
+
+	// NoLimit may be given as MaxStackDepth, MaxAssignments, or
+	// MaxMemoEntries to lift the default cap.
+	NoLimit = ^uint64(0)
+)
+
+// Limits caps the resources that a Program may use. A zero field means that
+// there is no limit, except for MaxStackDepth and MaxAssignments, which
+// default to caps large enough for any reasonable grammar and input but
+// small enough that runaway recursion or repetition fails with a
+// RuntimeError instead of exhausting memory.
+type Limits struct {
+	// MaxCodeSize caps the length of the bytecode accepted by LoadUntrusted.
+	MaxCodeSize uint64
+
+	// MaxSteps caps the number of instructions that an Execution may run
+	// before it halts with ErrBudgetExceeded.
+	MaxSteps uint64
+
+	// MaxBacktracks caps the number of times that an Execution may
+	// backtrack to a pending CHOICE, beyond which it halts with
+	// ErrBudgetExceeded. Unlike MaxSteps, it does not grow with the
+	// length of a match that succeeds without backtracking, and so it can
+	// be set tightly to catch grammars that backtrack exponentially.
+	MaxBacktracks uint64
+
+	// MaxStackDepth caps the length of Execution.CS, beyond which the
+	// Execution halts with ErrStackLimit. If zero, DefaultMaxStackDepth
+	// applies.
+	MaxStackDepth uint64
+
+	// MaxAssignments caps the length of Execution.KS, beyond which the
+	// Execution halts with ErrCaptureLimit. If zero,
+	// DefaultMaxAssignments applies.
+	MaxAssignments uint64
+
+	// MaxMemoEntries caps the number of results that MEMOSET keeps, and
+	// that failures of memoized rules leave behind, beyond which the
+	// oldest are forgotten. Forgetting a result only costs the time to
+	// compute it again. If zero, DefaultMaxMemoEntries applies.
+	MaxMemoEntries uint64
+
+	// AllowExtOpCodes permits LoadUntrusted to accept extension opcodes
+	// that have been registered with RegisterOpCode. By default, their
+	// handlers are not trusted to cope with hostile bytecode.
+	AllowExtOpCodes bool
+}
+
+// LoadUntrusted decodes a Program from data, which may hold either a program
+// file (as written by WriteProgram) or the output of Program.MarshalBinary,
+// and which need not come from a trusted source.
+//
+// The Program is rejected unless it passes Validate in full, and unless its
+// named captures, labels, and entry points are consistent with its code.
+// Once loaded, its Limits field is set to limits, so that every Execution of
+// it is held to the step, stack, and capture caps. Even with all of these
+// checks, limits should not be left at zero for input that is untrusted too.
+//
+func LoadUntrusted(data []byte, limits Limits) (*Program, error) {
+	var p *Program
+	if bytes.HasPrefix(data, []byte(fileMagic)) {
+		var err error
+		p, err = ReadProgram(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		p = new(Program)
+		if err := p.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+	}
+
+	end := uint64(len(p.Bytes))
+	if limits.MaxCodeSize != 0 && end > limits.MaxCodeSize {
+		return nil, ErrCodeSizeLimit
+	}
+	if errs := p.Validate(); len(errs) != 0 {
+		return nil, errs[0]
+	}
+	if !limits.AllowExtOpCodes {
+		it := p.Instructions()
+		for it.Next() {
+			if code := it.Op().Code; code >= MinExtOpCode && code <= MaxExtOpCode {
+				return nil, p.annotate(&VerifyError{Err: ErrUnknownOpcode, XP: it.XP()})
+			}
+		}
+	}
+	for _, idx := range p.NamedCaptures {
+		if idx >= uint64(len(p.Captures)) {
+			return nil, ErrIndexRange
+		}
+	}
+	for _, label := range p.Labels {
+		if label.Offset > end {
+			return nil, ErrCodeOffsetRange
+		}
+	}
+	for i := 1; i < len(p.Labels); i++ {
+		if p.Labels[i].Offset < p.Labels[i-1].Offset {
+			return nil, ErrBadEncoding
+		}
+	}
+
+	p.Limits = limits
+	return p, nil
+}
+
+// stackDepth returns the effective cap on the length of Execution.CS.
+func (l Limits) stackDepth() uint64 {
+	if l.MaxStackDepth == 0 {
+		return DefaultMaxStackDepth
+	}
+	return l.MaxStackDepth
+}
+
+// memoEntries returns the effective cap on the size of the memo table.
+func (l Limits) memoEntries() uint64 {
+	if l.MaxMemoEntries == 0 {
+		return DefaultMaxMemoEntries
+	}
+	return l.MaxMemoEntries
+}
+
+// assignments returns the effective cap on the length of Execution.KS.
+func (l Limits) assignments() uint64 {
+	if l.MaxAssignments == 0 {
+		return DefaultMaxAssignments
+	}
+	return l.MaxAssignments
+}
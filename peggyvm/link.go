@@ -0,0 +1,121 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// Object is a relocatable unit of code: a Program that may call rules defined
+// by other Objects. Link combines Objects into a single Program.
+type Object struct {
+	// Program holds the object's code, literals, byte sets, captures, and
+	// labels. Program.Entries lists the labels that the object exports.
+	Program *Program
+
+	// Relocs lists the ops whose code offsets are left unresolved.
+	Relocs []Reloc
+}
+
+// Reloc is an unresolved reference to a label exported by another Object.
+type Reloc struct {
+	// XP is the address of the op that refers to the label. The op's code
+	// offset is a placeholder, to be replaced by Link.
+	XP uint64
+
+	// Symbol is the name of the label.
+	Symbol string
+}
+
+// FinishObject is like Finish, but returns an Object. Rather than being an
+// error, a reference to a public label that is never emitted becomes a Reloc,
+// to be resolved by Link. References to private labels must still be
+// resolved locally.
+//
+func (a *Assembler) FinishObject() (*Object, error) {
+	if err := a.resolveSymbols(); err != nil {
+		return nil, err
+	}
+	if err := a.linkFragments(); err != nil {
+		return nil, err
+	}
+
+	type pending struct {
+		item   *AsmItem
+		symbol string
+	}
+	var relocs []pending
+	for _, item := range a.List {
+		if !item.IsOp || item.Fixed || item.FixBlockedBy == nil {
+			continue
+		}
+		label := item.FixBlockedBy
+		if label.Seen || !label.Public {
+			continue
+		}
+		item.applyFixup(0)
+		item.generate()
+		relocs = append(relocs, pending{item, label.Name})
+	}
+
+	if err := a.checkLabels(); err != nil {
+		return nil, err
+	}
+	a.Fix()
+
+	obj := &Object{Program: a.build()}
+	for _, r := range relocs {
+		obj.Relocs = append(obj.Relocs, Reloc{XP: r.item.XP, Symbol: r.symbol})
+	}
+	return obj, nil
+}
+
+// Link combines objs into a single Program, laid out in the order given.
+// Execution begins at the start of the first object. Each object's Relocs are
+// resolved against the labels exported by all the objects; its literals and
+// byte sets are merged with those of the other objects, and its captures are
+// renumbered to follow theirs. The combined program's Entries are the
+// objects' exports.
+//
+// Exporting the same label from two objects is an error, as is a Reloc that
+// no object exports.
+//
+func Link(objs ...*Object) (*Program, error) {
+	owners := make(map[string]int)
+	for i, obj := range objs {
+		for _, entry := range obj.Program.Entries {
+			if _, dupe := owners[entry.Name]; dupe {
+				return nil, &LabelError{Err: ErrDuplicateLabel, Label: entry.Name}
+			}
+			owners[entry.Name] = i
+		}
+	}
+
+	a := NewAssembler()
+	for i, obj := range objs {
+		p := obj.Program
+		exports := make(map[string]struct{}, len(p.Entries))
+		for _, entry := range p.Entries {
+			exports[entry.Name] = struct{}{}
+		}
+		relocs := make(map[uint64]string, len(obj.Relocs))
+		for _, r := range obj.Relocs {
+			relocs[r.XP] = r.Symbol
+		}
+
+		if a.canFallOffEnd() {
+			a.EmitOp(OpEND.Meta(), nil, nil, nil)
+		}
+		capBase, err := a.importProgram(p, fmt.Sprintf(".O%d/", i), exports, relocs, "")
+		if err != nil {
+			return nil, err
+		}
+		for name, idx := range p.NamedCaptures {
+			if _, found := a.NamedCaptures[name]; !found {
+				a.NamedCaptures[name] = capBase + idx
+			}
+		}
+		for _, entry := range p.Entries {
+			a.DeclareEntry(entry.Name)
+		}
+	}
+	return a.Finish()
+}
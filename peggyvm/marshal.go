@@ -0,0 +1,416 @@
+package peggyvm
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"sort"
+
+	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
+)
+
+// programVersion is the version byte written by Program.MarshalBinary.
+// Versions 1, which lacked capture kinds, 2, which lacked DFAs, 3, which
+// lacked jump tables, and 4, which lacked rune sets, are still accepted.
+const programVersion = 5
+
+var (
+	_ encoding.BinaryMarshaler   = (*Program)(nil)
+	_ encoding.BinaryUnmarshaler = (*Program)(nil)
+)
+
+// MarshalBinary encodes the Program, so that it can be stored and later
+// loaded with UnmarshalBinary instead of being recompiled.
+//
+// The encoding is a version byte, followed by each field of the Program in
+// declaration order. Integers are written as uvarints; strings and byte
+// slices, as a uvarint length followed by the bytes; lists, as a uvarint
+// count followed by the items. Byte sets and rune sets are written in the
+// syntax of byteset.Parse and runeset.Parse, so that a set built from a
+// Unicode property stays as short as its name; DFAs are written as in
+// DFA.MarshalBinary, and entry points by label name. The kind of each
+// capture, the DFAs, the jump tables, and the rune sets come last, as they
+// were added in versions 2, 3, 4, and 5 respectively.
+//
+func (p *Program) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.buf.WriteByte(programVersion)
+	e.bytes(p.Bytes)
+	e.literals(p)
+	e.byteSets(p)
+	e.captures(p)
+	e.labels(p)
+	e.debug(p)
+	e.captureKinds(p)
+	e.dfas(p)
+	e.jumpTables(p)
+	e.runeSets(p)
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a Program encoded by MarshalBinary, replacing the
+// contents of p.
+func (p *Program) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return ErrBadEncoding
+	}
+	if data[0] < 1 || data[0] > programVersion {
+		return ErrBadVersion
+	}
+	d := &binaryDecoder{data: data[1:]}
+	q := newEmptyProgram()
+	q.Bytes = d.bytes()
+	d.literals(q)
+	d.byteSets(q)
+	d.captures(q)
+	d.labels(q)
+	d.debug(q)
+	if data[0] >= 2 {
+		d.captureKinds(q)
+	}
+	if data[0] >= 3 {
+		d.dfas(q)
+	}
+	if data[0] >= 4 {
+		d.jumpTables(q)
+	}
+	if data[0] >= 5 {
+		d.runeSets(q)
+	}
+	if d.bad || len(d.data) != 0 {
+		return ErrBadEncoding
+	}
+	*p = *q
+	return nil
+}
+
+func newEmptyProgram() *Program {
+	return &Program{
+		NamedCaptures: make(map[string]uint64),
+		LabelsByName:  make(map[string]*Label),
+	}
+}
+
+func (e *binaryEncoder) literals(p *Program) {
+	e.uint(uint64(len(p.Literals)))
+	for _, lit := range p.Literals {
+		e.bytes(lit)
+	}
+}
+
+func (e *binaryEncoder) byteSets(p *Program) {
+	e.uint(uint64(len(p.ByteSets)))
+	for _, set := range p.ByteSets {
+		e.string(set.String())
+	}
+}
+
+// captures encodes both Captures and NamedCaptures.
+func (e *binaryEncoder) captures(p *Program) {
+	e.uint(uint64(len(p.Captures)))
+	for _, capture := range p.Captures {
+		e.string(capture.Name)
+		e.bool(capture.Repeat)
+	}
+
+	names := make([]string, 0, len(p.NamedCaptures))
+	for name := range p.NamedCaptures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.uint(uint64(len(names)))
+	for _, name := range names {
+		e.string(name)
+		e.uint(p.NamedCaptures[name])
+	}
+}
+
+// labels encodes both Labels and Entries.
+func (e *binaryEncoder) labels(p *Program) {
+	e.uint(uint64(len(p.Labels)))
+	for _, label := range p.Labels {
+		e.string(label.Name)
+		e.bool(label.Public)
+		e.xp(label.Offset)
+	}
+
+	e.uint(uint64(len(p.Entries)))
+	for _, label := range p.Entries {
+		e.string(label.Name)
+	}
+}
+
+func (e *binaryEncoder) debug(p *Program) {
+	e.uint(uint64(len(p.Debug)))
+	for _, entry := range p.Debug {
+		e.xp(entry.XP)
+		e.string(entry.Pos.File)
+		e.uint(uint64(entry.Pos.Line))
+		e.string(entry.Pos.Rule)
+	}
+}
+
+// captureKinds encodes the Kind of each capture. It is separate from
+// captures, so that older encodings without it remain readable.
+func (e *binaryEncoder) captureKinds(p *Program) {
+	e.uint(uint64(len(p.Captures)))
+	for _, capture := range p.Captures {
+		e.uint(uint64(capture.Kind))
+	}
+}
+
+func (e *binaryEncoder) dfas(p *Program) {
+	e.uint(uint64(len(p.DFAs)))
+	for _, dfa := range p.DFAs {
+		raw, _ := dfa.MarshalBinary()
+		e.bytes(raw)
+	}
+}
+
+// jumpTables encodes each table as its keys, followed by one XP per key.
+func (e *binaryEncoder) jumpTables(p *Program) {
+	e.uint(uint64(len(p.JumpTables)))
+	for _, table := range p.JumpTables {
+		e.bytes(table.Keys)
+		for _, target := range table.Targets {
+			e.xp(target)
+		}
+	}
+}
+
+func (e *binaryEncoder) runeSets(p *Program) {
+	e.uint(uint64(len(p.RuneSets)))
+	for _, set := range p.RuneSets {
+		e.string(set.String())
+	}
+}
+
+func (d *binaryDecoder) literals(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		q.Literals = append(q.Literals, d.bytes())
+	}
+}
+
+func (d *binaryDecoder) byteSets(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		set, err := byteset.Parse(d.string())
+		if err != nil {
+			d.fail()
+			return
+		}
+		q.ByteSets = append(q.ByteSets, set)
+	}
+}
+
+func (d *binaryDecoder) captures(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		var capture CaptureMeta
+		capture.Name = d.string()
+		capture.Repeat = d.bool()
+		q.Captures = append(q.Captures, capture)
+	}
+
+	for n := d.count(); n > 0; n-- {
+		name := d.string()
+		q.NamedCaptures[name] = d.uint()
+	}
+}
+
+func (d *binaryDecoder) captureKinds(q *Program) {
+	if d.count() != uint64(len(q.Captures)) {
+		d.fail()
+		return
+	}
+	for i := range q.Captures {
+		kind := d.uint()
+		if kind >= uint64(len(captureKindNames)) {
+			d.fail()
+			return
+		}
+		q.Captures[i].Kind = CaptureKind(kind)
+	}
+}
+
+func (d *binaryDecoder) dfas(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		dfa := new(DFA)
+		if err := dfa.UnmarshalBinary(d.bytes()); err != nil {
+			d.fail()
+			return
+		}
+		q.DFAs = append(q.DFAs, dfa)
+	}
+}
+
+func (d *binaryDecoder) jumpTables(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		var table JumpTable
+		table.Keys = d.bytes()
+		for range table.Keys {
+			table.Targets = append(table.Targets, d.xp())
+		}
+		if d.bad || !table.wellFormed() {
+			d.fail()
+			return
+		}
+		q.JumpTables = append(q.JumpTables, table)
+	}
+}
+
+func (d *binaryDecoder) runeSets(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		set, err := runeset.Parse(d.string())
+		if err != nil {
+			d.fail()
+			return
+		}
+		q.RuneSets = append(q.RuneSets, set)
+	}
+}
+
+func (d *binaryDecoder) labels(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		label := &Label{}
+		label.Name = d.string()
+		label.Public = d.bool()
+		label.Offset = d.xp()
+		q.Labels = append(q.Labels, label)
+		q.LabelsByName[label.Name] = label
+	}
+
+	for n := d.count(); n > 0; n-- {
+		label := q.LabelsByName[d.string()]
+		if label == nil {
+			d.fail()
+			return
+		}
+		q.Entries = append(q.Entries, label)
+	}
+}
+
+func (d *binaryDecoder) debug(q *Program) {
+	for n := d.count(); n > 0; n-- {
+		var entry DebugEntry
+		entry.XP = d.xp()
+		entry.Pos.File = d.string()
+		entry.Pos.Line = uint(d.uint())
+		entry.Pos.Rule = d.string()
+		q.Debug = append(q.Debug, entry)
+	}
+}
+
+type binaryEncoder struct {
+	buf     bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+
+	// delta is true if XPs are written as the difference from the last XP
+	// written, as in the compressed sections of a program file.
+	delta  bool
+	lastXP uint64
+}
+
+func (e *binaryEncoder) uint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf.Write(e.scratch[:n])
+}
+
+func (e *binaryEncoder) xp(v uint64) {
+	if !e.delta {
+		e.uint(v)
+		return
+	}
+	n := binary.PutVarint(e.scratch[:], int64(v-e.lastXP))
+	e.buf.Write(e.scratch[:n])
+	e.lastXP = v
+}
+
+func (e *binaryEncoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *binaryEncoder) bytes(v []byte) {
+	e.uint(uint64(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *binaryEncoder) string(v string) {
+	e.uint(uint64(len(v)))
+	e.buf.WriteString(v)
+}
+
+// binaryDecoder is the inverse of binaryEncoder. Once any read fails, bad is
+// set and all further reads return zero values.
+type binaryDecoder struct {
+	data   []byte
+	bad    bool
+	delta  bool
+	lastXP uint64
+}
+
+func (d *binaryDecoder) fail() {
+	d.bad = true
+	d.data = nil
+}
+
+func (d *binaryDecoder) uint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) xp() uint64 {
+	if !d.delta {
+		return d.uint()
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	d.lastXP += uint64(v)
+	return d.lastXP
+}
+
+// count reads a list length, which cannot exceed the number of bytes left.
+func (d *binaryDecoder) count() uint64 {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return 0
+	}
+	return n
+}
+
+func (d *binaryDecoder) bool() bool {
+	if len(d.data) == 0 || d.data[0] > 1 {
+		d.fail()
+		return false
+	}
+	v := d.data[0] == 1
+	d.data = d.data[1:]
+	return v
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	n := d.count()
+	if d.bad {
+		return nil
+	}
+	v := append([]byte(nil), d.data[:n]...)
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) string() string {
+	return string(d.bytes())
+}
@@ -0,0 +1,121 @@
+package peggyvm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Matcher runs a Program on behalf of many goroutines at once. Each call
+// borrows an Execution from a pool, and returns it when done, so that the
+// capture stack, the frame stack, and the history buffer are reused instead
+// of being allocated afresh as by Program.Match. Only the Result is
+// allocated for each match.
+//
+// A Matcher is safe for concurrent use, as long as the Program is not
+// modified while it is in use.
+//
+type Matcher struct {
+	// P is the program to run.
+	P *Program
+
+	pool sync.Pool
+}
+
+// NewMatcher returns a Matcher for p. It precompiles p, if it is not already
+// precompiled, so that executions share the decoded instructions; it returns
+// an error if the bytecode cannot be decoded.
+func NewMatcher(p *Program) (*Matcher, error) {
+	if !p.IsPrecompiled() {
+		if err := p.Precompile(); err != nil {
+			return nil, err
+		}
+	}
+	return &Matcher{P: p}, nil
+}
+
+// Match is like Program.Match.
+func (m *Matcher) Match(input []byte) Result {
+	x := m.get(input)
+	defer m.put(x)
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.Result()
+}
+
+// IsMatch is like Program.IsMatch.
+func (m *Matcher) IsMatch(input []byte) bool {
+	x := m.get(input)
+	defer m.put(x)
+	x.MatchOnly = true
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.R == SuccessState
+}
+
+// MatchAt is like Program.MatchAt.
+func (m *Matcher) MatchAt(input []byte, start uint64) Result {
+	if start > uint64(len(input)) {
+		panic(fmt.Errorf("peggyvm: MatchAt: start %d is past the end of the input (%d)", start, len(input)))
+	}
+	x := m.get(input)
+	defer m.put(x)
+	x.DP = start
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.Result()
+}
+
+// MatchContext is like Program.MatchContext.
+func (m *Matcher) MatchContext(ctx context.Context, input []byte) (Result, error) {
+	x := m.get(input)
+	defer m.put(x)
+	if err := x.RunContext(ctx); err != nil {
+		return Result{}, err
+	}
+	return x.Result(), nil
+}
+
+// get returns an Execution of P on input, as Exec would, reusing a pooled
+// one if there is one.
+func (m *Matcher) get(input []byte) *Execution {
+	x, _ := m.pool.Get().(*Execution)
+	if x == nil {
+		return m.P.Exec(input)
+	}
+	history := x.history
+	*x = Execution{
+		P:      m.P,
+		I:      input,
+		KS:     x.KS[:0],
+		CS:     x.CS[:0],
+		Limits: m.P.Limits,
+	}
+	if n := m.P.HistorySize; n > 0 && len(history) == n {
+		x.history = history
+	} else {
+		x.KeepHistory(n)
+	}
+	if m.P.KeepStats {
+		x.KeepStats()
+	}
+	return x
+}
+
+// put returns x to the pool. The input and the last match's assignments are
+// dropped first, so that the pool does not keep them alive. As with
+// stackPool, stacks that grew past maxPooledStack are not kept either.
+func (m *Matcher) put(x *Execution) {
+	x.I = nil
+	x.KS = x.KS[:0]
+	if cap(x.KS) > maxPooledStack {
+		x.KS = nil
+	}
+	if cap(x.CS) > maxPooledStack {
+		x.CS = nil
+	}
+	m.pool.Put(x)
+}
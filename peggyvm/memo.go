@@ -0,0 +1,130 @@
+package peggyvm
+
+// memoKey identifies a memoized result: the rule ID given to MEMOGET and
+// MEMOSET, and the position at which the rule was tried.
+type memoKey struct {
+	rule uint64
+	dp   uint64
+}
+
+// memoEntry is the outcome of trying a rule at a position: whether it
+// matched, how many bytes it consumed, and the capture assignments it made.
+type memoEntry struct {
+	ok bool
+	n  uint64
+	ks []Assignment
+}
+
+// memoTable holds the results stored by MEMOSET, and the failures recorded
+// when a MEMOGET frame is unwound.
+//
+// Once the table holds Limits.memoEntries() results, storing another evicts
+// the oldest. As a packrat parse mostly moves forward through the input, the
+// oldest results are those for the positions that are least likely to be
+// tried again.
+type memoTable struct {
+	entries map[memoKey]*memoEntry
+
+	// order lists the keys of entries in the order they were stored, as a
+	// ring buffer of which order[next] is the oldest once it is full.
+	order []memoKey
+	next  int
+}
+
+func (t *memoTable) get(key memoKey) *memoEntry {
+	if t == nil {
+		return nil
+	}
+	return t.entries[key]
+}
+
+// clone returns a copy of t that can be updated without affecting t. The
+// entries themselves are shared, as they are never modified once stored.
+func (t *memoTable) clone() *memoTable {
+	u := &memoTable{
+		entries: make(map[memoKey]*memoEntry, len(t.entries)),
+		order:   append([]memoKey(nil), t.order...),
+		next:    t.next,
+	}
+	for key, entry := range t.entries {
+		u.entries[key] = entry
+	}
+	return u
+}
+
+func (t *memoTable) put(key memoKey, entry *memoEntry, limit uint64) {
+	if limit == 0 {
+		return
+	}
+	if _, found := t.entries[key]; !found {
+		if uint64(len(t.order)) < limit {
+			t.order = append(t.order, key)
+		} else {
+			delete(t.entries, t.order[t.next])
+			t.order[t.next] = key
+			t.next = (t.next + 1) % len(t.order)
+		}
+	}
+	t.entries[key] = entry
+}
+
+// memoize stores entry as the result of the rule at the position given by
+// key, creating the table if need be.
+func (x *Execution) memoize(key memoKey, entry *memoEntry) {
+	if x.memo == nil {
+		x.memo = &memoTable{entries: make(map[memoKey]*memoEntry)}
+	}
+	x.memo.put(key, entry, x.Limits.memoEntries())
+}
+
+func execMEMOGET(x *Execution, op *Op) error {
+	entry := x.memo.get(memoKey{op.Imm1, x.DP})
+	if entry == nil {
+		x.CS = append(x.CS, Frame{
+			Memo:  true,
+			DP:    x.DP,
+			XP:    op.Imm1,
+			KSLen: uint64(len(x.KS)),
+			VSLen: uint64(len(x.vs)),
+		})
+		return nil
+	}
+	if !entry.ok {
+		x.fail()
+		return nil
+	}
+	if x.availableBytes() < entry.n {
+		return ErrCountRange
+	}
+	x.KS = append(x.KS, entry.ks...)
+	x.DP += entry.n
+	x.XP = addOffset(x.XP, u2s(op.Imm0))
+	return nil
+}
+
+func execMEMOSET(x *Execution, op *Op) error {
+	fr, ok := x.popCS()
+	if !ok {
+		return ErrEmptyStack
+	}
+	if fr.IsChoice {
+		return ErrChoiceFailFrame
+	}
+	if !fr.Memo {
+		return ErrCallRetFrame
+	}
+	if fr.XP != op.Imm0 {
+		return ErrMemoFrame
+	}
+	if uint64(len(x.vs)) != fr.VSLen {
+		// The rule pushed values, which cannot be replayed: the entries
+		// of the value stack point at the entries below them.
+		return nil
+	}
+	x.memoize(memoKey{op.Imm0, fr.DP}, &memoEntry{
+		ok: true,
+		n:  x.DP - fr.DP,
+		ks: append([]Assignment(nil), x.KS[fr.KSLen:]...),
+	})
+	return nil
+}
@@ -0,0 +1,381 @@
+// Package mutate perturbs valid peggyvm Programs into hostile ones, for
+// exercising the verifier and the VM's error paths.
+//
+//   m := mutate.New(rand.New(rand.NewSource(1)))
+//   for i := 0; i < 1000; i++ {
+//           q, _ := m.Mutate(p)
+//           if errs := q.Validate(); len(errs) == 0 {
+//                   q.Match(input)
+//           }
+//   }
+//
+// Each mutation changes a single thing: an immediate, an opcode, or the
+// length of the code. The result is always decodable, meaning that its
+// bytecode is a sequence of well-formed instructions with legal opcodes, so
+// that the damage reaches the analyses and the VM rather than stopping at
+// the decoder. Code offsets in untouched instructions are adjusted to keep
+// pointing at the same instructions, as are labels, debug entries, and jump
+// tables, so that the mutated instruction is the only source of trouble.
+//
+package mutate
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/chronos-tachyon/go-peggy/peggyvm"
+)
+
+// Kind identifies a type of mutation.
+type Kind uint8
+
+const (
+	// FlipImmediate replaces one immediate of one instruction with a
+	// nearby, extreme, or bit-flipped value.
+	FlipImmediate Kind = iota
+
+	// SwapOpCode replaces the opcode of one instruction with another
+	// legal opcode, keeping its immediates.
+	SwapOpCode
+
+	// Truncate drops every instruction from a random one onward.
+	Truncate
+
+	// DeleteOp removes one instruction.
+	DeleteOp
+
+	// DuplicateOp repeats one instruction.
+	DuplicateOp
+)
+
+var kindNames = []string{
+	"FlipImmediate",
+	"SwapOpCode",
+	"Truncate",
+	"DeleteOp",
+	"DuplicateOp",
+}
+
+// AllKinds lists every Kind.
+var AllKinds = []Kind{FlipImmediate, SwapOpCode, Truncate, DeleteOp, DuplicateOp}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", uint8(k))
+}
+
+// Mutator applies random mutations to Programs.
+type Mutator struct {
+	// Rand is the source of randomness.
+	Rand *rand.Rand
+
+	// Kinds lists the mutations to choose among. If empty, AllKinds is
+	// used.
+	Kinds []Kind
+}
+
+// New returns a Mutator that draws from r and uses every Kind.
+func New(r *rand.Rand) *Mutator {
+	return &Mutator{Rand: r}
+}
+
+// Mutate returns a mutated copy of p, together with the Kind of the mutation
+// applied. p itself is not modified. It panics if p does not decode; the
+// output of Mutate always does.
+//
+// If p has no instructions, or the chosen mutation has nothing to act on,
+// the copy is returned unchanged.
+//
+func (m *Mutator) Mutate(p *peggyvm.Program) (*peggyvm.Program, Kind) {
+	kinds := m.Kinds
+	if len(kinds) == 0 {
+		kinds = AllKinds
+	}
+	kind := kinds[m.Rand.Intn(len(kinds))]
+	return m.Apply(p, kind), kind
+}
+
+// MutateN applies n mutations in turn, and returns the result.
+func (m *Mutator) MutateN(p *peggyvm.Program, n int) *peggyvm.Program {
+	for i := 0; i < n; i++ {
+		p, _ = m.Mutate(p)
+	}
+	return p
+}
+
+// Apply returns a copy of p with one mutation of the given kind.
+func (m *Mutator) Apply(p *peggyvm.Program, kind Kind) *peggyvm.Program {
+	ops := decode(p)
+	if len(ops) == 0 {
+		return rebuild(p, ops)
+	}
+	i := m.Rand.Intn(len(ops))
+	switch kind {
+	case FlipImmediate:
+		op := &ops[i]
+		meta := op.Code.Meta()
+		slots := usedSlots(meta)
+		if len(slots) == 0 {
+			break
+		}
+		slot := slots[m.Rand.Intn(len(slots))]
+		v := op.imm(slot)
+		op.setImm(slot, m.nextValue(p, immType(meta, slot), v))
+		op.raw = true
+
+	case SwapOpCode:
+		codes := legalOpCodes()
+		ops[i].Code = codes[m.Rand.Intn(len(codes))]
+		ops[i].raw = true
+
+	case Truncate:
+		ops = ops[:i]
+
+	case DeleteOp:
+		ops = append(ops[:i], ops[i+1:]...)
+
+	case DuplicateOp:
+		dup := ops[i]
+		dup.origXP = noXP
+		ops = append(ops[:i+1], append([]op{dup}, ops[i+1:]...)...)
+
+	default:
+		panic(fmt.Errorf("unknown mutation %v", kind))
+	}
+	return rebuild(p, ops)
+}
+
+// nextValue picks a replacement for the immediate v, of type t.
+func (m *Mutator) nextValue(p *peggyvm.Program, t peggyvm.ImmType, v uint64) uint64 {
+	for {
+		var w uint64
+		switch m.Rand.Intn(4) {
+		case 0:
+			w = v + 1
+		case 1:
+			w = v - 1
+		case 2:
+			w = v ^ (1 << uint(m.Rand.Intn(64)))
+		default:
+			values := interesting(p, t)
+			w = values[m.Rand.Intn(len(values))]
+		}
+		if w != v {
+			return w
+		}
+	}
+}
+
+// interesting returns values of type t that are likely to be mishandled.
+func interesting(p *peggyvm.Program, t peggyvm.ImmType) []uint64 {
+	out := []uint64{0, 1, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10ffff, 0x110000, 1 << 31, 1 << 32, 1 << 63, ^uint64(0)}
+	switch t {
+	case peggyvm.ImmLiteralIdx:
+		out = append(out, uint64(len(p.Literals)))
+	case peggyvm.ImmMatcherIdx:
+		out = append(out, uint64(len(p.ByteSets)))
+	case peggyvm.ImmCaptureIdx:
+		out = append(out, uint64(len(p.Captures)))
+	case peggyvm.ImmDFAIdx:
+		out = append(out, uint64(len(p.DFAs)))
+	case peggyvm.ImmRuneSetIdx:
+		out = append(out, uint64(len(p.RuneSets)))
+	case peggyvm.ImmJumpTableIdx:
+		out = append(out, uint64(len(p.JumpTables)))
+	case peggyvm.ImmPredicateIdx:
+		out = append(out, uint64(len(p.Predicates())))
+	case peggyvm.ImmFolderIdx:
+		out = append(out, uint64(len(p.Folders())))
+	case peggyvm.ImmCodeOffset:
+		n := uint64(len(p.Bytes))
+		out = append(out, n, -n, n+1)
+	}
+	return out
+}
+
+// legalOpCodes returns the opcodes that decode.
+func legalOpCodes() []peggyvm.OpCode {
+	var out []peggyvm.OpCode
+	for c := peggyvm.OpCode(0); c <= peggyvm.OpEND; c++ {
+		if !c.Meta().Illegal {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// immType returns the type of immediate slot 0, 1, or 2 of meta.
+func immType(meta *peggyvm.OpMeta, slot int) peggyvm.ImmType {
+	switch slot {
+	case 0:
+		return meta.Imm0.Type
+	case 1:
+		return meta.Imm1.Type
+	default:
+		return meta.Imm2.Type
+	}
+}
+
+// usedSlots returns the indices of the immediate slots of meta that are not
+// ImmNone.
+func usedSlots(meta *peggyvm.OpMeta) []int {
+	var out []int
+	for slot := 0; slot < 3; slot++ {
+		if immType(meta, slot) != peggyvm.ImmNone {
+			out = append(out, slot)
+		}
+	}
+	return out
+}
+
+// noXP marks an op that has no counterpart in the original code.
+const noXP = ^uint64(0)
+
+// op is an instruction being mutated.
+type op struct {
+	peggyvm.Op
+
+	// origXP is the XP of the instruction in the original code, or noXP.
+	origXP uint64
+
+	// raw is true if the code offsets of the instruction are to be kept
+	// as they are, rather than adjusted to follow their targets.
+	raw bool
+}
+
+func (o *op) imm(slot int) uint64 {
+	switch slot {
+	case 0:
+		return o.Imm0
+	case 1:
+		return o.Imm1
+	default:
+		return o.Imm2
+	}
+}
+
+func (o *op) setImm(slot int, v uint64) {
+	switch slot {
+	case 0:
+		o.Imm0 = v
+	case 1:
+		o.Imm1 = v
+	default:
+		o.Imm2 = v
+	}
+}
+
+func decode(p *peggyvm.Program) []op {
+	var ops []op
+	it := p.Instructions()
+	for it.Next() {
+		ops = append(ops, op{Op: *it.Op(), origXP: it.XP()})
+	}
+	if err := it.Err(); err != nil {
+		panic(err)
+	}
+	return ops
+}
+
+// rebuild encodes ops, and returns a copy of p with the new code. Code
+// offsets, labels, debug entries, and jump tables are adjusted to follow the
+// instructions they refer to; those that refer to an instruction that no
+// longer exists are dropped, except for code offsets and jump table targets,
+// which are left as they were.
+func rebuild(p *peggyvm.Program, ops []op) *peggyvm.Program {
+	// The original absolute target of each code offset.
+	targets := make([][3]uint64, len(ops))
+	for i := range ops {
+		o := &ops[i]
+		meta := o.Code.Meta()
+		for slot := 0; slot < 3; slot++ {
+			if immType(meta, slot) == peggyvm.ImmCodeOffset && o.origXP != noXP {
+				targets[i][slot] = o.origXP + uint64(o.Len) + o.imm(slot)
+			}
+		}
+	}
+
+	// Encoding a new offset may change the length of an instruction,
+	// which moves others, so repeat until the layout settles.
+	var xps map[uint64]uint64
+	var code []byte
+	for pass := 0; pass < 16; pass++ {
+		xps = make(map[uint64]uint64, len(ops)+1)
+		var xp uint64
+		for i := range ops {
+			if ops[i].origXP != noXP {
+				xps[ops[i].origXP] = xp
+			}
+			xp += uint64(ops[i].Len)
+		}
+		xps[uint64(len(p.Bytes))] = xp
+
+		code = code[:0]
+		changed := false
+		for i := range ops {
+			o := &ops[i]
+			meta := o.Code.Meta()
+			next := uint64(len(code)) + uint64(o.Len)
+			for slot := 0; slot < 3; slot++ {
+				if immType(meta, slot) != peggyvm.ImmCodeOffset || o.raw || o.origXP == noXP {
+					continue
+				}
+				if target, found := xps[targets[i][slot]]; found {
+					o.setImm(slot, target-next)
+				}
+			}
+			raw := meta.Encode(o.Imm0, o.Imm1, o.Imm2)
+			if uint(len(raw)) != o.Len {
+				o.Len = uint(len(raw))
+				changed = true
+			}
+			code = append(code, raw...)
+		}
+		if !changed {
+			break
+		}
+	}
+
+	q := &peggyvm.Program{
+		Bytes:         code,
+		Literals:      p.Literals,
+		ByteSets:      p.ByteSets,
+		DFAs:          p.DFAs,
+		RuneSets:      p.RuneSets,
+		Captures:      p.Captures,
+		NamedCaptures: p.NamedCaptures,
+		LabelsByName:  make(map[string]*peggyvm.Label, len(p.Labels)),
+		Limits:        p.Limits,
+	}
+	for _, table := range p.JumpTables {
+		t := peggyvm.JumpTable{Keys: table.Keys, Targets: make([]uint64, len(table.Targets))}
+		for i, target := range table.Targets {
+			if xp, found := xps[target]; found {
+				target = xp
+			}
+			t.Targets[i] = target
+		}
+		q.JumpTables = append(q.JumpTables, t)
+	}
+	for _, label := range p.Labels {
+		if xp, found := xps[label.Offset]; found {
+			l := &peggyvm.Label{Name: label.Name, Public: label.Public, Offset: xp}
+			q.Labels = append(q.Labels, l)
+			q.LabelsByName[l.Name] = l
+		}
+	}
+	for _, label := range p.Entries {
+		if l := q.LabelsByName[label.Name]; l != nil {
+			q.Entries = append(q.Entries, l)
+		}
+	}
+	for _, entry := range p.Debug {
+		if xp, found := xps[entry.XP]; found {
+			entry.XP = xp
+			q.Debug = append(q.Debug, entry)
+		}
+	}
+	return q
+}
@@ -0,0 +1,178 @@
+package mutate
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/chronos-tachyon/go-peggy/peggyvm"
+)
+
+var sources = []string{
+	`%literal "ab"
+%matcher [0-9]
+%captures 2
+BCAP 0
+CHOICE L1
+LITB 0
+COMMIT L2
+L1:
+BCAP 1
+MATCHB 0
+SPANB 0
+ECAP 1
+L2:
+ECAP 0
+END
+`,
+	`%literal "if"
+%literal "int"
+%literal "else"
+%jumptable 0x65 e, 0x69 i
+%captures 1
+BCAP 0
+CALL kw
+ECAP 0
+END
+kw:
+CHOICE rest
+DISPATCH 0
+i:
+CHOICE i2
+LITB 1
+COMMIT done
+i2:
+LITB 0
+JMP done
+e:
+LITB 2
+done:
+COMMIT end
+rest:
+SAMEB 'x'
+end:
+RET
+`,
+	`%captures 1
+BCAP 0
+loop:
+CHOICE out
+ANYB
+CHOICE bad
+SAMEB 'c'
+FAIL2X
+bad:
+COMMIT loop
+out:
+ECAP 0
+END
+`,
+}
+
+var inputs = []string{"", "ab", "42", "if", "int", "else", "x", "abcabc"}
+
+func TestKind_String(t *testing.T) {
+	if actual := fmt.Sprint(AllKinds, " ", Kind(99)); actual != "[FlipImmediate SwapOpCode Truncate DeleteOp DuplicateOp] Kind(99)" {
+		t.Errorf("%s: got %s", t.Name(), actual)
+	}
+}
+
+func TestMutate_Unchanged(t *testing.T) {
+	// With nothing to act on, a mutation is a copy.
+	for i, source := range sources {
+		p, err := peggyvm.ParseAssembly(strings.NewReader(source))
+		if err != nil {
+			t.Fatalf("%s/%03d: error: %v", t.Name(), i, err)
+		}
+		q := rebuild(p, decode(p))
+		if !bytes.Equal(p.Bytes, q.Bytes) {
+			t.Errorf("%s/%03d: code changed", t.Name(), i)
+		}
+		if actual, expected := q.String(), p.String(); actual != expected {
+			t.Errorf("%s/%03d: wrong copy:\n\texpected: %s\n\tactual: %s", t.Name(), i, expected, actual)
+		}
+	}
+}
+
+func TestMutate_DeleteOp(t *testing.T) {
+	// Deleting an instruction keeps the others' jumps on target.
+	p, err := peggyvm.ParseAssembly(strings.NewReader(sources[0]))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	ops := decode(p)
+	ops = append(ops[:4], ops[5:]...) // BCAP 1
+	q := rebuild(p, ops)
+	if errs := q.Validate(); len(errs) != 0 {
+		t.Errorf("%s: Validate: unexpected errors: %v", t.Name(), errs)
+	}
+	if actual := q.Match([]byte("ab")).String(); actual != "{true [0:{(0,2) [(0,2)]} 1:-]}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	m := New(rand.New(rand.NewSource(1)))
+	kinds := make(map[Kind]int)
+	for i, source := range sources {
+		p, err := peggyvm.ParseAssembly(strings.NewReader(source))
+		if err != nil {
+			t.Fatalf("%s/%03d: error: %v", t.Name(), i, err)
+		}
+		for j := 0; j < 500; j++ {
+			q, kind := m.Mutate(p)
+			kinds[kind]++
+			if j%5 == 4 {
+				q = m.MutateN(q, 3)
+			}
+			exercise(t, fmt.Sprintf("%03d/%03d", i, j), q)
+		}
+	}
+	for _, kind := range AllKinds {
+		if kinds[kind] == 0 {
+			t.Errorf("%s: %v never chosen", t.Name(), kind)
+		}
+	}
+}
+
+// exercise checks that q decodes, and that neither the analyses nor the VM
+// panic on it.
+func exercise(t *testing.T, name string, q *peggyvm.Program) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			var buf bytes.Buffer
+			q.Disassemble(&buf)
+			t.Errorf("%s/%s: panic: %v\n%s", t.Name(), name, r, buf.String())
+		}
+	}()
+
+	it := q.Instructions()
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		t.Errorf("%s/%s: does not decode: %v", t.Name(), name, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	q.Disassemble(&buf)
+	q.VerifyStack()
+	q.CFG()
+	q.FirstSets()
+	q.Stats()
+	raw, _ := q.MarshalBinary()
+	limits := peggyvm.Limits{MaxSteps: 1000, MaxStackDepth: 100, MaxAssignments: 100}
+	r, err := peggyvm.LoadUntrusted(raw, limits)
+	if err != nil {
+		return
+	}
+	for _, input := range inputs {
+		x := r.Exec([]byte(input))
+		if err := x.Run(); err == nil {
+			x.Result()
+		}
+	}
+}
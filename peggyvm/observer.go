@@ -0,0 +1,48 @@
+package peggyvm
+
+// Observer receives callbacks from an Execution as it runs, so that
+// debuggers, tracers, profilers, and coverage tools can watch the VM without
+// changing Step. Install one by setting Execution.Observer before the first
+// Step.
+//
+// Each callback receives the Execution, whose registers and stacks may be
+// inspected but must not be modified, and the instruction being executed.
+// The Op is only valid for the duration of the callback.
+//
+// Embed NopObserver to implement only some of the callbacks.
+//
+type Observer interface {
+	// OnStep is called before each instruction executes. x.XP is still
+	// the address of op.
+	OnStep(x *Execution, op *Op)
+
+	// OnChoicePush is called after a CHOICE instruction has pushed its
+	// frame, which is the last item of x.CS.
+	OnChoicePush(x *Execution, op *Op)
+
+	// OnFail is called whenever the match fails at the current position,
+	// before the Execution backtracks. x.DP is the position of the
+	// failure, and x.CS still holds the frames that are about to be
+	// unwound. If no CHOICE frame is pending, the Execution halts in
+	// FailureState once OnFail returns.
+	OnFail(x *Execution, op *Op)
+
+	// OnCaptureCommit is called after a capture is closed, by ECAP or
+	// FCAP, with the end assignment that was pushed onto x.KS.
+	OnCaptureCommit(x *Execution, op *Op, a Assignment)
+
+	// OnCall is called after a CALL instruction has pushed its frame.
+	// x.XP is the address of the callee.
+	OnCall(x *Execution, op *Op)
+}
+
+// NopObserver implements Observer with callbacks that do nothing.
+type NopObserver struct{}
+
+var _ Observer = NopObserver{}
+
+func (NopObserver) OnStep(x *Execution, op *Op)                        {}
+func (NopObserver) OnChoicePush(x *Execution, op *Op)                  {}
+func (NopObserver) OnFail(x *Execution, op *Op)                        {}
+func (NopObserver) OnCaptureCommit(x *Execution, op *Op, a Assignment) {}
+func (NopObserver) OnCall(x *Execution, op *Op)                        {}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"unicode/utf8"
 )
 
 // Op is a single PEG instruction, decoded from raw bytecode.
@@ -164,3 +165,37 @@ func (op *Op) Decode(stream []byte, xp uint64) error {
 	}
 	return err
 }
+
+// Encode returns the bytecode for this instruction, the inverse of Decode.
+// The shortest legal encoding is chosen: the one-byte form if the opcode and
+// immediate lengths allow it, and the fewest bytes for each immediate, with
+// immediates that equal their defaults omitted. Op.Len and Op.XP are ignored.
+func (op *Op) Encode() ([]byte, error) {
+	meta := op.Meta
+	if meta == nil {
+		meta = op.Code.Meta()
+	}
+	if meta.Illegal {
+		return nil, ErrUnknownOpcode
+	}
+	for _, pair := range []struct {
+		m ImmMeta
+		v uint64
+	}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+		switch pair.m.Type {
+		case ImmNone:
+			if pair.v != 0 {
+				return nil, ErrUnexpectedImmediate
+			}
+		case ImmByte:
+			if pair.v > 0xff {
+				return nil, ErrBadOperand
+			}
+		case ImmRune:
+			if pair.v > utf8.MaxRune || !utf8.ValidRune(rune(pair.v)) {
+				return nil, ErrBadOperand
+			}
+		}
+	}
+	return meta.Encode(op.Imm0, op.Imm1, op.Imm2), nil
+}
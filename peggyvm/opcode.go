@@ -22,10 +22,8 @@ const (
 	// --------------------
 	// OpCodes below this line must use two-byte instructions.
 
-	OpJMP OpCode = 0x08
-
-	// 0x09 RESERVED
-
+	OpJMP     OpCode = 0x08
+	OpDFAB    OpCode = 0x09
 	OpCALL    OpCode = 0x0a
 	OpRET     OpCode = 0x0b
 	OpTANYB   OpCode = 0x0c
@@ -41,7 +39,33 @@ const (
 	OpBCAP    OpCode = 0x16
 	OpECAP    OpCode = 0x17
 
-	// 0x18 .. 0x3d RESERVED
+	OpDISPATCH OpCode = 0x18
+	OpRANYB    OpCode = 0x19
+	OpRSAMEB   OpCode = 0x1a
+	OpRLITB    OpCode = 0x1b
+	OpRMATCHB  OpCode = 0x1c
+	OpRSPANB   OpCode = 0x1d
+	OpPRED     OpCode = 0x1e
+	OpVCAP     OpCode = 0x1f
+	OpVFOLD    OpCode = 0x20
+	OpEOI      OpCode = 0x21
+	OpWORDB    OpCode = 0x22
+	OpBALB     OpCode = 0x23
+	OpDCOMMIT  OpCode = 0x24
+	OpANYR     OpCode = 0x25
+	OpSAMER    OpCode = 0x26
+	OpMATCHR   OpCode = 0x27
+	OpSPANR    OpCode = 0x28
+	OpTMATCHR  OpCode = 0x29
+	OpFSAMER   OpCode = 0x2a
+	OpTSPANB   OpCode = 0x2b
+	OpMEMOGET  OpCode = 0x2c
+	OpMEMOSET  OpCode = 0x2d
+	OpTHROW    OpCode = 0x2e
+	OpRECOVER  OpCode = 0x2f
+	OpBEHINDB  OpCode = 0x30
+
+	// 0x31 .. 0x3d RESERVED for extensions; see RegisterOpCode
 
 	OpGIVEUP OpCode = 0x3e
 	OpEND    OpCode = 0x3f
@@ -54,6 +78,9 @@ func (c OpCode) Meta() *OpMeta {
 	if i < len(opMeta) && opMeta[i].Code == c {
 		return &opMeta[i]
 	}
+	if ext := lookupExtOp(c); ext != nil {
+		return &ext.meta
+	}
 	return &OpMeta{
 		Code:    c,
 		Illegal: true,
@@ -102,8 +129,48 @@ const (
 
 	// ImmCaptureIdx says the slot holds an unsigned capture index.
 	ImmCaptureIdx
+
+	// ImmDFAIdx says the slot holds an unsigned DFA index.
+	ImmDFAIdx
+
+	// ImmJumpTableIdx says the slot holds an unsigned jump table index.
+	ImmJumpTableIdx
+
+	// ImmPredicateIdx says the slot holds an unsigned predicate index.
+	ImmPredicateIdx
+
+	// ImmFolderIdx says the slot holds an unsigned folder index.
+	ImmFolderIdx
+
+	// ImmRuneSetIdx says the slot holds an unsigned rune set index.
+	ImmRuneSetIdx
 )
 
+var immTypeNames = []string{
+	"none",
+	"uint",
+	"sint",
+	"byte",
+	"rune",
+	"count",
+	"codeOffset",
+	"literalIdx",
+	"matcherIdx",
+	"captureIdx",
+	"dfaIdx",
+	"jumpTableIdx",
+	"predicateIdx",
+	"folderIdx",
+	"runeSetIdx",
+}
+
+func (t ImmType) String() string {
+	if int(t) < len(immTypeNames) {
+		return immTypeNames[t]
+	}
+	return fmt.Sprintf("ImmType(%d)", uint8(t))
+}
+
 func (t ImmType) Signed() bool {
 	return immSigned[t]
 }
@@ -152,6 +219,7 @@ func (m ImmMeta) Decode(data []byte) (value uint64, err error) {
 		return
 	}
 
+	value = 0
 	for i, b := range data {
 		value |= uint64(b) << (uint(i) * 8)
 	}
@@ -225,11 +293,12 @@ type OpMeta struct {
 
 // Encode returns the encoding for an instruction with the given immediates.
 func (meta *OpMeta) Encode(imm0, imm1, imm2 uint64) []byte {
-	result := make([]byte, 0, 8)
+	return meta.encodeRaw(meta.Imm0.Encode(imm0), meta.Imm1.Encode(imm1), meta.Imm2.Encode(imm2))
+}
 
-	raw0 := meta.Imm0.Encode(imm0)
-	raw1 := meta.Imm1.Encode(imm1)
-	raw2 := meta.Imm2.Encode(imm2)
+// encodeRaw generates the encoded bytes for the given pre-encoded immediates.
+func (meta *OpMeta) encodeRaw(raw0, raw1, raw2 []byte) []byte {
+	result := make([]byte, 0, 8)
 
 	a := byte(meta.Code)
 	b := ImmLengthEncode(len(raw0))
@@ -250,3 +319,24 @@ func (meta *OpMeta) Encode(imm0, imm1, imm2 uint64) []byte {
 	result = append(result, raw2...)
 	return result
 }
+
+// LookupOpCode returns the OpCode whose mnemonic is name.
+func LookupOpCode(name string) (OpCode, bool) {
+	extMu.RLock()
+	defer extMu.RUnlock()
+	return lookupOpCodeLocked(name)
+}
+
+func lookupOpCodeLocked(name string) (OpCode, bool) {
+	for i := range opMeta {
+		if opMeta[i].Name == name {
+			return opMeta[i].Code, true
+		}
+	}
+	for code, ext := range extOps {
+		if ext.meta.Name == name {
+			return code, true
+		}
+	}
+	return 0, false
+}
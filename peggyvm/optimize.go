@@ -0,0 +1,351 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// ThreadJumps retargets every code offset and jump table entry whose
+// destination is an unconditional JMP, so that it points at the JMP's own
+// destination instead.
+// Chains of JMPs collapse to a single hop; cycles are left alone. The JMPs
+// themselves are kept, as other code may still fall through into them.
+//
+// ThreadJumps must be called before Fix (and therefore before Finish).
+//
+func (a *Assembler) ThreadJumps() {
+	for _, item := range a.List {
+		if item.IsOp && !item.Fixed && item.FixBlockedBy != nil {
+			item.FixBlockedBy = a.threadTarget(item.FixBlockedBy)
+		}
+	}
+	for _, table := range a.JumpTables {
+		for i, label := range table.Labels {
+			table.Labels[i] = a.threadTarget(label)
+		}
+	}
+}
+
+func (a *Assembler) threadTarget(label *AsmItem) *AsmItem {
+	seen := make(map[*AsmItem]struct{})
+	for {
+		op := a.opAt(label)
+		if op == nil || op.Meta.Code != OpJMP || op.FixBlockedBy == nil {
+			return label
+		}
+		if _, found := seen[label]; found {
+			return label
+		}
+		seen[label] = struct{}{}
+		label = op.FixBlockedBy
+	}
+}
+
+// opAt returns the first op that would execute upon reaching label, skipping
+// over other labels and NOPs. It returns nil if there is no such op, or if
+// the next item is not an ordinary instruction.
+func (a *Assembler) opAt(label *AsmItem) *AsmItem {
+	if !label.Seen {
+		return nil
+	}
+	for i := label.Index + 1; i < uint(len(a.List)); i++ {
+		item := a.List[i]
+		if !item.IsOp {
+			continue
+		}
+		if item.Meta == nil {
+			return nil
+		}
+		if item.Meta.Code == OpNOP {
+			continue
+		}
+		return item
+	}
+	return nil
+}
+
+// headFailTests maps each single-byte-test instruction to the corresponding
+// test-and-branch instruction.
+var headFailTests = map[OpCode]OpCode{
+	OpANYB:   OpTANYB,
+	OpSAMEB:  OpTSAMEB,
+	OpLITB:   OpTLITB,
+	OpMATCHB: OpTMATCHB,
+}
+
+// HeadFail rewrites each alternative that begins with a byte test, so that
+// failing the test jumps straight to the next alternative without pushing a
+// CHOICE/FAIL frame. For example:
+//
+//   CHOICE L                    TSAMEB L, 'c'
+//   SAMEB 'c'          ==>      CHOICE L'
+//   ...                         ...
+//
+//                               L': RWNDB 1
+//                                   JMP L
+//
+// The CHOICE frame, pushed only once the test has passed, records a DP that
+// is past the tested bytes; the out-of-line trampoline L' rewinds them before
+// resuming at L. The trampolines are placed at the end of the program,
+// preceded by an END if control could otherwise fall through into them.
+//
+// Since BCOMMIT would restore the wrong DP from such a frame, alternatives
+// are only rewritten when a scan of the code that follows shows that their
+// frame is popped some other way.
+//
+// HeadFail must be called before Fix (and therefore before Finish).
+//
+func (a *Assembler) HeadFail() {
+	type trampoline struct {
+		label *AsmItem
+		alt   *AsmItem
+		n     uint64
+	}
+	var pending []trampoline
+
+	for i := 0; i+1 < len(a.List); i++ {
+		choice, test := a.List[i], a.List[i+1]
+		if !choice.IsOp || choice.Meta == nil || choice.Meta.Code != OpCHOICE || choice.FixBlockedBy == nil {
+			continue
+		}
+		if !test.IsOp || test.Meta == nil || len(test.symbols) != 0 {
+			continue
+		}
+		tcode, found := headFailTests[test.Meta.Code]
+		if !found || !a.frameDPUnobserved(i+2) {
+			continue
+		}
+
+		// The test instruction's immediates shift over by one, to make
+		// room for the code offset.
+		var imm1, imm2, n uint64
+		switch test.Meta.Code {
+		case OpANYB:
+			imm1, n = test.Imm0, test.Imm0
+		case OpSAMEB, OpMATCHB:
+			imm1, imm2, n = test.Imm0, test.Imm1, test.Imm1
+		case OpLITB:
+			if test.Imm0 >= uint64(len(a.Literals)) {
+				continue
+			}
+			imm1, n = test.Imm0, uint64(len(a.Literals[test.Imm0]))
+		}
+		if n == 0 {
+			continue
+		}
+
+		alt := choice.FixBlockedBy
+		label := a.GrabLabel(a.uniqueLabel(".HF"))
+
+		choice.Meta = tcode.Meta()
+		choice.Name = choice.Meta.Name
+		choice.Imm1 = imm1
+		choice.Imm2 = imm2
+
+		test.Meta = OpCHOICE.Meta()
+		test.Name = test.Meta.Name
+		test.Imm0, test.Imm1, test.Imm2 = 0, 0, 0
+		test.Fixed = false
+		test.Bytes = nil
+		test.Fixup = &test.Imm0
+		test.FixBlockedBy = label
+
+		pending = append(pending, trampoline{label, alt, n})
+		i++
+	}
+
+	if len(pending) == 0 {
+		return
+	}
+	if a.canFallOffEnd() {
+		a.EmitOp(OpEND.Meta(), nil, nil, nil)
+	}
+	for _, t := range pending {
+		a.EmitLabel(t.label.Name)
+		a.EmitOp(OpRWNDB.Meta(), t.n, nil, nil)
+		a.EmitOp(OpJMP.Meta(), t.alt, nil, nil)
+	}
+}
+
+// frameDPUnobserved scans forward from a.List[start], which immediately
+// follows a CHOICE, and returns true iff that CHOICE's frame is certain to be
+// discarded or replaced without its DP being restored on success -- that is,
+// the frame is popped by COMMIT, PCOMMIT, or FAIL2X, or by ordinary failure.
+// It gives up (returning false) on any control flow that it can't follow.
+func (a *Assembler) frameDPUnobserved(start int) bool {
+	depth := 0
+	for _, item := range a.List[start:] {
+		if !item.IsOp {
+			continue
+		}
+		if item.Meta == nil {
+			return false
+		}
+		switch item.Meta.Code {
+		case OpCHOICE:
+			depth++
+
+		case OpCOMMIT, OpFAIL2X:
+			if depth == 0 {
+				return true
+			}
+			depth--
+
+		case OpBCOMMIT, OpDCOMMIT:
+			if depth == 0 {
+				return false
+			}
+			depth--
+
+		case OpPCOMMIT, OpFAIL, OpEND, OpGIVEUP:
+			if depth == 0 {
+				return true
+			}
+
+		case OpJMP, OpRET, OpTANYB, OpTSAMEB, OpTLITB, OpTMATCHB, OpTMATCHR, OpTSPANB, OpMEMOGET, OpMEMOSET, OpRECOVER, OpTHROW, OpDISPATCH:
+			return false
+		}
+	}
+	return false
+}
+
+// canFallOffEnd returns true iff execution could run past the last item.
+func (a *Assembler) canFallOffEnd() bool {
+	if len(a.List) == 0 {
+		return false
+	}
+	last := a.List[len(a.List)-1]
+	if !last.IsOp || last.Meta == nil {
+		return true
+	}
+	switch last.Meta.Code {
+	case OpJMP, OpRET, OpFAIL, OpFAIL2X, OpGIVEUP, OpEND, OpDISPATCH:
+		return false
+	}
+	return true
+}
+
+// uniqueLabel returns a label name, beginning with prefix, that is not yet in
+// use.
+func (a *Assembler) uniqueLabel(prefix string) string {
+	for {
+		a.nextLabel++
+		name := fmt.Sprintf("%s%d", prefix, a.nextLabel)
+		if _, found := a.LabelsByName[name]; !found {
+			return name
+		}
+	}
+}
+
+// FuseEOI rewrites each negative lookahead of a single byte, which anchors a
+// grammar to the end of its input, into the equivalent EOI:
+//
+//   CHOICE L
+//   ANYB               ==>      EOI
+//   FAIL2X
+//   L:                          L:
+//
+// FuseEOI must be called before HeadFail, which would otherwise rewrite the
+// CHOICE and ANYB, and before Fix (and therefore before Finish).
+//
+func (a *Assembler) FuseEOI() {
+	isOp := func(item *AsmItem, code OpCode) bool {
+		return item.IsOp && item.Meta != nil && item.Meta.Code == code && len(item.symbols) == 0
+	}
+	for i := 0; i+2 < len(a.List); i++ {
+		choice, anyb, fail := a.List[i], a.List[i+1], a.List[i+2]
+		if !isOp(choice, OpCHOICE) || choice.FixBlockedBy == nil {
+			continue
+		}
+		if !isOp(anyb, OpANYB) || anyb.Imm0 != 1 || !isOp(fail, OpFAIL2X) {
+			continue
+		}
+		if !a.labelAt(i+3, choice.FixBlockedBy) {
+			continue
+		}
+		choice.Meta = OpEOI.Meta()
+		choice.Name = choice.Meta.Name
+		choice.Imm0 = 0
+		choice.Fixup = nil
+		choice.FixBlockedBy = nil
+		choice.generate()
+		a.remove(i + 2)
+		a.remove(i + 1)
+	}
+}
+
+// labelAt returns true iff label is among the labels that begin at
+// a.List[i].
+func (a *Assembler) labelAt(i int, label *AsmItem) bool {
+	for ; i < len(a.List) && !a.List[i].IsOp; i++ {
+		if a.List[i] == label {
+			return true
+		}
+	}
+	return false
+}
+
+// TailCalls rewrites each "CALL L; RET" into "JMP L", so that right-recursive
+// rules run in constant stack space. The RET is dropped unless a label makes
+// it reachable some other way.
+//
+// TailCalls must be called before Fix (and therefore before Finish).
+//
+func (a *Assembler) TailCalls() {
+	for i := 0; i < len(a.List); i++ {
+		call := a.List[i]
+		if !call.IsOp || call.Meta == nil || call.Meta.Code != OpCALL || call.FixBlockedBy == nil {
+			continue
+		}
+		j := i + 1
+		for j < len(a.List) && !a.List[j].IsOp {
+			j++
+		}
+		if j == len(a.List) || a.List[j].Meta == nil || a.List[j].Meta.Code != OpRET {
+			continue
+		}
+		call.Meta = OpJMP.Meta()
+		call.Name = call.Meta.Name
+		if j == i+1 {
+			a.remove(j)
+		}
+	}
+}
+
+// remove deletes a.List[i], renumbering the items after it.
+func (a *Assembler) remove(i int) {
+	copy(a.List[i:], a.List[i+1:])
+	a.List[len(a.List)-1] = nil
+	a.List = a.List[:len(a.List)-1]
+	for j := i; j < len(a.List); j++ {
+		a.List[j].Index = uint(j)
+	}
+}
+
+// Optimize returns a copy of p that has been decoded into an Assembler,
+// rewritten by TailCalls, FuseEOI, ThreadJumps, and HeadFail, and then
+// reassembled with freshly relaxed code offsets. This allows bytecode that
+// was loaded from a file, or produced by some other compiler, to be improved
+// without access to its original assembly.
+//
+// Labels, entry points, captures, and debug info are carried over, although
+// label offsets will generally change. Literals and byte sets are merged
+// where they are duplicates. Alignment padding is decoded like any other
+// code, so it is kept but may no longer align anything.
+//
+func (p *Program) Optimize() (*Program, error) {
+	a := NewAssembler()
+	if _, err := a.importProgram(p, "", nil, nil, ""); err != nil {
+		return nil, err
+	}
+	for name, idx := range p.NamedCaptures {
+		a.NamedCaptures[name] = idx
+	}
+	for _, label := range p.Entries {
+		a.DeclareEntry(label.Name)
+	}
+	a.TailCalls()
+	a.FuseEOI()
+	a.ThreadJumps()
+	a.HeadFail()
+	return a.Finish()
+}
@@ -2,10 +2,26 @@ package peggyvm
 
 import (
 	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"testing/quick"
+	"time"
+	"unicode"
 
+	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
 	"github.com/renstrom/dedent"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
@@ -163,6 +179,7 @@ func TestProgram_Disassemble(t *testing.T) {
 			Program: sampleProgram2,
 			Expected: `
 			%captures 2
+			%repeatcapture 1
 
 				BCAP 0
 				SAMEB 'b'
@@ -629,3 +646,5741 @@ func TestAssembler_nine(t *testing.T) {
 	".L0" false 0x84
 	`)
 }
+
+func TestAssembler_intern(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareLiteral([]byte("ana"))
+	a.DeclareByteSet(byteset.Ranges(byteset.Range{Lo: 'a', Hi: 'c'}))
+
+	type testrow struct {
+		Index    uint64
+		Expected uint64
+	}
+
+	data := []testrow{
+		testrow{a.InternLiteral([]byte("ana")), 0},
+		testrow{a.InternLiteral([]byte("ban")), 1},
+		testrow{a.InternLiteral([]byte("ban")), 1},
+		testrow{a.InternLiteral(nil), 2},
+		testrow{a.InternByteSet(byteset.DenseSet('a', 'b', 'c')), 0},
+		testrow{a.InternByteSet(byteset.Not(byteset.Exactly('a'))), 1},
+		testrow{a.InternByteSet(byteset.Not(byteset.Exactly('a'))), 1},
+		testrow{a.InternByteSet(byteset.Or(byteset.Exactly('a'), byteset.Ranges(byteset.Range{Lo: 'b', Hi: 'c'}))), 0},
+	}
+
+	for i, row := range data {
+		if row.Index != row.Expected {
+			t.Errorf("%s/%03d: expected %d, got %d", t.Name(), i, row.Expected, row.Index)
+		}
+	}
+	if len(a.Literals) != 3 || len(a.ByteSets) != 2 {
+		t.Errorf("%s: wrong pool sizes: %d literals, %d bytesets", t.Name(), len(a.Literals), len(a.ByteSets))
+	}
+}
+
+func TestAssembler_namedSymbols(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.EmitOp(OpLITB.Meta(), "kw_then", nil, nil)
+	a.EmitOp(OpTMATCHB.Meta(), a.GrabLabel(".L0"), "digit", 2)
+	a.EmitLabel(".L0")
+	a.EmitOp(OpLITB.Meta(), "kw_if", nil, nil)
+	a.DeclareNamedLiteral("kw_if", []byte("if"))
+	a.DeclareNamedLiteral("kw_then", []byte("then"))
+	a.DeclareNamedByteSet("digit", byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'}))
+
+	testAssemblerHelper(t, a, `
+	00000  64 01 9e 49 00 00 02 64  00
+	00009
+	".L0" false 0x7
+	`)
+
+	a = NewAssembler()
+	a.EmitOp(OpMATCHB.Meta(), "nope", nil, nil)
+	_, err := a.Finish()
+	if x, ok := err.(*AssemblyError); !ok || x.Err != ErrUndefinedByteSet {
+		t.Errorf("%s: expected ErrUndefinedByteSet, got %v", t.Name(), err)
+	}
+
+	a = NewAssembler()
+	err = a.Parse(strings.NewReader(`
+		%namedliteral kw_if "if"
+		%namedmatcher digit [0-9]
+		%captures 0
+		LITB kw_if
+		MATCHB digit, 2
+	`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	testAssemblerHelper(t, a, `
+	00000  64 00 75 00 02
+	00005
+	`)
+}
+
+func TestAssembler_rawAndAlign(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitAlign(4, 0xcc)
+	a.EmitRaw([]byte{0xfe, 0x00})
+	a.EmitAlign(2, 0x00)
+	a.EmitLabel(".L0")
+	a.EmitAlign(8, 0x00)
+
+	testAssemblerHelper(t, a, `
+	00000  40 cc cc cc fe 00 00 00
+	00008
+	".L0" false 0x6
+	`)
+
+	// Widening the CHOICE shrinks the padding after it, which brings its
+	// offset back within range of a one-byte immediate. The op keeps its
+	// width, with the offset sign-extended.
+	a = NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitAlign(4, 0x00)
+	for i := 0; i < 126; i++ {
+		a.EmitOp(OpNOP.Meta(), nil, nil, nil)
+	}
+	a.EmitLabel(".L0")
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := fmt.Sprintf("% x", p.Bytes[:4]); actual != "18 7f 00 00" {
+		t.Errorf("%s: wrong output: %s", t.Name(), actual)
+	}
+
+	a = NewAssembler()
+	err = a.Parse(strings.NewReader(`
+		%captures 0
+		ANYB
+		%align 4, 0xcc
+		%bytes 0xfe, 0x00
+	`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	testAssemblerHelper(t, a, `
+	00000  40 cc cc cc fe 00
+	00006
+	`)
+}
+
+func TestProgram_MatchEntry(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareEntry("ab")
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpCALL.Meta(), a.GrabLabel("ab"), nil, nil)
+	a.EmitOp(OpSAMEB.Meta(), 'c', nil, nil)
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpEND.Meta(), nil, nil, nil)
+	a.EmitLabel("ab")
+	a.EmitOp(OpSAMEB.Meta(), 'a', nil, nil)
+	a.EmitOp(OpSAMEB.Meta(), 'b', nil, nil)
+	a.EmitOp(OpRET.Meta(), nil, nil, nil)
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Entry    string
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"ab", "abx", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"ab", "ax", "{false}"},
+	}
+
+	for i, row := range data {
+		r, err := p.MatchEntry(row.Entry, []byte(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual := r.String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	if _, err := p.MatchEntry("main", nil); err != ErrUnknownEntry {
+		t.Errorf("%s: expected ErrUnknownEntry, got %v", t.Name(), err)
+	}
+
+	a = NewAssembler()
+	a.DeclareEntry(".private")
+	a.EmitLabel(".private")
+	_, err = a.Finish()
+	if x, ok := err.(*LabelError); !ok || x.Err != ErrPrivateEntry {
+		t.Errorf("%s: expected ErrPrivateEntry, got %v", t.Name(), err)
+	}
+}
+
+func TestProgram_MatchRule(t *testing.T) {
+	input := "%captures 1\n%entry main\n" +
+		"main:\nCALL digit\nCALL digit\nRET\n" +
+		"digit:\nTSAMEB .L0, '0'\nRET\n.L0:\nSAMEB '1'\nRET\n" +
+		".hidden:\nANYB\nRET"
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Rule     string
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"main", "10x", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"main", "1x", "{false}"},
+		testrow{"digit", "1x", "{true [0:{(0,1) [(0,1)]}]}"},
+		testrow{"digit", "x", "{false}"},
+		testrow{".hidden", "x", "error: " + ErrUnknownEntry.Error()},
+		testrow{"nonesuch", "x", "error: " + ErrUnknownEntry.Error()},
+	}
+
+	for i, row := range data {
+		r, err := p.MatchRule(row.Rule, []byte(row.Input))
+		actual := r.String()
+		if err != nil {
+			actual = "error: " + err.Error()
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	if _, err := p.MatchEntry("digit", nil); err != ErrUnknownEntry {
+		t.Errorf("%s: MatchEntry: expected ErrUnknownEntry, got %v", t.Name(), err)
+	}
+}
+
+func TestAssembler_ThreadJumps(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".L1"), nil, nil)
+	a.EmitLabel(".L0")
+	a.EmitOp(OpJMP.Meta(), a.GrabLabel(".L1"), nil, nil)
+	a.EmitLabel(".L1")
+	a.EmitOp(OpNOP.Meta(), nil, nil, nil)
+	a.EmitOp(OpJMP.Meta(), a.GrabLabel(".L2"), nil, nil)
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitLabel(".L2")
+	a.EmitLabel(".L3")
+	a.EmitOp(OpJMP.Meta(), a.GrabLabel(".L3"), nil, nil)
+	a.ThreadJumps()
+
+	testAssemblerHelper(t, a, `
+	00000  14 0a 24 08 90 40 05 00  90 40 01 40 90 40 fd
+	0000f
+	".L0" false 0x4
+	".L1" false 0x7
+	".L2" false 0xc
+	".L3" false 0xc
+	`)
+}
+
+func TestAssembler_HeadFail(t *testing.T) {
+	// main <- 'ab' 'x' / [0-9]+ / &'c' .
+	a := NewAssembler()
+	a.DeclareLiteral([]byte("ab"))
+	a.DeclareByteSet(byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'}))
+	a.DeclareNumCaptures(1)
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitOp(OpLITB.Meta(), 0, nil, nil)
+	a.EmitOp(OpSAMEB.Meta(), 'x', nil, nil)
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".L9"), nil, nil)
+	a.EmitLabel(".L0")
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L1"), nil, nil)
+	a.EmitOp(OpMATCHB.Meta(), 0, nil, nil)
+	a.EmitOp(OpSPANB.Meta(), 0, nil, nil)
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".L9"), nil, nil)
+	a.EmitLabel(".L1")
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L2"), nil, nil)
+	a.EmitOp(OpSAMEB.Meta(), 'c', nil, nil)
+	a.EmitOp(OpBCOMMIT.Meta(), a.GrabLabel(".L3"), nil, nil)
+	a.EmitLabel(".L2")
+	a.EmitOp(OpFAIL.Meta(), nil, nil, nil)
+	a.EmitLabel(".L3")
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitLabel(".L9")
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	a.HeadFail()
+
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := p.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := dedent.Dedent(`
+	%literal "ab"
+	%matcher [\x30\x31\x32\x33\x34\x35\x36\x37\x38\x39]
+	%captures 1
+
+		BCAP 0
+		TLITB .L0 <.+6>, 0
+		CHOICE .HF1 <.+29>
+		SAMEB 'x'
+		COMMIT .L9 <.+20>
+	.L0:
+		TMATCHB .L1 <.+7>, 0
+		CHOICE .HF2 <.+25>
+		SPANB 0
+		COMMIT .L9 <.+9>
+	.L1:
+		CHOICE .L2 <.+5>
+		SAMEB 'c'
+		BCOMMIT .L3 <.+1>
+	.L2:
+		FAIL
+	.L3:
+		ANYB
+	.L9:
+		ECAP 0
+		END
+	.HF1:
+		RWNDB 2
+		JMP .L0 <.-31>
+	.HF2:
+		RWNDB 1
+		JMP .L1 <.-26>
+	`)[1:]
+	if actual := buf.String(); actual != expected {
+		t.Errorf("%s: wrong output:\n%s", t.Name(), diff(expected, actual))
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"abx", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"ab9", "{false}"},
+		testrow{"123ab", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"abc", "{false}"},
+		testrow{"cd", "{true [0:{(0,1) [(0,1)]}]}"},
+		testrow{"d", "{false}"},
+	}
+
+	for i, row := range data {
+		actual := p.Match([]byte(row.Input)).String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+}
+
+func TestAssembler_TailCalls(t *testing.T) {
+	// main <- list !.
+	// list <- 'a' list / ''
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpCALL.Meta(), a.GrabLabel("list"), nil, nil)
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L1"), nil, nil)
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitOp(OpFAIL2X.Meta(), nil, nil, nil)
+	a.EmitLabel(".L1")
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpEND.Meta(), nil, nil, nil)
+	a.EmitLabel("list")
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L2"), nil, nil)
+	a.EmitOp(OpSAMEB.Meta(), 'a', nil, nil)
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".L3"), nil, nil)
+	a.EmitLabel(".L3")
+	a.EmitOp(OpCALL.Meta(), a.GrabLabel("list"), nil, nil)
+	a.EmitOp(OpRET.Meta(), nil, nil, nil)
+	a.EmitLabel(".L2")
+	a.EmitOp(OpRET.Meta(), nil, nil, nil)
+	a.TailCalls()
+
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := p.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if !strings.Contains(buf.String(), "\tJMP list") || strings.Count(buf.String(), "RET") != 1 {
+		t.Errorf("%s: CALL+RET not rewritten:\n%s", t.Name(), buf.String())
+	}
+
+	input := bytes.Repeat([]byte{'a'}, 1000)
+	x := p.Exec(input)
+	maxDepth := 0
+	for x.R == RunningState {
+		if err := x.Step(); err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+		if len(x.CS) > maxDepth {
+			maxDepth = len(x.CS)
+		}
+	}
+	if x.R != SuccessState || x.DP != uint64(len(input)) {
+		t.Errorf("%s: wrong result: state %d DP %d", t.Name(), x.R, x.DP)
+	}
+	if maxDepth > 2 {
+		t.Errorf("%s: stack grew to depth %d", t.Name(), maxDepth)
+	}
+}
+
+func TestAssembler_labelDiagnostics(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".missing"), nil, nil)
+	a.EmitLabel(".unused")
+	a.EmitOp(OpJMP.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitLabel("public")
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".missing"), nil, nil)
+	a.EmitLabel(".L0")
+
+	_, err := a.Finish()
+	x, ok := err.(*LabelError)
+	if !ok || x.Err != ErrUndefinedLabel || x.Label != ".missing" || fmt.Sprint(x.Indices) != "[0 4]" {
+		t.Errorf("%s: wrong error: %v", t.Name(), err)
+	}
+
+	a.EmitLabel(".missing")
+	if _, err := a.Finish(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var names []string
+	for _, item := range a.UnreferencedLabels() {
+		names = append(names, item.Name)
+	}
+	if fmt.Sprint(names) != "[.unused]" {
+		t.Errorf("%s: wrong unreferenced labels: %v", t.Name(), names)
+	}
+}
+
+func TestAssembler_EmitCallRule(t *testing.T) {
+	fragment := func(rule string, m byteset.Matcher) *Program {
+		a := NewAssembler()
+		a.DeclareNumCaptures(1)
+		a.DeclareNamedCapture(0, rule)
+		a.DeclareByteSet(m)
+		a.DeclareEntry(rule)
+		a.EmitLabel(rule)
+		a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+		a.EmitOp(OpMATCHB.Meta(), 0, nil, nil)
+		a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+		a.EmitOp(OpRET.Meta(), nil, nil, nil)
+		p, err := a.Finish()
+		if err != nil {
+			t.Fatalf("%s: %s: error: %v", t.Name(), rule, err)
+		}
+		return p
+	}
+
+	a := NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.AddFragment(fragment("alpha", byteset.Ranges(byteset.Range{Lo: 'a', Hi: 'z'})))
+	a.AddFragment(fragment("digit", byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})))
+	a.EmitCallRule("digit")
+	a.EmitCallRule("digit")
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if _, found := p.LabelsByName["alpha"]; found {
+		t.Errorf("%s: unused fragment was linked", t.Name())
+	}
+	if idx, found := p.NamedCaptures["digit"]; !found || idx != 0 {
+		t.Errorf("%s: wrong capture names: %v", t.Name(), p.NamedCaptures)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"12x", "{true [0:{(1,2) [(0,1) (1,2)]}]}"},
+		testrow{"1x", "{false}"},
+	}
+
+	for i, row := range data {
+		actual := p.Match([]byte(row.Input)).String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	a = NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.AddFragment(fragment("alpha", byteset.Ranges(byteset.Range{Lo: 'a', Hi: 'z'})))
+	a.EmitCallRule("digit")
+	_, err = a.Finish()
+	if x, ok := err.(*LabelError); !ok || x.Err != ErrUndefinedLabel || x.Label != "digit" {
+		t.Errorf("%s: wrong error: %v", t.Name(), err)
+	}
+}
+
+func TestLink(t *testing.T) {
+	// main <- 'ab' num
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareNamedCapture(0, "main")
+	a.DeclareLiteral([]byte("ab"))
+	a.DeclareEntry("main")
+	a.EmitLabel("main")
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpLITB.Meta(), 0, nil, nil)
+	a.EmitCallRule("num")
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	main, err := a.FinishObject()
+	if err != nil {
+		t.Fatalf("%s: main: error: %v", t.Name(), err)
+	}
+	if fmt.Sprint(main.Relocs) != "[{5 num}]" {
+		t.Errorf("%s: wrong relocs: %v", t.Name(), main.Relocs)
+	}
+
+	// num <- [0-9] 'ab'
+	a = NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareNamedCapture(0, "num")
+	a.DeclareByteSet(byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'}))
+	a.DeclareLiteral([]byte("ab"))
+	a.DeclareEntry("num")
+	a.EmitLabel("num")
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpMATCHB.Meta(), 0, nil, nil)
+	a.EmitOp(OpLITB.Meta(), 0, nil, nil)
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpRET.Meta(), nil, nil, nil)
+	num, err := a.FinishObject()
+	if err != nil {
+		t.Fatalf("%s: num: error: %v", t.Name(), err)
+	}
+
+	p, err := Link(main, num)
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if len(p.Literals) != 1 || len(p.Entries) != 2 || fmt.Sprint(p.NamedCaptures) != "map[main:0 num:1]" {
+		t.Errorf("%s: wrong pools: %d literals, %d entries, captures %v", t.Name(), len(p.Literals), len(p.Entries), p.NamedCaptures)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"ab1ab", "{true [0:{(0,5) [(0,5)]} 1:{(2,5) [(2,5)]}]}"},
+		testrow{"ab1a", "{false}"},
+	}
+
+	for i, row := range data {
+		actual := p.Match([]byte(row.Input)).String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	if _, err := Link(main); err == nil {
+		t.Errorf("%s: expected error for unresolved reloc", t.Name())
+	}
+	if _, err := Link(num, num); err == nil {
+		t.Errorf("%s: expected error for duplicate export", t.Name())
+	}
+}
+
+func TestBuilder(t *testing.T) {
+	digits := byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})
+
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareLiteral([]byte("ana"))
+	a.DeclareByteSet(digits)
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L1"), nil, nil)
+	a.EmitOp(OpLITB.Meta(), 0, nil, nil)
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitOp(OpFAIL2X.Meta(), nil, nil, nil)
+	a.EmitLabel(".L1")
+	a.EmitOp(OpTMATCHB.Meta(), a.GrabLabel(".L2"), 0, 2)
+	a.EmitOp(OpSPANB.Meta(), 0, nil, nil)
+	a.EmitLabel(".L2")
+	a.EmitOp(OpLITB.Meta(), 0, nil, nil)
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpEND.Meta(), nil, nil, nil)
+	expected, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	actual, err := NewBuilder().NumCaptures(1).
+		BCap(0).
+		Choice(".L1").Lit("ana").AnyB().Fail2x().
+		Label(".L1").TMatchN(".L2", digits, 2).Span(digits).
+		Label(".L2").Lit("ana").
+		ECap(0).End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	if !bytes.Equal(actual.Bytes, expected.Bytes) || len(actual.Literals) != 1 || len(actual.ByteSets) != 1 {
+		t.Errorf("%s: wrong output:\n\texpected: %x\n\tactual: %x", t.Name(), expected.Bytes, actual.Bytes)
+	}
+}
+
+func TestAssembler_runeImmediate(t *testing.T) {
+	meta := OpSAMER.Meta()
+
+	type testrow struct {
+		Input    interface{}
+		Expected string
+		Panics   bool
+	}
+
+	data := []testrow{
+		testrow{'a', "cc 40 61", false},
+		testrow{'é', "cc 40 e9", false},
+		testrow{'世', "cc 80 16 4e", false},
+		testrow{rune(0x10ffff), "cc c0 ff ff 10 00", false},
+		testrow{uint32(0x1f600), "cc c0 00 f6 01 00", false},
+		testrow{rune(0xd800), "", true},
+		testrow{rune(0x110000), "", true},
+		testrow{rune(-1), "", true},
+	}
+
+	for i, row := range data {
+		var actual string
+		panicked := func() (panicked bool) {
+			defer func() {
+				panicked = (recover() != nil)
+			}()
+			a := NewAssembler()
+			a.EmitOp(meta, row.Input, nil, nil)
+			actual = fmt.Sprintf("% x", a.List[0].Bytes)
+			return false
+		}()
+		if panicked != row.Panics || actual != row.Expected {
+			t.Errorf("%s/%03d: %v: wrong output:\n\texpected: %q panics=%v\n\tactual: %q panics=%v", t.Name(), i, row.Input, row.Expected, row.Panics, actual, panicked)
+		}
+	}
+}
+
+func TestProgram_VerifyStack(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		// balanced
+		testrow{"CHOICE .L0\nANYB\nCOMMIT .L0\n.L0:\nCALL r\nEND\nr:\nANYB\nRET", ""},
+		testrow{"CHOICE .L1\n.L0:\nANYB\nPCOMMIT .L1\nJMP .L0\n.L1:\nEND", ""},
+		testrow{"TSAMEB .L0, 'a'\nCHOICE .HF\nSAMEB 'b'\nCOMMIT .L1\n.L0:\nANYB\n.L1:\nEND\n.HF:\nRWNDB 1\nJMP .L0", ""},
+		// RET with a pending CHOICE
+		testrow{"CALL r\nEND\nr:\nCHOICE .L0\nANYB\nRET\n.L0:\nRET", "XP 8: RET with a CHOICE frame pending"},
+		// COMMIT that would pop a CALL frame
+		testrow{"CALL r\nEND\nr:\nANYB\nCOMMIT .L0\n.L0:\nRET", "XP 6: no CHOICE frame is pending"},
+		// FAIL2X on an empty stack
+		testrow{"FAIL2X", "XP 0: no CHOICE frame is pending"},
+		// a loop that pushes a frame on every iteration
+		testrow{".L0:\nCHOICE .L1\nANYB\nJMP .L0\n.L1:\nEND", "XP 0: paths disagree on the number of pending CHOICE frames"},
+		// a test-and-branch that leaves a CHOICE frame behind
+		testrow{"%runeset [a]\nCHOICE .L1\nTMATCHR .L0, 0\nCOMMIT .L0\n.L0:\nEND\n.L1:\nEND", "XP 8: paths disagree on the number of pending CHOICE frames"},
+	}
+
+	for i, row := range data {
+		p, err := ParseAssembly(strings.NewReader("%captures 0\n" + row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var actual string
+		if err := p.VerifyStack(); err != nil {
+			x, ok := err.(*VerifyError)
+			if !ok {
+				t.Errorf("%s/%03d: wrong error type: %v", t.Name(), i, err)
+				continue
+			}
+			actual = fmt.Sprintf("XP %d: %v", x.XP, x.Err)
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %q\n\tactual: %q", t.Name(), i, row.Expected, actual)
+		}
+	}
+
+	a := NewAssembler()
+	a.Verify = true
+	a.DeclareNumCaptures(0)
+	a.EmitOp(OpRET.Meta(), nil, nil, nil)
+	a.EmitLabel("r")
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitOp(OpRET.Meta(), nil, nil, nil)
+	a.EmitLabel(".L0")
+	a.DeclareEntry("r")
+	if _, err := a.Finish(); err == nil {
+		t.Errorf("%s: expected Finish to fail verification", t.Name())
+	}
+}
+
+func TestAssembler_Capture(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	key := a.Capture("key")
+	value := a.Capture("value")
+	if again := a.Capture("key"); again != key {
+		t.Errorf("%s: Capture(\"key\") changed: %d vs %d", t.Name(), key, again)
+	}
+	if key != 1 || value != 2 {
+		t.Errorf("%s: wrong indices: key=%d value=%d", t.Name(), key, value)
+	}
+
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpFCAP.Meta(), key, 0, nil)
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitOp(OpFCAP.Meta(), key, 1, nil)
+	a.EmitOp(OpSAMEB.Meta(), '=', nil, nil)
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.EmitOp(OpFCAP.Meta(), value, 1, nil)
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	if len(p.Captures) != 3 || p.Captures[1].Name != "key" || p.Captures[2].Name != "value" {
+		t.Errorf("%s: wrong captures: %v", t.Name(), p.Captures)
+	}
+	expected := "{true [0:{(0,3) [(0,3)]} 1:{(0,1) [(0,0) (0,1)]} 2:{(2,3) [(2,3)]}]}"
+	if actual := p.Match([]byte("k=v")).String(); actual != expected {
+		t.Errorf("%s: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), expected, actual)
+	}
+}
+
+func TestAssembler_Parse_constants(t *testing.T) {
+	type testrow struct {
+		Debug    int64
+		Expected *Builder
+	}
+
+	data := []testrow{
+		testrow{0, NewBuilder().NumCaptures(0).AnyBN(8).SameB('b').SameBN('c', 5).End()},
+		testrow{1, NewBuilder().NumCaptures(0).AnyBN(8).SameB('b').Nop().SameBN('x', 2).End()},
+	}
+
+	for i, row := range data {
+		a := NewAssembler()
+		a.Constants["DEBUG"] = row.Debug
+		err := a.Parse(strings.NewReader(`
+			COUNT = 4
+			%captures COUNT - 4
+			ANYB COUNT*2
+			SAMEB 'a' + 1
+			%if DEBUG
+			NOP
+			%if COUNT > 10
+			FAIL
+			%else
+			SAMEB 'x', (COUNT >> 1) & 0xff
+			%endif
+			%else
+			SAMEB 'c', COUNT + !DEBUG
+			%endif
+			END
+		`))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual, err := a.Finish()
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		expected, err := row.Expected.Finish()
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if !bytes.Equal(actual.Bytes, expected.Bytes) {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %x\n\tactual: %x", t.Name(), i, expected.Bytes, actual.Bytes)
+		}
+	}
+}
+
+func TestAssembler_SetSourcePos(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(0)
+	a.DeclareEntry("main")
+	a.EmitLabel("main")
+	a.SetSourcePos(SourcePos{File: "x.peg", Line: 3, Rule: "main"})
+	a.EmitOp(OpANYB.Meta(), nil, nil, nil)
+	a.SetSourcePos(SourcePos{Rule: "broken"})
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitLabel(".L0")
+	a.SetSourcePos(SourcePos{})
+	a.EmitOp(OpEND.Meta(), nil, nil, nil)
+	obj, err := a.FinishObject()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	// Linking moves the code, and the positions must follow it.
+	b := NewAssembler()
+	b.DeclareNumCaptures(0)
+	b.EmitOp(OpNOP.Meta(), nil, nil, nil)
+	b.EmitOp(OpNOP.Meta(), nil, nil, nil)
+	prefix, err := b.FinishObject()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	p, err := Link(prefix, obj)
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if fmt.Sprint(p.Debug) != "[{4 x.peg:3 (main)} {5 broken}]" {
+		t.Errorf("%s: wrong debug section: %v", t.Name(), p.Debug)
+	}
+
+	var buf bytes.Buffer
+	p.Disassemble(&buf)
+	if !strings.Contains(buf.String(), "\tANYB\t; x.peg:3 (main)\n") {
+		t.Errorf("%s: position missing from disassembly:\n%s", t.Name(), buf.String())
+	}
+
+	x, err := p.ExecEntry("main", []byte("a"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	err = x.Run()
+	if x, ok := err.(*RuntimeError); !ok || x.Pos.Rule != "broken" || !strings.HasSuffix(x.Error(), " (from broken)") {
+		t.Errorf("%s: wrong error: %v", t.Name(), err)
+	}
+}
+
+func TestProgram_Validate(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"%literal \"ab\"\nCHOICE .L0\nLITB 0\nCOMMIT .L0\n.L0:\nEND", "[]"},
+		// JMP +1, into the middle of LITB 0
+		testrow{"%literal \"ab\"\n%bytes 0x90, 0x40, 0x01\nLITB 0", "[XP 0: code offset does not land on an instruction boundary]"},
+		// JMP +16, past the end
+		testrow{"%bytes 0x90, 0x40, 0x10", "[XP 0: code offset out of range]"},
+		testrow{"%literal \"ab\"\nLITB 1\nMATCHB 0\nBCAP 0", "[XP 0: index out of range XP 2: index out of range XP 4: index out of range]"},
+		testrow{"ANYB\n%bytes 0x90", "[XP 1: unexpected EOF]"},
+		testrow{"ANYB\nFAIL2X", "[XP 1: no CHOICE frame is pending]"},
+	}
+
+	for i, row := range data {
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var list []string
+		for _, v := range p.Validate() {
+			list = append(list, fmt.Sprintf("XP %d: %v", v.XP, v.Err))
+		}
+		actual := "[" + strings.Join(list, " ") + "]"
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Expected, actual)
+		}
+	}
+
+	for i, p := range []*Program{sampleProgram1, sampleProgram2} {
+		if v := p.Validate(); v != nil {
+			t.Errorf("%s: sample %d: unexpected violations: %v", t.Name(), i+1, v)
+		}
+	}
+}
+
+func TestProgram_Stats(t *testing.T) {
+	input := "%literal \"ab\"\n%literal \"xyz\"\n%captures 2\n" +
+		"CHOICE .L0\nCHOICE .L1\nLITB 0\nCOMMIT .L1\n.L1:\nLITB 1\nCOMMIT .L0\n.L0:\nANYB\nEND"
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	stats, err := p.Stats()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Name     string
+		Expected uint64
+		Actual   uint64
+	}
+
+	data := []testrow{
+		testrow{"CodeSize", uint64(len(p.Bytes)), stats.CodeSize},
+		testrow{"NumOps", 8, stats.NumOps},
+		testrow{"CHOICE", 2, stats.Histogram[OpCHOICE]},
+		testrow{"COMMIT", 2, stats.Histogram[OpCOMMIT]},
+		testrow{"LITB", 2, stats.Histogram[OpLITB]},
+		testrow{"NOP", 0, stats.Histogram[OpNOP]},
+		testrow{"NumLiterals", 2, stats.NumLiterals},
+		testrow{"LiteralBytes", 5, stats.LiteralBytes},
+		testrow{"NumByteSets", 0, stats.NumByteSets},
+		testrow{"NumCaptures", 2, stats.NumCaptures},
+		testrow{"MaxOpLength", 2, uint64(stats.MaxOpLength)},
+		testrow{"MaxNesting", 2, uint64(stats.MaxNesting)},
+	}
+
+	for i, row := range data {
+		if row.Actual != row.Expected {
+			t.Errorf("%s/%03d: wrong %s: expected %d, got %d", t.Name(), i, row.Name, row.Expected, row.Actual)
+		}
+	}
+
+	bad := &Program{Bytes: []byte{0x90}}
+	if _, err := bad.Stats(); err == nil {
+		t.Errorf("%s: expected error for truncated bytecode", t.Name())
+	}
+}
+
+func TestProgram_CFG(t *testing.T) {
+	input := "%literal \"ab\"\n" +
+		"CHOICE .L0\nLITB 0\nCOMMIT .L1\n.L0:\nCALL sub\n.L1:\nEND\n" +
+		"sub:\nTANYB .L2\nRET\n.L2:\nFAIL"
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	g, err := p.CFG()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var list []string
+	for _, block := range g.Blocks {
+		var ops []string
+		for _, op := range block.Ops {
+			ops = append(ops, op.Code.String())
+		}
+		var succs []string
+		for _, edge := range block.Succs {
+			succs = append(succs, fmt.Sprintf("%v:%d", edge.Kind, edge.XP))
+		}
+		list = append(list, fmt.Sprintf("%d-%d [%s] -> [%s]", block.Start, block.End, strings.Join(ops, " "), strings.Join(succs, " ")))
+	}
+	actual := strings.Join(list, "\n")
+	expected := strings.Join([]string{
+		"0-2 [CHOICE] -> [fallthrough:2 failure:6]",
+		"2-6 [LITB COMMIT] -> [jump:9]",
+		"6-9 [CALL] -> [call:11 fallthrough:9]",
+		"9-11 [END] -> []",
+		"11-14 [TANYB] -> [fallthrough:14 jump:16]",
+		"14-16 [RET] -> []",
+		"16-17 [FAIL] -> []",
+	}, "\n")
+	if actual != expected {
+		t.Errorf("%s: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), expected, actual)
+	}
+
+	if b := g.BlockAt(0); b != g.Blocks[0] {
+		t.Errorf("%s: BlockAt(0) returned %v", t.Name(), b)
+	}
+	if b := g.BlockAt(1); b != nil {
+		t.Errorf("%s: BlockAt(1) returned %v", t.Name(), b)
+	}
+
+	bad := &Program{Bytes: []byte{0x90, 0x40, 0x10}}
+	if _, err := bad.CFG(); err == nil {
+		t.Errorf("%s: expected error for out-of-range jump", t.Name())
+	}
+}
+
+func TestProgram_WriteDot(t *testing.T) {
+	input := "%literal \"ab\"\n" +
+		"CHOICE .L0\nLITB 0\nCOMMIT .L0\n.L0:\nCALL sub\nJMP .L1\n" +
+		"sub:\nSAMEB '\"'\nRET\n.L1:"
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var buf bytes.Buffer
+	if _, err := p.WriteDot(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := strings.Join([]string{
+		"digraph program {",
+		"\tnode [shape=box, fontname=\"monospace\"];",
+		"\tx0 [label=\"000  CHOICE .L0 <.+4>\\l\"];",
+		"\tx0 -> x2;",
+		"\tx0 -> x6 [style=dashed];",
+		"\tx2 [label=\"002  LITB 0\\l004  COMMIT .L0 <.+0>\\l\"];",
+		"\tx2 -> x6;",
+		"\tx6 [label=\".L0:\\l006  CALL sub <.+3>\\l\"];",
+		"\tx6 -> xc [style=bold];",
+		"\tx6 -> x9;",
+		"\tx9 [label=\"009  JMP .L1 <.+4>\\l\"];",
+		"\tx9 -> end;",
+		"\txc [label=\"sub:\\l00c  SAMEB '\\\"'\\l00e  RET\\l\"];",
+		"\tend [shape=doublecircle, label=\"end\"];",
+		"}",
+		"",
+	}, "\n")
+	actual := buf.String()
+	if actual != expected {
+		t.Errorf("%s: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), expected, actual)
+	}
+}
+
+func TestProgram_DisassembleWithOptions(t *testing.T) {
+	type testrow struct {
+		Options  DisassembleOptions
+		Expected string
+	}
+
+	header := "%literal \"ana\"\n%captures 1\n\n"
+	data := []testrow{
+		testrow{
+			DisassembleOptions{ShowOffsets: true, ShowBytes: true, LabelStyle: LabelsInline},
+			header +
+				"000 ac 40 00       BCAP 0\n" +
+				"003 14 07     .L0: CHOICE .L1 <.+7>\n" +
+				"005 64 00          LITB 0\n" +
+				"007 14 07          CHOICE .L2 <.+7>\n" +
+				"009 40             ANYB\n" +
+				"00a a6 00          FAIL2X\n" +
+				"00c 40        .L1: ANYB\n" +
+				"00d 90 40 f3       JMP .L0 <.-13>\n" +
+				"010 ae 40 00  .L2: ECAP 0\n" +
+				"013 fe 00          END\n",
+		},
+		testrow{
+			DisassembleOptions{ShowOffsets: true},
+			header +
+				"000  BCAP 0\n" +
+				".L0:\n" +
+				"003  CHOICE .L1 <.+7>\n" +
+				"005  LITB 0\n" +
+				"007  CHOICE .L2 <.+7>\n" +
+				"009  ANYB\n" +
+				"00a  FAIL2X\n" +
+				".L1:\n" +
+				"00c  ANYB\n" +
+				"00d  JMP .L0 <.-13>\n" +
+				".L2:\n" +
+				"010  ECAP 0\n" +
+				"013  END\n",
+		},
+		testrow{
+			DisassembleOptions{TabWidth: 4},
+			header +
+				"    BCAP 0\n" +
+				".L0:\n" +
+				"    CHOICE .L1 <.+7>\n" +
+				"    LITB 0\n" +
+				"    CHOICE .L2 <.+7>\n" +
+				"    ANYB\n" +
+				"    FAIL2X\n" +
+				".L1:\n" +
+				"    ANYB\n" +
+				"    JMP .L0 <.-13>\n" +
+				".L2:\n" +
+				"    ECAP 0\n" +
+				"    END\n",
+		},
+	}
+
+	for i, row := range data {
+		var buf bytes.Buffer
+		_, err := sampleProgram1.DisassembleWithOptions(&buf, row.Options)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if actual := buf.String(); actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), i, row.Expected, actual)
+		}
+	}
+}
+
+func TestProgram_DisassembleRange(t *testing.T) {
+	type testrow struct {
+		Start    uint64
+		End      uint64
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{0, 5, "\tBCAP 0\n.L0:\n\tCHOICE .L1 <.+7>\n"},
+		testrow{5, 0x0d, "\tLITB 0\n\tCHOICE .L2 <.+7>\n\tANYB\n\tFAIL2X\n.L1:\n\tANYB\n"},
+		testrow{0x10, 0x15, ".L2:\n\tECAP 0\n\tEND\n"},
+		testrow{0x15, 0x15, ""},
+		testrow{3, 3, ""},
+		testrow{4, 0x15, "error: github.com/chronos-tachyon/peggy/peggyvm: disassemble error @ XP 4 (.L0+0x1): code offset does not land on an instruction boundary"},
+		testrow{0x16, 0x20, "error: github.com/chronos-tachyon/peggy/peggyvm: disassemble error @ XP 22 (.L2+0x6): code offset out of range"},
+	}
+
+	for i, row := range data {
+		var buf bytes.Buffer
+		_, err := sampleProgram1.DisassembleRange(&buf, row.Start, row.End)
+		actual := buf.String()
+		if err != nil {
+			actual = "error: " + err.Error()
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %q\n\tactual: %q", t.Name(), i, row.Expected, actual)
+		}
+	}
+
+	var full, ranged bytes.Buffer
+	sampleProgram2.Disassemble(&full)
+	sampleProgram2.DisassembleRange(&ranged, 0, uint64(len(sampleProgram2.Bytes)))
+	if !strings.HasSuffix(full.String(), "\n\n"+ranged.String()) {
+		t.Errorf("%s: full range differs from Disassemble:\n%s\nvs:\n%s", t.Name(), ranged.String(), full.String())
+	}
+}
+
+func TestProgram_DisassembleAt(t *testing.T) {
+	type testrow struct {
+		XP       uint64
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{0x00, "BCAP 0"},
+		testrow{0x03, "CHOICE .L1 <.+7>"},
+		testrow{0x0d, "JMP .L0 <.-13>"},
+		testrow{0x13, "END"},
+		testrow{0x15, "error"},
+	}
+
+	for i, row := range data {
+		actual, err := sampleProgram1.DisassembleAt(row.XP)
+		if err != nil {
+			actual = "error"
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output: expected %q, got %q", t.Name(), i, row.Expected, actual)
+		}
+	}
+}
+
+func TestProgram_DisassembleJSON(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader("main:\nCHOICE .L0\nSAMEB 'a'\n.L0:\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var buf bytes.Buffer
+	if err := p.DisassembleJSON(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := `[{"xp":0,"len":2,"op":"CHOICE","labels":["main"],"imms":[{"type":"codeOffset","value":2,"target":4,"label":".L0"}]},` +
+		`{"xp":2,"len":2,"op":"SAMEB","imms":[{"type":"byte","value":97},{"type":"count","value":1}]},` +
+		`{"xp":4,"len":2,"op":"END","labels":[".L0"]}]` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Errorf("%s: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), expected, actual)
+	}
+
+	buf.Reset()
+	if err := sampleProgram1.DisassembleJSON(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var list []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &list); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if len(list) != 10 {
+		t.Errorf("%s: expected 10 instructions, got %d", t.Name(), len(list))
+	}
+}
+
+func TestProgram_Instructions(t *testing.T) {
+	type testrow struct {
+		Program  *Program
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{&Program{}, "[] end@0"},
+		testrow{sampleProgram1, "[0:BCAP<0> 3:CHOICE<7> 5:LITB<0> 7:CHOICE<7> 9:ANYB<> a:FAIL2X<> c:ANYB<> d:JMP<18446744073709551603> 10:ECAP<0> 13:END<>] end@15"},
+		testrow{&Program{Bytes: []byte{0x40, 0x90}}, "[0:ANYB<>] error@1"},
+	}
+
+	for i, row := range data {
+		var list []string
+		it := row.Program.Instructions()
+		for it.Next() {
+			list = append(list, fmt.Sprintf("%x:%v", it.XP(), it.Op()))
+		}
+		actual := "[" + strings.Join(list, " ") + "]"
+		if it.Err() != nil {
+			actual += fmt.Sprintf(" error@%x", it.XP())
+		} else {
+			actual += fmt.Sprintf(" end@%x", it.XP())
+		}
+		if it.Next() {
+			t.Errorf("%s/%03d: Next returned true after the end", t.Name(), i)
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Expected, actual)
+		}
+	}
+}
+
+func TestOp_Encode(t *testing.T) {
+	for _, p := range []*Program{sampleProgram1, sampleProgram2} {
+		it := p.Instructions()
+		for it.Next() {
+			op := it.Op()
+			expected := p.Bytes[op.XP : op.XP+uint64(op.Len)]
+			actual, err := op.Encode()
+			if err != nil {
+				t.Errorf("%s: %v: error: %v", t.Name(), op, err)
+				continue
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("%s: %v: expected % x, got % x", t.Name(), op, expected, actual)
+			}
+		}
+	}
+
+	type testrow struct {
+		Op       Op
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{Op{Code: OpANYB, Imm0: 1}, "40"},
+		testrow{Op{Code: OpANYB, Imm0: 2}, "44 02"},
+		testrow{Op{Code: OpLITB, Imm0: 0}, "64 00"},
+		testrow{Op{Code: OpJMP, Imm0: 0x100}, "90 80 00 01"},
+		testrow{Op{Code: OpSAMEB, Imm0: 0x100}, "error: " + ErrBadOperand.Error()},
+		testrow{Op{Code: OpNOP, Imm0: 1}, "error: " + ErrUnexpectedImmediate.Error()},
+		testrow{Op{Code: OpCode(0x3d)}, "error: " + ErrUnknownOpcode.Error()},
+	}
+
+	for i, row := range data {
+		raw, err := row.Op.Encode()
+		actual := fmt.Sprintf("% x", raw)
+		if err != nil {
+			actual = "error: " + err.Error()
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output: expected %q, got %q", t.Name(), i, row.Expected, actual)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var op Op
+		if err := op.Decode(raw, 0); err != nil {
+			t.Errorf("%s/%03d: decode error: %v", t.Name(), i, err)
+		} else if op.Code != row.Op.Code || op.Imm0 != row.Op.Imm0 || op.Imm1 != row.Op.Imm1 || op.Imm2 != row.Op.Imm2 {
+			t.Errorf("%s/%03d: round trip: expected %v, got %v", t.Name(), i, &row.Op, &op)
+		}
+	}
+}
+
+func TestRegisterOpCode(t *testing.T) {
+	meta := OpMeta{
+		Code: 0x3c,
+		Imm0: optional(ImmCount, 1),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "EVENB",
+	}
+	handler := func(x *Execution, op *Op) error {
+		if x.DP+op.Imm0 > uint64(len(x.I)) {
+			x.Fail()
+			return nil
+		}
+		for i := uint64(0); i < op.Imm0; i++ {
+			if x.I[x.DP+i]&1 != 0 {
+				x.Fail()
+				return nil
+			}
+		}
+		x.DP += op.Imm0
+		return nil
+	}
+	if err := RegisterOpCode(meta, handler); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	defer UnregisterOpCode(meta.Code)
+
+	if err := RegisterOpCode(meta, handler); err != ErrDuplicateOpCode {
+		t.Errorf("%s: duplicate: expected %v, got %v", t.Name(), ErrDuplicateOpCode, err)
+	}
+	meta.Code = OpEND
+	if err := RegisterOpCode(meta, handler); err != ErrExtOpCodeRange {
+		t.Errorf("%s: range: expected %v, got %v", t.Name(), ErrExtOpCodeRange, err)
+	}
+
+	p, err := ParseAssembly(strings.NewReader("EVENB 2\nANYB\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var buf bytes.Buffer
+	p.Disassemble(&buf)
+	if !strings.Contains(buf.String(), "\tEVENB 2\n") {
+		t.Errorf("%s: wrong disassembly:\n%s", t.Name(), buf.String())
+	}
+
+	type testrow struct {
+		Input    string
+		Expected bool
+	}
+
+	data := []testrow{
+		testrow{"\x02\x04\x05", true},
+		testrow{"\x02\x03\x05", false},
+		testrow{"\x02", false},
+	}
+
+	for i, row := range data {
+		x := p.Exec([]byte(row.Input))
+		if err := x.Run(); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if actual := x.Result().Success; actual != row.Expected {
+			t.Errorf("%s/%03d: expected %v, got %v", t.Name(), i, row.Expected, actual)
+		}
+	}
+
+	UnregisterOpCode(0x3c)
+	x := p.Exec([]byte("\x02\x04\x05"))
+	if err := x.Run(); err == nil {
+		t.Errorf("%s: expected error after UnregisterOpCode", t.Name())
+	}
+}
+
+func TestCompose(t *testing.T) {
+	parse := func(text string) *Program {
+		p, err := ParseAssembly(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("%s: %q: error: %v", t.Name(), text, err)
+		}
+		return p
+	}
+	ab := parse("%literal \"ab\"\n%captures 1\n%namedcapture 0 \"x\"\nBCAP 0\nLITB 0\nECAP 0\nEND")
+	cd := parse("%literal \"cd\"\n%captures 1\nBCAP 0\nLITB 0\nECAP 0")
+	a := parse("SAMEB 'a'\nEND")
+
+	concat, err := Concat(ab, cd)
+	if err != nil {
+		t.Fatalf("%s: Concat: error: %v", t.Name(), err)
+	}
+	alt, err := Alternate(ab, cd, a)
+	if err != nil {
+		t.Fatalf("%s: Alternate: error: %v", t.Name(), err)
+	}
+	none, err := Alternate()
+	if err != nil {
+		t.Fatalf("%s: Alternate: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Program  *Program
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{concat, "abcdx", "{true [0:{(0,4) [(0,4)]} 1:{(0,2) [(0,2)]} 2:{(2,4) [(2,4)]}]}"},
+		testrow{concat, "abx", "{false}"},
+		testrow{concat, "cd", "{false}"},
+		testrow{alt, "abx", "{true [0:{(0,2) [(0,2)]} 1:{(0,2) [(0,2)]} 2:-]}"},
+		testrow{alt, "cdx", "{true [0:{(0,2) [(0,2)]} 1:- 2:{(0,2) [(0,2)]}]}"},
+		testrow{alt, "ax", "{true [0:{(0,1) [(0,1)]} 1:- 2:-]}"},
+		testrow{alt, "x", "{false}"},
+		testrow{none, "", "{false}"},
+	}
+
+	for i, row := range data {
+		actual := row.Program.Match([]byte(row.Input)).String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	if idx, found := concat.NamedCaptures["x"]; !found || idx != 1 {
+		t.Errorf("%s: NamedCaptures: expected x=1, got %v", t.Name(), concat.NamedCaptures)
+	}
+
+	unbalanced := parse("CHOICE .L0\nANYB\nEND\n.L0:")
+	if _, err := Concat(ab, unbalanced); err == nil || !strings.Contains(err.Error(), ErrNotComposable.Error()) {
+		t.Errorf("%s: unbalanced: expected ErrNotComposable, got %v", t.Name(), err)
+	}
+	giveup := parse("GIVEUP")
+	if _, err := Alternate(ab, giveup); err == nil || !strings.Contains(err.Error(), ErrNotComposable.Error()) {
+		t.Errorf("%s: GIVEUP: expected ErrNotComposable, got %v", t.Name(), err)
+	}
+	throw := parse("RECOVER .L0, 1\nTHROW 2\n.L0:\nEND")
+	if _, err := Alternate(ab, throw); err == nil || !strings.Contains(err.Error(), ErrNotComposable.Error()) {
+		t.Errorf("%s: THROW: expected ErrNotComposable, got %v", t.Name(), err)
+	}
+	set := NewProgramSet()
+	set.Add("ab", ab)
+	set.Add("throw", throw)
+	if err := set.Compile(); err == nil || !strings.Contains(err.Error(), ErrNotComposable.Error()) {
+		t.Errorf("%s: ProgramSet: THROW: expected ErrNotComposable, got %v", t.Name(), err)
+	}
+}
+
+func TestProgram_FirstSets(t *testing.T) {
+	input := `
+		%literal "if"
+		%matcher [0-9]
+		%entry number
+		%entry opt
+		CHOICE .L0
+		LITB 0
+		COMMIT .L1
+	.L0:
+		CALL number
+	.L1:
+		END
+	number:
+		MATCHB 0
+		SPANB 0
+		RET
+	opt:
+		TSAMEB .L2, '-'
+	.L2:
+		CALL number
+		RET
+	`
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	sets, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	str := func(fs FirstSet) string {
+		return fmt.Sprintf("%v/%v", fs.Bytes, fs.MayBeEmpty)
+	}
+
+	type testrow struct {
+		Name     string
+		Expected string
+		Actual   FirstSet
+	}
+
+	data := []testrow{
+		testrow{"Start", `[\x30\x31\x32\x33\x34\x35\x36\x37\x38\x39\x69]/false`, sets.Start},
+		testrow{"number", `[\x30\x31\x32\x33\x34\x35\x36\x37\x38\x39]/false`, sets.Entries["number"]},
+		testrow{"opt", `[\x2d\x30\x31\x32\x33\x34\x35\x36\x37\x38\x39]/false`, sets.Entries["opt"]},
+		testrow{"CHOICE/0", `[\x69]/false`, sets.Choices[0][0]},
+		testrow{"CHOICE/1", `[\x30\x31\x32\x33\x34\x35\x36\x37\x38\x39]/false`, sets.Choices[0][1]},
+		testrow{"end", `!./true`, sets.At(uint64(len(p.Bytes)))},
+	}
+
+	for i, row := range data {
+		if actual := str(row.Actual); actual != row.Expected {
+			t.Errorf("%s/%03d: %s: expected %s, got %s", t.Name(), i, row.Name, row.Expected, actual)
+		}
+	}
+
+	sets, err = sampleProgram1.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := str(sets.Choices[3][0]); actual != `[\x61]/false` {
+		t.Errorf("%s: sample1: CHOICE .L1: got %s", t.Name(), actual)
+	}
+	if m := sets.Start.Matcher(); m.String() != "." {
+		t.Errorf("%s: sample1: Start: got %v", t.Name(), m)
+	}
+}
+
+func TestProgram_RequiredPrefixes(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Limit    int
+		Expected string
+		Prefix   string
+	}
+
+	data := []testrow{
+		testrow{"%literal \"GET \"\nLITB 0\nANYB\nEND", 4, `["GET "]`, "GET "},
+		testrow{"%literal \"foo\"\n%literal \"bar\"\nCHOICE .L0\nLITB 0\nCOMMIT .L1\n.L0:\nLITB 1\n.L1:\nEND", 4, `["bar" "foo"]`, ""},
+		testrow{"%literal \"foo\"\n%literal \"fob\"\nCHOICE .L0\nLITB 0\nCOMMIT .L1\n.L0:\nLITB 1\n.L1:\nEND", 4, `["fob" "foo"]`, "fo"},
+		testrow{"%literal \"foo\"\n%literal \"bar\"\nCHOICE .L0\nLITB 0\nCOMMIT .L1\n.L0:\nLITB 1\n.L1:\nEND", 1, `[]`, ""},
+		testrow{"%literal \"ab\"\nCHOICE .L0\nLITB 0\nCOMMIT .L1\n.L0:\nSAMEB 'a'\n.L1:\nEND", 4, `["a"]`, "a"},
+		testrow{".L0:\nCHOICE .L1\nSAMEB 'a'\nCOMMIT .L0\n.L1:\nEND", 4, `[]`, ""},
+		testrow{"%literal \"hi\"\nCALL w\nSAMEB '!', 2\nEND\nw:\nLITB 0\nRET", 4, `["hi!!"]`, "hi!!"},
+		testrow{"%literal \"hi\"\nCHOICE .L0\nSAMEB 'x'\nFAIL2X\n.L0:\nLITB 0\nEND", 4, `["hi"]`, "hi"},
+		testrow{"%literal \"hi\"\nTSAMEB .L0, 'x'\nEND\n.L0:\nLITB 0\nEND", 4, `["hi" "x"]`, ""},
+		testrow{"%matcher [\\x7a]\nMATCHB 0, 3", 4, `["zzz"]`, "zzz"},
+	}
+
+	for i, row := range data {
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		list, err := p.RequiredPrefixes(row.Limit)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var quoted []string
+		for _, item := range list {
+			quoted = append(quoted, fmt.Sprintf("%q", item))
+		}
+		actual := "[" + strings.Join(quoted, " ") + "]"
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong prefixes: expected %s, got %s", t.Name(), i, row.Expected, actual)
+		}
+		prefix, err := p.RequiredPrefix()
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if string(prefix) != row.Prefix {
+			t.Errorf("%s/%03d: wrong prefix: expected %q, got %q", t.Name(), i, row.Prefix, prefix)
+		}
+	}
+
+	if list, err := sampleProgram1.RequiredPrefixes(16); err != nil || list != nil {
+		t.Errorf("%s: sample1: expected nil, got %q, %v", t.Name(), list, err)
+	}
+}
+
+func TestProgram_Optimize(t *testing.T) {
+	// main <- list !.
+	// list <- 'a' list / ''
+	input := dedent.Dedent(`
+	%captures 1
+		BCAP 0
+		CALL list
+		CHOICE .L1
+		ANYB
+		FAIL2X
+	.L1:
+		JMP .L2
+	.L2:
+		ECAP 0
+		END
+	list:
+		CHOICE .L3
+		SAMEB 'a'
+		COMMIT .L4
+	.L4:
+		CALL list
+		RET
+	.L3:
+		RET
+	`)
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q, err := p.Optimize()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := q.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := dedent.Dedent(`
+	%captures 1
+
+		BCAP 0
+		CALL list <.+10>
+		EOI
+	.L1:
+		JMP .L2 <.+0>
+	.L2:
+		ECAP 0
+		END
+	list:
+		TSAMEB .L3 <.+7>, 'a'
+		CHOICE .HF1 <.+7>
+		COMMIT list <.-8>
+	.L4:
+		JMP list <.-11>
+	.L3:
+		RET
+	.HF1:
+		RWNDB 1
+		JMP .L3 <.-8>
+	`)[1:]
+	if actual := buf.String(); actual != expected {
+		t.Errorf("%s: wrong output:\n%s", t.Name(), diff(expected, actual))
+	}
+
+	for i, input := range []string{"", "a", "aaa", "ab", "b"} {
+		expected := p.Match([]byte(input)).String()
+		actual := q.Match([]byte(input)).String()
+		if actual != expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, input, expected, actual)
+		}
+	}
+
+	if _, err := (&Program{Bytes: []byte{0x20}}).Optimize(); err == nil {
+		t.Errorf("%s: expected error for truncated bytecode", t.Name())
+	}
+}
+
+func TestProgram_Precompile(t *testing.T) {
+	type testrow struct {
+		Program *Program
+		Input   string
+	}
+
+	data := []testrow{
+		testrow{sampleProgram1, ""},
+		testrow{sampleProgram1, "ana"},
+		testrow{sampleProgram1, "anax"},
+		testrow{sampleProgram1, "banana"},
+		testrow{sampleProgram2, ""},
+		testrow{sampleProgram2, "ana"},
+		testrow{sampleProgram2, "banana"},
+		testrow{sampleProgram2, "bananas"},
+	}
+
+	for i, row := range data {
+		p := *row.Program
+		if p.IsPrecompiled() {
+			t.Errorf("%s/%03d: IsPrecompiled: expected false before Precompile", t.Name(), i)
+		}
+		if err := p.Precompile(); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if !p.IsPrecompiled() {
+			t.Errorf("%s/%03d: IsPrecompiled: expected true after Precompile", t.Name(), i)
+		}
+		expected := row.Program.Match([]byte(row.Input)).String()
+		actual := p.Match([]byte(row.Input)).String()
+		if actual != expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, expected, actual)
+		}
+	}
+
+	bad := &Program{Bytes: []byte{0x20}}
+	if err := bad.Precompile(); err == nil {
+		t.Errorf("%s: expected error for truncated bytecode", t.Name())
+	} else if bad.IsPrecompiled() {
+		t.Errorf("%s: IsPrecompiled: expected false after failed Precompile", t.Name())
+	}
+}
+
+func TestProgram_Symbolize(t *testing.T) {
+	type testrow struct {
+		XP       uint64
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{0, "0x0"},
+		testrow{2, "0x2"},
+		testrow{3, ".L0"},
+		testrow{4, ".L0+0x1"},
+		testrow{0x16, ".L2+0x6"},
+	}
+
+	for i, row := range data {
+		if actual := sampleProgram1.Symbolize(row.XP); actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output: expected %q, got %q", t.Name(), i, row.Expected, actual)
+		}
+	}
+
+	p, err := ParseAssembly(strings.NewReader("main:\nCHOICE .L0\nRET\n.L0:\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	err = p.Exec(nil).Run()
+	if re, ok := err.(*RuntimeError); !ok || re.Symbol != "main+0x2" {
+		t.Errorf("%s: wrong runtime error: %v", t.Name(), err)
+	} else if !strings.Contains(err.Error(), "@ XP 2 (main+0x2) DP 0: RET: ") {
+		t.Errorf("%s: wrong message: %v", t.Name(), err)
+	}
+}
+
+func TestProgram_MaterializeLabels(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(".L0:\nCHOICE .L1\nANYB\n.L1:\nJMP .L0"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	p.Labels, p.LabelsByName = nil, nil
+
+	n, err := p.MaterializeLabels()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if n != 2 {
+		t.Errorf("%s: expected 2 labels added, got %d", t.Name(), n)
+	}
+	var names []string
+	for _, label := range p.Labels {
+		names = append(names, fmt.Sprintf("%s=%d", label.Name, label.Offset))
+	}
+	if actual := strings.Join(names, " "); actual != ".ANON@0=0 .ANON@3=3" {
+		t.Errorf("%s: wrong labels: %s", t.Name(), actual)
+	}
+	if p.LabelsByName[".ANON@3"] == nil {
+		t.Errorf("%s: LabelsByName not updated", t.Name())
+	}
+	if sym := p.Symbolize(4); sym != ".ANON@3+0x1" {
+		t.Errorf("%s: wrong symbol: %q", t.Name(), sym)
+	}
+
+	if n, err := p.MaterializeLabels(); err != nil || n != 0 {
+		t.Errorf("%s: second call: expected 0, <nil>, got %d, %v", t.Name(), n, err)
+	}
+
+	q := &Program{Bytes: append([]byte(nil), p.Bytes...)}
+	q.Bytes[len(q.Bytes)-1] = 0x7f
+	if _, err := q.MaterializeLabels(); err == nil {
+		t.Errorf("%s: expected error for out-of-range jump", t.Name())
+	}
+}
+
+func TestAssembler_relaxation(t *testing.T) {
+	// The CHOICE and the JMP each span the other, so neither length can be
+	// determined without knowing the other's. The JMP's offset also spans
+	// the JMP itself.
+	type testrow struct {
+		Fill   int
+		Choice string
+		Jmp    string
+	}
+
+	data := []testrow{
+		testrow{0, "14 03", "90 40 fb"},
+		testrow{123, "14 7e", "90 40 80"},
+		testrow{124, "18 80 00", "90 80 7d ff"},
+		testrow{125, "18 81 00", "90 80 7c ff"},
+	}
+
+	for i, row := range data {
+		a := NewAssembler()
+		a.DeclareNumCaptures(0)
+		a.EmitLabel(".L0")
+		a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L1"), nil, nil)
+		for j := 0; j < row.Fill; j++ {
+			a.EmitOp(OpNOP.Meta(), nil, nil, nil)
+		}
+		a.EmitOp(OpJMP.Meta(), a.GrabLabel(".L0"), nil, nil)
+		a.EmitLabel(".L1")
+
+		p, err := a.Finish()
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+
+		var op Op
+		if err := op.Decode(p.Bytes, 0); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		jmpXP := uint(op.Len) + uint(row.Fill)
+		choice := fmt.Sprintf("% x", p.Bytes[:op.Len])
+		jmp := fmt.Sprintf("% x", p.Bytes[jmpXP:])
+		if choice != row.Choice || jmp != row.Jmp {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %s / %s\n\tactual: %s / %s", t.Name(), i, row.Choice, row.Jmp, choice, jmp)
+		}
+	}
+}
+
+func TestProgramSet_Match(t *testing.T) {
+	s := NewProgramSet()
+	s.Add("suffix-ana", sampleProgram1)
+	s.Add("b-an-a", sampleProgram2)
+	if err := s.Compile(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Index    int
+		Name     string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"banana", 0, "suffix-ana", "{true [0:{(0,6) [(0,6)]}]}"},
+		testrow{"ba", 1, "b-an-a", "{true [0:{(0,2) [(0,2)]} 1:-]}"},
+		testrow{"bana", 0, "suffix-ana", "{true [0:{(0,4) [(0,4)]}]}"},
+		testrow{"banan", -1, "", "{false}"},
+	}
+
+	for i, row := range data {
+		index, r := s.Match([]byte(row.Input))
+		name, _ := s.MatchName([]byte(row.Input))
+		actual := r.String()
+		if index != row.Index || name != row.Name || actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %d %q %s\n\tactual: %d %q %s", t.Name(), i, row.Input, row.Index, row.Name, row.Expected, index, name, actual)
+		}
+	}
+}
+
+func TestProgramSet_Expand(t *testing.T) {
+	parse := func(source string) *Program {
+		p, err := ParseAssembly(strings.NewReader(source))
+		if err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+		return p
+	}
+	s := NewProgramSet()
+	s.Add("pair", parse("%captures 2\n%namedcapture 1 \"word\"\nBCAP 0\nSAMEB 'a'\nECAP 0\nBCAP 1\nSAMEB 'b'\nECAP 1\nEND"))
+	s.Add("single", parse("%captures 2\n%namedcapture 0 \"word\"\n%namedcapture 1 \"num\"\nBCAP 0\nSAMEB 'c'\nECAP 0\nBCAP 1\nSAMEB '1'\nECAP 1\nEND"))
+	if err := s.Compile(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Template string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"ab", "<$word>", "<b>"},
+		testrow{"c1", "<$word:$num>", "<c:1>"},
+	}
+
+	for i, row := range data {
+		input := []byte(row.Input)
+		index, r := s.Match(input)
+		if index < 0 {
+			t.Errorf("%s/%03d: %q: expected a match", t.Name(), i, row.Input)
+			continue
+		}
+		if actual := string(r.Expand(nil, []byte(row.Template), input)); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Template, row.Expected, actual)
+		}
+	}
+}
+
+func TestParseAssembly_roundTrip(t *testing.T) {
+	set := NewProgramSet()
+	set.Add("suffix-ana", sampleProgram1)
+	set.Add("b-an-a", sampleProgram2)
+	if err := set.Compile(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	a := NewAssembler()
+	a.DeclareLiteral([]byte{0xff, 0x00})
+	a.DeclareByteSet(byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'}))
+	a.DeclareNumCaptures(2)
+	a.DeclareNamedCapture(1, "digits")
+	a.Captures[1].Repeat = true
+	a.EmitLabel("main")
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpBCAP.Meta(), 1, nil, nil)
+	a.EmitOp(OpMATCHB.Meta(), 0, 3, nil)
+	a.EmitLabel("unused")
+	a.EmitOp(OpECAP.Meta(), 1, nil, nil)
+	a.EmitOp(OpTLITB.Meta(), a.GrabLabel("end"), 0, nil)
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpEND.Meta(), nil, nil, nil)
+	a.EmitLabel("end")
+	a.DeclareEntry("unused")
+	extras, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Program *Program
+	}
+
+	data := []testrow{
+		testrow{sampleProgram1},
+		testrow{sampleProgram2},
+		testrow{set.Program()},
+		testrow{extras},
+	}
+
+	for i, row := range data {
+		var buf bytes.Buffer
+		_, err := row.Program.Disassemble(&buf)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		text := buf.String()
+		p, err := ParseAssembly(&buf)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		expected := hexDump(row.Program.Bytes)
+		actual := hexDump(p.Bytes)
+		if expected != actual {
+			t.Errorf("%s/%03d: wrong bytes:\n%s", t.Name(), i, diff(expected, actual))
+		}
+		expected = fmt.Sprint(row.Program.Captures)
+		actual = fmt.Sprint(p.Captures)
+		if expected != actual {
+			t.Errorf("%s/%03d: wrong captures:\n\texpected: %s\n\tactual: %s", t.Name(), i, expected, actual)
+		}
+		buf.Reset()
+		_, err = p.Disassemble(&buf)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if buf.String() != text {
+			t.Errorf("%s/%03d: wrong disassembly:\n%s", t.Name(), i, diff(text, buf.String()))
+		}
+	}
+}
+
+func TestProgram_MarshalBinary(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(2)
+	a.DeclareNamedCapture(1, "digits")
+	a.Captures[1].Repeat = true
+	a.DeclareEntry("main")
+	a.EmitLabel("main")
+	a.SetSourcePos(SourcePos{File: "x.peg", Line: 7, Rule: "main"})
+	a.EmitOp(OpFCAP.Meta(), 1, 0, nil)
+	a.EmitOp(OpSPANB.Meta(), a.InternByteSet(byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})), nil, nil)
+	a.EmitOp(OpLITB.Meta(), a.InternLiteral([]byte("\x00\xff")), nil, nil)
+	withDebug, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Program *Program
+	}
+
+	data := []testrow{
+		testrow{sampleProgram1},
+		testrow{sampleProgram2},
+		testrow{withDebug},
+	}
+
+	for i, row := range data {
+		raw, err := row.Program.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var p Program
+		if err := p.UnmarshalBinary(raw); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+
+		var expected, actual bytes.Buffer
+		row.Program.Disassemble(&expected)
+		p.Disassemble(&actual)
+		if actual.String() != expected.String() || !bytes.Equal(p.Bytes, row.Program.Bytes) {
+			t.Errorf("%s/%03d: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), i, expected.String(), actual.String())
+		}
+		if fmt.Sprint(p.NamedCaptures) != fmt.Sprint(row.Program.NamedCaptures) || fmt.Sprint(p.Debug) != fmt.Sprint(row.Program.Debug) {
+			t.Errorf("%s/%03d: wrong metadata: %v %v", t.Name(), i, p.NamedCaptures, p.Debug)
+		}
+
+		for n := 0; n < len(raw); n++ {
+			if err := p.UnmarshalBinary(raw[:n]); err == nil {
+				t.Errorf("%s/%03d: truncated to %d bytes: expected error", t.Name(), i, n)
+				break
+			}
+		}
+	}
+
+	var p Program
+	if err := p.UnmarshalBinary([]byte{99}); err != ErrBadVersion {
+		t.Errorf("%s: expected ErrBadVersion, got %v", t.Name(), err)
+	}
+}
+
+func TestProgram_MarshalJSON(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareNamedCapture(0, "all")
+	a.DeclareEntry("main")
+	a.EmitLabel("main")
+	a.SetSourcePos(SourcePos{File: "x.peg", Line: 2})
+	a.EmitOp(OpLITB.Meta(), a.InternLiteral([]byte("ab")), nil, nil)
+	a.EmitOp(OpMATCHB.Meta(), a.InternByteSet(byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})), nil, nil)
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	raw, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := `{"version":1,"bytes":"ZAB0AA==","literals":["YWI="],` +
+		`"byteSets":["[\\x30\\x31\\x32\\x33\\x34\\x35\\x36\\x37\\x38\\x39]"],` +
+		`"captures":[{"name":"all"}],"namedCaptures":{"all":0},` +
+		`"labels":[{"name":"main","public":true,"offset":0}],"entries":["main"],` +
+		`"debug":[{"xp":0,"file":"x.peg","line":2},{"xp":2,"file":"x.peg","line":2}]}`
+	if string(raw) != expected {
+		t.Errorf("%s: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), expected, raw)
+	}
+
+	for i, prog := range []*Program{p, sampleProgram1, sampleProgram2} {
+		raw, err := json.Marshal(prog)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var q Program
+		if err := json.Unmarshal(raw, &q); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var expected, actual bytes.Buffer
+		prog.Disassemble(&expected)
+		q.Disassemble(&actual)
+		if actual.String() != expected.String() {
+			t.Errorf("%s/%03d: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), i, expected.String(), actual.String())
+		}
+	}
+
+	var q Program
+	if err := json.Unmarshal([]byte(`{"version":2}`), &q); err != ErrBadVersion {
+		t.Errorf("%s: expected ErrBadVersion, got %v", t.Name(), err)
+	}
+	if err := json.Unmarshal([]byte(`{"version":1,"entries":["nope"]}`), &q); err != ErrBadEncoding {
+		t.Errorf("%s: expected ErrBadEncoding, got %v", t.Name(), err)
+	}
+}
+
+func TestProgram_Gob(t *testing.T) {
+	type envelope struct {
+		Program *Program
+		Any     interface{}
+	}
+
+	data := []*Program{sampleProgram1, sampleProgram2}
+
+	for i, p := range data {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(envelope{p, p}); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var out envelope
+		if err := gob.NewDecoder(&buf).Decode(&out); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		q, ok := out.Any.(*Program)
+		if !ok {
+			t.Errorf("%s/%03d: wrong type for interface field: %T", t.Name(), i, out.Any)
+			continue
+		}
+
+		for j, r := range []*Program{out.Program, q} {
+			if !bytes.Equal(r.Bytes, p.Bytes) || len(r.ByteSets) != len(p.ByteSets) || len(r.Labels) != len(p.Labels) {
+				t.Errorf("%s/%03d/%d: wrong program: %#v", t.Name(), i, j, r)
+				continue
+			}
+			for k := range p.ByteSets {
+				if byteSetKey(r.ByteSets[k]) != byteSetKey(p.ByteSets[k]) {
+					t.Errorf("%s/%03d/%d: wrong byte set %d: %v", t.Name(), i, j, k, r.ByteSets[k])
+				}
+			}
+			for _, input := range []string{"", "ana", "banana", "bananas"} {
+				expected := p.Match([]byte(input)).String()
+				if actual := r.Match([]byte(input)).String(); actual != expected {
+					t.Errorf("%s/%03d/%d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, j, input, expected, actual)
+				}
+			}
+		}
+	}
+
+	var p Program
+	if err := p.GobDecode([]byte{99}); err != ErrBadVersion {
+		t.Errorf("%s: expected ErrBadVersion, got %v", t.Name(), err)
+	}
+	raw, _ := sampleProgram2.GobEncode()
+	if err := p.GobDecode(raw[:len(raw)-1]); err != ErrBadEncoding {
+		t.Errorf("%s: expected ErrBadEncoding, got %v", t.Name(), err)
+	}
+}
+
+func TestCaptureKind(t *testing.T) {
+	input := "%captures 2\n%namedcapture 0 \"n\"\n%capturekind 0 int\n%capturekind 1 timestamp\n" +
+		"%entry main\nmain:\nFCAP 0, 1\nANYB\nEND"
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := "[{n false int} { false timestamp}]"
+	if actual := fmt.Sprint(p.Captures); actual != expected {
+		t.Fatalf("%s: wrong captures:\n\texpected: %s\n\tactual: %s", t.Name(), expected, actual)
+	}
+
+	var buf bytes.Buffer
+	p.Disassemble(&buf)
+	if !strings.Contains(buf.String(), "%capturekind 0 int\n%capturekind 1 timestamp\n") {
+		t.Errorf("%s: kinds missing from disassembly:\n%s", t.Name(), buf.String())
+	}
+
+	type testrow struct {
+		Name  string
+		Round func() (*Program, error)
+	}
+
+	data := []testrow{
+		testrow{"assembly", func() (*Program, error) {
+			return ParseAssembly(bytes.NewReader(buf.Bytes()))
+		}},
+		testrow{"binary", func() (*Program, error) {
+			raw, _ := p.MarshalBinary()
+			q := &Program{}
+			return q, q.UnmarshalBinary(raw)
+		}},
+		testrow{"gob", func() (*Program, error) {
+			raw, _ := p.GobEncode()
+			q := &Program{}
+			return q, q.GobDecode(raw)
+		}},
+		testrow{"json", func() (*Program, error) {
+			raw, _ := json.Marshal(p)
+			q := &Program{}
+			return q, json.Unmarshal(raw, q)
+		}},
+		testrow{"file", func() (*Program, error) {
+			var file bytes.Buffer
+			if err := WriteProgram(&file, p); err != nil {
+				return nil, err
+			}
+			return ReadProgram(&file)
+		}},
+	}
+
+	for _, row := range data {
+		q, err := row.Round()
+		if err != nil {
+			t.Errorf("%s/%s: error: %v", t.Name(), row.Name, err)
+			continue
+		}
+		if actual := fmt.Sprint(q.Captures); actual != expected {
+			t.Errorf("%s/%s: wrong captures:\n\texpected: %s\n\tactual: %s", t.Name(), row.Name, expected, actual)
+		}
+	}
+
+	// Version 1 of the binary encoding has no kinds (and no DFAs, jump
+	// tables, or rune sets).
+	raw, _ := p.MarshalBinary()
+	raw[0] = 1
+	var q Program
+	if err := q.UnmarshalBinary(raw[:len(raw)-6]); err != nil {
+		t.Errorf("%s: version 1: error: %v", t.Name(), err)
+	} else if actual := fmt.Sprint(q.Captures); actual != "[{n false none} { false none}]" {
+		t.Errorf("%s: version 1: wrong captures: %s", t.Name(), actual)
+	}
+
+	if _, err := ParseAssembly(strings.NewReader("%captures 1\n%capturekind 0 complex\nEND")); err == nil {
+		t.Errorf("%s: unknown kind: expected error", t.Name())
+	}
+}
+
+func TestLoadUntrusted(t *testing.T) {
+	assemble := func(text string) []byte {
+		p, err := ParseAssembly(strings.NewReader(text))
+		if err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+		raw, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+		return raw
+	}
+
+	raw, _ := sampleProgram1.MarshalBinary()
+	p, err := LoadUntrusted(raw, Limits{MaxSteps: 1000})
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if r := p.Match([]byte("banana")).String(); r != "{true [0:{(0,6) [(0,6)]}]}" {
+		t.Errorf("%s: wrong match: %s", t.Name(), r)
+	}
+
+	var buf bytes.Buffer
+	WriteProgram(&buf, sampleProgram1)
+	if _, err := LoadUntrusted(buf.Bytes(), Limits{}); err != nil {
+		t.Errorf("%s: program file: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Data     []byte
+		Limits   Limits
+		Input    string
+		Expected error
+	}
+
+	loop := assemble(".L0:\nJMP .L0")
+	recurse := assemble("a:\nCALL a")
+	captures := assemble("%captures 1\n.L0:\nBCAP 0\nJMP .L0")
+	backtrack := assemble(".L0:\nCHOICE .L0\nFAIL")
+	data := []testrow{
+		testrow{loop, Limits{MaxSteps: 100}, "", ErrBudgetExceeded},
+		testrow{recurse, Limits{MaxStackDepth: 10}, "", ErrStackLimit},
+		testrow{recurse, Limits{}, "", ErrStackLimit},
+		testrow{recurse, Limits{MaxStackDepth: NoLimit, MaxSteps: 1000}, "", ErrBudgetExceeded},
+		testrow{captures, Limits{MaxAssignments: NoLimit, MaxSteps: 1000}, "", ErrBudgetExceeded},
+		testrow{captures, Limits{MaxAssignments: 10}, "", ErrCaptureLimit},
+		testrow{backtrack, Limits{MaxBacktracks: 10}, "", ErrBudgetExceeded},
+		testrow{raw, Limits{MaxBacktracks: 1}, "banana", ErrBudgetExceeded},
+		testrow{raw, Limits{MaxBacktracks: 10}, "banana", nil},
+		testrow{raw, Limits{MaxSteps: 5}, "banana", ErrBudgetExceeded},
+		testrow{raw, Limits{MaxSteps: 1000}, "banana", nil},
+	}
+
+	for i, row := range data {
+		p, err := LoadUntrusted(row.Data, row.Limits)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		err = p.Exec([]byte(row.Input)).Run()
+		if row.Expected == nil {
+			if err != nil {
+				t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			}
+			continue
+		}
+		if re, ok := err.(*RuntimeError); !ok || re.Err != row.Expected {
+			t.Errorf("%s/%03d: expected %v, got %v", t.Name(), i, row.Expected, err)
+		}
+	}
+
+	bad := assemble("CHOICE .L0\nANYB\n.L0:\nEND")
+	bad[3] = 0x7f // version, code length, CHOICE, and then its code offset
+
+	type rejectrow struct {
+		Data     []byte
+		Limits   Limits
+		Expected error
+	}
+
+	rejects := []rejectrow{
+		rejectrow{nil, Limits{}, ErrBadEncoding},
+		rejectrow{[]byte("PGVM\x01\x00"), Limits{}, ErrBadMagic},
+		rejectrow{loop, Limits{MaxCodeSize: 1}, ErrCodeSizeLimit},
+	}
+
+	for i, row := range rejects {
+		if _, err := LoadUntrusted(row.Data, row.Limits); err != row.Expected {
+			t.Errorf("%s/%03d: expected %v, got %v", t.Name(), i, row.Expected, err)
+		}
+	}
+	if _, err := LoadUntrusted(bad, Limits{}); err == nil || !strings.Contains(err.Error(), "verify error") {
+		t.Errorf("%s: expected verify error for invalid code offset, got %v", t.Name(), err)
+	}
+}
+
+func TestProgramFile(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareNamedCapture(0, "all")
+	a.DeclareEntry("main")
+	a.EmitLabel("main")
+	a.SetSourcePos(SourcePos{Rule: "main"})
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitOp(OpLITB.Meta(), a.InternLiteral([]byte("ab")), nil, nil)
+	a.EmitOp(OpSPANB.Meta(), a.InternByteSet(byteset.Exactly('c')), nil, nil)
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteProgram(&buf, p); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	raw := append([]byte(nil), buf.Bytes()...)
+	if string(raw[:8]) != "PGVM\x01\x00\x06\x00" || string(raw[8:16]) != ".code\x00\x00\x00" {
+		t.Errorf("%s: wrong header: % x", t.Name(), raw[:16])
+	}
+
+	f, err := ReadProgramFile(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var names []string
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+	}
+	if fmt.Sprint(names) != "[.code .lits .sets .caps .labels .debug]" {
+		t.Errorf("%s: wrong sections: %v", t.Name(), names)
+	}
+
+	q, err := ReadProgram(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var expected, actual bytes.Buffer
+	p.Disassemble(&expected)
+	q.Disassemble(&actual)
+	if actual.String() != expected.String() {
+		t.Errorf("%s: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), expected.String(), actual.String())
+	}
+	if r := q.Match([]byte("abcc")).String(); r != "{true [0:{(0,4) [(0,4)]}]}" {
+		t.Errorf("%s: wrong match: %s", t.Name(), r)
+	}
+
+	// Unknown sections are ignored, and all but .code are optional.
+	f = &ProgramFile{Version: 1, Sections: []Section{{".code", p.Bytes}, {".x-new", []byte{1, 2, 3}}}}
+	buf.Reset()
+	f.WriteTo(&buf)
+	if q, err := ReadProgram(&buf); err != nil || !bytes.Equal(q.Bytes, p.Bytes) {
+		t.Errorf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    []byte
+		Expected error
+	}
+
+	data := []testrow{
+		testrow{[]byte("PGV"), ErrBadMagic},
+		testrow{[]byte("ELF\x7f\x01\x00\x00\x00"), ErrBadMagic},
+		testrow{[]byte("PGVM\x02\x00\x00\x00"), ErrBadVersion},
+		testrow{[]byte("PGVM\x01\x00\x00\x00"), ErrBadEncoding},
+		testrow{raw[:len(raw)-1], ErrBadEncoding},
+	}
+
+	for i, row := range data {
+		_, err := ReadProgram(bytes.NewReader(row.Input))
+		if err != row.Expected {
+			t.Errorf("%s/%03d: expected %v, got %v", t.Name(), i, row.Expected, err)
+		}
+	}
+}
+
+func TestProgramFile_compressed(t *testing.T) {
+	a := NewAssembler()
+	a.DeclareNumCaptures(1)
+	a.DeclareEntry("main")
+	a.EmitLabel("main")
+	a.SetSourcePos(SourcePos{Rule: "main"})
+	a.EmitOp(OpBCAP.Meta(), 0, nil, nil)
+	a.EmitLabel(".L0")
+	a.SetSourcePos(SourcePos{Rule: "loop"})
+	a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(".L1"), nil, nil)
+	a.EmitOp(OpLITB.Meta(), a.InternLiteral([]byte("ab")), nil, nil)
+	a.EmitOp(OpCOMMIT.Meta(), a.GrabLabel(".L0"), nil, nil)
+	a.EmitLabel(".L1")
+	a.SetSourcePos(SourcePos{Rule: "main"})
+	a.EmitOp(OpECAP.Meta(), 0, nil, nil)
+	p, err := a.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteCompressedProgram(&buf, p); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	raw := append([]byte(nil), buf.Bytes()...)
+
+	f, err := ReadProgramFile(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var names []string
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+	}
+	if fmt.Sprint(names) != "[.zcode .zlits .zsets .zcaps .zlabels .zdebug]" {
+		t.Errorf("%s: wrong sections: %v", t.Name(), names)
+	}
+
+	q, err := ReadProgram(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	var expected, actual bytes.Buffer
+	p.Disassemble(&expected)
+	q.Disassemble(&actual)
+	if actual.String() != expected.String() {
+		t.Errorf("%s: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), expected.String(), actual.String())
+	}
+	if fmt.Sprint(q.Debug) != fmt.Sprint(p.Debug) {
+		t.Errorf("%s: wrong debug info:\n\texpected: %v\n\tactual: %v", t.Name(), p.Debug, q.Debug)
+	}
+	if len(q.Entries) != 1 || q.Entries[0].Name != "main" {
+		t.Errorf("%s: wrong entries: %v", t.Name(), q.Entries)
+	}
+	if r := q.Match([]byte("ababc")).String(); r != "{true [0:{(0,4) [(0,4)]}]}" {
+		t.Errorf("%s: wrong match: %s", t.Name(), r)
+	}
+
+	// Compressed and uncompressed sections may be mixed.
+	f = &ProgramFile{Version: 1, Sections: []Section{{".zcode", deflate(p.Bytes)}, {".lits", NewProgramFile(p).Section(".lits").Data}}}
+	buf.Reset()
+	f.WriteTo(&buf)
+	if q, err := ReadProgram(&buf); err != nil || !bytes.Equal(q.Bytes, p.Bytes) || len(q.Literals) != 1 {
+		t.Errorf("%s: mixed: error: %v", t.Name(), err)
+	}
+
+	f = &ProgramFile{Version: 1, Sections: []Section{{".zcode", []byte("not deflate")}}}
+	buf.Reset()
+	f.WriteTo(&buf)
+	if _, err := ReadProgram(&buf); err != ErrBadEncoding {
+		t.Errorf("%s: corrupt: expected %v, got %v", t.Name(), ErrBadEncoding, err)
+	}
+}
+
+func TestAssembler_Parse_extras(t *testing.T) {
+	a := NewAssembler()
+	err := a.Parse(strings.NewReader(`
+		; comment
+		%literal 0x61, 0xff
+		%matcher [0-9a-f]
+		%captures 2
+		%namedcapture 1 "hex"
+
+		BCAP 0
+	top:	CHOICE .done		; trailing comment
+		BCAP 1
+		MATCHB 0, 2
+		TSAMEB .done, ';', 3
+		SAMEB $ff
+		ECAP 1
+		COMMIT top
+	.done:	ECAP 0
+		END
+	`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if a.Captures[1].Name != "hex" || a.NamedCaptures["hex"] != 1 {
+		t.Errorf("%s: named capture not recorded: %v", t.Name(), a.Captures)
+	}
+	if string(a.Literals[0]) != "a\xff" {
+		t.Errorf("%s: wrong literal: %q", t.Name(), a.Literals[0])
+	}
+	testAssemblerHelper(t, a, `
+	00000  ac 40 00 14 12 ac 40 01  75 00 02 9a 49 07 3b 03
+	00010  54 ff ae 40 01 24 ec ae  40 00 fe 00
+	0001c
+	"top" true 0x3
+	".done" false 0x17
+	`)
+
+	type testrow struct {
+		Input    string
+		Expected error
+	}
+
+	data := []testrow{
+		testrow{"FROB", ErrUnknownMnemonic},
+		testrow{"%frob 1", ErrUnknownDirective},
+		testrow{"SAMEB", ErrOperandCount},
+		testrow{"SAMEB 'a', 1, 2", ErrOperandCount},
+		testrow{"SAMEB 'ab'", ErrBadOperand},
+		testrow{"%captures -1", ErrBadOperand},
+		testrow{"%captures x", ErrUndefinedConstant},
+		testrow{"%captures 100000000000", ErrCountRange},
+		testrow{"%captures 1\n%namedcapture 100000000000 \"k\"", ErrBadOperand},
+		testrow{"%captures 1\n%repeatcapture 100000000000", ErrBadOperand},
+		testrow{"N = 1\nN = 2", ErrDuplicateConstant},
+		testrow{"ANYB 1 +", ErrBadExpression},
+		testrow{"ANYB 4/0", ErrBadExpression},
+		testrow{"N = 0x100000000 * 0x100000000", ErrExprOverflow},
+		testrow{"N = -1 * (-0x7fffffffffffffff - 1)", ErrExprOverflow},
+		testrow{"N = (-0x7fffffffffffffff - 1) / -1", ErrExprOverflow},
+		testrow{"N = 0x7fffffffffffffff + 1", ErrExprOverflow},
+		testrow{"N = -0x7fffffffffffffff - 2", ErrExprOverflow},
+		testrow{"N = 1 << 63", ErrExprOverflow},
+		testrow{"N = 1 << 64", ErrExprOverflow},
+		testrow{"N = -(-0x7fffffffffffffff - 1)", ErrExprOverflow},
+		testrow{"%if 1", ErrUnbalancedIf},
+		testrow{"%endif", ErrUnbalancedIf},
+		testrow{"%if 0\n%else\n%else\n%endif", ErrUnbalancedIf},
+		testrow{"JMP nowhere", ErrUndefinedLabel},
+		testrow{"x:\nx:", ErrDuplicateLabel},
+		testrow{"%entry a b", ErrBadOperand},
+		testrow{"%namedliteral 9x \"a\"", ErrBadOperand},
+		testrow{"%namedliteral x \"a\"\n%namedliteral x \"b\"", ErrBadOperand},
+	}
+
+	for i, row := range data {
+		err := NewAssembler().Parse(strings.NewReader(row.Input))
+		var actual error
+		if x, ok := err.(*AssemblyError); ok {
+			actual = x.Err
+		}
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %v, got %v", t.Name(), i, row.Input, row.Expected, err)
+		}
+	}
+
+	err = NewAssembler().Parse(strings.NewReader("ANYB\n%captures 100000000000\nEND"))
+	if x, ok := err.(*AssemblyError); !ok || x.Err != ErrCountRange || x.Line != 2 {
+		t.Errorf("%s: expected %v on line 2, got %v", t.Name(), ErrCountRange, err)
+	}
+}
+
+func TestProgram_String(t *testing.T) {
+	input := "%captures 2\n%namedcapture 1 \"d\"\n%capturekind 1 int\n%literal \"ab\"\n%matcher [0-9]\n%entry main\n" +
+		"main:\nBCAP 0\nLITB 0\nFCAP 1, 0\nSPANB 0\nFCAP 1, 1\nECAP 0\nEND"
+	p, err := ParseAssembly(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	expected := "Program{size=21 literals=1 byteSets=1 captures=2 labels=1 code=[BCAP 0; LITB 0; FCAP 1, 0; SPANB 0; ...]}"
+	if actual := p.String(); actual != expected {
+		t.Errorf("%s: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), expected, actual)
+	}
+
+	var buf bytes.Buffer
+	if _, err := p.DumpTo(&buf); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected = dedent.Dedent(`
+		Program: 21 bytes of code
+		literals: 1
+			0	"ab"
+		byteSets: 1
+			0	[\x30\x31\x32\x33\x34\x35\x36\x37\x38\x39]
+		captures: 2
+			0
+			1	name="d"	kind=int
+		labels: 1
+			000	main	public
+		entries: 1
+			main
+		code:
+			000	BCAP 0
+			003	LITB 0
+			005	FCAP 1, 0
+			009	SPANB 0
+			00c	FCAP 1, 1
+			010	ECAP 0
+			013	END
+	`)[1:]
+	if actual := buf.String(); actual != expected {
+		t.Errorf("%s: wrong output:\n%s", t.Name(), diff(expected, actual))
+	}
+
+	empty := &Program{}
+	if actual := empty.String(); actual != "Program{size=0 literals=0 byteSets=0 captures=0 labels=0 code=[]}" {
+		t.Errorf("%s: wrong output for empty program: %s", t.Name(), actual)
+	}
+}
+
+// sampleDFA matches 'ab' / 'a'.
+func sampleDFA() *DFA {
+	d := &DFA{NumClasses: 3, NumRegs: 1}
+	d.Classes['a'] = 1
+	d.Classes['b'] = 2
+	fail := DFAEdge{Target: DFAFail}
+	d.States = []DFAState{
+		DFAState{
+			Next: []DFAEdge{fail, DFAEdge{Target: 1, Regs: []int{DFANow}}, fail},
+			EOF:  fail,
+		},
+		DFAState{
+			Next: []DFAEdge{
+				DFAEdge{Target: DFAAccept, End: 0},
+				DFAEdge{Target: DFAAccept, End: 0},
+				DFAEdge{Target: DFAAccept, End: DFANow},
+			},
+			EOF: DFAEdge{Target: DFAAccept, End: 0},
+		},
+	}
+	return d
+}
+
+func TestDFA(t *testing.T) {
+	d := sampleDFA()
+	if err := d.Validate(); err != nil {
+		t.Fatalf("%s: Validate: error: %v", t.Name(), err)
+	}
+	if d.MayMatchEmpty() {
+		t.Errorf("%s: MayMatchEmpty: expected false", t.Name())
+	}
+
+	type testrow struct {
+		Input    string
+		DP       uint64
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"ab", 0, "2 true"},
+		testrow{"aa", 0, "1 true"},
+		testrow{"a", 0, "1 true"},
+		testrow{"b", 0, "0 false"},
+		testrow{"", 0, "0 false"},
+		testrow{"xab", 1, "3 true"},
+	}
+
+	for i, row := range data {
+		end, ok := d.Match([]byte(row.Input), row.DP)
+		if actual := fmt.Sprint(end, ok); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	raw, err := d.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%s: MarshalBinary: error: %v", t.Name(), err)
+	}
+	var q DFA
+	if err := q.UnmarshalBinary(raw); err != nil {
+		t.Fatalf("%s: UnmarshalBinary: error: %v", t.Name(), err)
+	}
+	if dfaKey(&q) != dfaKey(d) {
+		t.Errorf("%s: round trip changed the DFA", t.Name())
+	}
+	if err := q.UnmarshalBinary(raw[:len(raw)-1]); err != ErrBadEncoding {
+		t.Errorf("%s: truncated: expected ErrBadEncoding, got %v", t.Name(), err)
+	}
+
+	bad := sampleDFA()
+	bad.States[1].EOF = DFAEdge{Target: 0, Regs: []int{0}}
+	if err := bad.Validate(); err != ErrBadDFA {
+		t.Errorf("%s: EOF edge to a state: expected ErrBadDFA, got %v", t.Name(), err)
+	}
+	bad = sampleDFA()
+	bad.States[0].Next[1].Regs = []int{1}
+	if err := bad.Validate(); err != ErrBadDFA {
+		t.Errorf("%s: register out of range: expected ErrBadDFA, got %v", t.Name(), err)
+	}
+	raw, _ = bad.MarshalBinary()
+	if err := q.UnmarshalBinary(raw); err != ErrBadDFA {
+		t.Errorf("%s: UnmarshalBinary: expected ErrBadDFA, got %v", t.Name(), err)
+	}
+}
+
+func TestDFAB(t *testing.T) {
+	b := NewBuilder()
+	b.Op(OpBCAP, uint64(0), nil, nil)
+	b.DFA(sampleDFA())
+	b.Match(byteset.Exactly('c'))
+	b.Op(OpECAP, uint64(0), nil, nil)
+	b.Op(OpEND, nil, nil, nil)
+	b.DeclareNumCaptures(1)
+	p, err := b.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"abc", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"ac", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"abd", "{false}"},
+		testrow{"c", "{false}"},
+	}
+
+	check := func(name string, p *Program) {
+		for i, row := range data {
+			x := p.Exec([]byte(row.Input))
+			if err := x.Run(); err != nil {
+				t.Errorf("%s/%s/%03d: error: %v", t.Name(), name, i, err)
+				continue
+			}
+			if actual := x.Result().String(); actual != row.Expected {
+				t.Errorf("%s/%s/%03d: %q: expected %s, got %s", t.Name(), name, i, row.Input, row.Expected, actual)
+			}
+		}
+	}
+	check("built", p)
+
+	var buf bytes.Buffer
+	if _, err := p.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: Disassemble: error: %v", t.Name(), err)
+	}
+	text := buf.String()
+	if !strings.Contains(text, "%dfa 0x01, 0x03, ") || !strings.Contains(text, "DFAB 0") {
+		t.Errorf("%s: Disassemble: missing DFA:\n%s", t.Name(), text)
+	}
+	q, err := ParseAssembly(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("%s: ParseAssembly: error: %v", t.Name(), err)
+	}
+	check("assembled", q)
+
+	raw, _ := p.MarshalBinary()
+	var r Program
+	if err := r.UnmarshalBinary(raw); err != nil {
+		t.Fatalf("%s: UnmarshalBinary: error: %v", t.Name(), err)
+	}
+	check("binary", &r)
+
+	fs, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: error: %v", t.Name(), err)
+	}
+	if actual := fs.Start.Matcher().String(); actual != `[\x61]` {
+		t.Errorf("%s: FirstSets: expected [\\x61], got %s", t.Name(), actual)
+	}
+
+	p.DFAs = nil
+	if errs := p.Validate(); len(errs) == 0 {
+		t.Errorf("%s: Validate: expected error for missing DFA", t.Name())
+	}
+}
+
+func TestProgram_Search(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Search   string
+		Expected string
+	}
+
+	data := []testrow{
+		// a required prefix: Index
+		testrow{"%literal \"ab\"\n%captures 1\nBCAP 0\nLITB 0\nECAP 0\nEND", "xaxab", "{true [0:{(3,5) [(3,5)]}]} 3"},
+		// one first byte: IndexByte
+		testrow{"%captures 1\nBCAP 0\nSAMEB 'a'\nANYB\nECAP 0\nEND", "xxab", "{true [0:{(2,4) [(2,4)]}]} 2"},
+		// a few ASCII first bytes: IndexAny
+		testrow{"%matcher [0-9]\n%captures 1\nBCAP 0\nMATCHB 0\nSPANB 0\nECAP 0\nEND", "ab 42", "{true [0:{(3,5) [(3,5)]}]} 3"},
+		// many first bytes: table
+		testrow{"%matcher [a-z]\n%captures 1\nBCAP 0\nMATCHB 0\nSAMEB '!'\nECAP 0\nEND", "a b!", "{true [0:{(2,4) [(2,4)]}]} 2"},
+		// non-ASCII first bytes: table
+		testrow{"%matcher [\\x80\\xff]\n%captures 1\nBCAP 0\nMATCHB 0\nECAP 0\nEND", "ab\xff", "{true [0:{(2,3) [(2,3)]}]} 2"},
+		// may be empty: every position
+		testrow{"%captures 1\nBCAP 0\nCHOICE L\nANYB\nFAIL2X\nL:\nECAP 0\nEND", "abc", "{true [0:{(3,3) [(3,3)]}]} 3"},
+		testrow{"%literal \"ab\"\n%captures 1\nBCAP 0\nLITB 0\nECAP 0\nEND", "xaxa", "{false} 0"},
+	}
+
+	for i, row := range data {
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		for _, precompile := range []bool{false, true} {
+			if precompile {
+				if err := p.Precompile(); err != nil {
+					t.Errorf("%s/%03d: Precompile: error: %v", t.Name(), i, err)
+					continue
+				}
+			}
+			r, start := p.Search([]byte(row.Search))
+			if actual := fmt.Sprint(r, " ", start); actual != row.Expected {
+				t.Errorf("%s/%03d/%v: %q: expected %s, got %s", t.Name(), i, precompile, row.Search, row.Expected, actual)
+			}
+			if r.Success && r.End != r.Captures[0].Solo.E {
+				t.Errorf("%s/%03d/%v: %q: expected End %d, got %d", t.Name(), i, precompile, row.Search, r.Captures[0].Solo.E, r.End)
+			}
+		}
+	}
+}
+
+func TestProgram_SearchPrefix(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%literal "hello"
+%literal "help"
+CHOICE alt
+LITB 0
+COMMIT done
+alt:
+LITB 1
+done:
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	s, err := p.newSkipper()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if string(s.prefix) != "hel" {
+		t.Fatalf("%s: expected prefix %q, got %q", t.Name(), "hel", s.prefix)
+	}
+
+	// The first-byte set alone would stop at each 'h'.
+	input := []byte("h he hex help")
+	if dp, ok := s.next(input, 0); !ok || dp != 9 {
+		t.Errorf("%s: next: expected 9, got %d %v", t.Name(), dp, ok)
+	}
+	if dp, ok := s.next(input, 10); ok {
+		t.Errorf("%s: next after the prefix: expected none, got %d", t.Name(), dp)
+	}
+	if r, start := p.Search(input); !r.Success || start != 9 || r.End != 13 {
+		t.Errorf("%s: Search: expected a match at 9..13, got %v %d", t.Name(), r, start)
+	}
+}
+
+func TestDISPATCH(t *testing.T) {
+	const source = `%literal "if"
+%literal "int"
+%literal "else"
+%jumptable 0x65 e, 0x69 i
+%captures 1
+BCAP 0
+CHOICE rest
+DISPATCH 0
+i:
+CHOICE i2
+LITB 1
+COMMIT done
+i2:
+LITB 0
+JMP done
+e:
+LITB 2
+done:
+COMMIT end
+rest:
+SAMEB 'x'
+end:
+ECAP 0
+END
+`
+	p, err := ParseAssembly(strings.NewReader(source))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"if", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"int", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"else", "{true [0:{(0,4) [(0,4)]}]}"},
+		testrow{"x", "{true [0:{(0,1) [(0,1)]}]}"},
+		testrow{"in", "{false}"},
+		testrow{"a", "{false}"},
+		testrow{"", "{false}"},
+	}
+
+	check := func(name string, p *Program) {
+		for i, row := range data {
+			x := p.Exec([]byte(row.Input))
+			if err := x.Run(); err != nil {
+				t.Errorf("%s/%s/%03d: error: %v", t.Name(), name, i, err)
+				continue
+			}
+			if actual := x.Result().String(); actual != row.Expected {
+				t.Errorf("%s/%s/%03d: %q: expected %s, got %s", t.Name(), name, i, row.Input, row.Expected, actual)
+			}
+		}
+	}
+	check("assembled", p)
+
+	var buf bytes.Buffer
+	if _, err := p.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: Disassemble: error: %v", t.Name(), err)
+	}
+	text := buf.String()
+	if !strings.Contains(text, "%jumptable 0x65 ") || !strings.Contains(text, "DISPATCH 0") {
+		t.Errorf("%s: Disassemble: missing jump table:\n%s", t.Name(), text)
+	}
+	q, err := ParseAssembly(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("%s: ParseAssembly: error: %v\n%s", t.Name(), err, text)
+	}
+	check("reassembled", q)
+
+	raw, _ := p.MarshalBinary()
+	var r Program
+	if err := r.UnmarshalBinary(raw); err != nil {
+		t.Fatalf("%s: UnmarshalBinary: error: %v", t.Name(), err)
+	}
+	check("binary", &r)
+
+	js, _ := p.MarshalJSON()
+	var s Program
+	if err := s.UnmarshalJSON(js); err != nil {
+		t.Fatalf("%s: UnmarshalJSON: error: %v", t.Name(), err)
+	}
+	check("json", &s)
+
+	buf.Reset()
+	if _, err := NewCompressedProgramFile(p).WriteTo(&buf); err != nil {
+		t.Fatalf("%s: WriteTo: error: %v", t.Name(), err)
+	}
+	f, err := ReadProgramFile(&buf)
+	if err != nil {
+		t.Fatalf("%s: ReadProgramFile: error: %v", t.Name(), err)
+	}
+	u, err := f.Program()
+	if err != nil {
+		t.Fatalf("%s: ProgramFile.Program: error: %v", t.Name(), err)
+	}
+	check("file", u)
+
+	fs, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: error: %v", t.Name(), err)
+	}
+	if actual := fs.Start.Matcher().String(); actual != `[\x65\x69\x78]` {
+		t.Errorf("%s: FirstSets: expected [\\x65\\x69\\x78], got %s", t.Name(), actual)
+	}
+
+	if errs := p.Validate(); len(errs) != 0 {
+		t.Errorf("%s: Validate: unexpected errors: %v", t.Name(), errs)
+	}
+	p.JumpTables[0].Keys = []byte{0x69, 0x65}
+	if errs := p.Validate(); len(errs) == 0 {
+		t.Errorf("%s: Validate: expected error for unsorted keys", t.Name())
+	}
+	p.JumpTables = nil
+	if errs := p.Validate(); len(errs) == 0 {
+		t.Errorf("%s: Validate: expected error for missing jump table", t.Name())
+	}
+}
+
+func TestGenProgram(t *testing.T) {
+	var _ quick.Generator = (*Program)(nil)
+
+	r := rand.New(rand.NewSource(1))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 200; i++ {
+		p := GenProgram(r, 1+i/4)
+		if errs := p.Validate(); len(errs) != 0 {
+			t.Errorf("%s/%03d: Validate: unexpected errors: %v\n%v", t.Name(), i, errs, p)
+			continue
+		}
+		for _, input := range inputs {
+			x := p.Exec([]byte(input))
+			x.Limits.MaxSteps = 1 << 20
+			if err := x.Run(); err != nil {
+				t.Errorf("%s/%03d: %q: error: %v\n%v", t.Name(), i, input, err, p)
+			}
+		}
+	}
+}
+
+func TestGenProgram_Quick(t *testing.T) {
+	// Disassembling and reassembling a program yields the same code.
+	roundTrip := func(p *Program) bool {
+		var buf bytes.Buffer
+		if _, err := p.Disassemble(&buf); err != nil {
+			t.Logf("Disassemble: error: %v", err)
+			return false
+		}
+		q, err := ParseAssembly(&buf)
+		if err != nil {
+			t.Logf("ParseAssembly: error: %v", err)
+			return false
+		}
+		return bytes.Equal(p.Bytes, q.Bytes) && reflect.DeepEqual(p.JumpTables, q.JumpTables)
+	}
+	config := &quick.Config{Rand: rand.New(rand.NewSource(1))}
+	if err := quick.Check(roundTrip, config); err != nil {
+		t.Errorf("%s: %v", t.Name(), err)
+	}
+
+	// The binary encoding round-trips too.
+	marshal := func(p *Program) bool {
+		raw, _ := p.MarshalBinary()
+		var q Program
+		if err := q.UnmarshalBinary(raw); err != nil {
+			return false
+		}
+		raw2, _ := q.MarshalBinary()
+		return bytes.Equal(raw, raw2)
+	}
+	if err := quick.Check(marshal, config); err != nil {
+		t.Errorf("%s: %v", t.Name(), err)
+	}
+}
+
+func TestExecution_RunContext(t *testing.T) {
+	loop, err := ParseAssembly(strings.NewReader("L:\nJMP L\n"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	x := loop.Exec(nil)
+	err = x.RunContext(ctx)
+	if rterr, ok := err.(*RuntimeError); !ok || rterr.Err != ErrCanceled {
+		t.Errorf("%s: canceled: expected ErrCanceled, got %v", t.Name(), err)
+	}
+	if x.R != ErrorState || x.Steps != 0 {
+		t.Errorf("%s: canceled: expected ErrorState after 0 steps, got %v after %d", t.Name(), x.R, x.Steps)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := loop.MatchContext(ctx, nil); err == nil || err.(*RuntimeError).Err != ErrCanceled {
+		t.Errorf("%s: timeout: expected ErrCanceled, got %v", t.Name(), err)
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("%s: timeout: expected DeadlineExceeded, got %v", t.Name(), ctx.Err())
+	}
+
+	r, err := sampleProgram1.MatchContext(context.Background(), []byte("banana"))
+	if err != nil {
+		t.Errorf("%s: background: error: %v", t.Name(), err)
+	} else if expected := sampleProgram1.Match([]byte("banana")).String(); r.String() != expected {
+		t.Errorf("%s: background: expected %s, got %s", t.Name(), expected, r)
+	}
+}
+
+func TestProgram_MatchTimeout(t *testing.T) {
+	loop, err := ParseAssembly(strings.NewReader("L:\nJMP L\n"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	x := loop.Exec(nil)
+	err = x.RunTimeout(0)
+	if rterr, ok := err.(*RuntimeError); !ok || rterr.Err != ErrTimeout {
+		t.Errorf("%s: zero: expected ErrTimeout, got %v", t.Name(), err)
+	}
+	if x.R != ErrorState || x.Steps != 0 {
+		t.Errorf("%s: zero: expected ErrorState after 0 steps, got %v after %d", t.Name(), x.R, x.Steps)
+	}
+
+	start := time.Now()
+	if _, err := loop.MatchTimeout(nil, 10*time.Millisecond); err == nil || err.(*RuntimeError).Err != ErrTimeout {
+		t.Errorf("%s: loop: expected ErrTimeout, got %v", t.Name(), err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("%s: loop: expected to stop soon after 10ms, took %v", t.Name(), elapsed)
+	}
+
+	r, err := sampleProgram1.MatchTimeout([]byte("banana"), time.Minute)
+	if err != nil {
+		t.Errorf("%s: minute: error: %v", t.Name(), err)
+	} else if expected := sampleProgram1.Match([]byte("banana")).String(); r.String() != expected {
+		t.Errorf("%s: minute: expected %s, got %s", t.Name(), expected, r)
+	}
+}
+
+type recordingObserver struct {
+	NopObserver
+	Events []string
+	Steps  uint64
+}
+
+func (o *recordingObserver) OnStep(x *Execution, op *Op) {
+	if x.XP != op.XP {
+		panic("OnStep called after XP was advanced")
+	}
+	o.Steps++
+}
+
+func (o *recordingObserver) OnChoicePush(x *Execution, op *Op) {
+	o.Events = append(o.Events, fmt.Sprintf("choice@%d dp=%d depth=%d", op.XP, x.DP, len(x.CS)))
+}
+
+func (o *recordingObserver) OnFail(x *Execution, op *Op) {
+	o.Events = append(o.Events, fmt.Sprintf("fail@%d %s dp=%d", op.XP, op.Code, x.DP))
+}
+
+func (o *recordingObserver) OnCaptureCommit(x *Execution, op *Op, a Assignment) {
+	o.Events = append(o.Events, fmt.Sprintf("capture@%d %d=%d", op.XP, a.Index, a.DP))
+}
+
+func (o *recordingObserver) OnCall(x *Execution, op *Op) {
+	o.Events = append(o.Events, fmt.Sprintf("call@%d xp=%d", op.XP, x.XP))
+}
+
+func TestObserver(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 2
+BCAP 0
+CALL r
+ECAP 0
+END
+r:
+CHOICE alt
+SAMEB 'x'
+COMMIT done
+alt:
+ANYB 2
+FCAP 1, 1
+done:
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	o := &recordingObserver{}
+	x := p.Exec([]byte("ab"))
+	x.Observer = o
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	expected := []string{
+		"call@3 xp=11",
+		"choice@11 dp=0 depth=2",
+		"fail@13 SAMEB dp=0",
+		"capture@19 1=2",
+		"capture@6 0=2",
+	}
+	if actual := strings.Join(o.Events, "\n"); actual != strings.Join(expected, "\n") {
+		t.Errorf("%s: wrong events:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), strings.Join(expected, "\n"), actual)
+	}
+	if o.Steps != x.Steps {
+		t.Errorf("%s: OnStep called %d times for %d steps", t.Name(), o.Steps, x.Steps)
+	}
+}
+
+func TestExecution_Trace(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+BCAP 0
+CALL r
+ECAP 0
+END
+r:
+CHOICE alt
+SAMEB 'x'
+COMMIT done
+alt:
+ANYB
+done:
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	var buf bytes.Buffer
+	o := &recordingObserver{}
+	x := p.Exec([]byte("a"))
+	x.Observer = o
+	x.Trace(&buf)
+	for i := 0; i < 4; i++ {
+		if err := x.Step(); err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+	}
+	x.Trace(nil)
+	if x.Observer != o {
+		t.Errorf("%s: Trace(nil) did not restore the Observer", t.Name())
+	}
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	expected := dedent.Dedent(`
+		0x0	DP 0	CS 0	KS 0	BCAP 0
+		0x3	DP 0	CS 0	KS 1	CALL r <.+5>
+		r	DP 0	CS 1	KS 1	CHOICE alt <.+4>
+		r+0x2	DP 0	CS 2	KS 1	SAMEB 'x'
+	`)[1:]
+	if actual := buf.String(); actual != expected {
+		t.Errorf("%s: wrong trace:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), expected, actual)
+	}
+	if o.Steps != x.Steps {
+		t.Errorf("%s: Observer saw %d steps, expected %d", t.Name(), o.Steps, x.Steps)
+	}
+}
+
+func TestExecution_RunUntilBreak(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+BCAP 0
+loop:
+CHOICE done
+CALL r
+COMMIT loop
+done:
+ECAP 0
+END
+r:
+ANYB
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	x := p.Exec([]byte("ab"))
+	if err := x.SetLabelBreakpoint("nosuch"); err != ErrUndefinedLabel {
+		t.Errorf("%s: expected ErrUndefinedLabel, got %v", t.Name(), err)
+	}
+	if err := x.SetLabelBreakpoint("r"); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	x.SetBreakpoint(0)
+
+	var stops []string
+	for {
+		hit, err := x.RunUntilBreak()
+		if err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+		if !hit {
+			break
+		}
+		stops = append(stops, fmt.Sprintf("%s@%d", x.P.Symbolize(x.XP), x.DP))
+		if len(stops) == 2 {
+			x.ClearBreakpoint(0)
+		}
+	}
+	if actual, expected := strings.Join(stops, " "), "0x0@0 r@0 r@1 r@2"; actual != expected {
+		t.Errorf("%s: wrong stops: expected %s, got %s", t.Name(), expected, actual)
+	}
+	if actual := fmt.Sprint(x.Breakpoints()); actual != fmt.Sprint([]uint64{p.LabelsByName["r"].Offset}) {
+		t.Errorf("%s: wrong breakpoints: %s", t.Name(), actual)
+	}
+	if actual := x.Result().String(); actual != "{true [0:{(0,2) [(0,2)]}]}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+	if hit, err := x.RunUntilBreak(); hit || err != nil {
+		t.Errorf("%s: after halting: expected (false, nil), got (%v, %v)", t.Name(), hit, err)
+	}
+}
+
+func TestExecution_History(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`loop:
+ANYB
+JMP loop
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	x := p.Exec([]byte("abc"))
+	if actual := x.History(); actual != nil {
+		t.Errorf("%s: expected no history by default, got %v", t.Name(), actual)
+	}
+
+	p.HistorySize = 3
+	x = p.Exec([]byte("abc"))
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	r := x.Result()
+	if r.Success {
+		t.Fatalf("%s: expected failure", t.Name())
+	}
+	expected := "[XP 0 DP 2 ANYB XP 1 DP 3 JMP XP 0 DP 3 ANYB]"
+	if actual := fmt.Sprint(r.History); actual != expected {
+		t.Errorf("%s: wrong Result.History: expected %s, got %s", t.Name(), expected, actual)
+	}
+	if actual := r.String(); actual != "{false}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+
+	x = p.Exec([]byte("abc"))
+	x.Limits.MaxSteps = 4
+	err = x.Run()
+	rterr, ok := err.(*RuntimeError)
+	if !ok || rterr.Err != ErrBudgetExceeded {
+		t.Fatalf("%s: expected ErrBudgetExceeded, got %v", t.Name(), err)
+	}
+	expected = "[XP 1 DP 1 JMP XP 0 DP 1 ANYB XP 1 DP 2 JMP]"
+	if actual := fmt.Sprint(rterr.History); actual != expected {
+		t.Errorf("%s: wrong RuntimeError.History: expected %s, got %s", t.Name(), expected, actual)
+	}
+
+	x.KeepHistory(0)
+	if actual := x.History(); actual != nil {
+		t.Errorf("%s: expected KeepHistory(0) to discard history, got %v", t.Name(), actual)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+BCAP 0
+loop:
+CHOICE done
+SAMEB 'a'
+COMMIT loop
+done:
+SAMEB 'b'
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q, err := ParseAssembly(strings.NewReader(`%captures 1
+BCAP 0
+loop:
+CHOICE done
+SAMEB 'a'
+COMMIT loop
+done:
+ANYB
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	x := p.Exec([]byte("aab"))
+	rec := x.Record()
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if len(rec.Steps) != int(x.Steps) {
+		t.Errorf("%s: expected %d steps, got %d", t.Name(), x.Steps, len(rec.Steps))
+	}
+
+	raw, err := rec.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%s: MarshalBinary: error: %v", t.Name(), err)
+	}
+	var rec2 Recording
+	if err := rec2.UnmarshalBinary(raw); err != nil {
+		t.Fatalf("%s: UnmarshalBinary: error: %v", t.Name(), err)
+	}
+	if !reflect.DeepEqual(*rec, rec2) {
+		t.Errorf("%s: round trip: expected %v, got %v", t.Name(), *rec, rec2)
+	}
+	if err := rec2.UnmarshalBinary(raw[:len(raw)-1]); err != ErrBadEncoding {
+		t.Errorf("%s: truncated: expected ErrBadEncoding, got %v", t.Name(), err)
+	}
+
+	r := p.Replay(&rec2)
+	if err := r.Run(); err != nil {
+		t.Errorf("%s: replay: error: %v", t.Name(), err)
+	}
+	if actual := r.X.Result().String(); actual != x.Result().String() {
+		t.Errorf("%s: replay: wrong result: %s", t.Name(), actual)
+	}
+
+	r = q.Replay(&rec2)
+	err = r.Run()
+	derr, ok := err.(*DivergenceError)
+	if !ok {
+		t.Fatalf("%s: modified: expected *DivergenceError, got %v", t.Name(), err)
+	}
+	if actual, expected := derr.Error(), "github.com/chronos-tachyon/peggy/peggyvm: replay diverged at step 9: expected XP 9 DP 2 SAMEB, got XP 9 DP 2 ANYB"; actual != expected {
+		t.Errorf("%s: modified: wrong error:\n\texpected %s\n\t     got %s", t.Name(), expected, actual)
+	}
+	if r.N != derr.Step || r.X.XP != derr.Actual.XP {
+		t.Errorf("%s: modified: Execution moved past the divergence", t.Name())
+	}
+
+	short := Recording{Input: rec.Input, Steps: rec.Steps[:3]}
+	r = p.Replay(&short)
+	err = r.Run()
+	if derr, ok := err.(*DivergenceError); !ok || derr.Step != 3 || derr.Expected != nil || derr.Actual == nil {
+		t.Errorf("%s: short: expected divergence at step 3 with nothing expected, got %v", t.Name(), err)
+	}
+}
+
+func TestExecution_Clone(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 2
+BCAP 0
+SAMEB 'a'
+CHOICE alt
+BCAP 1
+SAMEB 'b'
+ECAP 1
+COMMIT done
+alt:
+SAMEB 'c'
+done:
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	x := p.Exec([]byte("ab"))
+	x.KeepHistory(4)
+	x.SetBreakpoint(p.LabelsByName["alt"].Offset)
+	for i := 0; i < 4; i++ {
+		if err := x.Step(); err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+	}
+
+	y := x.Clone()
+	y.I = []byte("ac")
+	y.ClearBreakpoints()
+	if err := y.Run(); err != nil {
+		t.Fatalf("%s: clone: error: %v", t.Name(), err)
+	}
+	if actual := y.Result().String(); actual != "{true [0:{(0,2) [(0,2)]} 1:-]}" {
+		t.Errorf("%s: clone: wrong result: %s", t.Name(), actual)
+	}
+
+	if len(x.CS) != 1 || len(x.KS) != 2 || x.DP != 1 || x.R != RunningState {
+		t.Errorf("%s: original was disturbed: DP %d CS %v KS %v", t.Name(), x.DP, x.CS, x.KS)
+	}
+	if len(x.Breakpoints()) != 1 || len(x.History()) != 4 {
+		t.Errorf("%s: original lost its breakpoints or history", t.Name())
+	}
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := x.Result().String(); actual != "{true [0:{(0,2) [(0,2)]} 1:{(1,2) [(1,2)]}]}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+
+	// The memo table is copied too: a result that the clone stores must
+	// not show up in the original.
+	p, err = ParseAssembly(strings.NewReader(`%captures 0
+MEMOGET .L0, 0
+CALL r
+MEMOSET 0
+.L0:
+MEMOGET .L1, 1
+CALL r
+MEMOSET 1
+.L1:
+END
+r:
+ANYB
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	x = p.Exec([]byte("ab"))
+	for i := 0; i < 6; i++ {
+		if err := x.Step(); err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+	}
+	y = x.Clone()
+	if err := y.Run(); err != nil {
+		t.Fatalf("%s: clone: error: %v", t.Name(), err)
+	}
+	if y.memo.get(memoKey{1, 1}) == nil {
+		t.Errorf("%s: clone did not memoize rule 1", t.Name())
+	}
+	if entry := x.memo.get(memoKey{1, 1}); entry != nil {
+		t.Errorf("%s: original sees the clone's memo entry: %+v", t.Name(), entry)
+	}
+	if x.memo.get(memoKey{0, 0}) == nil {
+		t.Errorf("%s: original lost its own memo entry", t.Name())
+	}
+}
+
+func TestResult_Expected(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%namedliteral end "end"
+%namedmatcher digit [0-9]
+SAMEB '('
+CHOICE alt1
+SAMEB ')'
+COMMIT done
+alt1:
+CHOICE alt2
+SAMEB ','
+COMMIT done
+alt2:
+CHOICE alt3
+LITB end
+COMMIT done
+alt3:
+TSAMEB alt4, 'x', 2
+JMP done
+alt4:
+MATCHB digit
+done:
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		DP       uint64
+		Expected string
+	}
+	for _, row := range []testrow{
+		testrow{"", 0, "'('"},
+		testrow{"(;", 1, `')' or ',' or '0'-'9' or "end" or "xx"`},
+		testrow{"[", 0, "'('"},
+	} {
+		r := p.Match([]byte(row.Input))
+		if r.Success {
+			t.Errorf("%s: %q: expected failure", t.Name(), row.Input)
+			continue
+		}
+		if r.Expected == nil {
+			t.Errorf("%s: %q: expected Expected, got nil", t.Name(), row.Input)
+			continue
+		}
+		if r.Expected.DP != row.DP {
+			t.Errorf("%s: %q: wrong DP: expected %d, got %d", t.Name(), row.Input, row.DP, r.Expected.DP)
+		}
+		if actual := r.Expected.String(); actual != row.Expected {
+			t.Errorf("%s: %q: wrong Expected: expected %s, got %s", t.Name(), row.Input, row.Expected, actual)
+		}
+	}
+
+	if r := p.Match([]byte("(xx")); !r.Success || r.Expected != nil {
+		t.Errorf("%s: expected success with no Expected, got %v %v", t.Name(), r, r.Expected)
+	}
+}
+
+func TestResult_End(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+%entry word
+BCAP 0
+CALL word
+ECAP 0
+END
+word:
+%matcher [a-z]
+SPANB 0
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	if r := p.Match([]byte("abc def")); !r.Success || r.End != 3 {
+		t.Errorf("%s: Match: expected End 3, got %v End %d", t.Name(), r, r.End)
+	}
+	if r, err := p.MatchEntry("word", []byte("ab1")); err != nil || !r.Success || r.End != 2 {
+		t.Errorf("%s: MatchEntry: expected End 2, got %v End %d (%v)", t.Name(), r, r.End, err)
+	}
+	if r, start := p.Search([]byte("12 xy!")); !r.Success || start != 0 || r.End != 0 {
+		t.Errorf("%s: Search: expected empty match at 0, got %v at %d End %d", t.Name(), r, start, r.End)
+	}
+}
+
+func TestStep_HostileNoPanic(t *testing.T) {
+	jmp, err := (&Op{Code: OpJMP, Imm0: s2u(-100)}).Encode()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	p := newEmptyProgram()
+	p.Bytes = append([]byte{0x00}, jmp...)
+	if err := p.Validate(); err == nil {
+		t.Errorf("%s: Validate: expected an error", t.Name())
+	}
+	x := p.Exec(nil)
+	err = x.Run()
+	if rterr, ok := err.(*RuntimeError); !ok || rterr.Err != ErrCodeOffsetRange || rterr.XP != 1 {
+		t.Errorf("%s: JMP: expected ErrCodeOffsetRange @ XP 1, got %v", t.Name(), err)
+	}
+	if _, err := p.Optimize(); err == nil || !strings.Contains(err.Error(), ErrCodeOffsetRange.Error()) {
+		t.Errorf("%s: Optimize: expected ErrCodeOffsetRange, got %v", t.Name(), err)
+	}
+	set := NewProgramSet()
+	set.Add("jmp", p)
+	if err := set.Compile(); err == nil || !strings.Contains(err.Error(), ErrCodeOffsetRange.Error()) {
+		t.Errorf("%s: ProgramSet: expected ErrCodeOffsetRange, got %v", t.Name(), err)
+	}
+	x.KS = append(x.KS, Assignment{Index: 5, IsEnd: true})
+	if r := x.Result(); r.Success || r.Captures != nil {
+		t.Errorf("%s: Result: expected failure for a bad capture index, got %v", t.Name(), r)
+	}
+
+	meta := OpMeta{
+		Code: 0x3b,
+		Imm0: required(ImmUint),
+		Imm1: none(),
+		Imm2: none(),
+		Name: "BADB",
+	}
+	handler := func(x *Execution, op *Op) error {
+		switch op.Imm0 {
+		case 0:
+			x.DP += 2
+		case 2:
+			x.KS = x.KS[:len(x.KS)-1]
+		default:
+			x.KS = append(x.KS, Assignment{Index: op.Imm0})
+		}
+		return nil
+	}
+	if err := RegisterOpCode(meta, handler); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	defer UnregisterOpCode(meta.Code)
+
+	type testrow struct {
+		Input    string
+		Expected error
+	}
+	for i, row := range []testrow{
+		testrow{"%captures 1\nBADB 0\nEND", ErrCountRange},
+		testrow{"%captures 1\nBADB 1\nEND", ErrIndexRange},
+		testrow{"%captures 1\nBCAP 0\nCHOICE .L0\nBADB 2\n.L0:\nEND", ErrCountRange},
+	} {
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		err = p.Exec([]byte("a")).Run()
+		if rterr, ok := err.(*RuntimeError); !ok || rterr.Err != row.Expected {
+			t.Errorf("%s/%03d: expected %v, got %v", t.Name(), i, row.Expected, err)
+		}
+	}
+}
+
+func TestProgram_Matches(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Search   string
+		Expected string
+	}
+
+	data := []testrow{
+		// words
+		testrow{"%matcher [a-z]\n%captures 1\nBCAP 0\nMATCHB 0\nSPANB 0\nECAP 0\nEND", "ab 1 cd e", "0-2 5-7 8-9"},
+		// possibly empty: empty matches abutting a match are skipped
+		testrow{"%matcher [a-z]\n%captures 1\nBCAP 0\nSPANB 0\nECAP 0\nEND", "ab 1 cd", "0-2 3-3 4-4 5-7"},
+		testrow{"%matcher [a-z]\n%captures 1\nBCAP 0\nSPANB 0\nECAP 0\nEND", "", "0-0"},
+		testrow{"%literal \"ab\"\n%captures 1\nBCAP 0\nLITB 0\nECAP 0\nEND", "xaxa", ""},
+	}
+
+	for i, row := range data {
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var found []string
+		for start, r := range p.Matches([]byte(row.Search)) {
+			found = append(found, fmt.Sprintf("%d-%d", start, r.End))
+		}
+		if actual := strings.Join(found, " "); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Search, row.Expected, actual)
+		}
+	}
+
+	p, err := ParseAssembly(strings.NewReader("ANYB\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	n := 0
+	for start := range p.Matches([]byte("abcdef")) {
+		if start != n {
+			t.Errorf("%s: early stop: expected start %d, got %d", t.Name(), n, start)
+		}
+		n++
+		if n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("%s: early stop: expected 2 matches, got %d", t.Name(), n)
+	}
+}
+
+func TestResult_Expand(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+%captures 3
+%namedcapture 1 "key"
+%namedcapture 2 "value"
+BCAP 0
+BCAP 1
+SPANB 0
+ECAP 1
+SAMEB '='
+BCAP 2
+SPANB 0
+ECAP 2
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	input := []byte("ab=cd")
+	r := p.Match(input)
+	if !r.Success {
+		t.Fatalf("%s: expected success", t.Name())
+	}
+
+	type testrow struct {
+		Template string
+		Expected string
+	}
+	for i, row := range []testrow{
+		testrow{"$value:$key", "cd:ab"},
+		testrow{"${value}x ${2}y", "cdx cdy"},
+		testrow{"$valuex|$1x|$9|$nosuch", "|||"},
+		testrow{"$0 costs $$5", "ab=cd costs $5"},
+		testrow{"$ ${ ${key $", "$ ${ ${key $"},
+	} {
+		actual := string(r.Expand([]byte(">"), []byte(row.Template), input))
+		if expected := ">" + row.Expected; actual != expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Template, expected, actual)
+		}
+	}
+}
+
+func TestProgram_MatchReader(t *testing.T) {
+	check := func(name string, p *Program, input string) {
+		expected := p.Match([]byte(input))
+		actual, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(input)))
+		if err != nil {
+			t.Errorf("%s/%s: %q: error: %v", t.Name(), name, input, err)
+			return
+		}
+		if actual.String() != expected.String() || actual.End != expected.End {
+			t.Errorf("%s/%s: %q: expected %v End %d, got %v End %d\n%v", t.Name(), name, input, expected, expected.End, actual, actual.End, p)
+		}
+	}
+
+	r := rand.New(rand.NewSource(2))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 100; i++ {
+		p := GenProgram(r, 1+i/4)
+		for _, input := range inputs {
+			check(fmt.Sprintf("%03d", i), p, input)
+		}
+	}
+
+	b := NewBuilder()
+	b.Op(OpBCAP, uint64(0), nil, nil)
+	b.DFA(sampleDFA())
+	b.Match(byteset.Exactly('c'))
+	b.Op(OpECAP, uint64(0), nil, nil)
+	b.Op(OpEND, nil, nil, nil)
+	b.DeclareNumCaptures(1)
+	dfa, err := b.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	for _, input := range []string{"abc", "ac", "abd", "c"} {
+		check("dfa", dfa, input)
+	}
+
+	// A long stream is matched in bounded memory.
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+%matcher [a]
+BCAP 0
+loop:
+CHOICE done
+SAMEB 'a'
+SPANB 0
+SAMEB 'b'
+COMMIT loop
+done:
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	const n = 1 << 20
+	x := p.Exec(nil)
+	input := strings.Repeat("aaab", n/4) + "aa"
+	if err := p.matchReader(x, strings.NewReader(input)); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := x.Result().String(); actual != fmt.Sprintf("{true [0:{(0,%d) [(0,%d)]}]}", n, n) {
+		t.Errorf("%s: stream: wrong result: %s", t.Name(), actual)
+	}
+	if cap(x.I) > 4*readChunkSize {
+		t.Errorf("%s: stream: expected a small window, got cap %d", t.Name(), cap(x.I))
+	}
+
+	// So is one for S <- ('a' {[0-9]} / 'b' {[a-z]})* !., as compiled by
+	// CompileProgram, where HeadFail has left a RWNDB behind.
+	p, err = ParseAssembly(strings.NewReader(`%matcher [0-9]
+%matcher [a-z]
+%captures 3
+%repeatcapture 1
+%repeatcapture 2
+%entry S
+	BCAP 0
+	CALL S
+	ECAP 0
+	END
+S:
+	CHOICE .L1
+	TSAMEB .L3, 'a'
+	CHOICE .HF1
+	BCAP 1
+	MATCHB 0
+	ECAP 1
+	COMMIT .L2
+.L3:
+	SAMEB 'b'
+	BCAP 2
+	MATCHB 1
+	ECAP 2
+.L2:
+	COMMIT S
+.L1:
+	EOI
+	RET
+.HF1:
+	RWNDB 1
+	JMP .L3
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if slack, ok := p.trimSlack(); !ok || slack != 1 {
+		t.Errorf("%s: HeadFail: expected slack 1, got %d %v", t.Name(), slack, ok)
+	}
+	x = p.Exec(nil)
+	input = strings.Repeat("a1bz", n/4)
+	if err := p.matchReader(x, strings.NewReader(input)); err != nil {
+		t.Fatalf("%s: HeadFail: error: %v", t.Name(), err)
+	}
+	if r := x.Result(); !r.Success || r.End != uint64(len(input)) {
+		t.Errorf("%s: HeadFail: wrong result: %v End %d", t.Name(), r, r.End)
+	}
+	if len(x.I) > 4*readChunkSize {
+		t.Errorf("%s: HeadFail: expected a small window, got len %d", t.Name(), len(x.I))
+	}
+}
+
+// ropeInput is an Input made of pieces, for TestProgram_MatchInput.
+type ropeInput [][]byte
+
+func (r ropeInput) Len() uint64 {
+	var n uint64
+	for _, piece := range r {
+		n += uint64(len(piece))
+	}
+	return n
+}
+
+func (r ropeInput) ByteAt(i uint64) byte {
+	for _, piece := range r {
+		if i < uint64(len(piece)) {
+			return piece[i]
+		}
+		i -= uint64(len(piece))
+	}
+	panic("index out of range")
+}
+
+func (r ropeInput) Slice(i, j uint64) []byte {
+	out := make([]byte, 0, j-i)
+	for k := i; k < j; k++ {
+		out = append(out, r.ByteAt(k))
+	}
+	return out
+}
+
+type failingReaderAt struct{}
+
+func (failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func TestProgram_MatchInput(t *testing.T) {
+	check := func(name string, p *Program, input string) {
+		expected := p.Match([]byte(input))
+		rope := ropeInput{}
+		for i := 0; i < len(input); i += 2 {
+			j := i + 2
+			if j > len(input) {
+				j = len(input)
+			}
+			rope = append(rope, []byte(input[i:j]))
+		}
+		for _, in := range []Input{
+			Bytes(input),
+			NewReaderAtInput(strings.NewReader(input), int64(len(input))),
+			rope,
+		} {
+			actual, err := p.MatchInput(in)
+			if err != nil {
+				t.Errorf("%s/%s/%T: %q: error: %v", t.Name(), name, in, input, err)
+				continue
+			}
+			if actual.String() != expected.String() || actual.End != expected.End {
+				t.Errorf("%s/%s/%T: %q: expected %v, got %v\n%v", t.Name(), name, in, input, expected, actual, p)
+			}
+		}
+	}
+
+	r := rand.New(rand.NewSource(3))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 100; i++ {
+		p := GenProgram(r, 1+i/4)
+		for _, input := range inputs {
+			check(fmt.Sprintf("%03d", i), p, input)
+		}
+	}
+
+	b := NewBuilder()
+	b.Op(OpBCAP, uint64(0), nil, nil)
+	b.DFA(sampleDFA())
+	b.Match(byteset.Exactly('c'))
+	b.Op(OpECAP, uint64(0), nil, nil)
+	b.Op(OpEND, nil, nil, nil)
+	b.DeclareNumCaptures(1)
+	dfa, err := b.Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	for _, input := range []string{"abc", "ac", "abd", "c"} {
+		check("dfa", dfa, input)
+	}
+
+	// Literals that straddle the blocks of a ReaderAtInput.
+	p, err := ParseAssembly(strings.NewReader(`%literal "abcab"
+%captures 1
+BCAP 0
+loop:
+CHOICE done
+LITB 0
+COMMIT loop
+done:
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	check("blocks", p, strings.Repeat("abcab", 2000)+"x")
+
+	_, err = p.MatchInput(NewReaderAtInput(failingReaderAt{}, 10))
+	if err == nil || err.Error() != "disk on fire" {
+		t.Errorf("%s: expected the read error, got %v", t.Name(), err)
+	}
+}
+
+func TestProgram_MatchSegments(t *testing.T) {
+	split := func(r *rand.Rand, input string) net.Buffers {
+		var bufs net.Buffers
+		for len(input) > 0 {
+			n := r.Intn(len(input) + 1)
+			bufs = append(bufs, []byte(input[:n]))
+			input = input[n:]
+		}
+		return bufs
+	}
+
+	r := rand.New(rand.NewSource(4))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 100; i++ {
+		p := GenProgram(r, 1+i/4)
+		for _, input := range inputs {
+			bufs := split(r, input)
+			expected := p.Match([]byte(input))
+			actual := p.MatchSegments(bufs)
+			if actual.String() != expected.String() || actual.End != expected.End {
+				t.Errorf("%s/%03d: %q: expected %v, got %v\n%v", t.Name(), i, bufs, expected, actual, p)
+			}
+		}
+	}
+
+	s := NewSegments([][]byte{[]byte("ab"), nil, []byte("c"), []byte("def")})
+	if actual := s.Len(); actual != 6 {
+		t.Errorf("%s: Len: expected 6, got %d", t.Name(), actual)
+	}
+	for _, row := range []struct {
+		I, J     uint64
+		Expected string
+	}{
+		{0, 6, "abcdef"},
+		{1, 2, "b"},
+		{1, 4, "bcd"},
+		{3, 6, "def"},
+		{6, 6, ""},
+	} {
+		if actual := string(s.Slice(row.I, row.J)); actual != row.Expected {
+			t.Errorf("%s: Slice(%d, %d): expected %q, got %q", t.Name(), row.I, row.J, row.Expected, actual)
+		}
+	}
+	var buf []byte
+	for i := uint64(5); i < 6; i-- {
+		buf = append(buf, s.ByteAt(i))
+	}
+	if string(buf) != "fedcba" {
+		t.Errorf("%s: ByteAt backwards: expected \"fedcba\", got %q", t.Name(), buf)
+	}
+}
+
+func TestProgram_MatchAt(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+%captures 2
+BCAP 0
+RWNDB 1
+SAMEB ' '
+BCAP 1
+SPANB 0
+ECAP 1
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	input := []byte("ab cd ef")
+	r := p.MatchAt(input, 6)
+	if actual := r.String(); actual != "{true [0:{(6,8) [(6,8)]} 1:{(6,8) [(6,8)]}]}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+	if r.End != 8 || string(r.Expand(nil, []byte("$1"), input)) != "ef" {
+		t.Errorf("%s: wrong End or text: %d %q", t.Name(), r.End, r.Expand(nil, []byte("$1"), input))
+	}
+	if r := p.MatchAt(input, 4); r.Success {
+		t.Errorf("%s: expected failure at 4, got %v", t.Name(), r)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s: expected a panic for start past the end", t.Name())
+		}
+	}()
+	p.MatchAt(input, 9)
+}
+
+func TestProgram_MatchReverse(t *testing.T) {
+	src := `%literal ".gz"
+%matcher [a-z]
+%captures 2
+BCAP 0
+BCAP 1
+RLITB 0
+ECAP 1
+RMATCHB 0
+RSPANB 0
+RSAMEB '/'
+RANYB
+ECAP 0
+END
+`
+	p, err := ParseAssembly(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	input := []byte("src/dir/file.gz")
+	r := p.MatchReverse(input)
+	if actual := r.String(); actual != "{true [0:{(6,15) [(6,15)]} 1:{(12,15) [(12,15)]}]}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+	if r.End != 6 || string(r.Expand(nil, []byte("$1"), input)) != ".gz" {
+		t.Errorf("%s: wrong End or text: %d %q", t.Name(), r.End, r.Expand(nil, []byte("$1"), input))
+	}
+	for _, bad := range []string{"file.bz", "gz", ".gz", "/f.gz", "dir/F.gz", ""} {
+		if r := p.MatchReverse([]byte(bad)); r.Success {
+			t.Errorf("%s: %q: expected failure, got %v", t.Name(), bad, r)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := p.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: Disassemble: %v", t.Name(), err)
+	}
+	q, err := ParseAssembly(&buf)
+	if err != nil {
+		t.Fatalf("%s: reassemble: %v", t.Name(), err)
+	}
+	if !bytes.Equal(p.Bytes, q.Bytes) {
+		t.Errorf("%s: round trip changed the bytecode", t.Name())
+	}
+
+	lower := byteset.Ranges(byteset.Range{Lo: 'a', Hi: 'z'})
+	q, err = NewBuilder().NumCaptures(2).
+		BCap(0).BCap(1).RLit(".gz").ECap(1).
+		RMatch(lower).RSpan(lower).RSameB('/').RAnyB().
+		ECap(0).End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: Build: %v", t.Name(), err)
+	}
+	if actual := q.MatchReverse(input).String(); actual != r.String() {
+		t.Errorf("%s: Builder program: wrong result: %s", t.Name(), actual)
+	}
+}
+
+func TestProgram_OverlappingMatches(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Search   string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"%literal \"aa\"\nLITB 0\nEND", "aaaa", "0-2 1-3 2-4"},
+		testrow{"%literal \"aa\"\nLITB 0\nEND", "xaxaa", "3-5"},
+		// words, and every suffix of each word
+		testrow{"%matcher [a-z]\nMATCHB 0\nSPANB 0\nEND", "ab 1 cd", "0-2 1-2 5-7 6-7"},
+		// possibly empty: one match at every position, including the end
+		testrow{"%matcher [a-z]\nSPANB 0\nEND", "ab 1", "0-2 1-2 2-2 3-3 4-4"},
+		testrow{"%matcher [a-z]\nSPANB 0\nEND", "", "0-0"},
+		testrow{"%literal \"ab\"\nLITB 0\nEND", "", ""},
+	}
+
+	for i, row := range data {
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		var found []string
+		for start, r := range p.OverlappingMatches([]byte(row.Search)) {
+			found = append(found, fmt.Sprintf("%d-%d", start, r.End))
+		}
+		if actual := strings.Join(found, " "); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Search, row.Expected, actual)
+		}
+	}
+
+	p, err := ParseAssembly(strings.NewReader("ANYB\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	n := 0
+	for range p.OverlappingMatches([]byte("abcdef")) {
+		n++
+		if n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("%s: early stop: expected 3 matches, got %d", t.Name(), n)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+%captures 2
+BCAP 0
+BCAP 1
+MATCHB 0
+SPANB 0
+ECAP 1
+SAMEB '='
+SPANB 0
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	p.HistorySize = 4
+	m, err := NewMatcher(p)
+	if err != nil {
+		t.Fatalf("%s: NewMatcher: %v", t.Name(), err)
+	}
+	if !p.IsPrecompiled() {
+		t.Errorf("%s: NewMatcher did not precompile the program", t.Name())
+	}
+
+	inputs := []string{"key=value", "k=", "=v", "key", "a=b=c", ""}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 200; n++ {
+				input := []byte(inputs[n%len(inputs)])
+				expected := p.Match(input)
+				actual := m.Match(input)
+				if !reflect.DeepEqual(expected, actual) {
+					t.Errorf("%s: %q: expected %v, got %v", t.Name(), input, expected, actual)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	input := []byte("xx ab=cd")
+	if expected, actual := p.MatchAt(input, 3), m.MatchAt(input, 3); !reflect.DeepEqual(expected, actual) {
+		t.Errorf("%s: MatchAt: expected %v, got %v", t.Name(), expected, actual)
+	}
+	if r, err := m.MatchContext(context.Background(), input); err != nil || r.Success {
+		t.Errorf("%s: MatchContext: expected failure, got %v, %v", t.Name(), r, err)
+	}
+
+	input = []byte("key=value")
+	m.Match(input)
+	pooled := testing.AllocsPerRun(100, func() { m.Match(input) })
+	fresh := testing.AllocsPerRun(100, func() { p.Match(input) })
+	if pooled >= fresh {
+		t.Errorf("%s: expected fewer allocations than Program.Match (%v), got %v", t.Name(), fresh, pooled)
+	}
+}
+
+func BenchmarkExecution_Step(b *testing.B) {
+	benchmarkMatch(b, (*Program).Precompile)
+}
+
+func TestProgram_IsMatch(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 100; i++ {
+		p := GenProgram(r, 1+i/4)
+		for _, input := range inputs {
+			expected := p.Match([]byte(input)).Success
+			if actual := p.IsMatch([]byte(input)); actual != expected {
+				t.Errorf("%s/%03d: %q: expected %v, got %v\n%v", t.Name(), i, input, expected, actual, p)
+			}
+		}
+	}
+
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+%literal "end"
+%captures 2
+BCAP 0
+CHOICE .L0
+LITB 0
+FCAP 1, 3
+COMMIT .L1
+.L0:
+BCAP 1
+SPANB 0
+ECAP 1
+.L1:
+ECAP 0
+SAMEB ';'
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	x := p.Exec([]byte("abc;"))
+	x.MatchOnly = true
+	if err := x.Run(); err != nil || x.R != SuccessState {
+		t.Fatalf("%s: expected success, got %v, %v", t.Name(), x.R, err)
+	}
+	if len(x.KS) != 0 {
+		t.Errorf("%s: expected no captures, got %v", t.Name(), x.KS)
+	}
+	x = p.Exec([]byte("abc,"))
+	x.MatchOnly = true
+	if err := x.Run(); err != nil || x.R != FailureState || x.Expected() != nil {
+		t.Errorf("%s: expected failure without expectations, got %v, %v, %v", t.Name(), x.R, err, x.Expected())
+	}
+
+	input := []byte("end;")
+	if !p.IsMatch(input) || p.IsMatch([]byte("end")) {
+		t.Errorf("%s: wrong answers", t.Name())
+	}
+	quick := testing.AllocsPerRun(100, func() { p.IsMatch(input) })
+	full := testing.AllocsPerRun(100, func() { p.Match(input) })
+	if quick >= full {
+		t.Errorf("%s: expected fewer allocations than Match (%v), got %v", t.Name(), full, quick)
+	}
+
+	m, err := NewMatcher(p)
+	if err != nil {
+		t.Fatalf("%s: NewMatcher: %v", t.Name(), err)
+	}
+	if !m.IsMatch(input) || m.IsMatch([]byte("end")) {
+		t.Errorf("%s: Matcher: wrong answers", t.Name())
+	}
+	if r := m.Match(input); r.String() != "{true [0:{(0,3) [(0,3)]} 1:{(0,3) [(0,3)]}]}" {
+		t.Errorf("%s: Matcher: MatchOnly leaked into Match: %v", t.Name(), r)
+	}
+}
+
+func TestProgram_MatchWithOptions(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 100; i++ {
+		p := GenProgram(r, 1+i/4)
+		for _, input := range inputs {
+			expected := p.Match([]byte(input))
+			actual := p.MatchWithOptions([]byte(input), MatchOptions{TwoPhase: true})
+			if actual.String() != expected.String() || actual.End != expected.End {
+				t.Errorf("%s/%03d: %q: expected %v End %d, got %v End %d\n%v", t.Name(), i, input, expected, expected.End, actual, actual.End, p)
+			}
+			if !actual.Success && actual.Expected != nil {
+				t.Errorf("%s/%03d: %q: expected no Expected, got %v", t.Name(), i, input, actual.Expected)
+			}
+			if plain := p.MatchWithOptions([]byte(input), MatchOptions{}); !reflect.DeepEqual(plain, expected) {
+				t.Errorf("%s/%03d: %q: zero options: expected %v, got %v", t.Name(), i, input, expected, plain)
+			}
+		}
+	}
+}
+
+func TestFrame_KSLen(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 2
+BCAP 0
+CHOICE alt
+BCAP 1
+SAMEB 'a'
+ECAP 1
+SAMEB 'b'
+COMMIT done
+alt:
+FCAP 1, 0
+SAMEB 'a'
+done:
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	x := p.Exec([]byte("ac"))
+	for i := 0; i < 2; i++ {
+		if err := x.Step(); err != nil {
+			t.Fatalf("%s: error: %v", t.Name(), err)
+		}
+	}
+	if len(x.CS) != 1 || x.CS[0].KSLen != 1 {
+		t.Fatalf("%s: expected a CHOICE frame with KSLen 1, got %v", t.Name(), x.CS)
+	}
+	ks := x.KS[:1:1]
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := x.Result().String(); actual != "{true [0:{(0,1) [(0,1)]} 1:{(0,0) [(0,0)]}]}" {
+		t.Errorf("%s: wrong result: %s", t.Name(), actual)
+	}
+	if ks[0] != (Assignment{Index: 0, DP: 0}) {
+		t.Errorf("%s: checkpointed assignment was overwritten: %v", t.Name(), ks[0])
+	}
+}
+
+func TestExecution_RetFrame(t *testing.T) {
+	good, err := ParseAssembly(strings.NewReader(`CALL rule
+END
+rule:
+SAMEB 'a'
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := good.Match([]byte("a")).String(); actual != "{true []}" {
+		t.Errorf("%s: CALL frame: wrong result: %s", t.Name(), actual)
+	}
+
+	// RET must not take a pending CHOICE frame for the return address.
+	bad, err := ParseAssembly(strings.NewReader(`CALL rule
+END
+rule:
+CHOICE alt
+RET
+alt:
+GIVEUP
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	err = bad.Exec([]byte("a")).Run()
+	if rterr, ok := err.(*RuntimeError); !ok || rterr.Err != ErrChoiceFailFrame {
+		t.Errorf("%s: CHOICE frame: expected ErrChoiceFailFrame, got %v", t.Name(), err)
+	}
+}
+
+func TestProgram_MatchAllocs(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+%literal "and"
+%captures 1
+BCAP 0
+.L0:
+CHOICE .L2
+TLITB .L1, 0
+.L1:
+SPANB 0
+SAMEB ' '
+PCOMMIT .L0
+.L2:
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := p.Precompile(); err != nil {
+		t.Fatalf("%s: Precompile: %v", t.Name(), err)
+	}
+	short := bytes.Repeat([]byte("this and that "), 10)
+	long := bytes.Repeat([]byte("this and that "), 1000)
+	p.Match(long)
+	a := testing.AllocsPerRun(50, func() { p.Match(short) })
+	b := testing.AllocsPerRun(50, func() { p.Match(long) })
+	// Allow for sync.Pool dropping items at random, as it does under -race.
+	if b > a+1 {
+		t.Errorf("%s: allocations grow with the input: %v for %d bytes, %v for %d bytes", t.Name(), a, len(short), b, len(long))
+	}
+}
+
+func TestResult_Stats(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 2
+BCAP 0
+CHOICE alt
+BCAP 1
+SAMEB 'a'
+SAMEB 'b'
+ECAP 1
+COMMIT done
+alt:
+CHOICE alt2
+SAMEB 'a'
+SAMEB 'c'
+COMMIT done
+alt2:
+SAMEB 'a'
+done:
+ECAP 0
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	if r := p.Match([]byte("a")); r.Stats != nil {
+		t.Errorf("%s: expected no Stats by default, got %v", t.Name(), r.Stats)
+	}
+
+	p.KeepStats = true
+	type testrow struct {
+		Input    string
+		Success  bool
+		Expected string
+	}
+	for i, row := range []testrow{
+		testrow{"ab", true, "steps=9 choices=1 failures=0 backtracks=0 maxstack=1 maxks=4"},
+		testrow{"ac", true, "steps=11 choices=2 failures=1 backtracks=1 maxstack=1 maxks=2"},
+		testrow{"ad", true, "steps=11 choices=2 failures=2 backtracks=2 maxstack=1 maxks=2"},
+		testrow{"x", false, "steps=7 choices=2 failures=3 backtracks=2 maxstack=1 maxks=2"},
+	} {
+		r := p.Match([]byte(row.Input))
+		if r.Success != row.Success || r.Stats == nil || r.Stats.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %v %s, got %v %v", t.Name(), i, row.Input, row.Success, row.Expected, r.Success, r.Stats)
+		}
+	}
+
+	m, err := NewMatcher(p)
+	if err != nil {
+		t.Fatalf("%s: NewMatcher: %v", t.Name(), err)
+	}
+	for i := 0; i < 2; i++ {
+		if r := m.Match([]byte("ac")); r.Stats == nil || r.Stats.Steps != 11 {
+			t.Errorf("%s: Matcher: expected 11 steps, got %v", t.Name(), r.Stats)
+		}
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+CHOICE word
+SAMEB '0'
+COMMIT done
+word:
+MATCHB 0
+SPANB 0
+done:
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	prof := NewProfiler()
+	var clock time.Time
+	prof.now = func() time.Time {
+		clock = clock.Add(time.Microsecond)
+		return clock
+	}
+	if r := prof.Match(p, []byte("abc")); !r.Success {
+		t.Errorf("%s: expected success, got %v", t.Name(), r)
+	}
+	if r := prof.Match(p, []byte("0")); !r.Success {
+		t.Errorf("%s: expected success, got %v", t.Name(), r)
+	}
+	if total := prof.Total(); total.Count != 9 || total.Time != 9*time.Microsecond {
+		t.Errorf("%s: wrong total: %+v", t.Name(), total)
+	}
+
+	var buf bytes.Buffer
+	if _, err := prof.WriteReport(&buf, p); err != nil {
+		t.Fatalf("%s: WriteReport: %v", t.Name(), err)
+	}
+	expected := dedent.Dedent(`
+		OPCODE  COUNT  TIME  %TIME
+		CHOICE  2      2µs   22.2
+		END     2      2µs   22.2
+		SAMEB   2      2µs   22.2
+		COMMIT  1      1µs   11.1
+		MATCHB  1      1µs   11.1
+		SPANB   1      1µs   11.1
+
+		LABEL  COUNT  TIME  %TIME
+		-      5      5µs   55.6
+		done   2      2µs   22.2
+		word   2      2µs   22.2
+	`)[1:]
+	if actual := buf.String(); actual != expected {
+		t.Errorf("%s: wrong report:\n%s\nexpected:\n%s", t.Name(), actual, expected)
+	}
+
+	x := p.Exec([]byte("x"))
+	prof = x.Profile()
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	prof.Stop()
+	if n := prof.ByXP[0].Count; n != 1 {
+		t.Errorf("%s: Execution.Profile: expected CHOICE once, got %d", t.Name(), n)
+	}
+}
+
+func TestProgram_CompileJIT(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	inputs := []string{"", "a", "ab", "abc", "cba", "aabbcc", "abcabcabc", "ccccc"}
+	for i := 0; i < 100; i++ {
+		p := GenProgram(r, 1+i/4)
+		p.KeepStats = true
+		q := *p
+		if q.IsJITCompiled() {
+			t.Errorf("%s/%03d: IsJITCompiled: expected false before CompileJIT", t.Name(), i)
+		}
+		if err := q.CompileJIT(); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if !q.IsJITCompiled() {
+			t.Errorf("%s/%03d: IsJITCompiled: expected true after CompileJIT", t.Name(), i)
+		}
+		for _, input := range inputs {
+			expected := p.Match([]byte(input))
+			actual := q.Match([]byte(input))
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("%s/%03d: %q: expected %v %v, got %v %v\n%v", t.Name(), i, input, expected, expected.Stats, actual, actual.Stats, p)
+			}
+
+			for _, limit := range []uint64{1, 5, 20} {
+				x := p.Exec([]byte(input))
+				x.Limits.MaxSteps = limit
+				expectedErr := x.Run()
+				y := q.Exec([]byte(input))
+				y.Limits.MaxSteps = limit
+				actualErr := y.Run()
+				if fmt.Sprint(actualErr) != fmt.Sprint(expectedErr) || y.Steps != x.Steps || y.XP != x.XP || y.DP != x.DP {
+					t.Errorf("%s/%03d: %q: MaxSteps %d: expected %v at %d, got %v at %d", t.Name(), i, input, limit, expectedErr, x.Steps, actualErr, y.Steps)
+				}
+			}
+		}
+	}
+
+	bad := &Program{Bytes: []byte{0x20}}
+	if err := bad.CompileJIT(); err == nil {
+		t.Errorf("%s: expected error for truncated bytecode", t.Name())
+	} else if bad.IsJITCompiled() {
+		t.Errorf("%s: IsJITCompiled: expected false after failed CompileJIT", t.Name())
+	}
+}
+
+func BenchmarkExecution_JIT(b *testing.B) {
+	benchmarkMatch(b, (*Program).CompileJIT)
+}
+
+// benchmarkMatch times a Match of a word-splitting program, prepared by
+// compile, over 28KiB of text.
+func benchmarkMatch(b *testing.B, compile func(*Program) error) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [a-z]
+%literal "and"
+%captures 2
+BCAP 0
+.L0:
+CHOICE .L2
+CALL .word
+COMMIT .L0
+.word:
+TLITB .L1, 0
+FCAP 1, 3
+JMP .L3
+.L1:
+MATCHB 0
+SPANB 0
+.L3:
+SAMEB ' '
+RET
+.L2:
+ECAP 0
+END
+`))
+	if err != nil {
+		b.Fatalf("%s: error: %v", b.Name(), err)
+	}
+	if err := compile(p); err != nil {
+		b.Fatalf("%s: compile: %v", b.Name(), err)
+	}
+	input := bytes.Repeat([]byte("this and that and the other "), 1024)
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r := p.Match(input); !r.Success || r.End != uint64(len(input)) {
+			b.Fatalf("%s: wrong result: %v", b.Name(), r)
+		}
+	}
+}
+
+func TestExecution_SetProgress(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`.L0:
+CHOICE .L1
+ANYB 1
+COMMIT .L0
+.L1:
+END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Bytes    uint64
+		Steps    uint64
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{4, 0, "[4@11 8@23]"},
+		testrow{0, 10, "[3@10 7@20 10@30]"},
+		testrow{5, 10, "[3@10 5@14 7@20 10@29 10@30]"},
+		testrow{0, 0, "[]"},
+	}
+
+	input := []byte("abcdefghij")
+	for i, row := range data {
+		for _, prog := range []*Program{p, &q} {
+			var calls []string
+			fn := func(x *Execution) error {
+				calls = append(calls, fmt.Sprintf("%d@%d", x.DP, x.Steps))
+				return nil
+			}
+			r, err := prog.MatchProgress(input, row.Bytes, row.Steps, fn)
+			if err != nil || !r.Success {
+				t.Errorf("%s/%03d: expected success, got %v, %v", t.Name(), i, r, err)
+			}
+			if actual := fmt.Sprintf("%v", calls); actual != row.Expected {
+				t.Errorf("%s/%03d: JIT %v: expected %s, got %s", t.Name(), i, prog.IsJITCompiled(), row.Expected, actual)
+			}
+		}
+	}
+
+	errStop := errors.New("stop")
+	_, err = p.MatchProgress(input, 1, 0, func(x *Execution) error {
+		if x.DP >= 6 {
+			return errStop
+		}
+		return nil
+	})
+	if rterr, ok := err.(*RuntimeError); !ok || rterr.Err != errStop || rterr.DP != 6 {
+		t.Errorf("%s: expected RuntimeError for errStop at DP 6, got %v", t.Name(), err)
+	}
+
+	// A clone keeps its own schedule, so running it does not move the
+	// original's callbacks.
+	var calls []string
+	x := p.Exec(input)
+	x.SetProgress(0, 10, func(y *Execution) error {
+		if y == x {
+			calls = append(calls, fmt.Sprintf("%d@%d", y.DP, y.Steps))
+		}
+		return nil
+	})
+	if err := x.Clone().Run(); err != nil {
+		t.Fatalf("%s: clone: error: %v", t.Name(), err)
+	}
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := fmt.Sprintf("%v", calls); actual != "[3@10 7@20 10@30]" {
+		t.Errorf("%s: clone disturbed the original: expected [3@10 7@20 10@30], got %s", t.Name(), actual)
+	}
+}
+
+func TestProgram_Predicates(t *testing.T) {
+	digits := byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})
+	var calls int
+	lengthMatches := func(input []byte, dp uint64) bool {
+		calls++
+		return uint64(input[dp-1]-'0') == uint64(len(input))-dp
+	}
+	p, err := NewBuilder().NumCaptures(1).
+		BCap(0).Match(digits).Pred(lengthMatches).
+		Label(".L0").TAnyB(".L1").Jmp(".L0").
+		Label(".L1").ECap(0).End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if n := len(p.Predicates()); n != 1 {
+		t.Fatalf("%s: expected 1 predicate, got %d", t.Name(), n)
+	}
+	var dis bytes.Buffer
+	p.Disassemble(&dis)
+	if !strings.Contains(dis.String(), "PRED 0\n") {
+		t.Errorf("%s: expected PRED 0 in disassembly, got:\n%s", t.Name(), dis.String())
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected bool
+	}
+
+	data := []testrow{
+		testrow{"3abc", true},
+		testrow{"3ab", false},
+		testrow{"3abcd", false},
+		testrow{"0", true},
+		testrow{"x", false},
+	}
+
+	for i, row := range data {
+		calls = 0
+		if r := p.Match([]byte(row.Input)); r.Success != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %v, got %v", t.Name(), i, row.Input, row.Expected, r)
+		}
+		if expected := strings.IndexByte("0123456789", row.Input[0]) >= 0; (calls == 1) != expected {
+			t.Errorf("%s/%03d: %q: predicate called %d times", t.Name(), i, row.Input, calls)
+		}
+		if r := q.Match([]byte(row.Input)); r.Success != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %v, got %v", t.Name(), i, row.Input, row.Expected, r)
+		}
+		if r := p.MatchSegments([][]byte{[]byte(row.Input[:1]), []byte(row.Input[1:])}); r.Success != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchSegments: expected %v, got %v", t.Name(), i, row.Input, row.Expected, r)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.Success != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %v, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(p); err != nil {
+		t.Fatalf("%s: gob: error: %v", t.Name(), err)
+	}
+	var loaded Program
+	if err := gob.NewDecoder(&buf).Decode(&loaded); err != nil {
+		t.Fatalf("%s: gob: error: %v", t.Name(), err)
+	}
+	if errs := loaded.Validate(); len(errs) != 0 {
+		t.Errorf("%s: Validate: expected success without predicates, got %v", t.Name(), errs)
+	}
+	x := loaded.Exec([]byte("3abc"))
+	if err := x.Run(); err == nil || err.(*RuntimeError).Err != ErrIndexRange {
+		t.Errorf("%s: expected ErrIndexRange without predicates, got %v", t.Name(), err)
+	}
+	loaded.AddPredicate(lengthMatches)
+	if r := loaded.Match([]byte("3abc")); !r.Success {
+		t.Errorf("%s: expected success once predicate is added, got %v", t.Name(), r)
+	}
+}
+
+func TestExecution_Values(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%matcher [0-9]
+%captures 2
+BCAP 0
+CALL .num
+.L0:
+CHOICE .L1
+SAMEB '+'
+CALL .num
+VFOLD 0
+SAMEB ';'
+COMMIT .L0
+.L1:
+ECAP 0
+END
+.num:
+BCAP 1
+MATCHB 0
+SPANB 0
+ECAP 1
+VCAP 1
+RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	errTooBig := errors.New("too big")
+	toInt := func(v interface{}) int {
+		if b, ok := v.([]byte); ok {
+			n, _ := strconv.Atoi(string(b))
+			return n
+		}
+		return v.(int)
+	}
+	p.AddFolder(func(values []interface{}) (interface{}, error) {
+		sum := toInt(values[0]) + toInt(values[1])
+		if sum > 100 {
+			return nil, errTooBig
+		}
+		return sum, nil
+	})
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input string
+		Value interface{}
+		End   uint64
+	}
+
+	data := []testrow{
+		testrow{"7", []byte("7"), 1},
+		testrow{"1+2", []byte("1"), 1},
+		testrow{"1+2;", 3, 4},
+		testrow{"1+2;+3", 3, 4},
+		testrow{"10+20;+30;", 60, 10},
+	}
+
+	for i, row := range data {
+		for _, prog := range []*Program{p, &q} {
+			r := prog.Match([]byte(row.Input))
+			if !r.Success || !reflect.DeepEqual(r.Value, row.Value) || r.End != row.End {
+				t.Errorf("%s/%03d: %q: JIT %v: expected %#v at %d, got %v %#v at %d", t.Name(), i, row.Input, prog.IsJITCompiled(), row.Value, row.End, r, r.Value, r.End)
+			}
+		}
+	}
+
+	x := p.Exec([]byte("1+2;+3;"))
+	if err := x.Run(); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if vs := x.Values(); !reflect.DeepEqual(vs, []interface{}{6}) {
+		t.Errorf("%s: Values: expected [6], got %v", t.Name(), vs)
+	}
+	if r := p.Match([]byte("x")); r.Success || r.Value != nil {
+		t.Errorf("%s: expected failure without Value, got %v %v", t.Name(), r, r.Value)
+	}
+	if !p.IsMatch([]byte("90+20;")) {
+		t.Errorf("%s: IsMatch: expected true, as MatchOnly skips VFOLD", t.Name())
+	}
+	if _, err := p.MatchContext(context.Background(), []byte("90+20;")); err == nil || err.(*RuntimeError).Err != errTooBig {
+		t.Errorf("%s: expected RuntimeError for errTooBig, got %v", t.Name(), err)
+	}
+
+	bad, err := ParseAssembly(strings.NewReader("%captures 2\nVFOLD 0, 1\nEND\n"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	bad.AddFolder(func(values []interface{}) (interface{}, error) { return nil, nil })
+	if _, err := bad.MatchContext(context.Background(), nil); err == nil || err.(*RuntimeError).Err != ErrCountRange {
+		t.Errorf("%s: empty stack: expected ErrCountRange, got %v", t.Name(), err)
+	}
+}
+
+func TestAssembler_FuseEOI(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"CHOICE .L1\nANYB\nFAIL2X\n.L1:\nEND\n", "EOI\nEND\n"},
+		testrow{"SAMEB 'a'\nCHOICE .L1\nANYB\nFAIL2X\n.L0:\n.L1:\nEND\n", "SAMEB 'a'\nEOI\nEND\n"},
+		testrow{"CHOICE .L1\nANYB 2\nFAIL2X\n.L1:\nEND\n", "CHOICE\nANYB 2\nFAIL2X\nEND\n"},
+		testrow{"CHOICE .L1\nANYB\nFAIL2X\nSAMEB 'a'\n.L1:\nEND\n", "CHOICE\nANYB\nFAIL2X\nSAMEB 'a'\nEND\n"},
+	}
+
+	for i, row := range data {
+		a := NewAssembler()
+		if err := a.Parse(strings.NewReader(row.Input)); err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		a.FuseEOI()
+		q, err := a.Finish()
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		p, err := ParseAssembly(strings.NewReader(row.Input))
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+
+		var names []string
+		it := q.Instructions()
+		for it.Next() {
+			op := it.Op()
+			name := op.Code.String()
+			if op.Code == OpANYB || op.Code == OpSAMEB {
+				name, _ = q.DisassembleAt(op.XP)
+			}
+			names = append(names, name)
+		}
+		if actual := strings.Join(names, "\n") + "\n"; actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected:\n%s\n\tactual:\n%s", t.Name(), i, row.Expected, actual)
+		}
+
+		for _, input := range []string{"", "a", "ab", "b"} {
+			expected := p.Match([]byte(input)).String()
+			if actual := q.Match([]byte(input)).String(); actual != expected {
+				t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, input, expected, actual)
+			}
+			r, err := q.MatchReader(iotest.OneByteReader(strings.NewReader(input)))
+			if err != nil || r.String() != expected {
+				t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, input, expected, r, err)
+			}
+		}
+	}
+}
+
+func TestExecution_WordB(t *testing.T) {
+	word := byteset.Or(
+		byteset.Ranges(byteset.Range{Lo: 'a', Hi: 'z'}),
+		byteset.Exactly('_'))
+	p, err := NewBuilder().NumCaptures(1).
+		Label(".L0").Choice(".L1").
+		WordB(word).BCap(0).Lit("cat").ECap(0).WordB(word).
+		Commit(".L2").
+		Label(".L1").AnyB().Jmp(".L0").
+		Label(".L2").End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"cat", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"a cat", "{true [0:{(2,5) [(2,5)]}]}"},
+		testrow{"cat!", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"concat cat_ cat", "{true [0:{(12,15) [(12,15)]}]}"},
+		testrow{"cats", "{false}"},
+		testrow{"bobcat", "{false}"},
+		testrow{"", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+}
+
+func TestExecution_BalB(t *testing.T) {
+	p, err := NewBuilder().NumCaptures(1).
+		BCap(0).Bal('(', ')').ECap(0).
+		Label(".L0").TAnyB(".L1").Jmp(".L0").
+		Label(".L1").End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+	sets, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: %v", t.Name(), err)
+	}
+	if fs := sets.Start; fs.MayBeEmpty || !fs.Bytes.Match('(') || fs.Bytes.Match(')') {
+		t.Errorf("%s: wrong first set: %v", t.Name(), sets.Start)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"()", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"(a(b)c)d)", "{true [0:{(0,7) [(0,7)]}]}"},
+		testrow{"((x)(y))", "{true [0:{(0,8) [(0,8)]}]}"},
+		testrow{"(a(b)c", "{false}"},
+		testrow{"a()", "{false}"},
+		testrow{")(", "{false}"},
+		testrow{"", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+
+	if r := p.Match([]byte("a()")); r.Expected == nil || r.Expected.String() != "'('" {
+		t.Errorf("%s: expected '(' to be expected, got %v", t.Name(), r.Expected)
+	}
+}
+
+func TestExecution_DCommit(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%captures 2
+	CHOICE .L1
+	BCAP 0
+	SAMEB 'a'
+	ECAP 0
+	DCOMMIT .L2
+.L1:
+	BCAP 0
+	SAMEB 'b'
+	ECAP 0
+.L2:
+	BCAP 1
+	ANYB
+	ECAP 1
+	END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"ax", "{true [0:- 1:{(1,2) [(1,2)]}]}"},
+		testrow{"bx", "{true [0:{(0,1) [(0,1)]} 1:{(1,2) [(1,2)]}]}"},
+		testrow{"a", "{false}"},
+		testrow{"x", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	bad, err := NewBuilder().DCommit(".L0").Label(".L0").End().Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := bad.VerifyStack(); err == nil || err.(*VerifyError).Err != ErrNoChoicePending {
+		t.Errorf("%s: expected ErrNoChoicePending, got %v", t.Name(), err)
+	}
+}
+
+func TestExecution_RuneOps(t *testing.T) {
+	p, err := NewBuilder().NumCaptures(1).
+		SameR('é').BCap(0).AnyR().ECap(0).SameR('!').
+		End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"éa!", "{true [0:{(2,3) [(2,3)]}]}"},
+		testrow{"é世!", "{true [0:{(2,5) [(2,5)]}]}"},
+		testrow{"é\U0001f600!", "{true [0:{(2,6) [(2,6)]}]}"},
+		testrow{"é\ufffd!", "{true [0:{(2,5) [(2,5)]}]}"},
+		testrow{"e\u0301a!", "{false}"},
+		testrow{"é\xe4\xb8!", "{false}"},
+		testrow{"é\xc0\x80!", "{false}"},
+		testrow{"é\xed\xa0\x80!", "{false}"},
+		testrow{"é\x80!", "{false}"},
+		testrow{"\xc3", "{false}"},
+		testrow{"é", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+		if len(row.Input) < 2 {
+			continue
+		}
+		r = p.MatchSegments([][]byte{[]byte(row.Input[:1]), []byte(row.Input[1:])})
+		if r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchSegments: expected %s, got %v", t.Name(), i, row.Input, row.Expected, r)
+		}
+	}
+
+	if r := p.Match([]byte("éa?")); r.Expected == nil || r.Expected.String() != "'!'" {
+		t.Errorf("%s: expected '!' to be expected, got %v", t.Name(), r.Expected)
+	}
+	if r := p.Match([]byte("e")); r.Expected == nil || r.Expected.String() != `"é"` {
+		t.Errorf("%s: expected \"é\" to be expected, got %v", t.Name(), r.Expected)
+	}
+	sets, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: %v", t.Name(), err)
+	}
+	if fs := sets.Start; fs.MayBeEmpty || !fs.Bytes.Match(0xc3) || fs.Bytes.Match('e') {
+		t.Errorf("%s: wrong first set: %v", t.Name(), fs)
+	}
+	if prefixes, err := p.RequiredPrefixes(4); err != nil || len(prefixes) != 1 || string(prefixes[0]) != "é" {
+		t.Errorf("%s: expected prefix %q, got %q", t.Name(), "é", prefixes)
+	}
+}
+
+func TestProgram_RuneSets(t *testing.T) {
+	greek := runeset.Table(unicode.Greek)
+	digits := runeset.Ranges(runeset.Range{Lo: '0', Hi: '9'})
+	p, err := NewBuilder().NumCaptures(1).
+		BCap(0).MatchR(greek).SpanR(greek).ECap(0).
+		TMatchR(".L0", digits).SpanR(digits).
+		Label(".L0").End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if n := len(p.RuneSets); n != 2 {
+		t.Fatalf("%s: expected 2 rune sets, got %d", t.Name(), n)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"αβγ", "{true [0:{(0,6) [(0,6)]}]}"},
+		testrow{"Ω12", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"αa", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"α\xce", "{true [0:{(0,2) [(0,2)]}]}"},
+		testrow{"a", "{false}"},
+		testrow{"\xce", "{false}"},
+		testrow{"", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+
+	sets, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: %v", t.Name(), err)
+	}
+	if fs := sets.Start; fs.MayBeEmpty || !fs.Bytes.Match(0xce) || !fs.Bytes.Match(0xe1) || fs.Bytes.Match('a') {
+		t.Errorf("%s: wrong first set: %v", t.Name(), fs)
+	}
+
+	var dis bytes.Buffer
+	p.Disassemble(&dis)
+	rounds := []struct {
+		Name  string
+		Round func() (*Program, error)
+	}{
+		{"assembly", func() (*Program, error) {
+			return ParseAssembly(bytes.NewReader(dis.Bytes()))
+		}},
+		{"binary", func() (*Program, error) {
+			raw, _ := p.MarshalBinary()
+			q := &Program{}
+			return q, q.UnmarshalBinary(raw)
+		}},
+		{"gob", func() (*Program, error) {
+			raw, _ := p.GobEncode()
+			q := &Program{}
+			return q, q.GobDecode(raw)
+		}},
+		{"json", func() (*Program, error) {
+			raw, _ := json.Marshal(p)
+			q := &Program{}
+			return q, json.Unmarshal(raw, q)
+		}},
+		{"file", func() (*Program, error) {
+			var file bytes.Buffer
+			if err := WriteProgram(&file, p); err != nil {
+				return nil, err
+			}
+			return ReadProgram(&file)
+		}},
+	}
+	for _, row := range rounds {
+		loaded, err := row.Round()
+		if err != nil {
+			t.Errorf("%s/%s: error: %v", t.Name(), row.Name, err)
+			continue
+		}
+		if len(loaded.RuneSets) != len(p.RuneSets) {
+			t.Errorf("%s/%s: expected %d rune sets, got %d", t.Name(), row.Name, len(p.RuneSets), len(loaded.RuneSets))
+			continue
+		}
+		for i, set := range loaded.RuneSets {
+			if expected, actual := p.RuneSets[i].String(), set.String(); actual != expected {
+				t.Errorf("%s/%s: rune set %d: expected %s, got %s", t.Name(), row.Name, i, expected, actual)
+			}
+		}
+		if actual := loaded.Match([]byte("Ω12")).String(); actual != data[1].Expected {
+			t.Errorf("%s/%s: expected %s, got %s", t.Name(), row.Name, data[1].Expected, actual)
+		}
+	}
+
+	bad, err := ParseAssembly(strings.NewReader("MATCHR 0\nEND\n"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if errs := bad.Validate(); len(errs) != 1 || errs[0].Err != ErrIndexRange {
+		t.Errorf("%s: expected ErrIndexRange, got %v", t.Name(), errs)
+	}
+}
+
+func TestProgram_RuneSetProperties(t *testing.T) {
+	p, err := ParseAssembly(strings.NewReader(`%runeset [\p{L}_]
+%runeset [\p{L}\p{Nd}_]
+%captures 1
+	BCAP 0
+	MATCHR 0
+	SPANR 1
+	ECAP 0
+	END
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"_x1", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"名前2 = 3", "{true [0:{(0,7) [(0,7)]}]}"},
+		testrow{"π٣-", "{true [0:{(0,4) [(0,4)]}]}"},
+		testrow{"2x", "{false}"},
+	}
+
+	raw, _ := p.MarshalBinary()
+	if len(raw) > 100 {
+		t.Errorf("%s: expected a compact encoding, got %d bytes", t.Name(), len(raw))
+	}
+	var q Program
+	if err := q.UnmarshalBinary(raw); err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := q.RuneSets[1].String(); actual != `[\p{L}\p{Nd}_]` {
+		t.Errorf("%s: expected %q, got %q", t.Name(), `[\p{L}\p{Nd}_]`, actual)
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: binary: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	b := NewBuilder().MatchR(runeset.MustProperty("Greek")).End()
+	if _, err := b.Finish(); err != nil {
+		t.Errorf("%s: Builder: error: %v", t.Name(), err)
+	} else if actual := b.RuneSets[0].String(); actual != `\p{Greek}` {
+		t.Errorf("%s: Builder: expected %q, got %q", t.Name(), `\p{Greek}`, actual)
+	}
+}
+
+func TestExecution_FoldR(t *testing.T) {
+	p, err := NewBuilder().NumCaptures(1).
+		FSameR('σ').BCap(0).SpanR(runeset.Fold(runeset.Ranges(runeset.Range{Lo: 'a', Hi: 'z'}))).ECap(0).
+		End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"σabc", "{true [0:{(2,5) [(2,5)]}]}"},
+		testrow{"ΣaBc1", "{true [0:{(2,5) [(2,5)]}]}"},
+		testrow{"ςOKK", "{true [0:{(2,7) [(2,7)]}]}"},
+		testrow{"s", "{false}"},
+		testrow{"τ", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+
+	sets, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: %v", t.Name(), err)
+	}
+	if fs := sets.Start; fs.MayBeEmpty || !fs.Bytes.Match(0xcf) || !fs.Bytes.Match(0xce) || fs.Bytes.Match('s') {
+		t.Errorf("%s: wrong first set: %v", t.Name(), fs)
+	}
+
+	var buf bytes.Buffer
+	if _, err := p.Disassemble(&buf); err != nil {
+		t.Fatalf("%s: Disassemble: %v", t.Name(), err)
+	}
+	text := buf.String()
+	if !strings.Contains(text, "%runeset ~[a-z]") || !strings.Contains(text, "FSAMER") {
+		t.Errorf("%s: wrong disassembly:\n%s", t.Name(), text)
+	}
+	p2, err := ParseAssembly(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("%s: ParseAssembly: %v", t.Name(), err)
+	}
+	if actual := p2.Match([]byte("ΣaBc1")).String(); actual != data[1].Expected {
+		t.Errorf("%s: reassembled: expected %s, got %s", t.Name(), data[1].Expected, actual)
+	}
+}
+
+func TestExecution_TSpan(t *testing.T) {
+	digits := byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})
+	p, err := NewBuilder().NumCaptures(1).
+		BCap(0).TSpan(".L0", digits).ECap(0).End().
+		Label(".L0").SameB('x').End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := p.VerifyStack(); err != nil {
+		t.Fatalf("%s: VerifyStack: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"7", "{true [0:{(0,1) [(0,1)]}]}"},
+		testrow{"123x", "{true [0:{(0,3) [(0,3)]}]}"},
+		testrow{"x12", "{true [0:-]}"},
+		testrow{"", "{false}"},
+		testrow{"y", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+
+	if r := p.Match([]byte("y")); r.Expected == nil || r.Expected.String() != "'0'-'9' or 'x'" {
+		t.Errorf("%s: expected '0'-'9' or 'x' to be expected, got %v", t.Name(), r.Expected)
+	}
+	sets, err := p.FirstSets()
+	if err != nil {
+		t.Fatalf("%s: FirstSets: %v", t.Name(), err)
+	}
+	if fs := sets.Start; fs.MayBeEmpty || !fs.Bytes.Match('5') || !fs.Bytes.Match('x') || fs.Bytes.Match('y') {
+		t.Errorf("%s: wrong first set: %v", t.Name(), fs)
+	}
+}
+
+func TestExecution_Memo(t *testing.T) {
+	// S <- A 'x' / A 'y'; A <- 'a'+, with A memoized as rule 7.
+	p, err := NewBuilder().NumCaptures(1).
+		Choice(".alt").
+		MemoGet(".m1", 7).Call("A").MemoSet(7).
+		Label(".m1").SameB('x').Commit(".done").
+		Label(".alt").
+		MemoGet(".m2", 7).Call("A").MemoSet(7).
+		Label(".m2").SameB('y').
+		Label(".done").End().
+		Label("A").BCap(0).TSpan(".fail", byteset.Exactly('a')).ECap(0).Ret().
+		Label(".fail").Fail().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := p.VerifyStack(); err != nil {
+		t.Fatalf("%s: VerifyStack: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+		Calls    int
+		Memo     string
+	}
+
+	data := []testrow{
+		testrow{"aax", "{true [0:{(0,2) [(0,2)]}]}", 1, "{true 2 2}"},
+		testrow{"aaay", "{true [0:{(0,3) [(0,3)]}]}", 1, "{true 3 2}"},
+		testrow{"aaaz", "{false}", 1, "{true 3 2}"},
+		testrow{"by", "{false}", 1, "{false 0 0}"},
+	}
+
+	for i, row := range data {
+		x := p.Exec([]byte(row.Input))
+		x.Observer = &callCounter{}
+		if err := x.Run(); err != nil {
+			t.Errorf("%s/%03d: %q: error: %v", t.Name(), i, row.Input, err)
+			continue
+		}
+		if actual := x.Result().String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := x.Observer.(*callCounter).calls; actual != row.Calls {
+			t.Errorf("%s/%03d: %q: expected %d CALLs, got %d", t.Name(), i, row.Input, row.Calls, actual)
+		}
+		entry := x.memo.get(memoKey{7, 0})
+		if entry == nil {
+			t.Errorf("%s/%03d: %q: nothing memoized", t.Name(), i, row.Input)
+			continue
+		}
+		if actual := fmt.Sprintf("{%v %d %d}", entry.ok, entry.n, len(entry.ks)); actual != row.Memo {
+			t.Errorf("%s/%03d: %q: expected memo %s, got %s", t.Name(), i, row.Input, row.Memo, actual)
+		}
+	}
+
+	var table memoTable
+	table.entries = make(map[memoKey]*memoEntry)
+	for dp := uint64(0); dp < 5; dp++ {
+		table.put(memoKey{0, dp}, &memoEntry{ok: true, n: dp}, 3)
+	}
+	table.put(memoKey{0, 4}, &memoEntry{ok: false}, 3)
+	var actual []uint64
+	for dp := uint64(0); dp < 5; dp++ {
+		if table.get(memoKey{0, dp}) != nil {
+			actual = append(actual, dp)
+		}
+	}
+	if fmt.Sprint(actual) != "[2 3 4]" || table.get(memoKey{0, 4}).ok {
+		t.Errorf("%s: wrong eviction: kept %v", t.Name(), actual)
+	}
+
+	// Two programs that each memoize their own rule 0 must not see each
+	// other's results once composed.
+	memoA, err := ParseAssembly(strings.NewReader("%captures 1\nMEMOGET .L0, 0\nCALL r\nMEMOSET 0\n.L0:\nEND\nr:\nSAMEB 'x'\nRET"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	memoB, err := ParseAssembly(strings.NewReader("%captures 1\nMEMOGET .L0, 0\nCALL r\nMEMOSET 0\n.L0:\nEND\nr:\nSAMEB 'y'\nRET"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := memoB.Match([]byte("y")).String(); actual != "{true [0:-]}" {
+		t.Errorf("%s: b: expected {true [0:-]}, got %s", t.Name(), actual)
+	}
+	alt, err := Alternate(memoA, memoB)
+	if err != nil {
+		t.Fatalf("%s: Alternate: error: %v", t.Name(), err)
+	}
+	if actual := alt.Match([]byte("y")).String(); actual != "{true [0:{(0,1) [(0,1)]} 1:- 2:-]}" {
+		t.Errorf("%s: Alternate: expected b to match, got %s", t.Name(), actual)
+	}
+	set := NewProgramSet()
+	set.Add("a", memoA)
+	set.Add("b", memoB)
+	if err := set.Compile(); err != nil {
+		t.Fatalf("%s: ProgramSet: error: %v", t.Name(), err)
+	}
+	if index, r := set.Match([]byte("y")); index != 1 || r.String() != "{true [0:-]}" {
+		t.Errorf("%s: ProgramSet: expected 1 {true [0:-]}, got %d %s", t.Name(), index, r)
+	}
+
+	q, err := ParseAssembly(strings.NewReader("%captures 0\nMEMOGET .L0, 1\nRET\n.L0:\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := q.VerifyStack(); err == nil {
+		t.Errorf("%s: expected VerifyStack to fail", t.Name())
+	}
+	x := q.Exec(nil)
+	if err := x.Run(); err == nil || !strings.Contains(err.Error(), ErrMemoFrame.Error()) {
+		t.Errorf("%s: expected %v, got %v", t.Name(), ErrMemoFrame, err)
+	}
+}
+
+// callCounter is an Observer that counts CALL instructions.
+type callCounter struct {
+	NopObserver
+	calls int
+}
+
+func (c *callCounter) OnCall(x *Execution, op *Op) {
+	c.calls++
+}
+
+func TestExecution_ThrowRecover(t *testing.T) {
+	// list <- item (',' item)*; item <- [0-9]+ / ^1, with ^1 recovered by
+	// skipping to the next ',' or the end.
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+%namedmatcher digits [0-9]
+%namedmatcher junk ![,]
+	CALL item
+.loop:
+	TSAMEB .done, ','
+	CALL item
+	JMP .loop
+.done:
+	END
+item:
+	RECOVER .recover, 1
+	CHOICE .throw
+	BCAP 0
+	MATCHB digits
+	SPANB digits
+	ECAP 0
+	COMMIT .ok
+.throw:
+	THROW 1
+.ok:
+	COMMIT .ret
+.recover:
+	SPANB junk
+.ret:
+	RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := p.VerifyStack(); err != nil {
+		t.Fatalf("%s: VerifyStack: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{"1,22,333", "{true [0:{(5,8) [(0,1) (2,4) (5,8)]}]}"},
+		testrow{"1,x,3", "{true [0:{(4,5) [(0,1) (4,5)]}]}"},
+		testrow{"1,22,", "{true [0:{(2,4) [(0,1) (2,4)]}]}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	// Without RECOVER, the label escapes the CHOICE around the THROW.
+	r, err := NewBuilder().NumCaptures(0).
+		Choice(".alt").
+		SameB('a').Throw(2).
+		Label(".alt").AnyB().End().
+		Finish()
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := r.Match([]byte("ab")).String(); actual != "{false throw 2 @ 1}" {
+		t.Errorf("%s: expected %s, got %s", t.Name(), "{false throw 2 @ 1}", actual)
+	}
+	if actual := r.Match([]byte("b")).String(); actual != "{true []}" {
+		t.Errorf("%s: expected %s, got %s", t.Name(), "{true []}", actual)
+	}
+
+	// A RECOVER frame for another label does not catch it, and RET may
+	// not pop one.
+	s, err := ParseAssembly(strings.NewReader("%captures 0\nRECOVER .L0, 1\nTHROW 3\n.L0:\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := s.Match(nil).String(); actual != "{false throw 3 @ 0}" {
+		t.Errorf("%s: expected %s, got %s", t.Name(), "{false throw 3 @ 0}", actual)
+	}
+	s, err = ParseAssembly(strings.NewReader("%captures 0\nRECOVER .L0, 1\nRET\n.L0:\nEND"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	x := s.Exec(nil)
+	if err := x.Run(); err == nil || !strings.Contains(err.Error(), ErrRecoverFrame.Error()) {
+		t.Errorf("%s: expected %v, got %v", t.Name(), ErrRecoverFrame, err)
+	}
+}
+
+func TestExecution_BehindB(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	// ..(?<=ab)c
+	p, err := ParseAssembly(strings.NewReader(`%captures 1
+%literal "ab"
+	ANYB 2
+	BCAP 0
+	BEHINDB .ab, 2
+	SAMEB 'c'
+	ECAP 0
+	END
+.ab:
+	LITB 0
+	RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if err := p.VerifyStack(); err != nil {
+		t.Fatalf("%s: VerifyStack: %v", t.Name(), err)
+	}
+	q := *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	data := []testrow{
+		testrow{"abc", "{true [0:{(2,3) [(2,3)]}]}"},
+		testrow{"xbc", "{false}"},
+		testrow{"abd", "{false}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	// A subroutine that runs past DP does not match.
+	r, err := ParseAssembly(strings.NewReader("%captures 0\n%literal \"ab\"\nANYB\nBEHINDB .L0, 1\nEND\n.L0:\nLITB 0\nRET"))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	if actual := r.Match([]byte("ab")).String(); actual != "{false}" {
+		t.Errorf("%s: expected overlong lookbehind to fail, got %s", t.Name(), actual)
+	}
+
+	// (?<!a)b, where the lookbehind at 0 fails for want of input.
+	p, err = ParseAssembly(strings.NewReader(`%captures 0
+.loop:
+	CHOICE .L0
+	BEHINDB .a, 1
+	FAIL2X
+.L0:
+	TSAMEB .next, 'b'
+	END
+.next:
+	ANYB
+	JMP .loop
+.a:
+	SAMEB 'a'
+	RET
+`))
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	q = *p
+	if err := q.CompileJIT(); err != nil {
+		t.Fatalf("%s: CompileJIT: %v", t.Name(), err)
+	}
+
+	data = []testrow{
+		testrow{"b", "{true []}"},
+		testrow{"xb", "{true []}"},
+		testrow{"ab", "{false}"},
+		testrow{"aab", "{false}"},
+		testrow{"xxb", "{true []}"},
+	}
+
+	for i, row := range data {
+		if actual := p.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		if actual := q.Match([]byte(row.Input)).String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: JIT: expected %s, got %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		r, err := p.MatchReader(iotest.OneByteReader(strings.NewReader(row.Input)))
+		if err != nil || r.String() != row.Expected {
+			t.Errorf("%s/%03d: %q: MatchReader: expected %s, got %v, %v", t.Name(), i, row.Input, row.Expected, r, err)
+		}
+	}
+	if _, ok := p.trimSlack(); ok {
+		t.Errorf("%s: expected trimSlack to be false", t.Name())
+	}
+}
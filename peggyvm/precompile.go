@@ -0,0 +1,60 @@
+package peggyvm
+
+// decodedCode is the instruction cache built by Program.Precompile.
+type decodedCode struct {
+	// ops holds every instruction, in order of XP.
+	ops []Op
+
+	// index maps the XP of each instruction to its index in ops.
+	index map[uint64]int
+
+	// skip finds the positions worth trying in Search.
+	skip *skipper
+}
+
+// Precompile decodes the program's bytecode once, so that executions can
+// fetch each instruction from the cache instead of decoding it again on
+// every Step. It also computes the first-byte set used by Search. It returns
+// an error, and leaves the program as it was, if the bytecode cannot be
+// decoded.
+//
+// The cache is not updated to match later changes to p.Bytes or to the set
+// of registered extension opcodes; call Precompile again after making any.
+// Jumps into the middle of an instruction, which the cache cannot serve,
+// still work: the bytecode is decoded at that XP, as without the cache.
+//
+func (p *Program) Precompile() error {
+	code := &decodedCode{index: make(map[uint64]int)}
+	it := p.Instructions()
+	for it.Next() {
+		code.index[it.XP()] = len(code.ops)
+		code.ops = append(code.ops, *it.Op())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	skip, err := p.newSkipper()
+	if err != nil {
+		return err
+	}
+	code.skip = skip
+	p.code = code
+	return nil
+}
+
+// IsPrecompiled returns true iff Precompile has been called successfully.
+func (p *Program) IsPrecompiled() bool {
+	return p.code != nil
+}
+
+// fetch decodes the instruction at xp into op, using the instruction cache
+// if there is one.
+func (p *Program) fetch(op *Op, xp uint64) error {
+	if p.code != nil {
+		if i, found := p.code.index[xp]; found {
+			*op = p.code.ops[i]
+			return nil
+		}
+	}
+	return op.Decode(p.Bytes, xp)
+}
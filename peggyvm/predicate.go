@@ -0,0 +1,38 @@
+package peggyvm
+
+// Predicate is a Go callback that the PRED instruction consults, for checks
+// that a PEG cannot express, such as whether a length field just matched
+// equals the number of bytes that remain. It is passed the whole input and
+// the current data position, and returns true to let the match continue or
+// false to fail. It must not modify the input, and should not depend on
+// anything but its arguments, since the VM may call it again after
+// backtracking.
+type Predicate func(input []byte, dp uint64) bool
+
+// AddPredicate appends fn to the program's predicates, and returns its index,
+// for use as the immediate of PRED. Being code, predicates are not
+// serialized: a Program that is decoded from bytes has none, and the same
+// functions must be added again, in the same order, before it is run.
+func (p *Program) AddPredicate(fn Predicate) uint64 {
+	p.predicates = append(p.predicates, fn)
+	return uint64(len(p.predicates) - 1)
+}
+
+// Predicates returns the program's predicates, indexed as by PRED.
+func (p *Program) Predicates() []Predicate {
+	return p.predicates
+}
+
+func execPRED(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.predicates)) {
+		return ErrIndexRange
+	}
+	input := x.I
+	if x.In != nil {
+		input = x.In.Slice(0, x.In.Len())
+	}
+	if !x.P.predicates[op.Imm0](input, x.DP-x.base) {
+		x.fail()
+	}
+	return nil
+}
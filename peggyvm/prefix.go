@@ -0,0 +1,274 @@
+package peggyvm
+
+import (
+	"bytes"
+	"sort"
+)
+
+const (
+	// maxPrefixLen caps the length of each prefix found by RequiredPrefixes.
+	maxPrefixLen = 256
+
+	// maxPrefixSteps caps the number of instructions that RequiredPrefixes
+	// will examine before giving up.
+	maxPrefixSteps = 1 << 16
+)
+
+// RequiredPrefixes returns a set of at most limit byte strings, such that
+// every successful match that begins at XP 0 begins with one of them. It
+// returns nil if no such set can be found: if the pattern can begin with a
+// byte that is not part of a literal, if there would be more than limit
+// prefixes, or if the program is too large to analyze.
+//
+// Unanchored searches can use the prefixes to skip ahead with bytes.Index,
+// instead of trying the match at every position.
+//
+// The prefixes are found by following each path through the code from XP 0,
+// collecting the bytes matched by SAMEB, LITB, SAMER, and single-byte
+// MATCHB, until it reaches an instruction that matches something else.
+// Paths that end in FAIL or FAIL2X are ignored. No prefix is a prefix of
+// another, and the result is sorted.
+func (p *Program) RequiredPrefixes(limit int) ([][]byte, error) {
+	var ops []Op
+	index := make(map[uint64]int)
+	it := p.Instructions()
+	for it.Next() {
+		index[it.XP()] = len(ops)
+		ops = append(ops, *it.Op())
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	end := it.XP()
+
+	w := &prefixWalker{
+		p:     p,
+		ops:   ops,
+		index: index,
+		end:   end,
+		limit: limit,
+		seen:  make(map[string]struct{}),
+	}
+	if err := w.walk(0, nil, nil); err != nil {
+		return nil, err
+	}
+	if w.giveUp {
+		return nil, nil
+	}
+	return w.result(), nil
+}
+
+// RequiredPrefix returns the longest byte string with which every successful
+// match that begins at XP 0 must begin. This is the longest common prefix of
+// the result of RequiredPrefixes, with a generous limit.
+func (p *Program) RequiredPrefix() ([]byte, error) {
+	list, err := p.RequiredPrefixes(64)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	prefix := list[0]
+	for _, candidate := range list[1:] {
+		n := 0
+		for n < len(prefix) && n < len(candidate) && prefix[n] == candidate[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	if len(prefix) == 0 {
+		return nil, nil
+	}
+	return prefix, nil
+}
+
+type prefixWalker struct {
+	p      *Program
+	ops    []Op
+	index  map[uint64]int
+	end    uint64
+	limit  int
+	steps  int
+	found  [][]byte
+	seen   map[string]struct{}
+	giveUp bool
+}
+
+// emit records acc as the prefix of a path that may succeed.
+func (w *prefixWalker) emit(acc []byte) {
+	if _, dupe := w.seen[string(acc)]; dupe {
+		return
+	}
+	if len(acc) == 0 || len(w.found) >= w.limit {
+		w.giveUp = true
+		return
+	}
+	w.seen[string(acc)] = struct{}{}
+	w.found = append(w.found, append([]byte(nil), acc...))
+}
+
+// walk follows the path from xp, having matched acc so far, with the return
+// addresses of the pending CALLs in calls. Paths are walked one at a time,
+// so the two sides of a fork may safely share the backing arrays of acc and
+// calls.
+func (w *prefixWalker) walk(xp uint64, acc []byte, calls []uint64) error {
+	for !w.giveUp {
+		w.steps++
+		if w.steps > maxPrefixSteps {
+			w.giveUp = true
+			return nil
+		}
+		if len(acc) >= maxPrefixLen {
+			w.emit(acc)
+			return nil
+		}
+		i, found := w.index[xp]
+		if !found {
+			// The end of the code: the match succeeds.
+			w.emit(acc)
+			return nil
+		}
+		op := &w.ops[i]
+		next := xp + uint64(op.Len)
+		target, _, err := opTarget(op, w.end)
+		if err != nil {
+			return err
+		}
+
+		switch op.Code {
+		case OpNOP, OpFCAP, OpBCAP, OpECAP:
+			xp = next
+
+		case OpSAMEB:
+			for n := uint64(0); n < op.Imm1 && len(acc) < maxPrefixLen; n++ {
+				acc = append(acc, byte(op.Imm0))
+			}
+			xp = next
+
+		case OpSAMER:
+			acc = append(acc, string(rune(op.Imm0))...)
+			xp = next
+
+		case OpLITB:
+			lit, ok := w.literal(op.Imm0)
+			if !ok {
+				w.emit(acc)
+				return nil
+			}
+			acc = append(acc, lit...)
+			xp = next
+
+		case OpMATCHB:
+			b, ok := w.singleByte(op.Imm0)
+			if !ok || op.Imm1 == 0 {
+				w.emit(acc)
+				return nil
+			}
+			for n := uint64(0); n < op.Imm1 && len(acc) < maxPrefixLen; n++ {
+				acc = append(acc, b)
+			}
+			xp = next
+
+		case OpTSAMEB, OpTLITB:
+			// Either the test succeeds and matches more bytes, or it
+			// fails and jumps to the target, having matched nothing.
+			if err := w.walk(target, acc, calls); err != nil {
+				return err
+			}
+			if op.Code == OpTSAMEB {
+				for n := uint64(0); n < op.Imm2 && len(acc) < maxPrefixLen; n++ {
+					acc = append(acc, byte(op.Imm1))
+				}
+			} else {
+				lit, ok := w.literal(op.Imm1)
+				if !ok {
+					w.emit(acc)
+					return nil
+				}
+				acc = append(acc, lit...)
+			}
+			xp = next
+
+		case OpCHOICE, OpPCOMMIT:
+			if err := w.walk(target, acc, calls); err != nil {
+				return err
+			}
+			xp = next
+
+		case OpJMP, OpCOMMIT, OpDCOMMIT:
+			xp = target
+
+		case OpDISPATCH:
+			if op.Imm0 >= uint64(len(w.p.JumpTables)) {
+				w.emit(acc)
+				return nil
+			}
+			for _, t := range w.p.JumpTables[op.Imm0].distinctTargets() {
+				if err := w.walk(t, acc, calls); err != nil {
+					return err
+				}
+			}
+			return nil
+
+		case OpCALL:
+			calls = append(calls, next)
+			xp = target
+
+		case OpRET:
+			if len(calls) == 0 {
+				w.emit(acc)
+				return nil
+			}
+			xp = calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+
+		case OpFAIL, OpFAIL2X, OpGIVEUP, OpTHROW:
+			// THROW fails too, as a RECOVER frame would have stopped
+			// the walk before it.
+			return nil
+
+		default:
+			// END, BCOMMIT (which rewinds the input), and anything
+			// that matches more than a single known byte.
+			w.emit(acc)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (w *prefixWalker) literal(idx uint64) ([]byte, bool) {
+	if idx >= uint64(len(w.p.Literals)) {
+		return nil, false
+	}
+	return w.p.Literals[idx], true
+}
+
+func (w *prefixWalker) singleByte(idx uint64) (byte, bool) {
+	if idx >= uint64(len(w.p.ByteSets)) {
+		return 0, false
+	}
+	var list []byte
+	w.p.ByteSets[idx].ForEach(func(b byte) {
+		list = append(list, b)
+	})
+	if len(list) != 1 {
+		return 0, false
+	}
+	return list[0], true
+}
+
+// result returns the prefixes found, sorted, without duplicates, and without
+// any prefix that has another as its own prefix.
+func (w *prefixWalker) result() [][]byte {
+	list := w.found
+	sort.Slice(list, func(i, j int) bool {
+		return bytes.Compare(list[i], list[j]) < 0
+	})
+	var out [][]byte
+	for _, item := range list {
+		if n := len(out); n != 0 && bytes.HasPrefix(item, out[n-1]) {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out
+}
@@ -0,0 +1,245 @@
+package peggyvm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// ProfileEntry is one line of a profile: how many times some instructions
+// were executed, and the time spent executing them.
+type ProfileEntry struct {
+	Count uint64
+	Time  time.Duration
+}
+
+// Profiler is an Observer that counts the instructions executed, by opcode
+// and by address, and measures the time spent in each, so that grammar
+// authors can find the alternatives where a match spends its time. The time
+// charged to an instruction runs from its OnStep to the next one, so it
+// includes the cost of the Observer itself; compare entries with each other,
+// not with an unprofiled run.
+//
+// One Profiler may accumulate the counts of many executions, one at a time.
+// Call Stop after each one, so that its last instruction is charged for its
+// time, and not for the time until the next execution begins. Match does
+// this for you.
+//
+// All callbacks are also passed on to Next, if it is not nil.
+//
+type Profiler struct {
+	// ByOp holds the entries for each opcode, and ByXP those for each
+	// instruction address.
+	ByOp map[OpCode]*ProfileEntry
+	ByXP map[uint64]*ProfileEntry
+
+	// Next is the Observer being wrapped, or nil.
+	Next Observer
+
+	// last is the entry of each kind for the instruction being timed, which
+	// began at lastTime; they are nil if no instruction is being timed.
+	lastOp   *ProfileEntry
+	lastXP   *ProfileEntry
+	lastTime time.Time
+
+	// now returns the current time. It is replaced by tests.
+	now func() time.Time
+}
+
+var _ Observer = (*Profiler)(nil)
+
+// NewProfiler returns an empty Profiler.
+func NewProfiler() *Profiler {
+	return &Profiler{
+		ByOp: make(map[OpCode]*ProfileEntry),
+		ByXP: make(map[uint64]*ProfileEntry),
+		now:  time.Now,
+	}
+}
+
+func (prof *Profiler) OnStep(x *Execution, op *Op) {
+	t := prof.now()
+	prof.charge(t)
+	prof.lastOp = prof.ByOp[op.Code]
+	if prof.lastOp == nil {
+		prof.lastOp = &ProfileEntry{}
+		prof.ByOp[op.Code] = prof.lastOp
+	}
+	prof.lastXP = prof.ByXP[op.XP]
+	if prof.lastXP == nil {
+		prof.lastXP = &ProfileEntry{}
+		prof.ByXP[op.XP] = prof.lastXP
+	}
+	prof.lastOp.Count++
+	prof.lastXP.Count++
+	prof.lastTime = t
+	if prof.Next != nil {
+		prof.Next.OnStep(x, op)
+	}
+}
+
+func (prof *Profiler) OnChoicePush(x *Execution, op *Op) {
+	if prof.Next != nil {
+		prof.Next.OnChoicePush(x, op)
+	}
+}
+
+func (prof *Profiler) OnFail(x *Execution, op *Op) {
+	if prof.Next != nil {
+		prof.Next.OnFail(x, op)
+	}
+}
+
+func (prof *Profiler) OnCaptureCommit(x *Execution, op *Op, a Assignment) {
+	if prof.Next != nil {
+		prof.Next.OnCaptureCommit(x, op, a)
+	}
+}
+
+func (prof *Profiler) OnCall(x *Execution, op *Op) {
+	if prof.Next != nil {
+		prof.Next.OnCall(x, op)
+	}
+}
+
+// charge charges the instruction being timed, if any, for the time until t.
+func (prof *Profiler) charge(t time.Time) {
+	if prof.lastOp == nil {
+		return
+	}
+	d := t.Sub(prof.lastTime)
+	prof.lastOp.Time += d
+	prof.lastXP.Time += d
+	prof.lastOp, prof.lastXP = nil, nil
+}
+
+// Stop charges the last instruction executed for the time since it began.
+// Call it once the Execution being profiled has halted.
+func (prof *Profiler) Stop() {
+	prof.charge(prof.now())
+}
+
+// Profile starts profiling the Execution, by wrapping its Observer in a new
+// Profiler, and returns the Profiler. Call its Stop method once the
+// Execution has halted.
+func (x *Execution) Profile() *Profiler {
+	prof := NewProfiler()
+	prof.Next = x.Observer
+	x.Observer = prof
+	return prof
+}
+
+// Match is like p.Match, but profiles the execution, adding to the counts
+// already accumulated.
+func (prof *Profiler) Match(p *Program, input []byte) Result {
+	x := p.Exec(input)
+	defer x.release()
+	x.Observer = prof
+	err := x.Run()
+	prof.Stop()
+	if err != nil {
+		panic(err)
+	}
+	return x.Result()
+}
+
+// Total returns the sum of all the entries.
+func (prof *Profiler) Total() ProfileEntry {
+	var total ProfileEntry
+	for _, e := range prof.ByOp {
+		total.Count += e.Count
+		total.Time += e.Time
+	}
+	return total
+}
+
+// ByLabel sums the entries of ByXP by the nearest label at or before each
+// address, as Program.Symbolize would name it, so that the instructions of
+// each rule or alternative are counted together. Addresses that no label
+// precedes are counted under "".
+func (prof *Profiler) ByLabel(p *Program) map[string]*ProfileEntry {
+	out := make(map[string]*ProfileEntry)
+	for xp, e := range prof.ByXP {
+		name := ""
+		i := sort.Search(len(p.Labels), func(i int) bool {
+			return p.Labels[i].Offset > xp
+		})
+		if i > 0 {
+			name = p.FindLabel(p.Labels[i-1].Offset).Name
+		}
+		sum := out[name]
+		if sum == nil {
+			sum = &ProfileEntry{}
+			out[name] = sum
+		}
+		sum.Count += e.Count
+		sum.Time += e.Time
+	}
+	return out
+}
+
+// WriteReport writes the profile as two tables, by opcode and by label (see
+// ByLabel), for the program p that was profiled. Each is sorted by time,
+// then by count, most first:
+//
+//   OPCODE  COUNT  TIME     %TIME
+//   SPANB   1200   150µs    41.7
+//   ...
+//
+//   LABEL   COUNT  TIME     %TIME
+//   .L3     2400   200µs    55.6
+//   ...
+//
+func (prof *Profiler) WriteReport(w io.Writer, p *Program) (int, error) {
+	total := prof.Total()
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+
+	ops := make([]string, 0, len(prof.ByOp))
+	byName := make(map[string]*ProfileEntry, len(prof.ByOp))
+	for code, e := range prof.ByOp {
+		name := code.String()
+		ops = append(ops, name)
+		byName[name] = e
+	}
+	writeProfileTable(tw, "OPCODE", ops, byName, total.Time)
+	fmt.Fprintln(tw)
+
+	byLabel := prof.ByLabel(p)
+	labels := make([]string, 0, len(byLabel))
+	for name := range byLabel {
+		labels = append(labels, name)
+	}
+	writeProfileTable(tw, "LABEL", labels, byLabel, total.Time)
+
+	tw.Flush()
+	return w.Write(buf.Bytes())
+}
+
+func writeProfileTable(w io.Writer, heading string, names []string, entries map[string]*ProfileEntry, total time.Duration) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := entries[names[i]], entries[names[j]]
+		if a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(w, "%s\tCOUNT\tTIME\t%%TIME\n", heading)
+	for _, name := range names {
+		e := entries[name]
+		pct := 0.0
+		if total > 0 {
+			pct = 100 * float64(e.Time) / float64(total)
+		}
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%v\t%.1f\n", name, e.Count, e.Time, pct)
+	}
+}
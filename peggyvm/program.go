@@ -2,12 +2,15 @@ package peggyvm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"sort"
+	"time"
 	"unicode/utf8"
 
 	"github.com/chronos-tachyon/go-peggy/byteset"
+	"github.com/chronos-tachyon/go-peggy/runeset"
 )
 
 // Program is a PEG pattern that has been compiled to bytecode.
@@ -23,6 +26,18 @@ type Program struct {
 	// MATCHB / TMATCHB / SPANB family of instructions.
 	ByteSets []byteset.Matcher
 
+	// DFAs is a list of automata for regular sub-patterns, referenced by
+	// the DFAB instruction.
+	DFAs []*DFA
+
+	// RuneSets is a list of matchers for rune sets, referenced by the
+	// MATCHR / TMATCHR / SPANR family of instructions.
+	RuneSets []runeset.Matcher
+
+	// JumpTables is a list of jump tables, referenced by the DISPATCH
+	// instruction.
+	JumpTables []JumpTable
+
 	// Captures is the list of all captures.
 	//
 	// - The whole match is always capture index 0.
@@ -39,11 +54,46 @@ type Program struct {
 
 	// LabelsByName is an index from Label.Name to Label.
 	LabelsByName map[string]*Label
+
+	// Entries lists the public labels at which ExecEntry may start
+	// execution, in addition to offset 0.
+	Entries []*Label
+
+	// Debug is the debug section: the source position of each instruction
+	// that has one, sorted by XP.
+	Debug []DebugEntry
+
+	// Limits is copied to each Execution of the program, which enforces
+	// it. It is set by LoadUntrusted, and is not serialized.
+	Limits Limits
+
+	// HistorySize is passed to Execution.KeepHistory by Exec. It is not
+	// serialized.
+	HistorySize int
+
+	// KeepStats, if true, makes Exec call Execution.KeepStats, so that
+	// each Result has Stats. It is not serialized.
+	KeepStats bool
+
+	// code is the instruction cache, if Precompile has been called.
+	code *decodedCode
+
+	// jit is the closure code, if CompileJIT has been called.
+	jit *jitCode
+
+	// predicates is the list of Go callbacks referenced by the PRED
+	// instruction. It is unexported because encoding/gob rejects types
+	// with exported fields of func type; see AddPredicate.
+	predicates []Predicate
+
+	// folders is the list of Go callbacks referenced by the VFOLD
+	// instruction, unexported for the same reason; see AddFolder.
+	folders []Folder
 }
 
 // FindLabel returns the best available label for the given code address. If no
 // labels are defined for that code address, then a synthetic local label is
-// returned.
+// returned; see MaterializeLabels to keep it.
 func (p *Program) FindLabel(xp uint64) *Label {
 	i := sort.Search(len(p.Labels), func(i int) bool {
 		return p.Labels[i].Offset >= xp
@@ -58,66 +108,297 @@ func (p *Program) FindLabel(xp uint64) *Label {
 	}
 }
 
+// MaterializeLabels records in p.Labels the synthetic label that FindLabel
+// would otherwise fabricate anew for each jump target that lacks a label.
+// Afterward, disassembly, symbolization, and DOT output all refer to these
+// targets by the same names, even if the code is later changed. It returns
+// the number of labels added; calling it again adds none.
+func (p *Program) MaterializeLabels() (int, error) {
+	end := uint64(len(p.Bytes))
+	targets := make(map[uint64]struct{})
+	it := p.Instructions()
+	for it.Next() {
+		target, hasTarget, err := opTarget(it.Op(), end)
+		if err != nil {
+			return 0, p.annotate(err)
+		}
+		if hasTarget {
+			targets[target] = struct{}{}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+
+	if p.LabelsByName == nil {
+		p.LabelsByName = make(map[string]*Label)
+	}
+	var added int
+	for xp := range targets {
+		label := p.FindLabel(xp)
+		if _, found := p.LabelsByName[label.Name]; found {
+			continue
+		}
+		p.Labels = append(p.Labels, label)
+		p.LabelsByName[label.Name] = label
+		added++
+	}
+	if added != 0 {
+		sort.Sort(Labels(p.Labels))
+	}
+	return added, nil
+}
+
+// Symbolize returns a name for the code address xp that is meaningful to a
+// human reader: the name of the nearest label at or before xp, followed by
+// the distance from it in hex, such as ".L0+0x7". The distance is omitted if
+// xp is itself labeled. If no label precedes xp, the result is just xp in hex.
+func (p *Program) Symbolize(xp uint64) string {
+	i := sort.Search(len(p.Labels), func(i int) bool {
+		return p.Labels[i].Offset > xp
+	})
+	if i == 0 {
+		return fmt.Sprintf("%#x", xp)
+	}
+	label := p.FindLabel(p.Labels[i-1].Offset)
+	if label.Offset == xp {
+		return label.Name
+	}
+	return fmt.Sprintf("%s+%#x", label.Name, xp-label.Offset)
+}
+
+// annotate fills in the Symbol field of err, if it is one of the error types
+// that report a code address, and returns it.
+func (p *Program) annotate(err error) error {
+	switch e := err.(type) {
+	case *DisassembleError:
+		if e.Symbol == "" {
+			e.Symbol = p.Symbolize(e.XP)
+		}
+	case *VerifyError:
+		if e.Symbol == "" {
+			e.Symbol = p.Symbolize(e.XP)
+		}
+	case *RuntimeError:
+		if e.Symbol == "" {
+			e.Symbol = p.Symbolize(e.XP)
+		}
+	}
+	return err
+}
+
 // Disassemble converts the program's bytecode into assembly instructions,
 // writing the result to the provided buffer.
 //
+// The output is accepted by ParseAssembly. Every label in p.Labels is written
+// out, as is a synthetic label for any jump target that lacks one, so that
+// reassembling the output reproduces the same Program. The round trip is
+// byte-identical for any Program built by Assembler; for other Programs it
+// yields the canonical form, in which each immediate uses its shortest
+// encoding, optional immediates equal to their defaults are omitted, and a
+// label is public iff its name does not begin with '.'.
+//
 func (p *Program) Disassemble(w io.Writer) (int, error) {
+	return p.DisassembleWithOptions(w, DisassembleOptions{})
+}
+
+// LabelStyle selects how DisassembleWithOptions writes labels.
+type LabelStyle uint8
+
+const (
+	// LabelsOnOwnLine writes each label on a line by itself, before the
+	// instruction that it labels.
+	LabelsOnOwnLine LabelStyle = iota
+
+	// LabelsInline writes a label in a column of its own, on the same line
+	// as the instruction that it labels. If several labels share an
+	// instruction, all but the last are written on lines by themselves.
+	LabelsInline
+)
+
+// DisassembleOptions controls the format of DisassembleWithOptions. The zero
+// value yields the same output as Disassemble.
+type DisassembleOptions struct {
+	// ShowOffsets prefixes each instruction with its code address, in hex.
+	ShowOffsets bool
+
+	// ShowBytes prefixes each instruction with its encoded bytes, in hex.
+	ShowBytes bool
+
+	// TabWidth, if positive, expands tabs into spaces, with a tab stop
+	// every TabWidth columns.
+	TabWidth int
+
+	// LabelStyle selects how labels are written.
+	LabelStyle LabelStyle
+}
+
+// DisassembleWithOptions is like Disassemble, but formats the listing as
+// directed by opts. For example, with ShowOffsets, ShowBytes, and
+// LabelsInline, the listing looks like this:
+//
+//   000 ac 40 00       BCAP 0
+//   003 14 07     .L0: CHOICE .L1 <.+7>
+//   005 64 00          LITB 0
+//
+// Output that shows offsets or bytes is not accepted by ParseAssembly.
+//
+func (p *Program) DisassembleWithOptions(w io.Writer, opts DisassembleOptions) (int, error) {
+	n, err := p.disassemble(w, opts, 0, allbits, true)
+	return n, p.annotate(err)
+}
+
+// DisassembleRange is like Disassemble, but only writes the instructions that
+// start at code addresses in the range [startXP, endXP), along with their
+// labels. The directives that describe literals, captures, and so on are
+// omitted. Labels that point just past the last instruction are written iff
+// endXP is at least the length of the code.
+//
+// It is an error if startXP is not the start of an instruction.
+//
+func (p *Program) DisassembleRange(w io.Writer, startXP, endXP uint64) (int, error) {
+	n, err := p.disassemble(w, DisassembleOptions{}, startXP, endXP, false)
+	return n, p.annotate(err)
+}
+
+// DisassembleAt returns the instruction that starts at code address xp,
+// formatted as in Disassemble but without labels or indentation. For
+// example, "CHOICE .L1 <.+7>".
+func (p *Program) DisassembleAt(xp uint64) (string, error) {
+	var op Op
+	err := op.Decode(p.Bytes, xp)
+	if err == io.EOF {
+		err = &DisassembleError{Err: ErrCodeOffsetRange, XP: xp}
+	}
+	if err != nil {
+		return "", p.annotate(err)
+	}
+	var buf bytes.Buffer
+	p.writeOp(&buf, &op, xp+uint64(op.Len))
+	return buf.String(), nil
+}
+
+func (p *Program) disassemble(w io.Writer, opts DisassembleOptions, startXP, endXP uint64, header bool) (int, error) {
 	var buf bytes.Buffer
 	var total int
 
 	flush := func() error {
+		if opts.TabWidth > 0 {
+			expanded := expandTabs(buf.Bytes(), opts.TabWidth)
+			buf.Reset()
+			buf.Write(expanded)
+		}
 		n, err := w.Write(buf.Bytes())
 		total += n
 		buf.Reset()
 		return err
 	}
 
-	for _, literal := range p.Literals {
-		buf.WriteString("%literal ")
-		if utf8.Valid(literal) {
-			fmt.Fprintf(&buf, "%q", literal)
-		} else {
-			first := true
-			for _, b := range literal {
-				if !first {
+	if header {
+		for _, literal := range p.Literals {
+			buf.WriteString("%literal ")
+			if utf8.Valid(literal) {
+				fmt.Fprintf(&buf, "%q", literal)
+			} else {
+				first := true
+				for _, b := range literal {
+					if !first {
+						buf.WriteByte(',')
+						buf.WriteByte(' ')
+					}
+					fmt.Fprintf(&buf, "0x%02x", b)
+					first = false
+				}
+			}
+			buf.WriteByte('\n')
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+
+		for _, matcher := range p.ByteSets {
+			buf.WriteString("%matcher ")
+			buf.WriteString(matcher.String())
+			buf.WriteByte('\n')
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+
+		for _, set := range p.RuneSets {
+			buf.WriteString("%runeset ")
+			buf.WriteString(set.String())
+			buf.WriteByte('\n')
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+
+		for _, table := range p.JumpTables {
+			buf.WriteString("%jumptable")
+			for i, key := range table.Keys {
+				if i != 0 {
+					buf.WriteByte(',')
+				}
+				fmt.Fprintf(&buf, " 0x%02x %s", key, p.FindLabel(table.Targets[i]).Name)
+			}
+			buf.WriteByte('\n')
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+
+		for _, dfa := range p.DFAs {
+			raw, _ := dfa.MarshalBinary()
+			buf.WriteString("%dfa ")
+			for i, b := range raw {
+				if i != 0 {
 					buf.WriteByte(',')
 					buf.WriteByte(' ')
 				}
 				fmt.Fprintf(&buf, "0x%02x", b)
-				first = false
+			}
+			buf.WriteByte('\n')
+			if err := flush(); err != nil {
+				return total, err
 			}
 		}
-		buf.WriteByte('\n')
-		if err := flush(); err != nil {
-			return total, err
-		}
-	}
 
-	for _, matcher := range p.ByteSets {
-		buf.WriteString("%matcher ")
-		buf.WriteString(matcher.String())
-		buf.WriteByte('\n')
+		fmt.Fprintf(&buf, "%%captures %d\n", len(p.Captures))
 		if err := flush(); err != nil {
 			return total, err
 		}
-	}
-
-	fmt.Fprintf(&buf, "%%captures %d\n", len(p.Captures))
-	if err := flush(); err != nil {
-		return total, err
-	}
-	for i, capture := range p.Captures {
-		if capture.Name != "" {
-			fmt.Fprintf(&buf, "%%namedcapture %d %q\n", i, capture.Name)
+		for i, capture := range p.Captures {
+			if capture.Name != "" {
+				fmt.Fprintf(&buf, "%%namedcapture %d %q\n", i, capture.Name)
+				if err := flush(); err != nil {
+					return total, err
+				}
+			}
+			if capture.Repeat {
+				fmt.Fprintf(&buf, "%%repeatcapture %d\n", i)
+				if err := flush(); err != nil {
+					return total, err
+				}
+			}
+			if capture.Kind != KindNone {
+				fmt.Fprintf(&buf, "%%capturekind %d %s\n", i, capture.Kind)
+				if err := flush(); err != nil {
+					return total, err
+				}
+			}
+		}
+		for _, label := range p.Entries {
+			fmt.Fprintf(&buf, "%%entry %s\n", label.Name)
 			if err := flush(); err != nil {
 				return total, err
 			}
 		}
-	}
 
-	buf.WriteByte('\n')
-	if err := flush(); err != nil {
-		return total, err
+		buf.WriteByte('\n')
+		if err := flush(); err != nil {
+			return total, err
+		}
 	}
 
 	var op Op
@@ -125,7 +406,12 @@ func (p *Program) Disassemble(w io.Writer) (int, error) {
 
 	// First pass: identify code offsets that need labels
 	var labelNeeded = make(map[uint64]struct{})
+	var maxLen uint
+	startFound := false
 	for {
+		if xp == startXP {
+			startFound = true
+		}
 		err := op.Decode(p.Bytes, xp)
 		if err == io.EOF {
 			break
@@ -133,6 +419,9 @@ func (p *Program) Disassemble(w io.Writer) (int, error) {
 		if err != nil {
 			return total, err
 		}
+		if op.Len > maxLen {
+			maxLen = op.Len
+		}
 
 		meta := op.Meta
 		if meta == nil {
@@ -141,22 +430,80 @@ func (p *Program) Disassemble(w io.Writer) (int, error) {
 
 		xp += uint64(op.Len)
 		if meta.Imm0.Type == ImmCodeOffset {
-			target := addOffset(xp, u2s(op.Imm0))
-			labelNeeded[target] = struct{}{}
+			if target, ok := tryAddOffset(xp, u2s(op.Imm0)); ok {
+				labelNeeded[target] = struct{}{}
+			}
 		}
 		if meta.Imm1.Type == ImmCodeOffset {
-			target := addOffset(xp, u2s(op.Imm1))
-			labelNeeded[target] = struct{}{}
+			if target, ok := tryAddOffset(xp, u2s(op.Imm1)); ok {
+				labelNeeded[target] = struct{}{}
+			}
 		}
 		if meta.Imm2.Type == ImmCodeOffset {
-			target := addOffset(xp, u2s(op.Imm2))
+			if target, ok := tryAddOffset(xp, u2s(op.Imm2)); ok {
+				labelNeeded[target] = struct{}{}
+			}
+		}
+	}
+
+	for _, table := range p.JumpTables {
+		for _, target := range table.Targets {
 			labelNeeded[target] = struct{}{}
 		}
 	}
 
+	labelsAt := make(map[uint64][]*Label, len(p.Labels))
+	for _, label := range p.Labels {
+		labelsAt[label.Offset] = append(labelsAt[label.Offset], label)
+	}
+	labelsFor := func(xp uint64) []*Label {
+		list := labelsAt[xp]
+		if _, yes := labelNeeded[xp]; yes && len(list) == 0 {
+			list = []*Label{p.FindLabel(xp)}
+		}
+		return list
+	}
+	writeLabels := func(list []*Label) error {
+		for _, label := range list {
+			buf.WriteString(label.Name)
+			buf.WriteByte(':')
+			buf.WriteByte('\n')
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var labelWidth int
+	if opts.LabelStyle == LabelsInline {
+		for _, label := range p.Labels {
+			if n := len(label.Name) + 1; n > labelWidth {
+				labelWidth = n
+			}
+		}
+		for xp := range labelNeeded {
+			if n := len(p.FindLabel(xp).Name) + 1; n > labelWidth {
+				labelWidth = n
+			}
+		}
+	}
+
+	if !startFound {
+		if startXP > xp {
+			return total, &DisassembleError{Err: ErrCodeOffsetRange, XP: startXP}
+		}
+		return total, &DisassembleError{Err: ErrMisalignedTarget, XP: startXP}
+	}
+
+	offsetWidth := len(fmt.Sprintf("%x", len(p.Bytes)))
+	if offsetWidth < 3 {
+		offsetWidth = 3
+	}
+
 	// Second pass: generate actual disassembly listing
-	xp = 0
-	for {
+	xp = startXP
+	for xp < endXP {
 		err := op.Decode(p.Bytes, xp)
 		if err == io.EOF {
 			break
@@ -165,29 +512,86 @@ func (p *Program) Disassemble(w io.Writer) (int, error) {
 			return total, err
 		}
 
-		if _, yes := labelNeeded[xp]; yes {
-			label := p.FindLabel(xp)
-			if label != nil {
-				buf.WriteString(label.Name)
-				buf.WriteByte(':')
-				buf.WriteByte('\n')
-				if err := flush(); err != nil {
-					return total, err
+		list := labelsFor(xp)
+		var inline *Label
+		if opts.LabelStyle == LabelsInline && len(list) != 0 {
+			inline = list[len(list)-1]
+			list = list[:len(list)-1]
+		}
+		if err := writeLabels(list); err != nil {
+			return total, err
+		}
+
+		if opts.ShowOffsets {
+			fmt.Fprintf(&buf, "%0*x ", offsetWidth, xp)
+		}
+		if opts.ShowBytes {
+			for i := uint(0); i < maxLen; i++ {
+				if i < op.Len {
+					fmt.Fprintf(&buf, "%02x ", p.Bytes[xp+uint64(i)])
+				} else {
+					buf.WriteString("   ")
 				}
 			}
 		}
+		hasPrefix := opts.ShowOffsets || opts.ShowBytes
+		if hasPrefix {
+			buf.WriteByte(' ')
+		}
+		if opts.LabelStyle == LabelsInline {
+			var name string
+			if inline != nil {
+				name = inline.Name + ":"
+			}
+			fmt.Fprintf(&buf, "%-*s ", labelWidth, name)
+		} else if !hasPrefix {
+			buf.WriteByte('\t')
+		}
 
+		pos, hasPos := p.SourcePos(xp)
 		xp += uint64(op.Len)
-		buf.WriteByte('\t')
 		p.writeOp(&buf, &op, xp)
+		if hasPos {
+			buf.WriteString("\t; ")
+			buf.WriteString(pos.String())
+		}
 		buf.WriteByte('\n')
 		if err := flush(); err != nil {
 			return total, err
 		}
 	}
+
+	// Labels may also point just past the last instruction.
+	if xp == uint64(len(p.Bytes)) && xp <= endXP {
+		if err := writeLabels(labelsFor(xp)); err != nil {
+			return total, err
+		}
+	}
 	return total, nil
 }
 
+// expandTabs replaces each tab in text with spaces, up to the next multiple
+// of width columns.
+func expandTabs(text []byte, width int) []byte {
+	out := make([]byte, 0, len(text))
+	col := 0
+	for _, b := range text {
+		switch b {
+		case '\t':
+			n := width - col%width
+			out = append(out, bytes.Repeat([]byte{' '}, n)...)
+			col += n
+		case '\n':
+			out = append(out, b)
+			col = 0
+		default:
+			out = append(out, b)
+			col++
+		}
+	}
+	return out
+}
+
 func (p *Program) writeOp(buf *bytes.Buffer, op *Op, xp uint64) {
 	meta := op.Meta
 	if meta == nil {
@@ -219,8 +623,11 @@ func (p *Program) writeOp(buf *bytes.Buffer, op *Op, xp uint64) {
 
 		case ImmCodeOffset:
 			s := u2s(v)
-			label := p.FindLabel(addOffset(xp, s))
-			fmt.Fprintf(buf, "%s <.%+d>", label.Name, s)
+			if target, ok := tryAddOffset(xp, s); ok {
+				fmt.Fprintf(buf, "%s <.%+d>", p.FindLabel(target).Name, s)
+			} else {
+				fmt.Fprintf(buf, "<.%+d> <bad-offset>", s)
+			}
 
 		case ImmLiteralIdx:
 			fmt.Fprintf(buf, "%d", v)
@@ -234,12 +641,42 @@ func (p *Program) writeOp(buf *bytes.Buffer, op *Op, xp uint64) {
 				buf.WriteString(" <bad-matcher>")
 			}
 
+		case ImmRuneSetIdx:
+			fmt.Fprintf(buf, "%d", v)
+			if v >= uint64(len(p.RuneSets)) {
+				buf.WriteString(" <bad-runeset>")
+			}
+
 		case ImmCaptureIdx:
 			fmt.Fprintf(buf, "%d", v)
 			if v >= uint64(len(p.Captures)) {
 				buf.WriteString(" <bad-capture>")
 			}
 
+		case ImmDFAIdx:
+			fmt.Fprintf(buf, "%d", v)
+			if v >= uint64(len(p.DFAs)) {
+				buf.WriteString(" <bad-dfa>")
+			}
+
+		case ImmJumpTableIdx:
+			fmt.Fprintf(buf, "%d", v)
+			if v >= uint64(len(p.JumpTables)) {
+				buf.WriteString(" <bad-jumptable>")
+			}
+
+		case ImmPredicateIdx:
+			fmt.Fprintf(buf, "%d", v)
+			if v >= uint64(len(p.predicates)) {
+				buf.WriteString(" <bad-predicate>")
+			}
+
+		case ImmFolderIdx:
+			fmt.Fprintf(buf, "%d", v)
+			if v >= uint64(len(p.folders)) {
+				buf.WriteString(" <bad-folder>")
+			}
+
 		default:
 			fmt.Fprintf(buf, "%d", v)
 		}
@@ -251,52 +688,210 @@ func (p *Program) writeOp(buf *bytes.Buffer, op *Op, xp uint64) {
 	f(meta.Imm2, op.Imm2)
 }
 
-func (p *Program) String() string {
-	var buf bytes.Buffer
-	buf.WriteString("Program{")
-	// FIXME
-	buf.WriteString("}")
-	return buf.String()
-}
-
 func (p *Program) Exec(input []byte) *Execution {
-	ks := make([]Assignment, 0, 2*len(p.Captures))
-	cs := make([]Frame, 0, 16)
-	return &Execution{
-		P:  p,
-		I:  input,
-		DP: 0,
-		XP: 0,
-		KS: ks,
-		CS: cs,
+	s := stackPool.Get().(*stacks)
+	if cap(s.ks) < 2*len(p.Captures) {
+		s.ks = make([]Assignment, 0, 2*len(p.Captures))
 	}
+	x := &Execution{
+		P:      p,
+		I:      input,
+		DP:     0,
+		XP:     0,
+		KS:     s.ks[:0],
+		CS:     s.cs[:0],
+		Limits: p.Limits,
+		stacks: s,
+	}
+	x.KeepHistory(p.HistorySize)
+	if p.KeepStats {
+		x.KeepStats()
+	}
+	return x
 }
 
 func (p *Program) Match(input []byte) Result {
-	var r Result
 	x := p.Exec(input)
+	defer x.release()
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.Result()
+}
+
+// IsMatch is like Match, but reports only whether the program matches. It
+// runs the Execution with MatchOnly set, so that no captures are recorded and
+// no Result is built, which saves their allocations.
+func (p *Program) IsMatch(input []byte) bool {
+	x := p.Exec(input)
+	defer x.release()
+	x.KS = nil
+	x.MatchOnly = true
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.R == SuccessState
+}
+
+// MatchOptions selects how MatchWithOptions runs the program. The zero value
+// runs it as Match does.
+type MatchOptions struct {
+	// TwoPhase first runs the program with Execution.MatchOnly set, and
+	// runs it again with captures only if the first run matches. This pays
+	// off for programs that backtrack heavily, where most of the capture
+	// bookkeeping of a single run is thrown away, and for inputs that
+	// mostly fail to match; otherwise it costs a second run. When the
+	// match fails, the Result has no Expected.
+	TwoPhase bool
+}
+
+// MatchWithOptions is like Match, but runs the program as directed by opts.
+func (p *Program) MatchWithOptions(input []byte, opts MatchOptions) Result {
+	if !opts.TwoPhase {
+		return p.Match(input)
+	}
+	x := p.Exec(input)
+	defer x.release()
+	x.KS = nil
+	x.MatchOnly = true
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	if x.R != SuccessState {
+		return x.Result()
+	}
+	return p.Match(input)
+}
+
+// MatchAt is like Match, but begins matching at position start of input
+// instead of at 0. Capture positions and Result.End are positions in the
+// whole input, so they need no adjusting, and the bytes before start remain
+// visible to RWNDB. It panics if start is past the end of input.
+func (p *Program) MatchAt(input []byte, start uint64) Result {
+	if start > uint64(len(input)) {
+		panic(fmt.Errorf("peggyvm: MatchAt: start %d is past the end of the input (%d)", start, len(input)))
+	}
+	x := p.Exec(input)
+	defer x.release()
+	x.DP = start
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	return x.Result()
+}
+
+// MatchReverse is like Match, but starts at the end of input, for a program
+// that matches backward using the reverse opcodes (RANYB, RSAMEB, RLITB,
+// RMATCHB, and RSPANB), such as a suffix check. Since such a program begins
+// each capture at the higher position, the capture pairs are swapped so that
+// S <= E. Result.End is the position at which the match stopped, i.e. where
+// the matched suffix begins.
+func (p *Program) MatchReverse(input []byte) Result {
+	x := p.Exec(input)
+	defer x.release()
+	x.DP = uint64(len(input))
 	if err := x.Run(); err != nil {
 		panic(err)
 	}
-	r.Success = (x.R == SuccessState)
-	r.Captures = make([]Capture, len(p.Captures))
-	pending := make([]uint64, len(p.Captures))
-	for _, a := range x.KS {
-		if a.Index >= uint64(len(r.Captures)) {
-			panic("capture out of range")
-		}
-		if a.IsEnd {
-			var pair CapturePair
-			pair.S = pending[a.Index]
-			pair.E = a.DP
-			ptr := &r.Captures[a.Index]
-			ptr.Exists = true
-			ptr.Solo = pair
-			ptr.Multi = append(ptr.Multi, pair)
-			pending[a.Index] = 0
-		} else {
-			pending[a.Index] = a.DP
+	r := x.Result()
+	for i := range r.Captures {
+		c := &r.Captures[i]
+		if c.Solo.S > c.Solo.E {
+			c.Solo.S, c.Solo.E = c.Solo.E, c.Solo.S
+		}
+		for j := range c.Multi {
+			if pair := &c.Multi[j]; pair.S > pair.E {
+				pair.S, pair.E = pair.E, pair.S
+			}
 		}
 	}
 	return r
 }
+
+// MatchContext is like Match, but runs the program with RunContext, and
+// returns any error instead of panicking.
+func (p *Program) MatchContext(ctx context.Context, input []byte) (Result, error) {
+	x := p.Exec(input)
+	defer x.release()
+	if err := x.RunContext(ctx); err != nil {
+		return Result{}, err
+	}
+	return x.Result(), nil
+}
+
+// MatchTimeout is like Match, but runs the program with RunTimeout, so that
+// it halts with a RuntimeError wrapping ErrTimeout once d has elapsed, and
+// returns any error instead of panicking.
+func (p *Program) MatchTimeout(input []byte, d time.Duration) (Result, error) {
+	x := p.Exec(input)
+	defer x.release()
+	if err := x.RunTimeout(d); err != nil {
+		return Result{}, err
+	}
+	return x.Result(), nil
+}
+
+// ExecEntry is like Exec, but starts execution at the named entry point
+// instead of at offset 0. The entry point is entered as if by CALL from just
+// past the end of the program, so that its RET halts the execution
+// successfully. Nothing is recorded for capture 0; see MatchEntry.
+func (p *Program) ExecEntry(name string, input []byte) (*Execution, error) {
+	for _, label := range p.Entries {
+		if label.Name == name {
+			return p.execAt(label, input), nil
+		}
+	}
+	return nil, ErrUnknownEntry
+}
+
+// MatchEntry is like Match, but starts at the named entry point. Capture 0
+// records the input consumed by the entry point.
+func (p *Program) MatchEntry(name string, input []byte) (Result, error) {
+	x, err := p.ExecEntry(name, input)
+	if err != nil {
+		return Result{}, err
+	}
+	return p.matchFrom(x)
+}
+
+// MatchRule is like MatchEntry, but also accepts any public label, whether
+// or not it was declared as an entry point. This lets test suites exercise
+// the sub-rules of a grammar, so long as each rule is a subroutine ending in
+// RET. It returns ErrUnknownEntry if there is no such label.
+func (p *Program) MatchRule(name string, input []byte) (Result, error) {
+	x, err := p.ExecEntry(name, input)
+	if err == ErrUnknownEntry {
+		label := p.LabelsByName[name]
+		if label == nil || !label.Public {
+			return Result{}, ErrUnknownEntry
+		}
+		x, err = p.execAt(label, input), nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return p.matchFrom(x)
+}
+
+func (p *Program) execAt(label *Label, input []byte) *Execution {
+	x := p.Exec(input)
+	x.XP = label.Offset
+	x.CS = append(x.CS, Frame{XP: uint64(len(p.Bytes))})
+	return x
+}
+
+// matchFrom runs x, which was started at an entry point, to completion.
+func (p *Program) matchFrom(x *Execution) (Result, error) {
+	defer x.release()
+	wholeMatch := len(p.Captures) != 0
+	if wholeMatch {
+		x.KS = append(x.KS, Assignment{DP: 0, Index: 0})
+	}
+	if err := x.Run(); err != nil {
+		return Result{}, err
+	}
+	if wholeMatch && x.R == SuccessState {
+		x.KS = append(x.KS, Assignment{DP: x.DP, Index: 0, IsEnd: true})
+	}
+	return x.Result(), nil
+}
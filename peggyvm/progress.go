@@ -0,0 +1,74 @@
+package peggyvm
+
+// ProgressFunc is called back by an Execution as it makes progress; see
+// SetProgress. If it returns an error, the Execution halts with a
+// RuntimeError whose Err is that error.
+type ProgressFunc func(x *Execution) error
+
+// progress is the state kept by SetProgress.
+type progress struct {
+	fn    ProgressFunc
+	bytes uint64
+	steps uint64
+
+	// nextDP and nextSteps are the values of DP and Steps at which fn is
+	// next due.
+	nextDP    uint64
+	nextSteps uint64
+}
+
+// SetProgress arranges for fn to be called after the instruction that first
+// takes DP at least bytes past where it stood at the last call (or at the
+// call to SetProgress), and after every steps instructions, so that a long
+// match can report how far it has come, or be abandoned by a policy of the
+// caller's own. Since DP moves back when the Execution backtracks, only
+// forward progress counts: the bytes are measured from the furthest point
+// reached. A zero bytes or steps disables that trigger; if both are zero, or
+// fn is nil, the callback is removed. fn is called at most once per
+// instruction.
+//
+// fn may examine the Execution, but must not change it.
+//
+func (x *Execution) SetProgress(bytes, steps uint64, fn ProgressFunc) {
+	if fn == nil || (bytes == 0 && steps == 0) {
+		x.progress = nil
+		return
+	}
+	x.progress = &progress{
+		fn:        fn,
+		bytes:     bytes,
+		steps:     steps,
+		nextDP:    x.DP + bytes,
+		nextSteps: x.Steps + steps,
+	}
+}
+
+// check calls fn if it is due.
+func (pr *progress) check(x *Execution) error {
+	due := false
+	if pr.bytes != 0 && x.DP >= pr.nextDP {
+		pr.nextDP = x.DP + pr.bytes
+		due = true
+	}
+	if pr.steps != 0 && x.Steps >= pr.nextSteps {
+		pr.nextSteps = x.Steps + pr.steps
+		due = true
+	}
+	if !due {
+		return nil
+	}
+	return pr.fn(x)
+}
+
+// MatchProgress is like Match, but calls fn as the match progresses, as set
+// up by Execution.SetProgress. It returns the RuntimeError if fn returns an
+// error, or if the program has a runtime error.
+func (p *Program) MatchProgress(input []byte, bytes, steps uint64, fn ProgressFunc) (Result, error) {
+	x := p.Exec(input)
+	defer x.release()
+	x.SetProgress(bytes, steps, fn)
+	if err := x.Run(); err != nil {
+		return Result{}, err
+	}
+	return x.Result(), nil
+}
@@ -0,0 +1,189 @@
+package peggyvm
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// readChunkSize is the number of bytes that MatchReader asks for at a time.
+const readChunkSize = 4096
+
+// errNeedInput is returned by Step, during MatchReader, when the next
+// instruction cannot be executed until more input has been read.
+var errNeedInput = errors.New("need more input")
+
+// MatchReader is like MatchContext, but reads the input from r as the program
+// needs it, instead of all at once.
+//
+// Input that the Execution can no longer examine, because it lies before DP
+// and before the position of every pending CHOICE frame, is discarded as the
+// match proceeds, so that a long stream can be matched in bounded memory.
+// Programs that use RWNDB keep as many bytes more as its largest count, which
+// suffices for the code produced by HeadFail, where RWNDB returns only to the
+// start of the test it follows. Programs that use the reverse opcodes,
+// BEHINDB, PRED, VCAP, or extension opcodes keep all of their input, as they
+// may look back arbitrarily far; PRED also waits for the end of the input,
+// as its predicate is passed all of it. Since the input is not kept, the
+// Result holds only positions.
+//
+func (p *Program) MatchReader(r io.Reader) (Result, error) {
+	x := p.Exec(nil)
+	defer x.release()
+	if err := p.matchReader(x, r); err != nil {
+		return Result{}, err
+	}
+	return x.Result(), nil
+}
+
+// matchReader runs x, a fresh Execution, to completion on the input read
+// from r.
+func (p *Program) matchReader(x *Execution, r io.Reader) error {
+	slack, trim := p.trimSlack()
+	x.partial = true
+	for x.R == RunningState {
+		err := x.Step()
+		if err == nil {
+			continue
+		}
+		if err != errNeedInput {
+			return err
+		}
+		if trim {
+			x.trimInput(slack)
+		}
+		n := len(x.I)
+		if cap(x.I)-n < readChunkSize {
+			grown := make([]byte, n, 2*cap(x.I)+readChunkSize)
+			copy(grown, x.I)
+			x.I = grown
+		}
+		m, err := r.Read(x.I[n : n+readChunkSize])
+		x.I = x.I[:n+m]
+		if err == io.EOF {
+			x.partial = false
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trimSlack returns the number of bytes before DP and the pending CHOICE
+// frames that the program may still look back at, which is the largest count
+// of any RWNDB, or false if the program uses a reverse opcode, BEHINDB, PRED,
+// VCAP, or an extension opcode.
+func (p *Program) trimSlack() (uint64, bool) {
+	var slack uint64
+	it := p.Instructions()
+	for it.Next() {
+		switch code := it.Op().Code; code {
+		case OpRWNDB:
+			if n := it.Op().Imm0; n > slack {
+				slack = n
+			}
+		case OpRANYB, OpRSAMEB, OpRLITB, OpRMATCHB, OpRSPANB, OpBEHINDB, OpPRED, OpVCAP:
+			return 0, false
+		default:
+			if lookupExtOp(code) != nil {
+				return 0, false
+			}
+		}
+	}
+	return slack, true
+}
+
+// trimInput discards the part of I that lies more than slack bytes before DP
+// and before the position of every pending CHOICE frame, if that is at least
+// half of it, so that the cost of moving the rest is amortized. One byte more
+// is kept, for WORDB to look back at.
+func (x *Execution) trimInput(slack uint64) {
+	low := x.DP
+	for _, fr := range x.CS {
+		if fr.IsChoice && fr.DP < low {
+			low = fr.DP
+		}
+	}
+	if low-x.base > slack {
+		low -= slack
+	} else {
+		low = x.base
+	}
+	if low > x.base {
+		low--
+	}
+	drop := low - x.base
+	if drop == 0 || drop < uint64(len(x.I))/2 {
+		return
+	}
+	n := copy(x.I, x.I[drop:])
+	x.I = x.I[:n]
+	x.base = low
+}
+
+// needsInput returns true if, during MatchReader, the outcome of op might
+// depend on input that has not been read yet.
+func (x *Execution) needsInput(op *Op) bool {
+	avail := x.availableBytes()
+	switch op.Code {
+	case OpANYB:
+		return avail < op.Imm0
+
+	case OpSAMEB, OpMATCHB, OpTANYB:
+		return avail < op.Imm1
+
+	case OpTSAMEB, OpTMATCHB:
+		return avail < op.Imm2
+
+	case OpLITB:
+		return op.Imm0 < uint64(len(x.P.Literals)) && avail < uint64(len(x.P.Literals[op.Imm0]))
+
+	case OpTLITB:
+		return op.Imm1 < uint64(len(x.P.Literals)) && avail < uint64(len(x.P.Literals[op.Imm1]))
+
+	case OpSPANB, OpTSPANB:
+		idx := op.Imm0
+		if op.Code == OpTSPANB {
+			idx = op.Imm1
+		}
+		if idx >= uint64(len(x.P.ByteSets)) {
+			return false
+		}
+		m := x.P.ByteSets[idx]
+		for _, b := range x.I[x.DP-x.base:] {
+			if !m.Match(b) {
+				return false
+			}
+		}
+		return true
+
+	case OpDFAB:
+		if op.Imm0 >= uint64(len(x.P.DFAs)) {
+			return false
+		}
+		_, _, atEOF := x.P.DFAs[op.Imm0].match(x.I, nil, x.DP-x.base)
+		return atEOF
+
+	case OpDISPATCH, OpEOI, OpWORDB:
+		return avail == 0
+
+	case OpANYR, OpSAMER, OpFSAMER, OpMATCHR, OpTMATCHR:
+		return !utf8.FullRune(x.I[x.DP-x.base:])
+
+	case OpSPANR:
+		if op.Imm0 >= uint64(len(x.P.RuneSets)) {
+			return false
+		}
+		return x.runeSpanNeedsInput(x.P.RuneSets[op.Imm0])
+
+	case OpBALB:
+		_, _, atEOF := x.scanBalanced(byte(op.Imm0), byte(op.Imm1))
+		return atEOF
+
+	case OpPRED:
+		return true
+
+	default:
+		return lookupExtOp(op.Code) != nil
+	}
+}
@@ -0,0 +1,228 @@
+package peggyvm
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// recordingVersion is the version byte written by Recording.MarshalBinary.
+const recordingVersion = 1
+
+var (
+	_ encoding.BinaryMarshaler   = (*Recording)(nil)
+	_ encoding.BinaryUnmarshaler = (*Recording)(nil)
+)
+
+// Recording is a complete trace of one Execution: its input, and every
+// instruction that it executed, in order. Since the VM is deterministic, the
+// Recording is enough to replay the Execution step by step with a Replayer,
+// even against a modified Program.
+type Recording struct {
+	Input []byte
+	Steps []HistoryEntry
+}
+
+// MarshalBinary encodes the Recording compactly, so that it can be shipped
+// from where a problem was seen to where it can be debugged.
+//
+// The encoding is a version byte, the input as a uvarint length followed by
+// the bytes, and a uvarint count of steps. Each step is then written as the
+// difference of its XP from the previous step's, as a varint, the same for
+// its DP, and its opcode as a single byte.
+//
+func (rec *Recording) MarshalBinary() ([]byte, error) {
+	e := binaryEncoder{delta: true}
+	e.buf.WriteByte(recordingVersion)
+	e.bytes(rec.Input)
+	e.uint(uint64(len(rec.Steps)))
+	var lastDP uint64
+	for _, step := range rec.Steps {
+		e.xp(step.XP)
+		n := binary.PutVarint(e.scratch[:], int64(step.DP-lastDP))
+		e.buf.Write(e.scratch[:n])
+		lastDP = step.DP
+		e.buf.WriteByte(byte(step.Code))
+	}
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a Recording encoded by MarshalBinary, replacing the
+// contents of rec.
+func (rec *Recording) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return ErrBadEncoding
+	}
+	if data[0] != recordingVersion {
+		return ErrBadVersion
+	}
+	d := &binaryDecoder{data: data[1:], delta: true}
+	input := d.bytes()
+	steps := make([]HistoryEntry, d.count())
+	var lastDP uint64
+	for i := range steps {
+		steps[i].XP = d.xp()
+		v, n := binary.Varint(d.data)
+		if n <= 0 || len(d.data) <= n {
+			d.fail()
+			break
+		}
+		lastDP += uint64(v)
+		steps[i].DP = lastDP
+		steps[i].Code = OpCode(d.data[n])
+		d.data = d.data[n+1:]
+	}
+	if d.bad || len(d.data) != 0 {
+		return ErrBadEncoding
+	}
+	rec.Input = input
+	rec.Steps = steps
+	return nil
+}
+
+// Recorder is an Observer that appends each instruction executed to a
+// Recording. All callbacks are also passed on to Next, if it is not nil.
+// See Execution.Record.
+type Recorder struct {
+	// Recording receives the steps.
+	Recording *Recording
+
+	// Next is the Observer being wrapped, or nil.
+	Next Observer
+}
+
+var _ Observer = (*Recorder)(nil)
+
+func (r *Recorder) OnStep(x *Execution, op *Op) {
+	r.Recording.Steps = append(r.Recording.Steps, HistoryEntry{XP: op.XP, DP: x.DP, Code: op.Code})
+	if r.Next != nil {
+		r.Next.OnStep(x, op)
+	}
+}
+
+func (r *Recorder) OnChoicePush(x *Execution, op *Op) {
+	if r.Next != nil {
+		r.Next.OnChoicePush(x, op)
+	}
+}
+
+func (r *Recorder) OnFail(x *Execution, op *Op) {
+	if r.Next != nil {
+		r.Next.OnFail(x, op)
+	}
+}
+
+func (r *Recorder) OnCaptureCommit(x *Execution, op *Op, a Assignment) {
+	if r.Next != nil {
+		r.Next.OnCaptureCommit(x, op, a)
+	}
+}
+
+func (r *Recorder) OnCall(x *Execution, op *Op) {
+	if r.Next != nil {
+		r.Next.OnCall(x, op)
+	}
+}
+
+// Record starts recording the Execution, by wrapping its Observer in a
+// Recorder, and returns the Recording, which grows as the Execution runs.
+// It should be called before the first Step, so that the Recording is
+// complete.
+func (x *Execution) Record() *Recording {
+	rec := &Recording{Input: x.I}
+	x.Observer = &Recorder{Recording: rec, Next: x.Observer}
+	return rec
+}
+
+// DivergenceError is returned by Replayer when the Execution being replayed
+// does not execute the instruction that was recorded. Expected is the
+// recorded step, and Actual is the instruction about to be executed, at the
+// DP where it would execute; either is nil if that side has halted.
+type DivergenceError struct {
+	Step     int
+	Expected *HistoryEntry
+	Actual   *HistoryEntry
+}
+
+func (e *DivergenceError) Error() string {
+	str := func(h *HistoryEntry) string {
+		if h == nil {
+			return "halt"
+		}
+		return h.String()
+	}
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/peggyvm: replay diverged at step %d: expected %s, got %s", e.Step, str(e.Expected), str(e.Actual))
+}
+
+// Replayer steps an Execution in lockstep with a Recording, checking before
+// each step that the Execution is about to do what was recorded.
+type Replayer struct {
+	// X is the Execution being replayed. Its registers and stacks may be
+	// inspected between steps, as with RunUntilBreak.
+	X *Execution
+
+	// Recording is the Recording being replayed.
+	Recording *Recording
+
+	// N is the number of steps replayed so far.
+	N int
+}
+
+// NewReplayer returns a Replayer that checks x against rec. The caller
+// prepares x as the recorded Execution was prepared, e.g. with
+// ExecEntry(name, rec.Input) if it was started at an entry point.
+func NewReplayer(x *Execution, rec *Recording) *Replayer {
+	return &Replayer{X: x, Recording: rec}
+}
+
+// Replay returns a Replayer for a fresh Execution of p on rec.Input. The
+// program need not be the one that was recorded, so that a fix can be
+// checked against a Recording of the problem.
+func (p *Program) Replay(rec *Recording) *Replayer {
+	return NewReplayer(p.Exec(rec.Input), rec)
+}
+
+// Done returns true once both the Recording and the Execution have ended.
+func (r *Replayer) Done() bool {
+	return r.N >= len(r.Recording.Steps) && r.X.R != RunningState
+}
+
+// Step executes one instruction, after checking that it matches the next
+// step of the Recording. If it does not, Step returns a *DivergenceError and
+// leaves the Execution as it was, just before the divergent step.
+func (r *Replayer) Step() error {
+	var expected, actual *HistoryEntry
+	if r.N < len(r.Recording.Steps) {
+		expected = &r.Recording.Steps[r.N]
+	}
+	if r.X.R == RunningState {
+		var op Op
+		err := r.X.P.fetch(&op, r.X.XP)
+		if err != nil && err != io.EOF {
+			return r.X.Step()
+		}
+		if err == nil {
+			actual = &HistoryEntry{XP: op.XP, DP: r.X.DP, Code: op.Code}
+		}
+	}
+	if expected == nil && actual == nil {
+		return r.X.Step()
+	}
+	if expected == nil || actual == nil || *expected != *actual {
+		return &DivergenceError{Step: r.N, Expected: expected, Actual: actual}
+	}
+	r.N++
+	return r.X.Step()
+}
+
+// Run replays the rest of the Recording, stopping at the first divergence
+// or error.
+func (r *Replayer) Run() error {
+	for !r.Done() {
+		if err := r.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,6 +9,36 @@ import (
 type Result struct {
 	Success  bool
 	Captures []Capture
+
+	// End, if the match succeeded, is the position in the input at which
+	// it ended, i.e. the final value of DP. For a match that began at 0,
+	// it is the number of bytes consumed.
+	End uint64
+
+	// Names maps the names of captures to their indices, as in
+	// Program.NamedCaptures. It is used by Expand.
+	Names map[string]uint64
+
+	// History holds the last instructions executed, oldest first, if the
+	// match failed and the Execution kept any (see KeepHistory).
+	History []HistoryEntry
+
+	// Thrown, if the match failed because THROW raised a label that no
+	// RECOVER frame caught, says which label and where.
+	Thrown *Thrown
+
+	// Expected, if the match failed, describes what would have been
+	// accepted at the farthest position it reached. It is nil if no
+	// instruction that looks for particular bytes failed.
+	Expected *Expected
+
+	// Stats counts the work done by the Execution, if it kept count (see
+	// KeepStats), whether or not the match succeeded.
+	Stats *ExecStats
+
+	// Value, if the match succeeded, is the value on top of the value
+	// stack built by VCAP and VFOLD, or nil if it is empty.
+	Value interface{}
 }
 
 // String provides a programmer-friendly debugging string for the Result.
@@ -28,6 +58,9 @@ func (r Result) String() string {
 			first = false
 		}
 		buf.WriteByte(']')
+	} else if r.Thrown != nil {
+		buf.WriteByte(' ')
+		buf.WriteString(r.Thrown.String())
 	}
 	buf.WriteByte('}')
 	return buf.String()
@@ -0,0 +1,193 @@
+package peggyvm
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/chronos-tachyon/go-peggy/runeset"
+)
+
+// decodeRune decodes the UTF-8 rune at DP. It returns false if the input
+// is exhausted, or if the bytes at DP are not a well-formed encoding:
+// a truncated, overlong, or surrogate sequence, or a stray continuation byte.
+func (x *Execution) decodeRune() (rune, uint64, bool) {
+	n := x.availableBytes()
+	if n > utf8.UTFMax {
+		n = utf8.UTFMax
+	}
+	if n == 0 {
+		return 0, 0, false
+	}
+	var p []byte
+	if x.In != nil {
+		p = x.In.Slice(x.DP, x.DP+n)
+	} else {
+		p = x.I[x.DP-x.base : x.DP-x.base+n]
+	}
+	r, size := utf8.DecodeRune(p)
+	if r == utf8.RuneError && size <= 1 {
+		return 0, 0, false
+	}
+	return r, uint64(size), true
+}
+
+// runeLeadKey is the set of bytes that can begin a well-formed UTF-8
+// encoding, as a firstSummary key.
+func runeLeadKey() [32]byte {
+	var key [32]byte
+	for b := 0; b < 0x100; b++ {
+		if b < 0x80 || (b >= 0xc2 && b <= 0xf4) {
+			key[b>>3] |= 1 << (uint(b) & 7)
+		}
+	}
+	return key
+}
+
+// runeSetLeadKey is the set of bytes that can begin the UTF-8 encoding of a
+// rune in m, as a firstSummary key. It may include a few bytes too many.
+func runeSetLeadKey(m runeset.Matcher) [32]byte {
+	var key [32]byte
+	m.ForEachRange(func(r runeset.Range) {
+		if r.Lo < 0 {
+			r.Lo = 0
+		}
+		if r.Hi > utf8.MaxRune {
+			r.Hi = utf8.MaxRune
+		}
+		for b := leadByte(r.Lo); b <= leadByte(r.Hi); b++ {
+			key[b>>3] |= 1 << (b & 7)
+		}
+	})
+	return key
+}
+
+// runeFoldLeadKey is the set of bytes that can begin the UTF-8 encoding of a
+// rune equivalent to r under simple case folding, as a firstSummary key.
+func runeFoldLeadKey(r rune) [32]byte {
+	var key [32]byte
+	f := r
+	for {
+		b := string(f)[0]
+		key[b>>3] |= 1 << (b & 7)
+		if f = unicode.SimpleFold(f); f == r {
+			return key
+		}
+	}
+}
+
+// leadByte returns the first byte of the UTF-8 encoding of r, as though
+// surrogates could be encoded, so that it never decreases as r increases.
+func leadByte(r rune) uint {
+	switch {
+	case r < 0x80:
+		return uint(r)
+	case r < 0x800:
+		return 0xc0 | uint(r>>6)
+	case r < 0x10000:
+		return 0xe0 | uint(r>>12)
+	default:
+		return 0xf0 | uint(r>>18)
+	}
+}
+
+// runeSetKey returns a canonical description of m. Two rune sets are
+// interchangeable iff their keys are equal.
+func runeSetKey(m runeset.Matcher) string {
+	return runeset.Ranges(runeset.RangesOf(m, nil)...).String()
+}
+
+// runeSpanNeedsInput returns true if every rune available at DP is in m, and
+// the bytes after them might begin one more.
+func (x *Execution) runeSpanNeedsInput(m runeset.Matcher) bool {
+	p := x.I[x.DP-x.base:]
+	for len(p) != 0 {
+		if !utf8.FullRune(p) {
+			return true
+		}
+		r, size := utf8.DecodeRune(p)
+		if (r == utf8.RuneError && size == 1) || !m.Match(r) {
+			return false
+		}
+		p = p[size:]
+	}
+	return true
+}
+
+func execANYR(x *Execution, op *Op) error {
+	if _, n, ok := x.decodeRune(); ok {
+		x.DP += n
+	} else {
+		x.fail()
+	}
+	return nil
+}
+
+func execSAMER(x *Execution, op *Op) error {
+	if r, n, ok := x.decodeRune(); ok && r == rune(op.Imm0) {
+		x.DP += n
+	} else {
+		x.expectLiteral([]byte(string(rune(op.Imm0))))
+		x.fail()
+	}
+	return nil
+}
+
+func execFSAMER(x *Execution, op *Op) error {
+	if r, n, ok := x.decodeRune(); ok && foldEqual(r, rune(op.Imm0)) {
+		x.DP += n
+	} else {
+		x.expectLiteral([]byte(string(rune(op.Imm0))))
+		x.fail()
+	}
+	return nil
+}
+
+// foldEqual returns true if a and b are equal under simple case folding.
+func foldEqual(a, b rune) bool {
+	for f := a; ; {
+		if f == b {
+			return true
+		}
+		if f = unicode.SimpleFold(f); f == a {
+			return false
+		}
+	}
+}
+
+func execMATCHR(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.RuneSets)) {
+		return ErrIndexRange
+	}
+	if r, n, ok := x.decodeRune(); ok && x.P.RuneSets[op.Imm0].Match(r) {
+		x.DP += n
+	} else {
+		x.fail()
+	}
+	return nil
+}
+
+func execSPANR(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.RuneSets)) {
+		return ErrIndexRange
+	}
+	m := x.P.RuneSets[op.Imm0]
+	for {
+		r, n, ok := x.decodeRune()
+		if !ok || !m.Match(r) {
+			return nil
+		}
+		x.DP += n
+	}
+}
+
+func execTMATCHR(x *Execution, op *Op) error {
+	if op.Imm1 >= uint64(len(x.P.RuneSets)) {
+		return ErrIndexRange
+	}
+	if r, n, ok := x.decodeRune(); ok && x.P.RuneSets[op.Imm1].Match(r) {
+		x.DP += n
+	} else {
+		x.XP = addOffset(x.XP, u2s(op.Imm0))
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package peggyvm
+
+import (
+	"bytes"
+	"iter"
+)
+
+// maxIndexAnyBytes is the largest first-byte set for which Search uses
+// bytes.IndexAny rather than a table.
+const maxIndexAnyBytes = 4
+
+// skipper finds the next position at which a match could begin, using the
+// prefix that every match must begin with, or else the bytes that can begin a
+// match at XP 0.
+type skipper struct {
+	// anywhere is true if a match may begin at any position, so that
+	// nothing can be skipped.
+	anywhere bool
+
+	// prefix, if at least two bytes long, is the prefix that every match
+	// must begin with; see RequiredPrefix.
+	prefix []byte
+
+	// list holds the bytes that can begin a match, in ascending order.
+	list []byte
+
+	// table is true for each byte in list.
+	table [256]bool
+}
+
+// newSkipper computes the skipper for p.
+func (p *Program) newSkipper() (*skipper, error) {
+	sets, err := p.FirstSets()
+	if err != nil {
+		return nil, err
+	}
+	s := &skipper{anywhere: sets.Start.MayBeEmpty}
+	if !s.anywhere {
+		sets.Start.Bytes.ForEach(func(b byte) {
+			s.list = append(s.list, b)
+			s.table[b] = true
+		})
+		prefix, err := p.RequiredPrefix()
+		if err != nil {
+			return nil, err
+		}
+		if len(prefix) >= 2 {
+			s.prefix = prefix
+		}
+	}
+	return s, nil
+}
+
+// next returns the first position at or after dp at which a match could
+// begin, or false if there is none.
+func (s *skipper) next(input []byte, dp uint64) (uint64, bool) {
+	n := uint64(len(input))
+	if s.anywhere {
+		return dp, dp <= n
+	}
+	if dp >= n {
+		return 0, false
+	}
+	rest := input[dp:]
+	i := -1
+	switch {
+	case len(s.list) == 0:
+		// no match is possible
+	case s.prefix != nil:
+		i = bytes.Index(rest, s.prefix)
+	case len(s.list) == 1:
+		i = bytes.IndexByte(rest, s.list[0])
+	case len(s.list) <= maxIndexAnyBytes && s.list[len(s.list)-1] < 0x80:
+		// IndexAny takes UTF-8, so only ASCII bytes stand for themselves.
+		i = bytes.IndexAny(rest, string(s.list))
+	default:
+		for j, b := range rest {
+			if s.table[b] {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 {
+		return 0, false
+	}
+	return dp + uint64(i), true
+}
+
+// Search tries the program at each position of input in turn, and returns the
+// Result of the first match, together with the position at which it begins.
+// The match ends at Result.End. Like Match, it panics if the program has a
+// runtime error.
+//
+// Positions at which the program cannot match, because the byte there is not
+// in the program's first-byte set (see FirstSets), are skipped without
+// running the program at all, using bytes.IndexByte or bytes.IndexAny when
+// the set is small. If every match must begin with the same literal of two
+// bytes or more (see RequiredPrefix), bytes.Index skips to the next
+// occurrence of it instead. These are computed once by Precompile, or on
+// every call if the program is not precompiled.
+//
+func (p *Program) Search(input []byte) (Result, uint64) {
+	return p.searchFrom(p.skipper(), input, 0)
+}
+
+// Matches returns an iterator over the successive non-overlapping matches of
+// the program in input, each with the position at which it begins, as found
+// by Search:
+//
+//   for start, r := range p.Matches(input) {
+//     ...
+//   }
+//
+// After each match, the search resumes where the match ended, or one byte
+// later if the match was empty. As in regexp.FindAll, an empty match that
+// abuts the preceding match is skipped. Matches are found lazily, as the
+// loop asks for them, so it may stop early at no extra cost.
+//
+func (p *Program) Matches(input []byte) iter.Seq2[int, Result] {
+	return func(yield func(int, Result) bool) {
+		s := p.skipper()
+		n := uint64(len(input))
+		var dp, lastEnd uint64
+		matched := false
+		for dp <= n {
+			r, start := p.searchFrom(s, input, dp)
+			if !r.Success {
+				return
+			}
+			if r.End == start && matched && start == lastEnd {
+				dp = start + 1
+				continue
+			}
+			if !yield(int(start), r) {
+				return
+			}
+			matched, lastEnd = true, r.End
+			if r.End > start {
+				dp = r.End
+			} else {
+				dp = start + 1
+			}
+		}
+	}
+}
+
+// OverlappingMatches is like Matches, but returns the match beginning at
+// every position of input at which the program matches, in order, including
+// those that lie within an earlier match. This is for indexing and
+// annotation, where every occurrence matters:
+//
+//   for start, r := range p.OverlappingMatches([]byte("aaaa")) {
+//     // with a program for "aa", yields 0, 1, and 2
+//   }
+//
+// Empty matches are reported too, including one at len(input) if the program
+// matches there. Positions are skipped using the first-byte set, as in
+// Search.
+//
+func (p *Program) OverlappingMatches(input []byte) iter.Seq2[int, Result] {
+	return func(yield func(int, Result) bool) {
+		s := p.skipper()
+		for dp := uint64(0); dp <= uint64(len(input)); dp++ {
+			var ok bool
+			if dp, ok = s.next(input, dp); !ok {
+				return
+			}
+			if r := p.MatchAt(input, dp); r.Success && !yield(int(dp), r) {
+				return
+			}
+		}
+	}
+}
+
+// skipper returns the precompiled skipper, or computes one.
+func (p *Program) skipper() *skipper {
+	if p.code != nil {
+		return p.code.skip
+	}
+	s, err := p.newSkipper()
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// searchFrom is Search, beginning at dp instead of at 0.
+func (p *Program) searchFrom(s *skipper, input []byte, dp uint64) (Result, uint64) {
+	for ; ; dp++ {
+		var ok bool
+		if dp, ok = s.next(input, dp); !ok {
+			return Result{}, 0
+		}
+		if r := p.MatchAt(input, dp); r.Success {
+			return r, dp
+		}
+	}
+}
+
+// Split uses the program as a separator, slicing input into the pieces
+// between its matches, with the semantics of regexp.Split. The count n
+// determines the number of pieces to return:
+//
+//   n > 0: at most n pieces; the last piece is the unsplit remainder.
+//   n == 0: nil (zero pieces).
+//   n < 0: all pieces.
+//
+// The pieces are subslices of input, with their capacity limited so that
+// appending to one cannot overwrite the next.
+//
+func (p *Program) Split(input []byte, n int) [][]byte {
+	if n == 0 {
+		return nil
+	}
+	if len(input) == 0 && !p.MatchAt(input, 0).Success {
+		// As with regexp, an empty input is a single empty piece,
+		// unless the separator matches it, in which case there are
+		// none.
+		return [][]byte{input[:0:0]}
+	}
+	var pieces [][]byte
+	var beg, end uint64
+	for start, r := range p.Matches(input) {
+		if n > 0 && len(pieces) == n-1 {
+			break
+		}
+		end = uint64(start)
+		if r.End != 0 {
+			pieces = append(pieces, input[beg:end:end])
+		}
+		beg = r.End
+	}
+	if end != uint64(len(input)) {
+		pieces = append(pieces, input[beg:len(input):len(input)])
+	}
+	return pieces
+}
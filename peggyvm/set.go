@@ -0,0 +1,147 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// ProgramSet combines several Programs into a single program that tries each
+// of them in turn, reporting which one matched. It is similar in spirit to
+// RE2::Set, except that PEG alternation is ordered: the result is the *first*
+// member that matches, not all of them.
+//
+// Usage: call Add for each member, then Compile, then Match.
+//
+type ProgramSet struct {
+	// Names holds the name of each member, by index.
+	Names []string
+
+	// Programs holds each member, by index.
+	Programs []*Program
+
+	combined *Program
+	members  []setMember
+}
+
+type setMember struct {
+	startXP uint64
+	endXP   uint64
+	capBase uint64
+}
+
+// NewProgramSet returns an empty ProgramSet.
+func NewProgramSet() *ProgramSet {
+	return &ProgramSet{}
+}
+
+// Add appends a member to the set, returning its index. It is an error to call
+// Add after Compile.
+func (s *ProgramSet) Add(name string, p *Program) int {
+	assert(s.combined == nil, "ProgramSet.Add called after Compile")
+	s.Names = append(s.Names, name)
+	s.Programs = append(s.Programs, p)
+	return len(s.Programs) - 1
+}
+
+// Compile builds the combined program. Each member is laid out as:
+//
+//   .M<i>:  CHOICE .M<i+1>
+//           ...member i, with its captures renumbered...
+//           END
+//
+// The last member omits the CHOICE. Because GIVEUP, or a THROW that no
+// RECOVER catches, would abandon the entire set rather than just one member,
+// programs containing GIVEUP or THROW are rejected with ErrNotComposable.
+//
+func (s *ProgramSet) Compile() error {
+	a := NewAssembler()
+	for i, p := range s.Programs {
+		if err := checkComposable(p); err != nil {
+			return err
+		}
+		a.EmitLabel(fmt.Sprintf(".M%d", i))
+		if i+1 < len(s.Programs) {
+			a.EmitOp(OpCHOICE.Meta(), a.GrabLabel(fmt.Sprintf(".M%d", i+1)), nil, nil)
+		}
+		capBase, err := a.importProgram(p, fmt.Sprintf(".M%d/", i), nil, nil, "")
+		if err != nil {
+			return err
+		}
+		a.EmitOp(OpEND.Meta(), nil, nil, nil)
+		s.members = append(s.members, setMember{capBase: capBase})
+	}
+	a.EmitLabel(fmt.Sprintf(".M%d", len(s.Programs)))
+	if len(s.Programs) == 0 {
+		a.EmitOp(OpGIVEUP.Meta(), nil, nil, nil)
+	}
+
+	combined, err := a.Finish()
+	if err != nil {
+		return err
+	}
+	for i := range s.members {
+		s.members[i].startXP = combined.LabelsByName[fmt.Sprintf(".M%d", i)].Offset
+		s.members[i].endXP = combined.LabelsByName[fmt.Sprintf(".M%d", i+1)].Offset
+	}
+	s.combined = combined
+	return nil
+}
+
+// Program returns the combined program. Compile must have been called.
+func (s *ProgramSet) Program() *Program {
+	assert(s.combined != nil, "ProgramSet.Compile has not been called")
+	return s.combined
+}
+
+// Match runs the combined program against input. It returns the index of the
+// first member that matched, together with that member's Result, with
+// captures numbered and named as in the member's own Program. If no member
+// matched, the index is -1.
+func (s *ProgramSet) Match(input []byte) (int, Result) {
+	x := s.Program().Exec(input)
+	defer x.release()
+	if err := x.Run(); err != nil {
+		panic(err)
+	}
+	r := x.Result()
+	if !r.Success {
+		return -1, Result{}
+	}
+
+	// The END that terminated the match lies within the code of exactly
+	// one member, and x.XP points just past it.
+	for i, m := range s.members {
+		if x.XP > m.startXP && x.XP <= m.endXP {
+			n := uint64(len(s.Programs[i].Captures))
+			r.Captures = r.Captures[m.capBase : m.capBase+n]
+			r.Names = s.Programs[i].NamedCaptures
+			return i, r
+		}
+	}
+	panic("ProgramSet: END outside of any member")
+}
+
+// MatchName is like Match, but returns the name of the member that matched,
+// or "" if none did.
+func (s *ProgramSet) MatchName(input []byte) (string, Result) {
+	i, r := s.Match(input)
+	if i < 0 {
+		return "", r
+	}
+	return s.Names[i], r
+}
+
+// checkComposable returns ErrNotComposable if p contains GIVEUP or THROW.
+func checkComposable(p *Program) error {
+	var op Op
+	var xp uint64
+	for xp < uint64(len(p.Bytes)) {
+		if err := op.Decode(p.Bytes, xp); err != nil {
+			return p.annotate(err)
+		}
+		if op.Code == OpGIVEUP || op.Code == OpTHROW {
+			return p.annotate(&DisassembleError{Err: ErrNotComposable, XP: xp})
+		}
+		xp += uint64(op.Len)
+	}
+	return nil
+}
@@ -1,20 +1,90 @@
 package peggyvm
 
+import (
+	"sync"
+)
+
 // Frame is a single frame on the call stack.
 type Frame struct {
 	// IsChoice is true iff this is a CHOICE/FAIL frame, or false iff this
-	// is a CALL/RET frame.
+	// is a CALL/RET, MEMOGET/MEMOSET, or RECOVER frame.
 	IsChoice bool
 
+	// Memo is true iff this is a MEMOGET/MEMOSET frame. Such a frame is
+	// never restored: FAIL records that its rule failed and pops on, while
+	// MEMOSET records what its rule matched. DP, KSLen, and VSLen are as
+	// they were at MEMOGET, and XP holds the rule ID instead.
+	Memo bool
+
+	// Recover is true iff this is a RECOVER frame, which catches the label
+	// in DP when THROW raises it, but which is skipped by FAIL. COMMIT pops
+	// it as it would a CHOICE/FAIL frame. XP, KSLen, and VSLen are restored
+	// when it catches, but DP is left where the label was thrown, so the
+	// frame's own DP is free to hold the label instead.
+	Recover bool
+
+	// Behind is true iff this is a CALL/RET frame pushed by BEHINDB. DP is
+	// where BEHINDB found DP, and where RET must find it too, or else fail.
+	Behind bool
+
 	// DP is the value of DP to use if the frame is restored.
-	// (This field is only meaningful for CHOICE/FAIL frames.)
+	// (This field is only meaningful for CHOICE/FAIL frames, and for
+	// CALL/RET frames pushed by BEHINDB; see Behind. RECOVER frames hold
+	// their label here instead; see Recover.)
 	DP uint64
 
 	// XP is the value of XP to use if the frame is restored.
 	// (This field is meaningful for both CALL/RET and CHOICE/FAIL frames.)
 	XP uint64
 
-	// KS is the value of KS to use if the frame is restored.
+	// KSLen is the length of KS when the frame was pushed. Since KS only
+	// grows between CHOICE and FAIL, restoring the frame truncates KS to
+	// KSLen, undoing the assignments made since.
+	// (This field is only meaningful for CHOICE/FAIL frames.)
+	KSLen uint64
+
+	// VSLen is the length of the value stack when the frame was pushed,
+	// which is restored in the same way as KSLen; see VCAP and VFOLD.
 	// (This field is only meaningful for CHOICE/FAIL frames.)
-	KS []Assignment
+	VSLen uint64
+}
+
+// initialFrames is the initial capacity of CS.
+const initialFrames = 16
+
+// maxPooledStack is the largest capacity of KS or CS that is kept in
+// stackPool, so that one deep match does not pin a large array forever.
+const maxPooledStack = 1 << 16
+
+// stacks holds the backing arrays of an Execution's KS and CS, for reuse.
+type stacks struct {
+	ks []Assignment
+	cs []Frame
+}
+
+// stackPool holds the stacks of finished Executions. Exec takes from it, and
+// the Match methods of Program return to it once they have built the Result,
+// so that matching in a loop does not allocate new stacks every time.
+var stackPool = sync.Pool{
+	New: func() interface{} {
+		return &stacks{cs: make([]Frame, 0, initialFrames)}
+	},
+}
+
+// release returns the stacks of x to stackPool. It is called by the Match
+// methods, which own x, once x will not be used again.
+func (x *Execution) release() {
+	s := x.stacks
+	if s == nil {
+		return
+	}
+	x.stacks = nil
+	if c := cap(x.KS); c > cap(s.ks) && c <= maxPooledStack {
+		s.ks = x.KS[:0]
+	}
+	if c := cap(x.CS); c > cap(s.cs) && c <= maxPooledStack {
+		s.cs = x.CS[:0]
+	}
+	x.KS, x.CS = nil, nil
+	stackPool.Put(s)
 }
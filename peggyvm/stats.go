@@ -0,0 +1,83 @@
+package peggyvm
+
+// Stats summarizes the size and shape of a Program. It is meant for tracking
+// the output of a compiler over time and for checking size budgets.
+type Stats struct {
+	// CodeSize is the length of the bytecode, in bytes.
+	CodeSize uint64
+
+	// NumOps is the number of instructions in the bytecode.
+	NumOps uint64
+
+	// Histogram counts the instructions in the bytecode, by opcode.
+	Histogram map[OpCode]uint64
+
+	// NumLiterals is the number of literals, and LiteralBytes is their
+	// total length.
+	NumLiterals  uint64
+	LiteralBytes uint64
+
+	// NumByteSets is the number of byte set matchers.
+	NumByteSets uint64
+
+	// NumDFAs is the number of DFAs.
+	NumDFAs uint64
+
+	// NumRuneSets is the number of rune set matchers.
+	NumRuneSets uint64
+
+	// NumJumpTables is the number of DISPATCH jump tables.
+	NumJumpTables uint64
+
+	// NumCaptures is the number of captures, including capture 0.
+	NumCaptures uint64
+
+	// MaxOpLength is the length of the longest encoded instruction.
+	MaxOpLength uint
+
+	// MaxNesting is the largest number of CHOICE frames that can be
+	// pending at once within a single call, as computed by VerifyStack.
+	MaxNesting uint
+}
+
+// Stats computes statistics about the Program. It returns an error if the
+// bytecode cannot be decoded or if it fails VerifyStack.
+func (p *Program) Stats() (*Stats, error) {
+	stats := &Stats{
+		CodeSize:      uint64(len(p.Bytes)),
+		Histogram:     make(map[OpCode]uint64),
+		NumLiterals:   uint64(len(p.Literals)),
+		NumByteSets:   uint64(len(p.ByteSets)),
+		NumDFAs:       uint64(len(p.DFAs)),
+		NumRuneSets:   uint64(len(p.RuneSets)),
+		NumJumpTables: uint64(len(p.JumpTables)),
+		NumCaptures:   uint64(len(p.Captures)),
+	}
+	for _, literal := range p.Literals {
+		stats.LiteralBytes += uint64(len(literal))
+	}
+
+	it := p.Instructions()
+	for it.Next() {
+		op := it.Op()
+		stats.NumOps++
+		stats.Histogram[op.Code]++
+		if op.Len > stats.MaxOpLength {
+			stats.MaxOpLength = op.Len
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	depths, _, err := p.stackDepths()
+	if err != nil {
+		return nil, err
+	}
+	for _, depth := range depths {
+		if depth > stats.MaxNesting {
+			stats.MaxNesting = depth
+		}
+	}
+	return stats, nil
+}
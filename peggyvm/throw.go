@@ -0,0 +1,61 @@
+package peggyvm
+
+import (
+	"fmt"
+)
+
+// Thrown describes a label raised by THROW that no RECOVER frame caught.
+type Thrown struct {
+	// Label is the label that was thrown.
+	Label uint64
+
+	// DP is the position in the input at which it was thrown.
+	DP uint64
+}
+
+func (t Thrown) String() string {
+	return fmt.Sprintf("throw %d @ %d", t.Label, t.DP)
+}
+
+// throw unwinds CS to the innermost RECOVER frame for label, skipping the
+// CHOICE/FAIL frames that an ordinary failure would restore. If there is no
+// such frame, the match fails, and Result reports the label.
+func (x *Execution) throw(label uint64) {
+	if x.Observer != nil {
+		x.Observer.OnFail(x, &x.op)
+	}
+	if x.stats != nil {
+		x.stats.Failures++
+	}
+	for {
+		fr, ok := x.popCS()
+		if !ok {
+			x.R = FailureState
+			x.KS = nil
+			x.thrown = &Thrown{Label: label, DP: x.DP}
+			return
+		}
+		if fr.Recover && fr.DP == label {
+			x.XP = fr.XP
+			x.KS = x.KS[:fr.KSLen]
+			x.vs = x.vs[:fr.VSLen]
+			return
+		}
+	}
+}
+
+func execTHROW(x *Execution, op *Op) error {
+	x.throw(op.Imm0)
+	return nil
+}
+
+func execRECOVER(x *Execution, op *Op) error {
+	x.CS = append(x.CS, Frame{
+		Recover: true,
+		DP:      op.Imm1,
+		XP:      addOffset(x.XP, u2s(op.Imm0)),
+		KSLen:   uint64(len(x.KS)),
+		VSLen:   uint64(len(x.vs)),
+	})
+	return nil
+}
@@ -0,0 +1,89 @@
+package peggyvm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Tracer is an Observer that writes one line to W for each instruction
+// executed, before it executes:
+//
+//   r+0x2	DP 0	CS 2	KS 1	SAMEB 'x'
+//
+// The fields are the symbolized XP (see Program.Symbolize), DP, the depths of
+// CS and KS, and the instruction, as Program.Disassemble would write it.
+//
+// All callbacks are also passed on to Next, if it is not nil, so that tracing
+// can be layered on top of another Observer. See Execution.Trace.
+//
+type Tracer struct {
+	// W receives the trace.
+	W io.Writer
+
+	// Next is the Observer being wrapped, or nil.
+	Next Observer
+
+	// Err is the first error returned by W. Once it is set, nothing more
+	// is written.
+	Err error
+
+	buf bytes.Buffer
+}
+
+var _ Observer = (*Tracer)(nil)
+
+// NewTracer returns a Tracer that writes to w.
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{W: w}
+}
+
+func (t *Tracer) OnStep(x *Execution, op *Op) {
+	if t.Err == nil {
+		t.buf.Reset()
+		fmt.Fprintf(&t.buf, "%s\tDP %d\tCS %d\tKS %d\t", x.P.Symbolize(op.XP), x.DP, len(x.CS), len(x.KS))
+		x.P.writeOp(&t.buf, op, op.XP+uint64(op.Len))
+		t.buf.WriteByte('\n')
+		_, t.Err = t.W.Write(t.buf.Bytes())
+	}
+	if t.Next != nil {
+		t.Next.OnStep(x, op)
+	}
+}
+
+func (t *Tracer) OnChoicePush(x *Execution, op *Op) {
+	if t.Next != nil {
+		t.Next.OnChoicePush(x, op)
+	}
+}
+
+func (t *Tracer) OnFail(x *Execution, op *Op) {
+	if t.Next != nil {
+		t.Next.OnFail(x, op)
+	}
+}
+
+func (t *Tracer) OnCaptureCommit(x *Execution, op *Op, a Assignment) {
+	if t.Next != nil {
+		t.Next.OnCaptureCommit(x, op, a)
+	}
+}
+
+func (t *Tracer) OnCall(x *Execution, op *Op) {
+	if t.Next != nil {
+		t.Next.OnCall(x, op)
+	}
+}
+
+// Trace turns tracing on or off. If w is not nil, the Execution's Observer is
+// wrapped in a Tracer that writes to w, replacing any Tracer already
+// installed. If w is nil, any installed Tracer is removed, leaving the
+// Observer that it wrapped. Tracing may be toggled between steps.
+func (x *Execution) Trace(w io.Writer) {
+	if t, ok := x.Observer.(*Tracer); ok {
+		x.Observer = t.Next
+	}
+	if w != nil {
+		x.Observer = &Tracer{W: w, Next: x.Observer}
+	}
+}
@@ -104,6 +104,17 @@ func addOffset(xp uint64, s int64) uint64 {
 	return xp
 }
 
+// tryAddOffset is like addOffset, but returns false instead of panicking.
+func tryAddOffset(xp uint64, s int64) (uint64, bool) {
+	if s < 0 && uint64(-s) > xp {
+		return 0, false
+	}
+	if s >= 0 && uint64(s) > allbits-xp {
+		return 0, false
+	}
+	return addOffset(xp, s), true
+}
+
 func writeByteLiteral(buf *bytes.Buffer, b byte) {
 	if ctrl, found := wellKnownControls[rune(b)]; found {
 		buf.WriteByte('\'')
@@ -0,0 +1,126 @@
+package peggyvm
+
+// Folder is a Go callback that the VFOLD instruction uses to combine the
+// values on top of the value stack into one, such as the two operands of a
+// sum into their total. It is passed the values, bottom first, and returns
+// the value that replaces them. If it returns an error, the Execution halts
+// with a RuntimeError whose Err is that error. The slice is not reused, but
+// the values may be shared with other alternatives, and must not be
+// modified.
+type Folder func(values []interface{}) (interface{}, error)
+
+// valueEntry is an entry of the value stack.
+//
+// Like KS, the stack is append-only, so that a CHOICE frame can restore it by
+// truncation: VFOLD does not pop the values that it folds, but appends the
+// result with below pointing past them. The live entries are those reached
+// from the last one by following below.
+type valueEntry struct {
+	v interface{}
+
+	// below is the index of the entry beneath this one, or -1.
+	below int
+}
+
+// AddFolder appends fn to the program's folders, and returns its index, for
+// use as the first immediate of VFOLD. Like predicates, folders are not
+// serialized; see AddPredicate.
+func (p *Program) AddFolder(fn Folder) uint64 {
+	p.folders = append(p.folders, fn)
+	return uint64(len(p.folders) - 1)
+}
+
+// Folders returns the program's folders, indexed as by VFOLD.
+func (p *Program) Folders() []Folder {
+	return p.folders
+}
+
+// Values returns the live contents of the value stack, bottom first.
+func (x *Execution) Values() []interface{} {
+	var out []interface{}
+	for i := len(x.vs) - 1; i >= 0; i = x.vs[i].below {
+		out = append(out, x.vs[i].v)
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// Value returns the value on top of the value stack, or nil if it is empty.
+func (x *Execution) Value() interface{} {
+	if len(x.vs) == 0 {
+		return nil
+	}
+	return x.vs[len(x.vs)-1].v
+}
+
+// pushValue pushes v onto the value stack, on top of the entry at below.
+func (x *Execution) pushValue(v interface{}, below int) {
+	x.vs = append(x.vs, valueEntry{v: v, below: below})
+}
+
+// lastCapture returns the span of the last completed assignment to capture
+// idx, as Result would report it, or false if there is none.
+func (x *Execution) lastCapture(idx uint64) (uint64, uint64, bool) {
+	for i := len(x.KS) - 1; i >= 0; i-- {
+		if a := x.KS[i]; a.Index != idx || !a.IsEnd {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if a := x.KS[j]; a.Index == idx && !a.IsEnd {
+				return a.DP, x.KS[i].DP, true
+			}
+		}
+		return 0, x.KS[i].DP, true
+	}
+	return 0, 0, false
+}
+
+func execVCAP(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.Captures)) {
+		return ErrIndexRange
+	}
+	if x.MatchOnly {
+		return nil
+	}
+	var v interface{}
+	if s, e, ok := x.lastCapture(op.Imm0); ok {
+		if s > e {
+			s, e = e, s
+		}
+		var text []byte
+		if x.In != nil {
+			text = x.In.Slice(s, e)
+		} else {
+			text = x.I[s-x.base : e-x.base]
+		}
+		v = append([]byte(nil), text...)
+	}
+	x.pushValue(v, len(x.vs)-1)
+	return nil
+}
+
+func execVFOLD(x *Execution, op *Op) error {
+	if op.Imm0 >= uint64(len(x.P.folders)) {
+		return ErrIndexRange
+	}
+	if x.MatchOnly {
+		return nil
+	}
+	values := make([]interface{}, op.Imm1)
+	i := len(x.vs) - 1
+	for k := len(values) - 1; k >= 0; k-- {
+		if i < 0 {
+			return ErrCountRange
+		}
+		values[k] = x.vs[i].v
+		i = x.vs[i].below
+	}
+	v, err := x.P.folders[op.Imm0](values)
+	if err != nil {
+		return err
+	}
+	x.pushValue(v, i)
+	return nil
+}
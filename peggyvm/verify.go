@@ -0,0 +1,274 @@
+package peggyvm
+
+import (
+	"io"
+)
+
+// VerifyStack checks, without running the program, that every path through
+// the code keeps the CHOICE/COMMIT and CALL/RET pairs balanced.
+//
+// The check tracks how many CHOICE frames are pending at each instruction,
+// counted from the start of the enclosing call; a MEMOGET frame, pushed when
+// MEMOGET misses and popped by MEMOSET, counts as one, as does a RECOVER
+// frame, popped by COMMIT. Analysis starts at XP 0, at
+// each entry point, and at each CALL target, with no frames pending. It is an
+// error for:
+//
+//   - a COMMIT, PCOMMIT, BCOMMIT, FAIL2X, or MEMOSET to execute with no
+//     frame pending, as it would find a CALL frame or an empty stack instead
+//     (ErrNoChoicePending);
+//
+//   - a RET to execute with a CHOICE frame pending (ErrChoicePending);
+//
+//   - two paths to reach the same instruction with different numbers of
+//     frames pending, as happens when a loop pushes a frame on every
+//     iteration (ErrStackDepth).
+//
+// Only code reachable from the starting points is checked.
+//
+func (p *Program) VerifyStack() error {
+	_, _, err := p.stackDepths()
+	return p.annotate(err)
+}
+
+// stackDepths performs the analysis for VerifyStack, returning the number of
+// CHOICE frames pending at each reachable instruction, and the set of numbers
+// pending when execution reaches the end of the code.
+func (p *Program) stackDepths() (map[uint64]uint, map[uint]struct{}, error) {
+	depths := make(map[uint64]uint)
+	ends := make(map[uint]struct{})
+	type state struct {
+		xp    uint64
+		depth uint
+	}
+	var queue []state
+
+	visit := func(xp uint64, depth uint, from uint64) error {
+		if xp == uint64(len(p.Bytes)) {
+			ends[depth] = struct{}{}
+			return nil
+		}
+		if xp > uint64(len(p.Bytes)) {
+			return &DisassembleError{Err: ErrCodeOffsetRange, XP: from}
+		}
+		if d, found := depths[xp]; found {
+			if d != depth {
+				return &VerifyError{Err: ErrStackDepth, XP: xp}
+			}
+			return nil
+		}
+		depths[xp] = depth
+		queue = append(queue, state{xp, depth})
+		return nil
+	}
+
+	if err := visit(0, 0, 0); err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range p.Entries {
+		if err := visit(entry.Offset, 0, entry.Offset); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for len(queue) != 0 {
+		s := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		var op Op
+		err := op.Decode(p.Bytes, s.xp)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		next := s.xp + uint64(op.Len)
+
+		var target uint64
+		meta := op.Code.Meta()
+		for _, pair := range []struct {
+			m ImmMeta
+			v uint64
+		}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+			if pair.m.Type == ImmCodeOffset {
+				offset := u2s(pair.v)
+				var ok bool
+				if target, ok = tryAddOffset(next, offset); !ok {
+					return nil, nil, &DisassembleError{Err: ErrCodeOffsetRange, XP: s.xp}
+				}
+			}
+		}
+
+		var succs []state
+		switch op.Code {
+		case OpCHOICE, OpMEMOGET, OpRECOVER:
+			succs = []state{{next, s.depth + 1}, {target, s.depth}}
+
+		case OpCOMMIT, OpBCOMMIT, OpDCOMMIT, OpPCOMMIT, OpFAIL2X, OpMEMOSET:
+			if s.depth == 0 {
+				return nil, nil, &VerifyError{Err: ErrNoChoicePending, XP: s.xp}
+			}
+			switch op.Code {
+			case OpMEMOSET:
+				succs = []state{{next, s.depth - 1}}
+			case OpCOMMIT, OpBCOMMIT, OpDCOMMIT:
+				succs = []state{{target, s.depth - 1}}
+			case OpPCOMMIT:
+				succs = []state{{next, s.depth}, {target, s.depth - 1}}
+			}
+
+		case OpRET:
+			if s.depth != 0 {
+				return nil, nil, &VerifyError{Err: ErrChoicePending, XP: s.xp}
+			}
+
+		case OpCALL, OpBEHINDB:
+			succs = []state{{next, s.depth}, {target, 0}}
+
+		case OpJMP:
+			succs = []state{{target, s.depth}}
+
+		case OpTANYB, OpTSAMEB, OpTLITB, OpTMATCHB, OpTMATCHR, OpTSPANB:
+			succs = []state{{next, s.depth}, {target, s.depth}}
+
+		case OpDISPATCH:
+			if op.Imm0 >= uint64(len(p.JumpTables)) {
+				return nil, nil, &VerifyError{Err: ErrIndexRange, XP: s.xp}
+			}
+			for _, target := range p.JumpTables[op.Imm0].distinctTargets() {
+				succs = append(succs, state{target, s.depth})
+			}
+
+		case OpFAIL, OpEND, OpGIVEUP, OpTHROW:
+			// no successors
+
+		default:
+			succs = []state{{next, s.depth}}
+		}
+
+		for _, succ := range succs {
+			if err := visit(succ.xp, succ.depth, s.xp); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return depths, ends, nil
+}
+
+// Validate statically checks the whole program, returning every violation
+// found, or nil if there are none. Unlike Match, which may fail partway
+// through on corrupt bytecode, Validate examines all of the code:
+//
+//   - every byte must decode as part of a valid instruction;
+//
+//   - every code offset, and every entry point, must refer to the start of an
+//     instruction or to the end of the code (ErrCodeOffsetRange if outside the
+//     program, ErrMisalignedTarget if inside an instruction);
+//
+//   - every literal, matcher, capture, DFA, and jump table index must be in
+//     range (ErrIndexRange);
+//
+//   - every jump table used by DISPATCH must have sorted keys, each with a
+//     target (ErrBadJumpTable), and each target must be valid as for a code
+//     offset;
+//
+//   - if all of the above hold, the stack must be balanced, as checked by
+//     VerifyStack.
+//
+func (p *Program) Validate() []*VerifyError {
+	var out []*VerifyError
+	report := func(err error, xp uint64) {
+		out = append(out, &VerifyError{Err: err, XP: xp, Symbol: p.Symbolize(xp)})
+	}
+
+	var ops []Op
+	boundaries := make(map[uint64]struct{})
+	it := p.Instructions()
+	for it.Next() {
+		boundaries[it.XP()] = struct{}{}
+		ops = append(ops, *it.Op())
+	}
+	xp := it.XP()
+	if err := it.Err(); err != nil {
+		if x, ok := err.(*DisassembleError); ok {
+			err = x.Err
+		}
+		report(err, xp)
+	}
+	boundaries[xp] = struct{}{}
+
+	checkTarget := func(target uint64, from uint64) {
+		if target > xp {
+			report(ErrCodeOffsetRange, from)
+		} else if _, found := boundaries[target]; !found {
+			report(ErrMisalignedTarget, from)
+		}
+	}
+
+	for _, op := range ops {
+		next := op.XP + uint64(op.Len)
+		meta := op.Code.Meta()
+		for _, pair := range []struct {
+			m ImmMeta
+			v uint64
+		}{{meta.Imm0, op.Imm0}, {meta.Imm1, op.Imm1}, {meta.Imm2, op.Imm2}} {
+			var limit int
+			switch pair.m.Type {
+			case ImmCodeOffset:
+				if target, ok := tryAddOffset(next, u2s(pair.v)); ok {
+					checkTarget(target, op.XP)
+				} else {
+					report(ErrCodeOffsetRange, op.XP)
+				}
+				continue
+			case ImmLiteralIdx:
+				limit = len(p.Literals)
+			case ImmMatcherIdx:
+				limit = len(p.ByteSets)
+			case ImmCaptureIdx:
+				limit = len(p.Captures)
+			case ImmDFAIdx:
+				limit = len(p.DFAs)
+			case ImmRuneSetIdx:
+				limit = len(p.RuneSets)
+			case ImmJumpTableIdx:
+				limit = len(p.JumpTables)
+			case ImmPredicateIdx, ImmFolderIdx:
+				// Checked by PRED and VFOLD instead: the callbacks are
+				// not serialized, so a program being loaded has none yet.
+				continue
+			default:
+				continue
+			}
+			if pair.v >= uint64(limit) {
+				report(ErrIndexRange, op.XP)
+			}
+		}
+		if op.Code == OpDISPATCH && op.Imm0 < uint64(len(p.JumpTables)) {
+			table := &p.JumpTables[op.Imm0]
+			if !table.wellFormed() {
+				report(ErrBadJumpTable, op.XP)
+				continue
+			}
+			for _, target := range table.distinctTargets() {
+				checkTarget(target, op.XP)
+			}
+		}
+	}
+
+	for _, entry := range p.Entries {
+		checkTarget(entry.Offset, entry.Offset)
+	}
+
+	if len(out) == 0 {
+		if err := p.VerifyStack(); err != nil {
+			x, ok := err.(*VerifyError)
+			if !ok {
+				x = &VerifyError{Err: err}
+			}
+			out = append(out, x)
+		}
+	}
+	return out
+}
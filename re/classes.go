@@ -0,0 +1,65 @@
+package re
+
+import (
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+var (
+	classDigit = byteset.Ranges(byteset.Range{Lo: '0', Hi: '9'})
+	classLower = byteset.Ranges(byteset.Range{Lo: 'a', Hi: 'z'})
+	classUpper = byteset.Ranges(byteset.Range{Lo: 'A', Hi: 'Z'})
+	classAlpha = byteset.Ranges(
+		byteset.Range{Lo: 'A', Hi: 'Z'},
+		byteset.Range{Lo: 'a', Hi: 'z'})
+	classAlnum = byteset.Ranges(
+		byteset.Range{Lo: '0', Hi: '9'},
+		byteset.Range{Lo: 'A', Hi: 'Z'},
+		byteset.Range{Lo: 'a', Hi: 'z'})
+	classXDigit = byteset.Ranges(
+		byteset.Range{Lo: '0', Hi: '9'},
+		byteset.Range{Lo: 'A', Hi: 'F'},
+		byteset.Range{Lo: 'a', Hi: 'f'})
+	classSpace = byteset.Ranges(
+		byteset.Range{Lo: '\t', Hi: '\r'},
+		byteset.Range{Lo: ' ', Hi: ' '})
+	classCntrl = byteset.Ranges(
+		byteset.Range{Lo: 0x00, Hi: 0x1f},
+		byteset.Range{Lo: 0x7f, Hi: 0x7f})
+	classGraph = byteset.Ranges(byteset.Range{Lo: 0x21, Hi: 0x7e})
+	classPunct = byteset.Ranges(
+		byteset.Range{Lo: 0x21, Hi: 0x2f},
+		byteset.Range{Lo: 0x3a, Hi: 0x40},
+		byteset.Range{Lo: 0x5b, Hi: 0x60},
+		byteset.Range{Lo: 0x7b, Hi: 0x7e})
+)
+
+var predefinedClasses = map[byte]byteset.Matcher{
+	'a': classAlpha,
+	'c': classCntrl,
+	'd': classDigit,
+	'g': classGraph,
+	'l': classLower,
+	'p': classPunct,
+	's': classSpace,
+	'u': classUpper,
+	'w': classAlnum,
+	'x': classXDigit,
+}
+
+// lookupClass returns the predefined class with the given name. An uppercase
+// name denotes the complement of the corresponding lowercase class.
+func lookupClass(name string) (byteset.Matcher, bool) {
+	if len(name) != 1 {
+		return nil, false
+	}
+	ch := name[0]
+	if m, found := predefinedClasses[ch]; found {
+		return m, true
+	}
+	if ch >= 'A' && ch <= 'Z' {
+		if m, found := predefinedClasses[ch+('a'-'A')]; found {
+			return byteset.Not(m).Optimize(), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,47 @@
+// Package re compiles patterns written in a compact, one-line notation
+// modeled on LPeg's "re" module.
+//
+//   p := re.MustCompile(`{ [0-9]+ } '.' { [0-9]+ }`)
+//   ok := p.MatchString("3.14")
+//
+// A pattern is either a single expression or a grammar of one or more
+// definitions; the first definition of a grammar is its start rule.
+//
+//   pattern     <- S (grammar / choice) !.
+//   grammar     <- definition+
+//   definition  <- name S '<-' S choice
+//   choice      <- sequence ('/' S sequence)*
+//   sequence    <- prefix*
+//   prefix      <- '&' S prefix / '!' S prefix / suffix
+//   suffix      <- primary S (([+*?] / '^' [+-]? [0-9]+) S)*
+//   primary     <- '(' S choice ')' / string / class / defined
+//                / '{:' (name ':')? S choice ':}'
+//                / '{}' / '{' S choice '}'
+//                / '.' / name S !'<-' / '<' name '>'
+//   string      <- '"' [^"]* '"' / "'" [^']* "'"
+//   class       <- '[' '^'? item (!']' item)* ']'
+//   item        <- defined / . '-' [^\]] / .
+//   defined     <- '%' name
+//   S           <- ([ \t\r\n] / '--' [^\n]*)*
+//
+// Strings have no escape sequences. Inside a class, ']' may appear as the
+// first item.
+//
+// The suffix p^n matches at least n repetitions of p, as does p^+n; p^-n
+// matches at most n repetitions. As each repetition is expanded into the
+// grammar, n may be at most MaxRepeatCount, and the expansion of a
+// repetition, including any repetitions nested inside it, may be at most
+// MaxRepeatSize nodes.
+//
+// The following predefined classes may be referenced with %: %a (letters),
+// %c (control characters), %d (digits), %g (printable characters except
+// space), %l (lowercase letters), %p (punctuation), %s (whitespace), %u
+// (uppercase letters), %w (letters and digits), and %x (hexadecimal digits).
+// The uppercase forms, e.g. %D, match the complement. %nl matches a newline.
+//
+// { p } captures the input matched by p, {: p :} is a synonym, and
+// {:name: p :} is a named capture. {} captures the empty string, recording
+// the current position. Captures other than these, back references, and
+// substitutions are not supported.
+//
+package re
@@ -0,0 +1,14 @@
+package re
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnknownClass       = errors.New("unknown predefined class")
+	ErrUnsupported        = errors.New("unsupported construct")
+	ErrExpectedCount      = errors.New("expected repetition count")
+	ErrCountRange         = errors.New("repetition count out of range")
+	ErrExpectedCloseAngle = errors.New("expected '>'")
+	ErrTrailingInput      = errors.New("unexpected input after pattern")
+)
@@ -0,0 +1,483 @@
+package re
+
+import (
+	"github.com/chronos-tachyon/go-peggy"
+	"github.com/chronos-tachyon/go-peggy/byteset"
+)
+
+// startRule is the name given to the rule holding a single-expression pattern.
+const startRule = "pattern"
+
+// MaxRepeatCount is the largest n accepted by the p^n, p^+n, and p^-n
+// suffixes.
+const MaxRepeatCount = 4096
+
+// MaxRepeatSize is the largest number of expression nodes that a repetition
+// suffix may expand to, counting the expansion of any repetitions nested
+// inside it. It keeps patterns such as (('a'^-300)^-300)^-300 from growing
+// without bound.
+const MaxRepeatSize = 1 << 16
+
+// Parse parses a pattern into a peggy.Grammar. See the package documentation
+// for the syntax.
+func Parse(pattern string) (*peggy.Grammar, error) {
+	p := &parser{src: pattern}
+	return p.parsePattern()
+}
+
+type parser struct {
+	src   string
+	pos   int
+	sizes map[peggy.Expr]uint
+}
+
+type parseError struct {
+	err error
+	pos int
+}
+
+func (p *parser) fail(err error, pos int) {
+	panic(parseError{err, pos})
+}
+
+func (p *parser) syntaxError(err error, pos int) *peggy.SyntaxError {
+	line, col := uint(1), uint(1)
+	for i := 0; i < pos && i < len(p.src); i++ {
+		if p.src[i] == '\n' {
+			line += 1
+			col = 1
+		} else {
+			col += 1
+		}
+	}
+	return &peggy.SyntaxError{Err: err, Line: line, Column: col}
+}
+
+func (p *parser) parsePattern() (g *peggy.Grammar, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe, ok := r.(parseError)
+			if !ok {
+				panic(r)
+			}
+			g = nil
+			err = p.syntaxError(pe.err, pe.pos)
+		}
+	}()
+
+	g = &peggy.Grammar{Source: p.src}
+	p.skipSpace()
+	if p.atDefinition() {
+		for p.atDefinition() {
+			name := p.parseName()
+			p.skipSpace()
+			p.consume("<-")
+			p.skipSpace()
+			g.Rules = append(g.Rules, &peggy.Rule{Name: name, Expr: p.parseChoice()})
+		}
+	} else {
+		g.Rules = append(g.Rules, &peggy.Rule{Name: startRule, Expr: p.parseChoice()})
+	}
+	if p.pos < len(p.src) {
+		p.fail(ErrTrailingInput, p.pos)
+	}
+	return g, nil
+}
+
+// atDefinition returns true iff the input is positioned at "name <-".
+func (p *parser) atDefinition() bool {
+	save := p.pos
+	defer func() { p.pos = save }()
+	if p.parseName() == "" {
+		return false
+	}
+	p.skipSpace()
+	return p.lookingAt("<-")
+}
+
+func (p *parser) parseChoice() peggy.Expr {
+	alts := []peggy.Expr{p.parseSequence()}
+	for p.consume("/") {
+		p.skipSpace()
+		alts = append(alts, p.parseSequence())
+	}
+	if len(alts) == 1 {
+		return alts[0]
+	}
+	return &peggy.Choice{Alts: alts}
+}
+
+func (p *parser) parseSequence() peggy.Expr {
+	var items []peggy.Expr
+	for {
+		item := p.parsePrefix()
+		if item == nil {
+			break
+		}
+		items = append(items, item)
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return &peggy.Sequence{Items: items}
+}
+
+func (p *parser) parsePrefix() peggy.Expr {
+	start := p.pos
+	switch {
+	case p.consume("&"):
+		p.skipSpace()
+		e := p.parsePrefix()
+		if e == nil {
+			p.fail(peggy.ErrExpectedExpression, start)
+		}
+		return &peggy.And{Expr: e}
+
+	case p.consume("!"):
+		p.skipSpace()
+		e := p.parsePrefix()
+		if e == nil {
+			p.fail(peggy.ErrExpectedExpression, start)
+		}
+		return &peggy.Not{Expr: e}
+	}
+	return p.parseSuffix()
+}
+
+func (p *parser) parseSuffix() peggy.Expr {
+	e := p.parsePrimary()
+	if e == nil {
+		return nil
+	}
+	for {
+		start := p.pos
+		switch {
+		case p.consume("*"):
+			e = &peggy.Star{Expr: e}
+		case p.consume("+"):
+			e = &peggy.Plus{Expr: e}
+		case p.consume("?"):
+			e = &peggy.Optional{Expr: e}
+		case p.consume("^"):
+			atMost := p.consume("-")
+			if !atMost {
+				p.consume("+")
+			}
+			numStart := p.pos
+			n, ok := p.parseNumber()
+			if !ok {
+				p.fail(ErrExpectedCount, p.pos)
+			}
+			if n > MaxRepeatCount || n*(p.size(e)+2) > MaxRepeatSize {
+				p.fail(ErrCountRange, numStart)
+			}
+			if atMost {
+				e = repeatAtMost(e, n)
+			} else {
+				e = repeatAtLeast(e, n)
+			}
+		case p.lookingAt("->"):
+			p.fail(ErrUnsupported, start)
+		default:
+			return e
+		}
+		p.skipSpace()
+	}
+}
+
+func (p *parser) parsePrimary() peggy.Expr {
+	if p.pos >= len(p.src) {
+		return nil
+	}
+	start := p.pos
+	ch := p.src[p.pos]
+	switch {
+	case ch == '(':
+		p.pos += 1
+		p.skipSpace()
+		e := p.parseChoice()
+		if !p.consume(")") {
+			p.fail(peggy.ErrExpectedCloseParen, p.pos)
+		}
+		p.skipSpace()
+		return e
+
+	case p.lookingAt("{~") || p.lookingAt("{|"):
+		p.fail(ErrUnsupported, start)
+
+	case p.consume("{:"):
+		var name string
+		save := p.pos
+		if id := p.parseName(); id != "" && p.consume(":") {
+			name = id
+		} else {
+			p.pos = save
+		}
+		p.skipSpace()
+		e := p.parseChoice()
+		if !p.consume(":}") {
+			p.fail(peggy.ErrExpectedCloseBrace, p.pos)
+		}
+		p.skipSpace()
+		return &peggy.Capture{Name: name, Expr: e}
+
+	case p.consume("{}"):
+		p.skipSpace()
+		return &peggy.Capture{Expr: &peggy.Sequence{}}
+
+	case p.consume("{"):
+		p.skipSpace()
+		e := p.parseChoice()
+		if !p.consume("}") {
+			p.fail(peggy.ErrExpectedCloseBrace, p.pos)
+		}
+		p.skipSpace()
+		return &peggy.Capture{Expr: e}
+
+	case ch == '\'' || ch == '"':
+		p.pos += 1
+		lit := p.parseString(ch)
+		p.skipSpace()
+		return &peggy.Literal{Bytes: lit}
+
+	case ch == '[':
+		p.pos += 1
+		set := p.parseClass()
+		p.skipSpace()
+		return &peggy.Class{Set: set}
+
+	case ch == '%':
+		p.pos += 1
+		e := p.parseDefined(start)
+		p.skipSpace()
+		return e
+
+	case ch == '.':
+		p.pos += 1
+		p.skipSpace()
+		return &peggy.Any{}
+
+	case ch == '=':
+		p.fail(ErrUnsupported, start)
+
+	case ch == '<':
+		p.pos += 1
+		name := p.parseName()
+		if name == "" || !p.consume(">") {
+			p.fail(ErrExpectedCloseAngle, p.pos)
+		}
+		p.skipSpace()
+		return &peggy.Ref{Name: name}
+
+	case isNameStart(ch):
+		if p.atDefinition() {
+			// Start of the next definition.
+			return nil
+		}
+		name := p.parseName()
+		p.skipSpace()
+		return &peggy.Ref{Name: name}
+	}
+	return nil
+}
+
+func (p *parser) parseString(quote byte) []byte {
+	start := p.pos - 1
+	for i := p.pos; i < len(p.src); i++ {
+		if p.src[i] == quote {
+			lit := []byte(p.src[p.pos:i])
+			p.pos = i + 1
+			return lit
+		}
+	}
+	p.fail(peggy.ErrUnterminatedLiteral, start)
+	return nil
+}
+
+func (p *parser) parseClass() byteset.Matcher {
+	start := p.pos - 1
+	negate := p.consume("^")
+	var ms []byteset.Matcher
+	var ranges []byteset.Range
+	first := true
+	for {
+		if p.pos >= len(p.src) {
+			p.fail(peggy.ErrUnterminatedClass, start)
+		}
+		ch := p.src[p.pos]
+		if ch == ']' && !first {
+			p.pos += 1
+			break
+		}
+		first = false
+		if ch == '%' {
+			itemStart := p.pos
+			p.pos += 1
+			name := p.parseName()
+			m, found := lookupClass(name)
+			if !found {
+				p.fail(ErrUnknownClass, itemStart)
+			}
+			ms = append(ms, m)
+			continue
+		}
+		if ch >= 0x80 {
+			p.fail(peggy.ErrNonASCIIClass, p.pos)
+		}
+		p.pos += 1
+		hi := ch
+		if p.lookingAt("-") && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+			hi = p.src[p.pos+1]
+			if hi >= 0x80 {
+				p.fail(peggy.ErrNonASCIIClass, p.pos+1)
+			}
+			p.pos += 2
+		}
+		ranges = append(ranges, byteset.Range{Lo: ch, Hi: hi})
+	}
+	ms = append(ms, byteset.Ranges(ranges...))
+	var m byteset.Matcher = byteset.Or(ms...)
+	if negate {
+		m = byteset.Not(m)
+	}
+	return m.Optimize()
+}
+
+func (p *parser) parseDefined(start int) peggy.Expr {
+	name := p.parseName()
+	if name == "nl" {
+		return &peggy.Literal{Bytes: []byte{'\n'}}
+	}
+	m, found := lookupClass(name)
+	if !found {
+		p.fail(ErrUnknownClass, start)
+	}
+	return &peggy.Class{Set: m}
+}
+
+func (p *parser) parseNumber() (uint, bool) {
+	start := p.pos
+	var n uint
+	for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+		digit := uint(p.src[p.pos] - '0')
+		if n > (^uint(0)-digit)/10 {
+			p.fail(ErrCountRange, start)
+		}
+		n = n*10 + digit
+		p.pos += 1
+	}
+	return n, p.pos > start
+}
+
+func (p *parser) parseName() string {
+	start := p.pos
+	if p.pos >= len(p.src) || !isNameStart(p.src[p.pos]) {
+		return ""
+	}
+	p.pos += 1
+	for p.pos < len(p.src) && isNameContinue(p.src[p.pos]) {
+		p.pos += 1
+	}
+	return p.src[start:p.pos]
+}
+
+// skipSpace skips over whitespace and "--" comments.
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch {
+		case p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\r' || p.src[p.pos] == '\n':
+			p.pos += 1
+		case p.lookingAt("--"):
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos += 1
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *parser) lookingAt(s string) bool {
+	return len(p.src)-p.pos >= len(s) && p.src[p.pos:p.pos+len(s)] == s
+}
+
+func (p *parser) consume(s string) bool {
+	if p.lookingAt(s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z')
+}
+
+func isNameContinue(ch byte) bool {
+	return isNameStart(ch) || (ch >= '0' && ch <= '9')
+}
+
+// size returns the number of nodes in e once every shared subexpression has
+// been expanded, as the compiler will do. Results are memoized, so that the
+// cost stays bounded by MaxRepeatSize even though repetitions share nodes.
+func (p *parser) size(e peggy.Expr) uint {
+	if n, found := p.sizes[e]; found {
+		return n
+	}
+	n := uint(1)
+	switch x := e.(type) {
+	case *peggy.Sequence:
+		for _, item := range x.Items {
+			n += p.size(item)
+		}
+	case *peggy.Choice:
+		for _, alt := range x.Alts {
+			n += p.size(alt)
+		}
+	case *peggy.Star:
+		n += p.size(x.Expr)
+	case *peggy.Plus:
+		n += p.size(x.Expr)
+	case *peggy.Optional:
+		n += p.size(x.Expr)
+	case *peggy.And:
+		n += p.size(x.Expr)
+	case *peggy.Not:
+		n += p.size(x.Expr)
+	case *peggy.Capture:
+		n += p.size(x.Expr)
+	}
+	if p.sizes == nil {
+		p.sizes = make(map[peggy.Expr]uint)
+	}
+	p.sizes[e] = n
+	return n
+}
+
+// repeatAtLeast returns an expression matching n or more repetitions of e.
+func repeatAtLeast(e peggy.Expr, n uint) peggy.Expr {
+	if n == 0 {
+		return &peggy.Star{Expr: e}
+	}
+	items := make([]peggy.Expr, 0, n)
+	for i := uint(1); i < n; i++ {
+		items = append(items, e)
+	}
+	items = append(items, &peggy.Plus{Expr: e})
+	if len(items) == 1 {
+		return items[0]
+	}
+	return &peggy.Sequence{Items: items}
+}
+
+// repeatAtMost returns an expression matching up to n repetitions of e.
+func repeatAtMost(e peggy.Expr, n uint) peggy.Expr {
+	if n == 0 {
+		return &peggy.Sequence{}
+	}
+	var out peggy.Expr = &peggy.Optional{Expr: e}
+	for i := uint(1); i < n; i++ {
+		out = &peggy.Optional{Expr: &peggy.Sequence{Items: []peggy.Expr{e, out}}}
+	}
+	return out
+}
@@ -0,0 +1,27 @@
+package re
+
+import (
+	"fmt"
+
+	"github.com/chronos-tachyon/go-peggy"
+)
+
+// Compile parses a pattern and, if successful, returns a peggy.Pattern that
+// can be used to match against input.
+func Compile(pattern string) (*peggy.Pattern, error) {
+	g, err := Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return peggy.CompileGrammar(g)
+}
+
+// MustCompile is like Compile but panics if the pattern cannot be compiled.
+// It simplifies safe initialization of global variables holding patterns.
+func MustCompile(pattern string) *peggy.Pattern {
+	p, err := Compile(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("re: Compile(%q): %v", pattern, err))
+	}
+	return p
+}
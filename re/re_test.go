@@ -0,0 +1,114 @@
+package re
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chronos-tachyon/go-peggy"
+)
+
+func TestParse_String(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{`[0-9]+ '.' [0-9]+`, "pattern <- [0-9]+ '.' [0-9]+\n"},
+		testrow{`%d^2 %a^-2`, "pattern <- ([0-9] [0-9]+) ([A-Za-z] [A-Za-z]?)?\n"},
+		testrow{`[]%s-]`, "pattern <- [\\t-\\r \\-\\]]\n"},
+		testrow{`{:key: %w+ :} {} %nl`, "pattern <- { key: [0-9A-Za-z]+ } { '' } '\\n'\n"},
+		testrow{"S <- A / B -- comment\nA <- 'a' <B>\nB <- \"b\"", "S <- A / B\nA <- 'a' B\nB <- 'b'\n"},
+		testrow{`!%D &. [^%c]`, "pattern <- ![\\x00-/:-\\xff] &. [ -~\\x80-\\xff]\n"},
+	}
+
+	for i, row := range data {
+		g, err := Parse(row.Input)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		actual := g.String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: wrong output:\n\texpected: %q\n\tactual: %q", t.Name(), i, row.Expected, actual)
+		}
+	}
+}
+
+func TestCompile_errors(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected error
+	}
+
+	data := []testrow{
+		testrow{"'a", peggy.ErrUnterminatedLiteral},
+		testrow{"[a", peggy.ErrUnterminatedClass},
+		testrow{"%q", ErrUnknownClass},
+		testrow{"[%q]", ErrUnknownClass},
+		testrow{"'a'^x", ErrExpectedCount},
+		testrow{"'a'^18446744073709551617", ErrCountRange},
+		testrow{"'a'^-18446744073709551617", ErrCountRange},
+		testrow{"'a'^50000000", ErrCountRange},
+		testrow{"'a'^-50000000", ErrCountRange},
+		testrow{"(('a'^-300)^-300)^-300", ErrCountRange},
+		testrow{"(('a'^300)^300)^300", ErrCountRange},
+		testrow{"{~ 'a' ~}", ErrUnsupported},
+		testrow{"=name", ErrUnsupported},
+		testrow{"'a' -> 'b'", ErrUnsupported},
+		testrow{"<name", ErrExpectedCloseAngle},
+		testrow{"'a' )", ErrTrailingInput},
+		testrow{"('a'", peggy.ErrExpectedCloseParen},
+		testrow{"A <- B", peggy.ErrUndefinedRule},
+	}
+
+	for i, row := range data {
+		_, err := Compile(row.Input)
+		var actual error
+		switch x := err.(type) {
+		case *peggy.SyntaxError:
+			actual = x.Err
+		case *peggy.CompileError:
+			actual = x.Err
+		default:
+			actual = err
+		}
+		if !errors.Is(actual, row.Expected) {
+			t.Errorf("%s/%03d: %q: expected %v, got %v", t.Name(), i, row.Input, row.Expected, err)
+		}
+	}
+}
+
+func TestCompile_Match(t *testing.T) {
+	type testrow struct {
+		Pattern  string
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{`[0-9]+ '.' [0-9]+`, "3.14", "{true [0:{(0,4) [(0,4)]}]}"},
+		testrow{`[0-9]+ '.' [0-9]+`, "3.x", "{false}"},
+		testrow{`{%a^3} !.`, "abc", "{true [0:{(0,3) [(0,3)]} 1:{(0,3) [(0,3)]}]}"},
+		testrow{`{%a^3} !.`, "ab", "{false}"},
+		testrow{`{'x'^-2} {}`, "xxx", "{true [0:{(0,2) [(0,2)]} 1:{(0,2) [(0,2)]} 2:{(2,2) [(2,2)]}]}"},
+		testrow{`{:k: %l+ :} '=' {:v: %d+ :}`, "ab=12", "{true [0:{(0,5) [(0,5)]} 1:{(0,2) [(0,2)]} 2:{(3,5) [(3,5)]}]}"},
+		testrow{"list <- item (',' item)* !.\nitem <- { %d+ }", "1,22", "{true [0:{(0,4) [(0,4)]} 1:{(2,4) [(0,1) (2,4)]}]}"},
+		testrow{`{ %d }^2`, "12", "{true [0:{(0,2) [(0,2)]} 1:{(1,2) [(0,1) (1,2)]}]}"},
+	}
+
+	for i, row := range data {
+		p, err := Compile(row.Pattern)
+		if err != nil {
+			t.Errorf("%s/%03d: error: %v", t.Name(), i, err)
+			continue
+		}
+		if p.String() != row.Pattern {
+			t.Errorf("%s/%03d: String: expected %q, got %q", t.Name(), i, row.Pattern, p.String())
+		}
+		actual := p.MatchResult([]byte(row.Input)).String()
+		if actual != row.Expected {
+			t.Errorf("%s/%03d: %q: wrong output:\n\texpected: %s\n\tactual: %s", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package runeset
+
+import (
+	"unicode/utf8"
+)
+
+// All returns a Matcher that matches every valid rune, 0 through
+// utf8.MaxRune. Surrogates are included, although they cannot be encoded in
+// UTF-8.
+func All() Matcher { return singletonAll }
+
+type mAll struct{}
+
+var _ Matcher = (*mAll)(nil)
+var singletonAll = &mAll{}
+
+func (m *mAll) Match(r rune) bool            { return r >= 0 && r <= utf8.MaxRune }
+func (m *mAll) ForEachRange(f func(r Range)) { f(Range{Lo: 0, Hi: utf8.MaxRune}) }
+func (m *mAll) String() string               { return "." }
@@ -0,0 +1,3 @@
+// Package runeset provides the Matcher interface for Unicode runes, the
+// counterpart of package byteset for UTF-8 text.
+package runeset
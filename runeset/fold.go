@@ -0,0 +1,82 @@
+package runeset
+
+import (
+	"sync"
+	"unicode"
+)
+
+// Fold returns a Matcher for the runes that are equivalent, under Unicode
+// simple case folding, to some rune that the given Matcher matches. For
+// example, Fold(Ranges(Range{'a', 'z'})) also matches 'A' through 'Z', as
+// well as 'ſ' (U+017F) and 'K' (U+212A), which fold to 's' and 'k'.
+func Fold(m Matcher) Matcher {
+	return &mFold{Inner: m}
+}
+
+type mFold struct {
+	Inner Matcher
+}
+
+var _ Matcher = (*mFold)(nil)
+
+func (m *mFold) Match(r rune) bool {
+	if m.Inner.Match(r) {
+		return true
+	}
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if m.Inner.Match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mFold) ForEachRange(f func(r Range)) {
+	list := RangesOf(m.Inner, nil)
+	for _, r := range foldableRunes() {
+		if !m.Inner.Match(r) && m.Match(r) {
+			list = append(list, Range{Lo: r, Hi: r})
+		}
+	}
+	for _, r := range coalesceRanges(list) {
+		f(r)
+	}
+}
+
+func (m *mFold) String() string {
+	return "~" + m.Inner.String()
+}
+
+var (
+	gFoldableOnce sync.Once
+	gFoldable     []rune
+)
+
+// foldableRunes returns, in no particular order, every rune that is
+// equivalent under simple case folding to at least one other rune.
+func foldableRunes() []rune {
+	gFoldableOnce.Do(func() {
+		for _, table := range unicode.CaseRanges {
+			for r := rune(table.Lo); r <= rune(table.Hi); r++ {
+				if unicode.SimpleFold(r) != r {
+					gFoldable = append(gFoldable, r)
+				}
+			}
+		}
+		// A few runes, such as 'K' (U+212A), have no case mapping of
+		// their own, but fold together with runes that do.
+		seen := make(map[rune]struct{}, len(gFoldable))
+		for _, r := range gFoldable {
+			seen[r] = struct{}{}
+		}
+		for _, r := range gFoldable {
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				if _, found := seen[f]; !found {
+					seen[f] = struct{}{}
+					gFoldable = append(gFoldable, f)
+				}
+			}
+		}
+	})
+	return gFoldable
+}
@@ -0,0 +1,27 @@
+package runeset
+
+// Matcher is a predicate that returns true for certain runes.
+//
+// As with byteset.Matcher, implementations of Matcher must not change their
+// state on a call to Match.
+//
+type Matcher interface {
+	// Match returns true iff rune r is in the set.
+	Match(r rune) bool
+
+	// ForEachRange calls f once for each maximal run of consecutive runes
+	// in the set. The ranges are passed in ascending order, and neither
+	// overlap nor touch.
+	ForEachRange(f func(r Range))
+
+	// String returns a string representation of the set, which Parse
+	// accepts.
+	String() string
+}
+
+// RangesOf appends the ranges of m to out, as passed to ForEachRange, then
+// returns the updated slice.
+func RangesOf(m Matcher, out []Range) []Range {
+	m.ForEachRange(func(r Range) { out = append(out, r) })
+	return out
+}
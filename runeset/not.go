@@ -0,0 +1,38 @@
+package runeset
+
+import (
+	"unicode/utf8"
+)
+
+// Not returns a Matcher for the runes, 0 through utf8.MaxRune, that the
+// given Matcher does not match.
+func Not(m Matcher) Matcher {
+	return &mNegation{Inner: m}
+}
+
+type mNegation struct {
+	Inner Matcher
+}
+
+var _ Matcher = (*mNegation)(nil)
+
+func (m *mNegation) Match(r rune) bool {
+	return r >= 0 && r <= utf8.MaxRune && !m.Inner.Match(r)
+}
+
+func (m *mNegation) ForEachRange(f func(r Range)) {
+	next := rune(0)
+	m.Inner.ForEachRange(func(r Range) {
+		if r.Lo > next {
+			f(Range{Lo: next, Hi: r.Lo - 1})
+		}
+		next = r.Hi + 1
+	})
+	if next <= utf8.MaxRune {
+		f(Range{Lo: next, Hi: utf8.MaxRune})
+	}
+}
+
+func (m *mNegation) String() string {
+	return "!" + m.Inner.String()
+}
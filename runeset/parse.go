@@ -0,0 +1,199 @@
+package runeset
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParseError is returned by Parse when its input is malformed.
+type ParseError struct {
+	Input  string
+	Offset int
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/runeset: parse error @ offset %d in %q", e.Offset, e.Input)
+}
+
+// Parse is the inverse of Matcher.String: it returns a Matcher for the set
+// described by s.
+//
+// The accepted syntax is that of byteset.Parse, widened to runes:
+//
+//   .         all runes
+//   !X        the complement of X
+//   ~X        the runes of X, and those equal to them under case folding
+//   \p{Name}  the runes with a Unicode property; see Property
+//   [...]     the runes listed between the brackets
+//
+// Between the brackets, a rune is written as \xHH, \uHHHH, or \UHHHHHHHH, or
+// as a printable ASCII character other than '\', ']', and '-'. Two runes
+// separated by '-' denote an inclusive range. A property, written \p{Name},
+// adds all of its runes.
+//
+func Parse(s string) (Matcher, error) {
+	m, n, ok := parseMatcher(s, 0)
+	if !ok || n != len(s) {
+		if ok {
+			n = len(s)
+		}
+		return nil, &ParseError{Input: s, Offset: n}
+	}
+	return m, nil
+}
+
+func parseMatcher(s string, i int) (Matcher, int, bool) {
+	if i >= len(s) {
+		return nil, i, false
+	}
+	switch s[i] {
+	case '.':
+		return All(), i + 1, true
+
+	case '!':
+		inner, j, ok := parseMatcher(s, i+1)
+		if !ok {
+			return nil, j, false
+		}
+		return Not(inner), j, true
+
+	case '~':
+		inner, j, ok := parseMatcher(s, i+1)
+		if !ok {
+			return nil, j, false
+		}
+		return Fold(inner), j, true
+
+	case '\\':
+		prop, j, ok := parseProperty(s, i)
+		if !ok {
+			return nil, j, false
+		}
+		return prop, j, true
+
+	case '[':
+		var ranges []Range
+		var props []*mProperty
+		j := i + 1
+		for {
+			if j >= len(s) {
+				return nil, j, false
+			}
+			if s[j] == ']' {
+				if len(props) != 0 {
+					return &mClass{Props: props, Rest: &mRange{Ranges: coalesceRanges(ranges)}}, j + 1, true
+				}
+				return Ranges(ranges...), j + 1, true
+			}
+			if strings.HasPrefix(s[j:], `\p{`) {
+				prop, k, ok := parseProperty(s, j)
+				if !ok {
+					return nil, k, false
+				}
+				props = append(props, prop)
+				j = k
+				continue
+			}
+			lo, k, ok := parseRune(s, j)
+			if !ok {
+				return nil, j, false
+			}
+			hi := lo
+			if k < len(s) && s[k] == '-' {
+				hi, k, ok = parseRune(s, k+1)
+				if !ok {
+					return nil, k, false
+				}
+			}
+			ranges = append(ranges, Range{Lo: lo, Hi: hi})
+			j = k
+		}
+	}
+	return nil, i, false
+}
+
+// parseProperty parses a property name, written \p{Name}, at s[i].
+func parseProperty(s string, i int) (*mProperty, int, bool) {
+	if !strings.HasPrefix(s[i:], `\p{`) {
+		return nil, i, false
+	}
+	n := strings.IndexByte(s[i:], '}')
+	if n < 0 {
+		return nil, i, false
+	}
+	m, err := Property(s[i+3 : i+n])
+	if err != nil {
+		return nil, i, false
+	}
+	return m.(*mProperty), i + n + 1, true
+}
+
+func parseRune(s string, i int) (rune, int, bool) {
+	if i >= len(s) {
+		return 0, i, false
+	}
+	ch := s[i]
+	if ch == '\\' {
+		if i+1 >= len(s) {
+			return 0, i, false
+		}
+		var width int
+		switch s[i+1] {
+		case 'x':
+			width = 2
+		case 'u':
+			width = 4
+		case 'U':
+			width = 8
+		default:
+			return 0, i, false
+		}
+		if i+2+width > len(s) {
+			return 0, i, false
+		}
+		var r rune
+		for _, digit := range []byte(s[i+2 : i+2+width]) {
+			v, ok := hexDigit(digit)
+			if !ok {
+				return 0, i, false
+			}
+			r = (r << 4) | rune(v)
+		}
+		if r < 0 || r > utf8.MaxRune {
+			return 0, i, false
+		}
+		return r, i + 2 + width, true
+	}
+	if ch < 0x20 || ch >= 0x7f || ch == ']' || ch == '-' {
+		return 0, i, false
+	}
+	return rune(ch), i + 1, true
+}
+
+func hexDigit(ch byte) (byte, bool) {
+	switch {
+	case ch >= '0' && ch <= '9':
+		return ch - '0', true
+	case ch >= 'A' && ch <= 'F':
+		return ch - 'A' + 10, true
+	case ch >= 'a' && ch <= 'f':
+		return ch - 'a' + 10, true
+	}
+	return 0, false
+}
+
+// writeRune writes r as parseRune reads it.
+func writeRune(buf *bytes.Buffer, r rune) {
+	switch {
+	case r >= 0x20 && r < 0x7f && r != '\\' && r != ']' && r != '-':
+		buf.WriteByte(byte(r))
+	case r < 0x100:
+		fmt.Fprintf(buf, "\\x%02x", r)
+	case r < 0x10000:
+		fmt.Fprintf(buf, "\\u%04x", r)
+	default:
+		fmt.Fprintf(buf, "\\U%08x", r)
+	}
+}
@@ -0,0 +1,97 @@
+package runeset
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+)
+
+// PropertyError is returned by Property when no Unicode category or script
+// has the given name.
+type PropertyError struct {
+	Name string
+}
+
+func (e *PropertyError) Error() string {
+	return fmt.Sprintf("github.com/chronos-tachyon/peggy/runeset: unknown Unicode property %q", e.Name)
+}
+
+// Property returns a Matcher for the runes with the named Unicode property:
+// either a general category, such as "L" or "Lu", or a script, such as
+// "Greek", as named in unicode.Categories and unicode.Scripts. Unlike Table,
+// the Matcher remembers the name, and its String is the compact "\p{Name}".
+func Property(name string) (Matcher, error) {
+	if t, found := unicode.Categories[name]; found {
+		return &mProperty{Name: name, Table: t}, nil
+	}
+	if t, found := unicode.Scripts[name]; found {
+		return &mProperty{Name: name, Table: t}, nil
+	}
+	return nil, &PropertyError{Name: name}
+}
+
+// MustProperty is like Property, but panics if the name is unknown. It
+// simplifies the construction of matchers for well-known properties.
+func MustProperty(name string) Matcher {
+	m, err := Property(name)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+type mProperty struct {
+	Name  string
+	Table *unicode.RangeTable
+}
+
+var _ Matcher = (*mProperty)(nil)
+
+func (m *mProperty) Match(r rune) bool {
+	return unicode.Is(m.Table, r)
+}
+
+func (m *mProperty) ForEachRange(f func(r Range)) {
+	Table(m.Table).ForEachRange(f)
+}
+
+func (m *mProperty) String() string {
+	return `\p{` + m.Name + `}`
+}
+
+// mClass is a bracketed set that names some properties, such as
+// "[\p{L}_0-9]", and matches the runes of each property and of Rest.
+type mClass struct {
+	Props []*mProperty
+	Rest  *mRange
+}
+
+var _ Matcher = (*mClass)(nil)
+
+func (m *mClass) Match(r rune) bool {
+	for _, prop := range m.Props {
+		if prop.Match(r) {
+			return true
+		}
+	}
+	return m.Rest.Match(r)
+}
+
+func (m *mClass) ForEachRange(f func(r Range)) {
+	rs := append([]Range(nil), m.Rest.Ranges...)
+	for _, prop := range m.Props {
+		rs = RangesOf(prop, rs)
+	}
+	Ranges(rs...).ForEachRange(f)
+}
+
+func (m *mClass) String() string {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for _, prop := range m.Props {
+		buf.WriteString(prop.String())
+	}
+	writeRanges(&buf, m.Rest.Ranges)
+	buf.WriteByte(']')
+	return buf.String()
+}
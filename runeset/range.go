@@ -0,0 +1,96 @@
+package runeset
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Range represents a range of consecutive runes.
+//
+// If Lo < Hi, then this Range represents the runes Lo, Lo+1, ..., Hi-1, Hi.
+//
+// If Lo == Hi, then this Range represents the single rune Lo.
+//
+// If Lo > Hi, then this Range represents the null set.
+//
+type Range struct {
+	Lo rune
+	Hi rune
+}
+
+// Ranges returns a Matcher that matches any rune that falls in one of the
+// given Range entries. The entries may be given in any order, and may
+// overlap.
+func Ranges(rs ...Range) Matcher {
+	return &mRange{Ranges: coalesceRanges(rs)}
+}
+
+type mRange struct {
+	Ranges []Range
+}
+
+var _ Matcher = (*mRange)(nil)
+
+func (m *mRange) Match(r rune) bool {
+	i := sort.Search(len(m.Ranges), func(i int) bool {
+		return m.Ranges[i].Hi >= r
+	})
+	return i < len(m.Ranges) && m.Ranges[i].Lo <= r
+}
+
+func (m *mRange) ForEachRange(f func(r Range)) {
+	for _, r := range m.Ranges {
+		f(r)
+	}
+}
+
+func (m *mRange) String() string {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	writeRanges(&buf, m.Ranges)
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// writeRanges writes rs as they appear between the brackets of a set.
+func writeRanges(buf *bytes.Buffer, rs []Range) {
+	for _, r := range rs {
+		writeRune(buf, r.Lo)
+		if r.Hi != r.Lo {
+			buf.WriteByte('-')
+			writeRune(buf, r.Hi)
+		}
+	}
+}
+
+// coalesceRanges sorts a by Lo, drops the empty entries, and merges those
+// that overlap or touch, so that (*mRange).Match can binary search.
+func coalesceRanges(a []Range) []Range {
+	b := make([]Range, 0, len(a))
+	for _, r := range a {
+		if r.Hi >= r.Lo {
+			b = append(b, r)
+		}
+	}
+	sort.Sort(rangeSlice(b))
+
+	c := make([]Range, 0, len(b))
+	for _, r := range b {
+		if n := len(c); n != 0 && r.Lo <= c[n-1].Hi+1 {
+			if r.Hi > c[n-1].Hi {
+				c[n-1].Hi = r.Hi
+			}
+			continue
+		}
+		c = append(c, r)
+	}
+	return c
+}
+
+type rangeSlice []Range
+
+var _ sort.Interface = (rangeSlice)(nil)
+
+func (x rangeSlice) Len() int           { return len(x) }
+func (x rangeSlice) Less(i, j int) bool { return x[i].Lo < x[j].Lo }
+func (x rangeSlice) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
@@ -0,0 +1,256 @@
+package runeset
+
+import (
+	"fmt"
+	"testing"
+	"unicode"
+)
+
+type matchRow struct {
+	Input    rune
+	Expected bool
+}
+
+func runMatchTests(t *testing.T, m Matcher, data []matchRow) {
+	t.Helper()
+	for i, row := range data {
+		actual := m.Match(row.Input)
+		if row.Expected != actual {
+			t.Errorf("%s/%03d: %q: expected %v, got %v", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+}
+
+func rangesString(m Matcher) string {
+	return fmt.Sprint(RangesOf(m, nil))
+}
+
+func TestAll_Match(t *testing.T) {
+	runMatchTests(t, All(), []matchRow{
+		matchRow{0, true},
+		matchRow{'a', true},
+		matchRow{unicode.MaxRune, true},
+		matchRow{unicode.MaxRune + 1, false},
+		matchRow{-1, false},
+	})
+	if actual := rangesString(All()); actual != "[{0 1114111}]" {
+		t.Errorf("%s: wrong ranges: %s", t.Name(), actual)
+	}
+}
+
+func TestRanges_Match(t *testing.T) {
+	m := Ranges(Range{'x', 'z'}, Range{'a', 'c'}, Range{'b', 'e'}, Range{'f', 'f'}, Range{'q', 'p'}, Range{'世', '世'})
+	runMatchTests(t, m, []matchRow{
+		matchRow{'`', false},
+		matchRow{'a', true},
+		matchRow{'d', true},
+		matchRow{'f', true},
+		matchRow{'g', false},
+		matchRow{'p', false},
+		matchRow{'y', true},
+		matchRow{'{', false},
+		matchRow{'世', true},
+		matchRow{'界', false},
+	})
+	if actual := rangesString(m); actual != "[{97 102} {120 122} {19990 19990}]" {
+		t.Errorf("%s: wrong ranges: %s", t.Name(), actual)
+	}
+}
+
+func TestNot_Match(t *testing.T) {
+	m := Not(Ranges(Range{0, 'a'}, Range{'c', 'c'}))
+	runMatchTests(t, m, []matchRow{
+		matchRow{'a', false},
+		matchRow{'b', true},
+		matchRow{'c', false},
+		matchRow{'d', true},
+		matchRow{unicode.MaxRune, true},
+		matchRow{unicode.MaxRune + 1, false},
+	})
+	if actual := rangesString(m); actual != "[{98 98} {100 1114111}]" {
+		t.Errorf("%s: wrong ranges: %s", t.Name(), actual)
+	}
+	if actual := rangesString(Not(All())); actual != "[]" {
+		t.Errorf("%s: wrong ranges: %s", t.Name(), actual)
+	}
+}
+
+func TestTable_Match(t *testing.T) {
+	m := Table(unicode.Greek)
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		if expected := unicode.Is(unicode.Greek, r); m.Match(r) != expected {
+			t.Errorf("%s: %U: expected %v", t.Name(), r, expected)
+		}
+	}
+	// unicode.Lu has strides greater than 1.
+	m = Table(unicode.Lu)
+	runMatchTests(t, m, []matchRow{
+		matchRow{'A', true},
+		matchRow{'a', false},
+		matchRow{'Ā', true},
+		matchRow{'ā', false},
+		matchRow{'Ă', true},
+	})
+}
+
+func TestParse(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+	}
+
+	data := []testrow{
+		testrow{".", "."},
+		testrow{"!.", "!."},
+		testrow{"[]", "[]"},
+		testrow{`[a-z]`, `[a-z]`},
+		testrow{`[c-fa-b]`, `[a-f]`},
+		testrow{`[\x61\x62]`, `[a-b]`},
+		testrow{`[\x00-\x1f\x2d\x5c-\x5d]`, `[\x00-\x1f\x2d\x5c-\x5d]`},
+		testrow{`[\xe9\u4e16]`, `[\xe9\u4e16]`},
+		testrow{`[\U0001f600-\U0010ffff]`, `[\U0001f600-\U0010ffff]`},
+		testrow{`![\u0370-\u03ff]`, `![\u0370-\u03ff]`},
+	}
+
+	for i, row := range data {
+		m, err := Parse(row.Input)
+		if err != nil {
+			t.Errorf("%s/%03d: %q: error: %v", t.Name(), i, row.Input, err)
+			continue
+		}
+		if actual := m.String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Input, row.Expected, actual)
+		}
+	}
+
+	for i, input := range []string{"", "[", `[\x6]`, `[\u00e]`, `[\U00110000]`, `[\q]`, `[a-]`, "[é]", "x", ".x", "!"} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s/bad%03d: %q: expected error", t.Name(), i, input)
+		}
+	}
+}
+
+func TestProperty(t *testing.T) {
+	m, err := Property("Lu")
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	runMatchTests(t, m, []matchRow{
+		matchRow{'A', true},
+		matchRow{'a', false},
+		matchRow{'Ω', true},
+		matchRow{'ω', false},
+	})
+	if actual := m.String(); actual != `\p{Lu}` {
+		t.Errorf("%s: expected %q, got %q", t.Name(), `\p{Lu}`, actual)
+	}
+	if expected, actual := rangesString(Table(unicode.Lu)), rangesString(m); actual != expected {
+		t.Errorf("%s: wrong ranges:\n\texpected: %s\n\tactual: %s", t.Name(), expected, actual)
+	}
+
+	m, err = Property("Greek")
+	if err != nil {
+		t.Fatalf("%s: error: %v", t.Name(), err)
+	}
+	runMatchTests(t, m, []matchRow{
+		matchRow{'α', true},
+		matchRow{'a', false},
+	})
+
+	if _, err := Property("Klingon"); err == nil {
+		t.Errorf("%s: expected error for unknown property", t.Name())
+	}
+}
+
+func TestParse_property(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+		Matches  string
+		Misses   string
+	}
+
+	data := []testrow{
+		testrow{`\p{L}`, `\p{L}`, "aZé世", "1_ "},
+		testrow{`!\p{L}`, `!\p{L}`, "1_ ", "aZé世"},
+		testrow{`[\p{L}_0-9]`, `[\p{L}0-9_]`, "a世_7", " -"},
+		testrow{`[\p{Greek}\p{Nd}]`, `[\p{Greek}\p{Nd}]`, "α7٣", "a_"},
+	}
+
+	for i, row := range data {
+		m, err := Parse(row.Input)
+		if err != nil {
+			t.Errorf("%s/%03d: %q: error: %v", t.Name(), i, row.Input, err)
+			continue
+		}
+		if actual := m.String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		for _, r := range row.Matches {
+			if !m.Match(r) {
+				t.Errorf("%s/%03d: %q: expected match for %q", t.Name(), i, row.Input, r)
+			}
+		}
+		for _, r := range row.Misses {
+			if m.Match(r) {
+				t.Errorf("%s/%03d: %q: expected no match for %q", t.Name(), i, row.Input, r)
+			}
+		}
+	}
+
+	m, _ := Parse(`[\p{Nd}a-c]`)
+	expected := append(RangesOf(Table(unicode.Nd), nil), Range{'a', 'c'})
+	if actual := rangesString(m); actual != rangesString(Ranges(expected...)) {
+		t.Errorf("%s: wrong ranges: %s", t.Name(), actual)
+	}
+
+	for i, input := range []string{`\p{Klingon}`, `\p{L`, `\pL`, `[\p{Klingon}]`, `[\p{L]`} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("%s/bad%03d: %q: expected error", t.Name(), i, input)
+		}
+	}
+}
+
+func TestFold(t *testing.T) {
+	type testrow struct {
+		Input    string
+		Expected string
+		Matches  string
+		Misses   string
+	}
+
+	data := []testrow{
+		testrow{`~[a-c]`, `~[a-c]`, "abcABC", "dD_"},
+		testrow{`~[k]`, `~[k]`, "kKK", "j"},
+		testrow{`~[\u03c3]`, `~[\u03c3]`, "σςΣ", "s"},
+		testrow{`!~[a]`, `!~[a]`, "bB", "aA"},
+		testrow{`~\p{Lu}`, `~\p{Lu}`, "aAéÉ", "1_"},
+	}
+
+	for i, row := range data {
+		m, err := Parse(row.Input)
+		if err != nil {
+			t.Errorf("%s/%03d: %q: error: %v", t.Name(), i, row.Input, err)
+			continue
+		}
+		if actual := m.String(); actual != row.Expected {
+			t.Errorf("%s/%03d: %q: expected %q, got %q", t.Name(), i, row.Input, row.Expected, actual)
+		}
+		for _, r := range row.Matches {
+			if !m.Match(r) {
+				t.Errorf("%s/%03d: %q: expected match for %q", t.Name(), i, row.Input, r)
+			}
+		}
+		for _, r := range row.Misses {
+			if m.Match(r) {
+				t.Errorf("%s/%03d: %q: expected no match for %q", t.Name(), i, row.Input, r)
+			}
+		}
+	}
+
+	m := Fold(Ranges(Range{'a', 'c'}, Range{'k', 'k'}))
+	expected := Ranges(Range{'A', 'C'}, Range{'K', 'K'}, Range{'a', 'c'}, Range{'k', 'k'}, Range{0x212a, 0x212a})
+	if actual := rangesString(m); actual != rangesString(expected) {
+		t.Errorf("%s: wrong ranges: %s", t.Name(), actual)
+	}
+}
@@ -0,0 +1,31 @@
+package runeset
+
+import (
+	"unicode"
+)
+
+// Table returns a Matcher that matches the runes in t, such as one of the
+// tables of package unicode. The table is copied into ranges, so its String
+// lists them rather than naming the table; see Property.
+func Table(t *unicode.RangeTable) Matcher {
+	var rs []Range
+	for _, r := range t.R16 {
+		for c := rune(r.Lo); c <= rune(r.Hi); c += rune(r.Stride) {
+			if r.Stride == 1 {
+				rs = append(rs, Range{Lo: c, Hi: rune(r.Hi)})
+				break
+			}
+			rs = append(rs, Range{Lo: c, Hi: c})
+		}
+	}
+	for _, r := range t.R32 {
+		for c := rune(r.Lo); c <= rune(r.Hi); c += rune(r.Stride) {
+			if r.Stride == 1 {
+				rs = append(rs, Range{Lo: c, Hi: rune(r.Hi)})
+				break
+			}
+			rs = append(rs, Range{Lo: c, Hi: c})
+		}
+	}
+	return Ranges(rs...)
+}